@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IP allow/deny list for user traffic. IP_ACL is a ";"-separated list of
+// rules tried in order against the resolved client IP (see clientip.go):
+//
+//	deny:203.0.113.0/24; allow:10.0.0.0/8,192.168.0.0/16
+//
+// Unmatched clients get IP_ACL_DEFAULT (allow or deny, default allow).
+// IP_ACL_FILE names a file with the same syntax, typically a mounted
+// ConfigMap, taking precedence over IP_ACL and re-read every
+// SECRETS_RELOAD_INTERVAL_S; an unreadable or malformed file keeps the last
+// good rules. /admin/acl replaces the rules at runtime, until the file
+// next changes. Denied requests get
+// a 403 and are counted in acl_denied_requests_total by rule.
+//
+// /admin/chaos/acl reproduces the classic self-inflicted outage:
+//
+//	deny_all  a "deny:0.0.0.0/0,::/0" rule is pushed ahead of the real ones
+//	peer_ip   rules are checked against the socket peer, as an ACL that
+//	          forgot about the ingress would, so every user looks like the
+//	          proxy
+type aclRule struct {
+	raw      string
+	allow    bool
+	prefixes []netip.Prefix
+}
+
+type aclConfig struct {
+	rules []aclRule
+	allow bool // the default
+	spec  string
+}
+
+var (
+	acl      atomic.Pointer[aclConfig]
+	aclChaos atomic.Value // string: "", "deny_all" or "peer_ip"
+	aclMu    sync.Mutex   // serialises file reloads and admin changes
+	aclFile  string       // the IP_ACL_FILE content last applied, under aclMu
+
+	aclDenyAll = aclRule{raw: "deny:0.0.0.0/0,::/0 (chaos)", prefixes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}}
+
+	aclDenied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "acl_denied_requests_total",
+			Help: "Requests refused by the IP ACL, by the rule that matched (default: IP_ACL_DEFAULT=deny)",
+		},
+		[]string{"rule"},
+	)
+	aclReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "acl_reloads_total",
+			Help: "IP_ACL_FILE reloads by outcome (changed, unchanged, failed)",
+		},
+		[]string{"outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(aclDenied, aclReloads)
+	aclChaos.Store("")
+	// A malformed IP_ACL or IP_ACL_FILE is reported by loadConfig.
+	c, err := loadACL()
+	if err != nil {
+		c = &aclConfig{allow: true}
+	}
+	acl.Store(c)
+	aclFile = c.spec
+}
+
+// aclSource returns the rules from IP_ACL_FILE, or IP_ACL without one.
+func aclSource() (string, error) {
+	if file := os.Getenv("IP_ACL_FILE"); file != "" {
+		b, err := os.ReadFile(file)
+		return string(b), err
+	}
+	return os.Getenv("IP_ACL"), nil
+}
+
+func parseACLRules(spec string) ([]aclRule, error) {
+	var rules []aclRule
+	for _, raw := range strings.FieldsFunc(spec, func(r rune) bool { return r == ';' || r == '\n' }) {
+		raw = strings.TrimSpace(raw)
+		if raw == "" || strings.HasPrefix(raw, "#") {
+			continue
+		}
+		action, list, ok := strings.Cut(raw, ":")
+		if !ok || (action != "allow" && action != "deny") {
+			return nil, fmt.Errorf("rule %q: want allow:<cidr>,... or deny:<cidr>,...", raw)
+		}
+		prefixes, err := parseTrustedProxies(list)
+		if err != nil || strings.TrimSpace(list) == "" {
+			return nil, fmt.Errorf("rule %q: bad address list", raw)
+		}
+		rules = append(rules, aclRule{raw: raw, allow: action == "allow", prefixes: prefixes})
+	}
+	return rules, nil
+}
+
+// loadACL reads the configured rules with IP_ACL_DEFAULT.
+func loadACL() (*aclConfig, error) {
+	spec, err := aclSource()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseACLRules(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &aclConfig{rules: rules, allow: cfg.ACLDefault == "allow", spec: spec}, nil
+}
+
+// aclDecision returns whether the client may proceed and the rule that
+// decided it.
+func aclDecision(r *http.Request, client string) (bool, string) {
+	c := acl.Load()
+	rules := c.rules
+	switch aclChaos.Load().(string) {
+	case "deny_all":
+		rules = append([]aclRule{aclDenyAll}, rules...)
+	case "peer_ip":
+		client = r.RemoteAddr
+		if ap, err := netip.ParseAddrPort(client); err == nil {
+			client = ap.Addr().String()
+		}
+	}
+	addr, err := netip.ParseAddr(client)
+	if err == nil {
+		addr = addr.Unmap()
+		for _, rule := range rules {
+			for _, p := range rule.prefixes {
+				if p.Contains(addr) {
+					return rule.allow, rule.raw
+				}
+			}
+		}
+	}
+	return c.allow, "default"
+}
+
+// aclAllows answers a denied request with a 403.
+func aclAllows(w http.ResponseWriter, r *http.Request, client string) bool {
+	allowed, rule := aclDecision(r, client)
+	if allowed {
+		return true
+	}
+	aclDenied.WithLabelValues(rule).Inc()
+	noteChaos(r.Context(), "acl: denied by %q", rule)
+	writeProblem(w, r, "client address "+client+" is not allowed", http.StatusForbidden)
+	return false
+}
+
+// startACLReloader polls IP_ACL_FILE for changes.
+func startACLReloader() {
+	if os.Getenv("IP_ACL_FILE") == "" {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(cfg.SecretsReloadIntervalS) * time.Second) {
+			aclMu.Lock()
+			c, err := loadACL()
+			switch {
+			case err != nil:
+				aclReloads.WithLabelValues("failed").Inc()
+				slog.Error("IP ACL reload failed, keeping last rules", "file", os.Getenv("IP_ACL_FILE"), "error", err)
+			case c.spec == aclFile:
+				aclReloads.WithLabelValues("unchanged").Inc()
+			default:
+				acl.Store(c)
+				aclFile = c.spec
+				aclReloads.WithLabelValues("changed").Inc()
+				slog.Warn("IP ACL reloaded", "rules", len(c.rules))
+			}
+			aclMu.Unlock()
+		}
+	}()
+}
+
+func handleAdminACL(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Rules   *string `json:"rules"`
+			Default *string `json:"default"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Default != nil && *req.Default != "allow" && *req.Default != "deny" {
+			writeProblem(w, r, "default must be allow or deny", http.StatusBadRequest)
+			return
+		}
+		aclMu.Lock()
+		c := *acl.Load()
+		if req.Rules != nil {
+			rules, err := parseACLRules(*req.Rules)
+			if err != nil {
+				aclMu.Unlock()
+				writeProblem(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.rules, c.spec = rules, *req.Rules
+		}
+		if req.Default != nil {
+			c.allow = *req.Default == "allow"
+		}
+		acl.Store(&c)
+		aclMu.Unlock()
+		slog.Warn("Admin: IP ACL updated", "rules", len(c.rules), "default_allow", c.allow)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := acl.Load()
+	rules := []string{}
+	for _, rule := range c.rules {
+		rules = append(rules, rule.raw)
+	}
+	def := "deny"
+	if c.allow {
+		def = "allow"
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"rules": rules, "default": def, "file": os.Getenv("IP_ACL_FILE")})
+}
+
+func handleAdminACLChaos(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Mode *string `json:"mode"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Mode != nil {
+			switch *req.Mode {
+			case "", "off":
+				aclChaos.Store("")
+			case "deny_all", "peer_ip":
+				aclChaos.Store(*req.Mode)
+			default:
+				writeProblem(w, r, "mode must be off, deny_all or peer_ip", http.StatusBadRequest)
+				return
+			}
+			slog.Warn("Admin: ACL chaos updated", "mode", *req.Mode)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mode := aclChaos.Load().(string)
+	if mode == "" {
+		mode = "off"
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"mode": mode})
+}
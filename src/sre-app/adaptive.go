@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Adaptive concurrency limit. ADAPTIVE_CONCURRENCY=aimd|vegas replaces the
+// fixed MAX_INFLIGHT with a limit that follows observed latency, in the
+// shape of Netflix's concurrency-limits:
+//
+//	aimd   +1 while requests finish under ADAPTIVE_LATENCY_TARGET_MS (default
+//	       250) with the limit in use; x0.9 on a slow or 5xx response
+//	vegas  estimates queueing as limit*(1 - minRTT/RTT) and grows while fewer
+//	       than 3 requests queue, shrinks when more than 6 do
+//
+// Every route feeds the same estimate, so mixing sub-millisecond and slow
+// routes biases vegas towards shrinking.
+//
+// The limit starts at ADAPTIVE_INITIAL_LIMIT (default 20) and stays within
+// ADAPTIVE_MIN_LIMIT..ADAPTIVE_MAX_LIMIT (default 5..1000). Priority classes
+// still take their share of whatever the current limit is.
+type adaptiveLimiter struct {
+	mu        sync.Mutex
+	algorithm string
+	limit     float64
+	min, max  float64
+	target    time.Duration
+
+	rttNoLoad      time.Duration
+	rttNoLoadReset time.Time
+}
+
+var concurrencyLimiter *adaptiveLimiter
+
+var (
+	adaptiveLimitGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "adaptive_concurrency_limit",
+		Help: "Current adaptive in-flight request limit",
+	})
+	adaptiveRTTNoLoad = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "adaptive_concurrency_rtt_noload_seconds",
+		Help: "Vegas estimate of latency without queueing (minimum recent RTT)",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(adaptiveLimitGauge, adaptiveRTTNoLoad)
+}
+
+func loadAdaptiveConfig() {
+	algorithm := cfg.AdaptiveConcurrency
+	if algorithm != "aimd" && algorithm != "vegas" {
+		return
+	}
+	l := &adaptiveLimiter{
+		algorithm: algorithm,
+		limit:     cfg.AdaptiveInitialLimit,
+		min:       cfg.AdaptiveMinLimit,
+		max:       cfg.AdaptiveMaxLimit,
+		target:    time.Duration(cfg.AdaptiveLatencyTargetMs) * time.Millisecond,
+	}
+	l.limit = math.Max(l.min, math.Min(l.max, l.limit))
+	adaptiveLimitGauge.Set(l.limit)
+	concurrencyLimiter = l
+}
+
+// currentInflightLimit is the cap admitRequest enforces; 0 means unlimited.
+func currentInflightLimit() int64 {
+	if concurrencyLimiter == nil {
+		return maxInflight
+	}
+	concurrencyLimiter.mu.Lock()
+	defer concurrencyLimiter.mu.Unlock()
+	return int64(concurrencyLimiter.limit)
+}
+
+// observeConcurrency feeds one admitted request's outcome to the limiter.
+func observeConcurrency(rtt time.Duration, status int, inflight int64) {
+	l := concurrencyLimiter
+	if l == nil || rtt <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dropped := status >= http.StatusInternalServerError
+	switch l.algorithm {
+	case "aimd":
+		switch {
+		case dropped || rtt > l.target:
+			l.limit *= 0.9
+		case float64(inflight)*2 >= l.limit:
+			// Only grow when the limit is actually being exercised.
+			l.limit++
+		}
+	case "vegas":
+		if dropped {
+			l.limit *= 0.9
+			break
+		}
+		// Re-learn the no-load RTT every minute in case the baseline moved.
+		if time.Since(l.rttNoLoadReset) > time.Minute {
+			l.rttNoLoad = 0
+			l.rttNoLoadReset = time.Now()
+		}
+		if l.rttNoLoad == 0 || rtt < l.rttNoLoad {
+			l.rttNoLoad = rtt
+			adaptiveRTTNoLoad.Set(rtt.Seconds())
+		}
+		queue := l.limit * (1 - float64(l.rttNoLoad)/float64(rtt))
+		switch {
+		case queue < 3:
+			l.limit += math.Log10(l.limit)
+		case queue > 6:
+			l.limit -= math.Log10(l.limit)
+		}
+	}
+	l.limit = math.Max(l.min, math.Min(l.max, l.limit))
+	adaptiveLimitGauge.Set(l.limit)
+}
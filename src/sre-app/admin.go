@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Admin API. When ADMIN_TOKEN (or ADMIN_TOKEN_FILE, see secrets.go) is set,
+// every /admin route requires "Authorization: Bearer <token>".
+func registerAdminRoutes(mux *http.ServeMux) {
+	mux.Handle("/admin/tracing/sampler", adminOnly(handleAdminSampler))
+	mux.Handle("/admin/chaos/logstorm", adminOnly(handleAdminLogStorm))
+	mux.Handle("/admin/loglevel", adminOnly(handleAdminLogLevel))
+	mux.Handle("/admin/chaos/redaction", adminOnly(handleAdminRedaction))
+	mux.Handle("/admin/telemetry/errors", adminOnly(handleAdminErrors))
+	mux.Handle("/admin/chaos/cardinality", adminOnly(handleAdminCardinality))
+	mux.Handle("/admin/brownout", adminOnly(handleAdminBrownout))
+	mux.Handle("/admin/chaos/dbpool", adminOnly(handleAdminDBPool))
+	mux.Handle("/admin/chaos/queries", adminOnly(handleAdminQueries))
+	mux.Handle("/admin/queue/dlq", adminOnly(handleAdminDLQ))
+	mux.Handle("/admin/chaos/upload", adminOnly(handleAdminUpload))
+	mux.Handle("/admin/chaos/static", adminOnly(handleAdminStatic))
+	mux.Handle("/admin/chaos/cache", adminOnly(handleAdminCache))
+	mux.Handle("/admin/chaos/singleflight", adminOnly(handleAdminSingleflight))
+	mux.Handle("/admin/workers", adminOnly(handleAdminWorkers))
+	mux.Handle("/admin/bulkheads", adminOnly(handleAdminBulkheads))
+	mux.Handle("/admin/chaos/payment", adminOnly(handleAdminPayment))
+	mux.Handle("/admin/lb", adminOnly(handleAdminLB))
+	mux.Handle("/admin/chaos/shards", adminOnly(handleAdminShards))
+	mux.Handle("/admin/backup", adminOnly(handleAdminBackup))
+	mux.Handle("/admin/restore", adminOnly(handleAdminRestore))
+	mux.Handle("/admin/chaos/s3", adminOnly(handleAdminS3))
+	mux.Handle("/admin/chaos/notifications", adminOnly(handleAdminNotifications))
+	mux.Handle("/admin/scheduler", adminOnly(handleAdminScheduler))
+	mux.Handle("/admin/reconciler", adminOnly(handleAdminReconciler))
+	mux.Handle("/admin/checkout/contract", adminOnly(handleAdminCheckoutContract))
+	mux.Handle("/admin/secrets", adminOnly(handleAdminSecrets))
+	mux.Handle("/admin/chaos/metrics", adminOnly(handleAdminMetricsChaos))
+	mux.Handle("/admin/chaos/propagation", adminOnly(handleAdminPropagation))
+	mux.Handle("/admin/chaos/spanflood", adminOnly(handleAdminSpanFlood))
+	mux.Handle("/admin/chaos/exporter", adminOnly(handleAdminExporter))
+	mux.Handle("/admin/metrics/relabel", adminOnly(handleAdminRelabel))
+	mux.Handle("/admin/incident", adminOnly(handleAdminIncident))
+	mux.Handle("/admin/chaos/latency-rules", adminOnly(handleAdminLatencyRules))
+	mux.Handle("/admin/experiment", adminOnly(handleAdminExperiment))
+	mux.Handle("/admin/loadgen", adminOnly(handleAdminLoadgen))
+	mux.Handle("/admin/acl", adminOnly(handleAdminACL))
+	mux.Handle("/admin/chaos/acl", adminOnly(handleAdminACLChaos))
+	mux.Handle("/admin/maintenance", adminOnly(handleAdminMaintenance))
+	mux.Handle("/admin/readonly", adminOnly(handleAdminReadOnly))
+	mux.Handle("/admin/chaos/corruption", adminOnly(handleAdminCorruption))
+	mux.Handle("/admin/chaos/duplicates", adminOnly(handleAdminDuplicates))
+	mux.Handle("/admin/chaos/ordering", adminOnly(handleAdminOrdering))
+	mux.Handle("/admin/chaos/saga", adminOnly(handleAdminSaga))
+	mux.Handle("/admin/chaos/grpc", adminOnly(handleAdminGRPC))
+	mux.Handle("/admin/chaos/dns", adminOnly(handleAdminDNS))
+	mux.Handle("/admin/chaos/tls", adminOnly(handleAdminTLSChaos))
+	mux.Handle("/admin/quotas", adminOnly(handleAdminQuotas))
+	mux.Handle("/admin/chaos/oidc", adminOnly(handleAdminOIDC))
+	mux.Handle("/admin/chaos/sessions", adminOnly(handleAdminSessions))
+	mux.Handle("/admin/chaos/fds", adminOnly(handleAdminFDs))
+	mux.Handle("/admin/chaos/disk", adminOnly(handleAdminDisk))
+	mux.Handle("/admin/chaos/fsync", adminOnly(handleAdminFsync))
+	mux.Handle("/admin/gomaxprocs", adminOnly(handleAdminGOMAXPROCS))
+	mux.Handle("/admin/chaos/contention", adminOnly(handleAdminContention))
+	mux.Handle("/admin/chaos/stuck", adminOnly(handleAdminStuck))
+	mux.Handle("/admin/chaos/restart", adminOnly(handleAdminRestart))
+	mux.Handle("/admin/chaos/storemigration", adminOnly(handleAdminStoreMigration))
+	mux.Handle("/admin/queuemodel", adminOnly(handleAdminQueueModel))
+}
+
+func adminOnly(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r) {
+			writeProblem(w, r, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		announceAdminChanges(h).ServeHTTP(w, r)
+	})
+}
+
+// adminAuthorized reports whether r carries the admin token, if one is set.
+func adminAuthorized(r *http.Request) bool {
+	token := adminToken.get()
+	if token == "" {
+		return true
+	}
+	got := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) == 1
+}
+
+// announceAdminChanges reports every successful mutating admin request as
+// a Grafana annotation and a chatops message. Only the method, path and
+// caller are announced: request bodies carry API keys (/admin/quotas) and
+// other values that must not reach a chat channel.
+func announceAdminChanges(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (grafanaURL == "" && chatopsURL.get() == "") || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, r)
+		if rw.status >= 300 {
+			return
+		}
+		kind := "config"
+		if strings.HasPrefix(r.URL.Path, "/admin/chaos/") {
+			kind = "chaos"
+		}
+		client, _ := resolveClientIP(r)
+		text := r.Method + " " + r.URL.Path + " by " + client
+		ctx := context.WithoutCancel(r.Context())
+		go func() {
+			if _, err := annotateGrafana(ctx, text, kind, path.Base(r.URL.Path)); err != nil {
+				slog.WarnContext(ctx, "Grafana annotation failed", "error", err)
+			}
+			postChatops(ctx, kind, text)
+		}()
+	})
+}
+
+// handleAdminSampler reports (GET) or replaces (PUT/POST) the trace sampler,
+// e.g. {"sampler": "always_on"} to capture everything during an incident.
+func handleAdminSampler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Name string   `json:"sampler"`
+			Arg  *float64 `json:"arg"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		arg := 1.0
+		if req.Arg != nil {
+			arg = *req.Arg
+		}
+		if err := traceSampler.set(req.Name, arg); err != nil {
+			writeProblem(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Admin: trace sampler set to %s (arg=%v)", req.Name, arg)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, traceSampler.config())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writing JSON response: %v", err)
+	}
+}
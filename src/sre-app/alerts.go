@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Alertmanager webhook receiver, closing the loop from alert to
+// remediation. Point a webhook_configs receiver at /alerts/webhook (with
+// the admin token as its bearer credentials when ADMIN_TOKEN is set); every
+// alert in a notification is logged, added to the request's span as an
+// "alert" event and counted by name, severity and status.
+// ALERT_REMEDIATIONS maps alert names to actions run when the alert fires:
+//
+//	ALERT_REMEDIATIONS="HighErrorRate=disable_chaos,LatencySLOBurn=sampler_always_on"
+//
+// disable_chaos turns off all runtime chaos (see disableChaos),
+// sampler_always_on keeps every trace and log_debug turns on debug
+// logging. Resolved alerts undo nothing; actions are idempotent, so
+// Alertmanager's repeats are harmless.
+var remediationActions = map[string]func(){
+	"disable_chaos":     disableChaos,
+	"sampler_always_on": func() { traceSampler.set("always_on", 1) },
+	"log_debug":         func() { setLogLevel(slog.LevelDebug) },
+}
+
+var alertRemediations map[string]string
+
+var (
+	alertsReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alerts_received_total",
+			Help: "Alerts received from Alertmanager, by alert name, severity and status (firing, resolved)",
+		},
+		[]string{"alertname", "severity", "status"},
+	)
+	alertRemediationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alert_remediations_total",
+			Help: "Remediation actions triggered by firing alerts, by alert name and action",
+		},
+		[]string{"alertname", "action"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(alertsReceived, alertRemediationsTotal)
+	// A malformed ALERT_REMEDIATIONS is reported by loadConfig.
+	alertRemediations, _ = parseAlertRemediations(os.Getenv("ALERT_REMEDIATIONS"))
+}
+
+func parseAlertRemediations(spec string) (map[string]string, error) {
+	remediations := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		alert, action, ok := strings.Cut(pair, "=")
+		if !ok || alert == "" {
+			return nil, fmt.Errorf("%q: want alertname=action", pair)
+		}
+		if _, known := remediationActions[action]; !known {
+			return nil, fmt.Errorf("%q: unknown action %q (use disable_chaos, sampler_always_on or log_debug)", pair, action)
+		}
+		remediations[alert] = action
+	}
+	return remediations, nil
+}
+
+// alertmanagerNotification is the webhook payload, version 4.
+type alertmanagerNotification struct {
+	Receiver string `json:"receiver"`
+	Status   string `json:"status"`
+	GroupKey string `json:"groupKey"`
+	Alerts   []struct {
+		Status       string            `json:"status"`
+		Labels       map[string]string `json:"labels"`
+		Annotations  map[string]string `json:"annotations"`
+		StartsAt     time.Time         `json:"startsAt"`
+		GeneratorURL string            `json:"generatorURL"`
+		Fingerprint  string            `json:"fingerprint"`
+	} `json:"alerts"`
+}
+
+func handleAlertWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !adminAuthorized(r) {
+		writeProblem(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var n alertmanagerNotification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("app.alert.receiver", n.Receiver),
+		attribute.String("app.alert.group_key", n.GroupKey),
+		attribute.Int("app.alert.count", len(n.Alerts)),
+	)
+	var remediated []string
+	for _, a := range n.Alerts {
+		name, severity := a.Labels["alertname"], a.Labels["severity"]
+		alertsReceived.WithLabelValues(name, severity, a.Status).Inc()
+		span.AddEvent("alert", trace.WithAttributes(
+			attribute.String("app.alert.name", name),
+			attribute.String("app.alert.severity", severity),
+			attribute.String("app.alert.status", a.Status),
+			attribute.String("app.alert.fingerprint", a.Fingerprint),
+		))
+		level := slog.LevelWarn
+		if a.Status == "resolved" {
+			level = slog.LevelInfo
+		}
+		slog.Log(ctx, level, "Alert "+a.Status, "alertname", name, "severity", severity,
+			"fingerprint", a.Fingerprint, "summary", a.Annotations["summary"], "starts_at", a.StartsAt)
+
+		action, ok := alertRemediations[name]
+		if !ok || a.Status != "firing" {
+			continue
+		}
+		remediationActions[action]()
+		alertRemediationsTotal.WithLabelValues(name, action).Inc()
+		remediated = append(remediated, name+"="+action)
+		span.AddEvent("remediation", trace.WithAttributes(
+			attribute.String("app.alert.name", name),
+			attribute.String("app.remediation.action", action),
+		))
+		slog.WarnContext(ctx, "Remediation triggered by alert", "alertname", name, "action", action)
+		text := "Remediation: " + name + " fired, ran " + action
+		if _, err := annotateGrafana(ctx, text, "remediation", action); err != nil {
+			slog.WarnContext(ctx, "Grafana annotation failed", "error", err)
+		}
+		go postChatops(context.WithoutCancel(ctx), "remediation", text)
+	}
+	if remediated == nil {
+		remediated = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"received": len(n.Alerts), "remediated": remediated})
+}
+
+// disableChaos zeroes every chaos knob that can be changed at runtime,
+// clears latency rules and ACL, DNS and outbound TLS chaos, restores queue
+// dedupe and ordering, and releases what chaos holds: leaked fds, disk junk,
+// stuck handlers, an armed exit and exporter blackholes.
+func disableChaos() {
+	for _, knob := range []interface{ Store(int64) }{
+		&paymentLatencyMs, &paymentErrorRate, &sagaCompensationErrorRate,
+		&propagationLossRate, &propagationCorruptRate,
+		&spanFloodRate,
+		&metricsChaosLatencyMs, &metricsChaosErrorRate, &metricsChaosExtra,
+		&notifyFailureRate, &notifyLatencyMs,
+		&uploadFailureRate,
+		&poisonRate, &consumerErrorRate, &duplicateRate, &orderEventReorder,
+		&grpcSlowConsumerMs,
+		&oidcLatencyMs, &oidcErrorRate,
+		&diskChaosRate, &fsyncSlowdown,
+		&stuckHandlerRate, &unreadyAfter,
+		&shadowWriteErrorRate, &shadowDriftRate,
+		&logStormRate,
+		&cardinalityBombRate,
+	} {
+		knob.Store(0)
+	}
+	latencyRules.Store(&[]latencyRule{})
+	aclChaos.Store("")
+	dnsChaos.Store("off")
+	outboundTLSChaos.Store("off")
+	queueDedupe.Store(true)
+	orderEventsOrdered.Store(true)
+	releaseFDs()
+	cleanDiskChaos()
+	releaseStuckHandlers()
+	disarmExit()
+	readiness.unblock("self-termination")
+	exporterBlackholesMu.Lock()
+	for _, blackhole := range exporterBlackholes {
+		blackhole.Store(false)
+	}
+	exporterBlackholesMu.Unlock()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Anomaly self-detection. Every ANOMALY_INTERVAL_S (default 10, 0 disables)
+// the app compares its own mean latency and error ratio over the interval
+// with an exponentially weighted baseline (ANOMALY_ALPHA, default 0.1) and
+// flags a signal whose z-score passes ANOMALY_Z_THRESHOLD (default 3) once
+// ANOMALY_WARMUP_INTERVALS (default 6) intervals have built the baseline.
+// The baseline is frozen while a signal is anomalous, so a sustained fault
+// stays flagged instead of becoming the new normal. Each start and end is a
+// log line, an "anomaly" span event on a root "anomaly detector" span and,
+// with GRAFANA_URL set, a region annotation on the dashboards.
+var (
+	anomalyZScore = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "anomaly_zscore",
+			Help: "Latest deviation of each self-monitored signal from its baseline, in standard deviations",
+		},
+		[]string{"signal"},
+	)
+	anomalyBaseline = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "anomaly_baseline",
+			Help: "EWMA baseline of each self-monitored signal (latency in ms, error ratio)",
+		},
+		[]string{"signal"},
+	)
+	anomalyActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "anomaly_active",
+			Help: "1 while the signal is flagged as anomalous",
+		},
+		[]string{"signal"},
+	)
+	anomaliesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "anomalies_total",
+			Help: "Anomalies detected, by signal",
+		},
+		[]string{"signal"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(anomalyZScore, anomalyBaseline, anomalyActive, anomaliesTotal)
+}
+
+// anomalySample accumulates the current interval.
+var anomalySample struct {
+	sync.Mutex
+	requests, errors int64
+	latencyMs        float64
+}
+
+// observeAnomalySignals feeds one finished request to the detector.
+func observeAnomalySignals(status int, elapsed time.Duration) {
+	anomalySample.Lock()
+	anomalySample.requests++
+	if status >= 500 {
+		anomalySample.errors++
+	}
+	anomalySample.latencyMs += float64(elapsed.Microseconds()) / 1000
+	anomalySample.Unlock()
+}
+
+// ewmaSignal tracks one signal's baseline and anomaly state.
+type ewmaSignal struct {
+	name      string
+	unit      string
+	minStdDev float64 // keeps a flat baseline from flagging noise
+	mean      float64
+	variance  float64
+	samples   int
+	active    bool
+	startedAt time.Time
+	annotID   int64
+}
+
+func startAnomalyDetector() {
+	if cfg.AnomalyIntervalSeconds <= 0 {
+		return
+	}
+	signals := []*ewmaSignal{
+		{name: "latency", unit: "ms", minStdDev: 1},
+		{name: "error_rate", unit: "", minStdDev: 0.01},
+	}
+	for _, s := range signals {
+		anomalyActive.WithLabelValues(s.name).Set(0)
+		anomaliesTotal.WithLabelValues(s.name)
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(cfg.AnomalyIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			anomalySample.Lock()
+			requests, errors, latencyMs := anomalySample.requests, anomalySample.errors, anomalySample.latencyMs
+			anomalySample.requests, anomalySample.errors, anomalySample.latencyMs = 0, 0, 0
+			anomalySample.Unlock()
+			if requests == 0 {
+				continue
+			}
+			signals[0].observe(latencyMs / float64(requests))
+			signals[1].observe(float64(errors) / float64(requests))
+		}
+	}()
+}
+
+func (s *ewmaSignal) observe(value float64) {
+	stdDev := math.Max(math.Sqrt(s.variance), math.Max(s.minStdDev, 0.05*math.Abs(s.mean)))
+	z := (value - s.mean) / stdDev
+	warm := s.samples >= cfg.AnomalyWarmupIntervals
+	if s.samples == 0 {
+		z = 0
+	}
+	anomalyZScore.WithLabelValues(s.name).Set(z)
+
+	anomalous := warm && math.Abs(z) > cfg.AnomalyZThreshold
+	switch {
+	case anomalous && !s.active:
+		s.active = true
+		s.startedAt = time.Now()
+		anomaliesTotal.WithLabelValues(s.name).Inc()
+		anomalyActive.WithLabelValues(s.name).Set(1)
+		s.report("detected", value, z)
+	case !anomalous && s.active:
+		s.active = false
+		anomalyActive.WithLabelValues(s.name).Set(0)
+		s.report("cleared", value, z)
+	}
+	if s.active {
+		return
+	}
+	// Exponentially weighted mean and variance (Finch, 2009).
+	alpha := cfg.AnomalyAlpha
+	if s.samples == 0 {
+		s.mean = value
+	} else {
+		diff := value - s.mean
+		s.mean += alpha * diff
+		s.variance = (1 - alpha) * (s.variance + alpha*diff*diff)
+	}
+	s.samples++
+	anomalyBaseline.WithLabelValues(s.name).Set(s.mean)
+}
+
+// report emits one anomaly transition as a span event, a log line and a
+// Grafana region.
+func (s *ewmaSignal) report(state string, value, z float64) {
+	ctx, span := tracer.Start(context.Background(), "anomaly detector",
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindInternal))
+	defer span.End()
+	attrs := []attribute.KeyValue{
+		attribute.String("app.anomaly.signal", s.name),
+		attribute.String("app.anomaly.state", state),
+		attribute.Float64("app.anomaly.value", value),
+		attribute.Float64("app.anomaly.baseline", s.mean),
+		attribute.Float64("app.anomaly.zscore", z),
+	}
+	span.SetAttributes(attrs...)
+	span.AddEvent("anomaly", trace.WithAttributes(attrs...))
+
+	text := fmt.Sprintf("Anomaly %s: %s %.3g%s against a baseline of %.3g%s (z=%.1f)", state, s.name, value, s.unit, s.mean, s.unit, z)
+	if state == "detected" {
+		slog.WarnContext(ctx, "Anomaly detected", "signal", s.name, "value", value, "baseline", s.mean, "zscore", z)
+		id, err := annotateGrafana(ctx, text, "anomaly", s.name)
+		if err != nil {
+			slog.WarnContext(ctx, "Grafana annotation failed", "error", err)
+		}
+		s.annotID = id
+		return
+	}
+	slog.InfoContext(ctx, "Anomaly cleared", "signal", s.name, "value", value, "baseline", s.mean, "duration_s", time.Since(s.startedAt).Seconds())
+	if err := endGrafanaAnnotation(ctx, s.annotID); err != nil {
+		slog.WarnContext(ctx, "Grafana annotation failed", "error", err)
+	}
+	s.annotID = 0
+}
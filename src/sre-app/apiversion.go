@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Checkout contract versions, for mixed-version rollout exercises.
+//
+//	v1  GET /checkout?email=..., or a JSON body {"email": "..."}
+//	v2  JSON body {"customer": {"email": "..."}, "currency": "EUR"}; currency
+//	    is required and the body is the only input
+//
+// Each instance serves CHECKOUT_API_VERSION (default v1) and decodes bodies
+// strictly, so a v1 body sent to a v2 pod fails with `unknown field "email"`
+// and a v2 body sent to a v1 pod (the rollback case) with `unknown field
+// "customer"`. Clients meanwhile keep sending whatever they were built for:
+// the bundled UI and load generators speak v1, so a v2 canary answers them
+// with 400s. CHECKOUT_ACCEPT_V1=true lets v2 pods keep serving v1 requests,
+// the expand-and-contract way to ship the change. /admin/checkout/contract
+// switches either setting per instance.
+var (
+	checkoutAPIVersion atomic.Value
+	checkoutAcceptV1   atomic.Bool
+)
+
+var (
+	errMissingCheckoutBody = errors.New(`checkout v2 requires a JSON body {"customer": {"email": ...}, "currency": ...}`)
+	errMissingCurrency     = errors.New("checkout v2 requires currency")
+)
+
+var checkoutContractRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "checkout_contract_requests_total",
+		Help: "Checkout requests by served contract, the contract the client sent, and outcome (ok, rejected)",
+	},
+	[]string{"server_version", "client_version", "outcome"},
+)
+
+type checkoutRequestV1 struct {
+	Email string `json:"email"`
+}
+
+type checkoutRequestV2 struct {
+	Customer *struct {
+		Email string `json:"email"`
+	} `json:"customer"`
+	Currency string `json:"currency"`
+}
+
+func init() {
+	prometheus.MustRegister(checkoutContractRequests)
+	checkoutAPIVersion.Store(cfg.CheckoutAPIVersion)
+	checkoutAcceptV1.Store(cfg.CheckoutAcceptV1)
+}
+
+func decodeStrict(body []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// decodeCheckoutRequest applies this instance's contract to r and returns the
+// customer email; errors mean 400.
+func decodeCheckoutRequest(r *http.Request) (string, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("reading body: %w", err)
+	}
+
+	serverVersion := checkoutAPIVersion.Load().(string)
+	clientVersion := "v1"
+	var probe map[string]json.RawMessage
+	if json.Unmarshal(body, &probe) == nil && probe["customer"] != nil {
+		clientVersion = "v2"
+	}
+
+	var email string
+	if serverVersion == "v2" {
+		email, err = decodeCheckoutV2(body)
+		if err != nil && clientVersion == "v1" && checkoutAcceptV1.Load() {
+			email, err = decodeCheckoutV1(r, body)
+		}
+	} else {
+		email, err = decodeCheckoutV1(r, body)
+	}
+
+	outcome := "ok"
+	if err != nil {
+		outcome = "rejected"
+		slog.WarnContext(r.Context(), "Rejected checkout request", "server_version", serverVersion, "client_version", clientVersion, "error", err)
+	}
+	checkoutContractRequests.WithLabelValues(serverVersion, clientVersion, outcome).Inc()
+	return email, err
+}
+
+func decodeCheckoutV1(r *http.Request, body []byte) (string, error) {
+	if len(body) == 0 {
+		return r.URL.Query().Get("email"), nil
+	}
+	var req checkoutRequestV1
+	if err := decodeStrict(body, &req); err != nil {
+		return "", fmt.Errorf("invalid checkout v1 body: %w", err)
+	}
+	return req.Email, nil
+}
+
+func decodeCheckoutV2(body []byte) (string, error) {
+	if len(body) == 0 {
+		return "", errMissingCheckoutBody
+	}
+	var req checkoutRequestV2
+	if err := decodeStrict(body, &req); err != nil {
+		return "", fmt.Errorf("invalid checkout v2 body: %w", err)
+	}
+	if req.Customer == nil {
+		return "", errMissingCheckoutBody
+	}
+	if req.Currency == "" {
+		return "", errMissingCurrency
+	}
+	return req.Customer.Email, nil
+}
+
+// handleAdminCheckoutContract reports or sets the served contract:
+// {"version": "v2", "accept_v1": false}.
+func handleAdminCheckoutContract(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Version  *string `json:"version"`
+			AcceptV1 *bool   `json:"accept_v1"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Version != nil {
+			if *req.Version != "v1" && *req.Version != "v2" {
+				writeProblem(w, r, "version must be v1 or v2", http.StatusBadRequest)
+				return
+			}
+			checkoutAPIVersion.Store(*req.Version)
+		}
+		if req.AcceptV1 != nil {
+			checkoutAcceptV1.Store(*req.AcceptV1)
+		}
+		slog.Warn("Admin: checkout contract updated", "version", checkoutAPIVersion.Load(), "accept_v1", checkoutAcceptV1.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"version":   checkoutAPIVersion.Load(),
+		"accept_v1": checkoutAcceptV1.Load(),
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Load generator arrival processes and concurrency models, for reproducing
+// queueing behaviour on purpose. In the open model (LOADGEN_MODEL=open, the
+// default) requests arrive at LOADGEN_RATE whether or not earlier ones have
+// been answered, up to LOADGEN_MAX_INFLIGHT (default 64) outstanding, and
+// LOADGEN_ARRIVALS spaces them:
+//
+//	constant  (default) evenly, one every 1/rate
+//	poisson   exponential gaps with mean 1/rate, the M in M/M/c
+//	bursty    a two-state Markov-modulated Poisson process: bursts of
+//	          LOADGEN_BURST_FACTOR (default 3) times the rate lasting
+//	          LOADGEN_BURST_S on average (default 2), between calm spells of
+//	          LOADGEN_CALM_S (default 8) at whatever rate keeps the long-run
+//	          mean at LOADGEN_RATE, or none when the bursts carry it all
+//
+// In the closed model LOADGEN_CONCURRENCY users (default 10) each send a
+// request, wait for the answer, think for an exponential LOADGEN_THINK_MS
+// (default 0) and go again, so a slow server slows its own load down and
+// hides the knee the open model shows; LOADGEN_RATE only switches it on and
+// off. loadgen_request_duration_seconds is the latency the generator saw.
+//
+// LOADGEN_PRESET sets up the textbook queues against the /mmc station:
+// mm1 (one server) and mmc (QUEUE_MODEL_SERVERS) both send Poisson arrivals
+// in the open model, to LOADGEN_PATHS if set and all to /mmc otherwise.
+// The in-flight cap is raised to loadgenPresetMaxInflight, high enough that
+// the queue grows past the knee but not without bound once ρ passes 1.
+// Raising the rate through /admin/loadgen then walks ρ up the latency curve.
+const (
+	loadgenPresetPaths       = "/mmc=1"
+	loadgenPresetMaxInflight = 10000
+)
+
+type arrivalProcess struct {
+	bursting bool
+	until    time.Time // end of the current MMPP state
+}
+
+// Arrivals are drawn ahead of time, so whether the generator is bursting
+// now is read off the latest scheduled burst rather than the draw's state.
+var (
+	burstMu            sync.Mutex
+	burstFrom, burstTo time.Time
+)
+
+var (
+	loadgenDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "loadgen_request_duration_seconds",
+			Help:    "Self-traffic latency as the load generator saw it, by path",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"path"},
+	)
+	loadgenInflightGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "loadgen_inflight_requests",
+			Help: "Self-traffic requests sent and not yet answered",
+		},
+		func() float64 { return float64(loadgenInflight.Load()) },
+	)
+	loadgenBursting = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "loadgen_bursting",
+			Help: "1 while bursty arrivals are in their burst state",
+		},
+		func() float64 {
+			burstMu.Lock()
+			defer burstMu.Unlock()
+			if now := time.Now(); !now.Before(burstFrom) && now.Before(burstTo) {
+				return 1
+			}
+			return 0
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(loadgenDuration, loadgenInflightGauge, loadgenBursting)
+}
+
+// expDuration samples an exponential duration with the given mean.
+func expDuration(rng *rand.Rand, mean time.Duration) time.Duration {
+	return time.Duration(rng.ExpFloat64() * float64(mean))
+}
+
+// next returns when the arrival after one at prev is due, at perSecond.
+func (a *arrivalProcess) next(rng *rand.Rand, prev time.Time, perSecond float64) time.Time {
+	gap := time.Duration(float64(time.Second) / perSecond)
+	switch loadgenArrivals.Load().(string) {
+	case "poisson":
+		return prev.Add(expDuration(rng, gap))
+	case "bursty":
+		return a.nextBursty(rng, prev, perSecond)
+	default:
+		return prev.Add(gap)
+	}
+}
+
+// nextBursty draws Poisson gaps at the current state's rate; a gap that runs
+// past the end of the state is redrawn from there, which memorylessness
+// makes exact.
+func (a *arrivalProcess) nextBursty(rng *rand.Rand, t time.Time, perSecond float64) time.Time {
+	burstS, calmS, factor := cfg.LoadgenBurstS, cfg.LoadgenCalmS, cfg.LoadgenBurstFactor
+	for {
+		if !t.Before(a.until) {
+			a.bursting = !a.bursting
+			mean := calmS
+			if a.bursting {
+				mean = burstS
+			}
+			a.until = t.Add(expDuration(rng, time.Duration(mean*float64(time.Second))))
+			if a.bursting {
+				burstMu.Lock()
+				burstFrom, burstTo = t, a.until
+				burstMu.Unlock()
+			}
+		}
+		rate := perSecond * factor
+		if !a.bursting {
+			rate = perSecond * math.Max(0, (burstS+calmS-factor*burstS)/calmS)
+		}
+		if rate > 0 {
+			if next := t.Add(expDuration(rng, time.Duration(float64(time.Second)/rate))); next.Before(a.until) {
+				return next
+			}
+		}
+		t = a.until
+	}
+}
+
+// runClosedLoadgen runs the closed-loop users until the model, the
+// concurrency or the on/off state changes.
+func runClosedLoadgen(target string) {
+	users := loadgenConcurrency.Load()
+	running := func() bool {
+		return loadgenModel.Load().(string) == "closed" && loadgenConcurrency.Load() == users && loadgenRate.Load() > 0
+	}
+	var wg sync.WaitGroup
+	for i := int64(0); i < users; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(time.Now().UnixNano() + i))
+			for running() {
+				mix := loadgenConfig.Load()
+				path := pickWeighted(rng, mix.paths)
+				loadgenInflight.Add(1)
+				sendLoadgenRequest(target, path, mix.user(rng.Intn(mix.users)))
+				loadgenInflight.Add(-1)
+				if think := loadgenThinkMs.Load(); think > 0 {
+					time.Sleep(expDuration(rng, time.Duration(think)*time.Millisecond))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Backup and restore of the in-memory store: committed-but-unpublished outbox
+// events and dead letters. POST /admin/backup writes a JSON snapshot and POST
+// /admin/restore replaces the store with one. BACKUP_TARGET (default
+// /tmp/sre-app-backup.json) is a file path or an http(s) URL, which is
+// written with PUT and read with GET, so a presigned object-storage URL
+// works. Only the operator sets it: a request that names its own target is
+// refused, as it would let any admin caller write or read any file the
+// process can reach, or make it call any URL. A URL target is shown in
+// spans, logs and reports as its host alone, since a presigned query string
+// is a credential. GET /admin/backup reports the last runs.
+type storeSnapshot struct {
+	TakenAt     time.Time      `json:"taken_at"`
+	Pod         string         `json:"pod"`
+	Outbox      []outboxEvent  `json:"outbox"`
+	DeadLetters []deadLetter   `json:"dead_letters"`
+	Meta        map[string]int `json:"meta"`
+}
+
+type backupRun struct {
+	Target     string    `json:"target"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	Bytes      int       `json:"bytes"`
+	DurationMs int64     `json:"duration_ms"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+var (
+	backupTarget = "/tmp/sre-app-backup.json"
+	backupClient = &http.Client{
+		Transport: otelhttp.NewTransport(credentialURLTransport{http.DefaultTransport}),
+		Timeout:   30 * time.Second,
+	}
+
+	// backupMu serialises backups and restores against each other.
+	backupMu    sync.Mutex
+	lastBackup  *backupRun
+	lastRestore *backupRun
+)
+
+var (
+	backupRunsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "backup_runs_total",
+			Help: "Backup and restore runs by operation and outcome (success, failure)",
+		},
+		[]string{"operation", "outcome"},
+	)
+	backupDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "backup_duration_seconds",
+			Help:    "Duration of backup and restore runs",
+			Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"operation"},
+	)
+	backupSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "backup_size_bytes",
+			Help: "Size of the snapshot written or read by the last successful run",
+		},
+		[]string{"operation"},
+	)
+	backupLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "backup_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful run, for backup-age SLOs",
+		},
+		[]string{"operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(backupRunsTotal, backupDuration, backupSize, backupLastSuccess)
+	if v := os.Getenv("BACKUP_TARGET"); v != "" {
+		backupTarget = v
+	}
+}
+
+func takeSnapshot() storeSnapshot {
+	snap := storeSnapshot{TakenAt: time.Now(), Pod: podName()}
+	outboxMu.Lock()
+	snap.Outbox = append([]outboxEvent{}, outboxPending...)
+	outboxMu.Unlock()
+	dlqMu.Lock()
+	snap.DeadLetters = append([]deadLetter{}, dlq...)
+	dlqMu.Unlock()
+	snap.Meta = map[string]int{"outbox_events": len(snap.Outbox), "dead_letters": len(snap.DeadLetters)}
+	return snap
+}
+
+// applySnapshot replaces the store's contents with snap.
+func applySnapshot(snap storeSnapshot) {
+	for i, d := range snap.DeadLetters {
+		snap.DeadLetters[i].msg = queueMessage{ID: d.ID, Body: []byte(d.Body), Headers: propagation.MapCarrier{}, Attempts: d.Attempts}
+	}
+	outboxMu.Lock()
+	outboxPending = snap.Outbox
+	outboxMu.Unlock()
+	dlqMu.Lock()
+	dlq = snap.DeadLetters
+	dlqDepth.WithLabelValues(ordersQueue).Set(float64(len(dlq)))
+	dlqMu.Unlock()
+}
+
+// shownTarget is how target appears in telemetry and admin reports.
+func shownTarget(target string) string {
+	if u, err := url.Parse(target); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return credentialURL(u)
+	}
+	return target
+}
+
+func writeBackup(ctx context.Context, target string, body []byte) error {
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return os.WriteFile(strings.TrimPrefix(target, "file://"), body, 0o600)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := backupClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("backup target answered %s", resp.Status)
+	}
+	return nil
+}
+
+func readBackup(ctx context.Context, target string) ([]byte, error) {
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return os.ReadFile(strings.TrimPrefix(target, "file://"))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := backupClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("backup source answered %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// runBackupOp wraps a backup or restore in a span, metrics and a backupRun.
+func runBackupOp(ctx context.Context, operation, target string, op func(context.Context) (int, error)) *backupRun {
+	start := time.Now()
+	target = shownTarget(target)
+	ctx, span := tracer.Start(ctx, "store."+operation, trace.WithAttributes(attribute.String("app.backup.target", target)))
+	defer span.End()
+
+	n, err := op(ctx)
+	if uerr := (*url.Error)(nil); errors.As(err, &uerr) {
+		uerr.URL = target
+	}
+	run := &backupRun{Target: target, Outcome: "success", Bytes: n, DurationMs: time.Since(start).Milliseconds(), FinishedAt: time.Now()}
+	backupDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.Int("app.backup.bytes", n))
+	if err != nil {
+		run.Outcome, run.Error = "failure", err.Error()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "Store "+operation+" failed", "target", target, "error", err)
+	} else {
+		backupSize.WithLabelValues(operation).Set(float64(n))
+		backupLastSuccess.WithLabelValues(operation).SetToCurrentTime()
+		slog.InfoContext(ctx, "Store "+operation+" completed", "target", target, "bytes", n, "duration_ms", run.DurationMs)
+	}
+	backupRunsTotal.WithLabelValues(operation, run.Outcome).Inc()
+	return run
+}
+
+// decodeBackupTarget checks the optional body names no target and returns
+// BACKUP_TARGET.
+func decodeBackupTarget(w http.ResponseWriter, r *http.Request) (string, bool) {
+	req := struct {
+		Target string `json:"target"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	if req.Target != "" {
+		writeProblem(w, r, "the backup target is set by BACKUP_TARGET and cannot be chosen per request", http.StatusBadRequest)
+		return "", false
+	}
+	return backupTarget, true
+}
+
+// handleAdminBackup reports the last backup and restore (GET) or takes a
+// backup (POST).
+func handleAdminBackup(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		backupMu.Lock()
+		defer backupMu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{"target": shownTarget(backupTarget), "last_backup": lastBackup, "last_restore": lastRestore})
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target, ok := decodeBackupTarget(w, r)
+	if !ok {
+		return
+	}
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	lastBackup = runBackupOp(r.Context(), "backup", target, func(ctx context.Context) (int, error) {
+		body, err := json.Marshal(takeSnapshot())
+		if err != nil {
+			return 0, err
+		}
+		return len(body), writeBackup(ctx, target, body)
+	})
+	status := http.StatusOK
+	if lastBackup.Outcome != "success" {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, lastBackup)
+}
+
+// handleAdminRestore replaces the store with the snapshot at the target.
+func handleAdminRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target, ok := decodeBackupTarget(w, r)
+	if !ok {
+		return
+	}
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	var meta map[string]int
+	lastRestore = runBackupOp(r.Context(), "restore", target, func(ctx context.Context) (int, error) {
+		body, err := readBackup(ctx, target)
+		if err != nil {
+			return len(body), err
+		}
+		var snap storeSnapshot
+		if err := json.Unmarshal(body, &snap); err != nil {
+			return len(body), fmt.Errorf("decoding snapshot: %w", err)
+		}
+		applySnapshot(snap)
+		meta = snap.Meta
+		return len(body), nil
+	})
+	if lastRestore.Outcome != "success" {
+		writeJSON(w, http.StatusBadGateway, lastRestore)
+		return
+	}
+	slog.Warn("Admin: store restored from backup", "target", shownTarget(target), "outbox_events", meta["outbox_events"], "dead_letters", meta["dead_letters"])
+	writeJSON(w, http.StatusOK, map[string]any{"run": lastRestore, "restored": meta})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// One bad replica mode. Every pod of a Deployment shares the same env, so
+// the replicas that misbehave are chosen by identity instead:
+//
+//	BAD_REPLICA_PODS=sre-app-7c9f-abcde,...  explicit pod names, or
+//	BAD_REPLICA_PERCENT=34                   pods whose name hashes below 34/100
+//
+// A bad replica swaps ERROR_RATE / LATENCY_MS for BAD_REPLICA_ERROR_RATE /
+// BAD_REPLICA_LATENCY_MS while its siblings stay healthy.
+var chaosBadReplica = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "chaos_bad_replica",
+	Help: "1 if this replica was selected to misbehave by the one-bad-replica mode",
+})
+
+func init() {
+	prometheus.MustRegister(chaosBadReplica)
+}
+
+func podName() string {
+	if name := os.Getenv("K8S_POD_NAME"); name != "" {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+func isBadReplica(pod string) bool {
+	for _, name := range strings.Split(os.Getenv("BAD_REPLICA_PODS"), ",") {
+		if name = strings.TrimSpace(name); name != "" && name == pod {
+			return true
+		}
+	}
+	percent := cfg.BadReplicaPercent
+	if percent <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(pod))
+	return int(h.Sum32()%100) < percent
+}
+
+func applyBadReplicaMode() {
+	pod := podName()
+	if !isBadReplica(pod) {
+		chaosBadReplica.Set(0)
+		return
+	}
+
+	if v := cfg.BadReplicaErrorRate; v != nil {
+		errorRate = *v
+	}
+	if v := cfg.BadReplicaLatencyMs; v != nil {
+		latencyMs = *v
+	}
+	chaosBadReplica.Set(1)
+	log.Printf("Bad replica mode: %s selected (ERROR_RATE=%d%%, LATENCY_MS=%dms)", pod, errorRate, latencyMs)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Client-side load balancing. When DOWNSTREAM_URLS lists several replicas
+// (comma-separated) they replace DOWNSTREAM_URL and the failover client, and
+// LB_STRATEGY picks one per call:
+//
+//	round-robin    (default) strict rotation
+//	least-pending  fewest calls in flight
+//	ewma           lowest peak-EWMA latency weighted by pending calls
+//	hash           consistent hashing on the session/tenant (see hashring.go)
+//
+// Backends are labelled by host:port.
+var downstreamBalancer *balancer
+
+type lbBackend struct {
+	name    string
+	url     string
+	pending int
+	ewma    float64 // seconds
+	lastAt  time.Time
+}
+
+type balancer struct {
+	mu       sync.Mutex
+	strategy string
+	backends []*lbBackend
+	next     int
+
+	ring        []ringPoint
+	assignments map[string]string
+}
+
+// ewmaDecay is the time constant of the latency average.
+const ewmaDecay = 10 * time.Second
+
+var (
+	lbBackendRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "downstream_backend_requests_total",
+			Help: "Load-balanced downstream calls by backend and outcome (ok, error)",
+		},
+		[]string{"backend", "outcome"},
+	)
+	lbBackendDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "downstream_backend_duration_seconds",
+			Help:    "Load-balanced downstream call latency by backend",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"backend"},
+	)
+	lbBackendPending = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "downstream_backend_pending",
+			Help: "Calls in flight to each downstream backend",
+		},
+		[]string{"backend"},
+	)
+	lbBackendEWMA = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "downstream_backend_ewma_seconds",
+			Help: "Peak-EWMA latency estimate per downstream backend",
+		},
+		[]string{"backend"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(lbBackendRequests, lbBackendDuration, lbBackendPending, lbBackendEWMA)
+}
+
+func loadBalancerConfig() {
+	raw := os.Getenv("DOWNSTREAM_URLS")
+	if raw == "" {
+		return
+	}
+	b := &balancer{strategy: cfg.LBStrategy, assignments: map[string]string{}}
+	for _, raw := range strings.Split(raw, ",") {
+		raw = strings.TrimSpace(raw)
+		u, err := url.Parse(raw)
+		if raw == "" || err != nil || u.Host == "" {
+			log.Printf("Ignoring invalid DOWNSTREAM_URLS entry %q", raw)
+			continue
+		}
+		b.backends = append(b.backends, &lbBackend{name: u.Host, url: raw})
+		lbBackendPending.WithLabelValues(u.Host).Set(0)
+	}
+	if len(b.backends) > 0 {
+		b.buildRing()
+		downstreamBalancer = b
+		log.Printf("Load balancing %d downstream backends with %s", len(b.backends), b.strategy)
+	}
+}
+
+// balancerCall tracks one in-flight call; done must be called once.
+type balancerCall struct {
+	b       *balancer
+	backend *lbBackend
+	start   time.Time
+}
+
+func (b *balancer) pick(ctx context.Context) *balancerCall {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.backends) == 0 {
+		return nil
+	}
+
+	var chosen *lbBackend
+	key, _ := ctx.Value(routingKeyKey{}).(string)
+	switch {
+	case b.strategy == "hash" && key != "":
+		chosen = b.lookup(key)
+		b.remember(key, chosen)
+	case b.strategy == "least-pending":
+		// Scan from the rotation point so ties spread across backends.
+		for i := range b.backends {
+			be := b.backends[(b.next+i)%len(b.backends)]
+			if chosen == nil || be.pending < chosen.pending {
+				chosen = be
+			}
+		}
+		b.next++
+	case b.strategy == "ewma":
+		best := math.Inf(1)
+		for i := range b.backends {
+			be := b.backends[(b.next+i)%len(b.backends)]
+			// Idle estimates fade so a backend that was slow gets re-probed.
+			ewma := be.ewma * math.Exp(-float64(time.Since(be.lastAt))/float64(ewmaDecay))
+			if cost := ewma * float64(be.pending+1); cost < best {
+				chosen, best = be, cost
+			}
+		}
+		b.next++
+	default:
+		chosen = b.backends[b.next%len(b.backends)]
+		b.next++
+	}
+
+	chosen.pending++
+	lbBackendPending.WithLabelValues(chosen.name).Set(float64(chosen.pending))
+	return &balancerCall{b: b, backend: chosen, start: time.Now()}
+}
+
+// cancel returns a pick that was never sent, without counting it against
+// the backend or feeding its latency estimate.
+func (c *balancerCall) cancel() {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	c.backend.pending--
+	lbBackendPending.WithLabelValues(c.backend.name).Set(float64(c.backend.pending))
+}
+
+func (c *balancerCall) done(ok bool) {
+	rtt := time.Since(c.start)
+	outcome := "ok"
+	if !ok {
+		outcome = "error"
+	}
+	lbBackendRequests.WithLabelValues(c.backend.name, outcome).Inc()
+	lbBackendDuration.WithLabelValues(c.backend.name).Observe(rtt.Seconds())
+
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	be := c.backend
+	be.pending--
+	// Peak EWMA: jump straight to a slower sample, decay towards faster ones.
+	if sample := rtt.Seconds(); sample > be.ewma {
+		be.ewma = sample
+	} else {
+		w := math.Exp(-float64(time.Since(be.lastAt)) / float64(ewmaDecay))
+		be.ewma = be.ewma*w + sample*(1-w)
+	}
+	be.lastAt = time.Now()
+	lbBackendPending.WithLabelValues(be.name).Set(float64(be.pending))
+	lbBackendEWMA.WithLabelValues(be.name).Set(be.ewma)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Batch order intake. POST /orders/batch takes {"orders": [{"sku", "quantity"}]}
+// (at most BATCH_MAX_ITEMS, default 100) and places each order independently.
+// Item failures do not fail the batch: a failed item among successful ones
+// turns the response into a 207 Multi-Status, which request-level SLIs count
+// as success. The batch_items_total series is the per-item SLI that exposes
+// it. A batch in which every item failed is answered with the items' status
+// (422 if they were all invalid, their 5xx if they all failed the same way,
+// 500 otherwise), so a total failure is visible at the request level too.
+var batchMaxItems = 100
+
+var (
+	batchRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "batch_requests_total",
+			Help: "Batch requests by outcome (complete, partial, failed, rejected)",
+		},
+		[]string{"outcome"},
+	)
+	batchItemsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "batch_items_total",
+			Help: "Batch items by outcome (ok, invalid, failed)",
+		},
+		[]string{"outcome"},
+	)
+	batchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "batch_size_items",
+		Help:    "Number of items per accepted batch",
+		Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 250},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(batchRequestsTotal, batchItemsTotal, batchSize)
+	batchMaxItems = cfg.BatchMaxItems
+}
+
+type batchOrder struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+type batchItemResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+var errInvalidItem = errors.New("invalid item")
+
+func handleOrdersBatch(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := tracer.Start(r.Context(), "handleOrdersBatch")
+	defer span.End()
+
+	status := http.StatusOK
+	defer func() {
+		httpRequestsTotal.WithLabelValues("/orders/batch", strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues("/orders/batch").Observe(time.Since(start).Seconds())
+	}()
+
+	if r.Method != http.MethodPost {
+		status = http.StatusMethodNotAllowed
+		w.Header().Set("Allow", "POST")
+		writeProblem(w, r, "method not allowed", status)
+		return
+	}
+	var req struct {
+		Orders []batchOrder `json:"orders"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status = http.StatusBadRequest
+		batchRequestsTotal.WithLabelValues("rejected").Inc()
+		writeProblem(w, r, "invalid JSON body: "+err.Error(), status)
+		return
+	}
+	if len(req.Orders) == 0 || len(req.Orders) > batchMaxItems {
+		status = http.StatusRequestEntityTooLarge
+		if len(req.Orders) == 0 {
+			status = http.StatusBadRequest
+		}
+		batchRequestsTotal.WithLabelValues("rejected").Inc()
+		writeProblem(w, r, fmt.Sprintf("batch must contain 1-%d orders", batchMaxItems), status)
+		return
+	}
+	batchSize.Observe(float64(len(req.Orders)))
+
+	results := make([]batchItemResult, len(req.Orders))
+	failed := 0
+	for i, order := range req.Orders {
+		results[i] = placeBatchItem(ctx, i, order)
+		if results[i].Status >= 300 {
+			failed++
+		}
+	}
+	span.SetAttributes(attribute.Int("app.batch.items", len(req.Orders)), attribute.Int("app.batch.failed_items", failed))
+
+	outcome := "complete"
+	switch {
+	case failed == len(req.Orders):
+		outcome = "failed"
+		status = results[0].Status
+		for _, res := range results[1:] {
+			if res.Status == status {
+				continue
+			}
+			if res.Status >= 500 || status >= 500 {
+				status = http.StatusInternalServerError
+			}
+		}
+	case failed > 0:
+		outcome = "partial"
+		status = http.StatusMultiStatus
+	}
+	batchRequestsTotal.WithLabelValues(outcome).Inc()
+	writeJSON(w, status, map[string]any{
+		"outcome":   outcome,
+		"succeeded": len(req.Orders) - failed,
+		"failed":    failed,
+		"results":   results,
+	})
+}
+
+func placeBatchItem(ctx context.Context, index int, order batchOrder) batchItemResult {
+	ctx, span := tracer.Start(ctx, "batch_item")
+	defer span.End()
+	span.SetAttributes(attribute.Int("app.batch.index", index), attribute.String("app.order.sku", order.SKU))
+
+	result := batchItemResult{Index: index, Status: http.StatusCreated}
+	var err error
+	switch {
+	case order.SKU == "" || order.Quantity <= 0:
+		err = fmt.Errorf("%w: sku is required and quantity must be positive", errInvalidItem)
+		result.Status = http.StatusUnprocessableEntity
+	case shouldError():
+		err = fmt.Errorf("artificial failure for batch item %d", index)
+		markFault(ctx, err)
+		result.Status = http.StatusInternalServerError
+	default:
+		if err = placeOrder(ctx, []orderLine{{SKU: order.SKU, Quantity: order.Quantity, UnitPrice: catalogPrice(order.SKU)}}); err != nil {
+			result.Status = http.StatusServiceUnavailable
+		}
+	}
+
+	switch {
+	case err == nil:
+		batchItemsTotal.WithLabelValues("ok").Inc()
+	case errors.Is(err, errInvalidItem):
+		batchItemsTotal.WithLabelValues("invalid").Inc()
+		result.Error = err.Error()
+	default:
+		batchItemsTotal.WithLabelValues("failed").Inc()
+		span.SetStatus(codes.Error, err.Error())
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Brownout controller. Instead of failing under overload, /checkout sheds
+// optional work: past 70% load recommendations are skipped, past 85% the
+// order details are dropped too and only the bare confirmation is returned.
+// Load is in-flight/MAX_INFLIGHT, or the simulated load set through
+// /admin/brownout. BROWNOUT=off disables the controller, BROWNOUT=on forces
+// every feature off.
+type brownoutFeature struct {
+	name      string
+	threshold float64
+	disabled  atomic.Bool
+}
+
+var (
+	brownoutMode     atomic.Value // "auto", "on" or "off"
+	brownoutSimLoad  atomic.Uint64
+	brownoutFeatures = []*brownoutFeature{
+		{name: "recommendations", threshold: 0.70},
+		{name: "detailed_response", threshold: 0.85},
+	}
+
+	brownoutFeatureDisabled = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "brownout_feature_disabled",
+			Help: "1 while a feature is browned out to protect the service",
+		},
+		[]string{"feature"},
+	)
+	brownoutLoad = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "brownout_load_ratio",
+		Help: "Load ratio the brownout controller is acting on",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(brownoutFeatureDisabled)
+	prometheus.MustRegister(brownoutLoad)
+}
+
+func startBrownoutController() {
+	brownoutMode.Store(cfg.Brownout)
+	go runBrownoutController(context.Background())
+}
+
+func runBrownoutController(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		evaluateBrownout()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func currentLoad() float64 {
+	load := math.Float64frombits(brownoutSimLoad.Load())
+	if limit := currentInflightLimit(); limit > 0 {
+		load = math.Max(load, float64(inflightCount.Load())/float64(limit))
+	}
+	return load
+}
+
+func evaluateBrownout() {
+	load := currentLoad()
+	brownoutLoad.Set(load)
+	mode := brownoutMode.Load().(string)
+	for _, f := range brownoutFeatures {
+		off := mode == "on" || (mode == "auto" && load >= f.threshold)
+		if f.disabled.Swap(off) != off {
+			slog.Warn("brownout feature toggled", "feature", f.name, "disabled", off, "load", load)
+		}
+		v := 0.0
+		if off {
+			v = 1
+		}
+		brownoutFeatureDisabled.WithLabelValues(f.name).Set(v)
+	}
+}
+
+func featureEnabled(name string) bool {
+	for _, f := range brownoutFeatures {
+		if f.name == name {
+			return !f.disabled.Load()
+		}
+	}
+	return true
+}
+
+// recommendations is the expensive optional part of a checkout.
+func recommendations(ctx context.Context) []string {
+	ctx, span := tracer.Start(ctx, "recommendations")
+	defer span.End()
+	queryDatabase(ctx, "recommendations_by_category")
+	items := []string{"sre-handbook", "pager-holster", "coffee-beans", "chaos-monkey-plush"}
+	rand.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+	span.SetAttributes(attribute.Int("app.recommendations.count", 2))
+	return items[:2]
+}
+
+// writeCheckoutResponse renders the confirmation plus whatever optional
+// sections the brownout controller currently allows.
+func writeCheckoutResponse(ctx context.Context, w http.ResponseWriter, traceID string, lines []orderLine) {
+	var browned []string
+	items, total := orderTotals(lines)
+	observeCheckoutValue(ctx, items, total)
+	fmt.Fprintf(w, "Checkout successful")
+	if featureEnabled("detailed_response") {
+		fmt.Fprintf(w, "\nOrder details: items=%d total=$%.2f trace=%s", items, total, traceID)
+	} else {
+		browned = append(browned, "detailed_response")
+	}
+	if featureEnabled("recommendations") {
+		fmt.Fprintf(w, "\nRecommended: %s", strings.Join(recommendations(ctx), ", "))
+	} else {
+		browned = append(browned, "recommendations")
+	}
+	if len(browned) > 0 {
+		serverSpan(ctx).SetAttributes(attribute.StringSlice("app.brownout.features", browned))
+	}
+}
+
+// handleAdminBrownout reports or changes the controller, e.g.
+// {"simulated_load": 0.9} or {"mode": "off"}.
+func handleAdminBrownout(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Mode          string   `json:"mode"`
+			SimulatedLoad *float64 `json:"simulated_load"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch req.Mode {
+		case "":
+		case "auto", "on", "off":
+			brownoutMode.Store(req.Mode)
+		default:
+			writeProblem(w, r, "mode must be auto, on or off", http.StatusBadRequest)
+			return
+		}
+		if req.SimulatedLoad != nil {
+			brownoutSimLoad.Store(math.Float64bits(*req.SimulatedLoad))
+		}
+		evaluateBrownout()
+		slog.Warn("Admin: brownout updated", "mode", brownoutMode.Load(), "simulated_load", math.Float64frombits(brownoutSimLoad.Load()))
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	disabled := map[string]bool{}
+	for _, f := range brownoutFeatures {
+		disabled[f.name] = f.disabled.Load()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"mode":           brownoutMode.Load(),
+		"simulated_load": math.Float64frombits(brownoutSimLoad.Load()),
+		"load":           currentLoad(),
+		"disabled":       disabled,
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Telemetry budgeting: failures are always kept, successes are sampled.
+//
+//   - Request logs: every 5xx is logged at ERROR and kept in an in-memory
+//     ring (ERROR_RING_SIZE, served at /admin/telemetry/errors); successes are
+//     logged for SUCCESS_LOG_SAMPLE_RATE percent of requests.
+//   - Spans: with ERROR_SPAN_RESCUE (default on) the head sampler records
+//     spans it would have dropped, and traces that end up containing an
+//     error are exported anyway, so a 1% ratio still shows every failure.
+var (
+	successLogRate  = 10
+	errorSpanRescue = true
+	errorRing       *ringBuffer
+
+	telemetryBudgetTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "telemetry_budget_decisions_total",
+			Help: "Telemetry keep/drop decisions made by the budgeting layer",
+		},
+		[]string{"signal", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(telemetryBudgetTotal)
+}
+
+func loadBudgetConfig() {
+	successLogRate = cfg.SuccessLogSampleRate
+	errorSpanRescue = cfg.ErrorSpanRescue
+	errorRing = newRingBuffer(cfg.ErrorRingSize)
+}
+
+type errorRecord struct {
+	Time       time.Time `json:"time"`
+	Route      string    `json:"route"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"duration_ms"`
+	TraceID    string    `json:"trace_id"`
+	RequestID  string    `json:"request_id"`
+}
+
+type ringBuffer struct {
+	mu   sync.Mutex
+	buf  []errorRecord
+	next int
+	full bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]errorRecord, size)}
+}
+
+func (rb *ringBuffer) add(rec errorRecord) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.buf[rb.next] = rec
+	rb.next = (rb.next + 1) % len(rb.buf)
+	if rb.next == 0 {
+		rb.full = true
+	}
+}
+
+// snapshot returns the buffered records newest first.
+func (rb *ringBuffer) snapshot() []errorRecord {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	n := rb.next
+	if rb.full {
+		n = len(rb.buf)
+	}
+	out := make([]errorRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, rb.buf[(rb.next-i+len(rb.buf))%len(rb.buf)])
+	}
+	return out
+}
+
+// logRequest applies the log budget to one completed request.
+func logRequest(ctx context.Context, route string, status int, d time.Duration) {
+	traceID := trace.SpanContextFromContext(ctx).TraceID().String()
+	if status >= 500 {
+		telemetryBudgetTotal.WithLabelValues("log", "kept").Inc()
+		errorRing.add(errorRecord{Time: time.Now(), Route: route, Status: status, DurationMs: d.Milliseconds(), TraceID: traceID, RequestID: requestIDFromContext(ctx)})
+		slog.ErrorContext(ctx, "request failed", "route", route, "status", status, "duration_ms", d.Milliseconds(), "trace_id", traceID)
+		return
+	}
+	if rand.Intn(100) >= successLogRate {
+		telemetryBudgetTotal.WithLabelValues("log", "dropped").Inc()
+		return
+	}
+	telemetryBudgetTotal.WithLabelValues("log", "kept").Inc()
+	slog.InfoContext(ctx, "request completed", "route", route, "status", status, "duration_ms", d.Milliseconds(), "trace_id", traceID)
+}
+
+func handleAdminErrors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, errorRing.snapshot())
+}
+
+// errorRescueProcessor buffers the recorded-but-unsampled spans of each
+// trace until its local root ends, then exports them only if one failed.
+// A trace whose root never ends here (it was dropped, or only its children
+// ran in this process) is settled the same way once it has been pending for
+// rescueTraceTTL, and each trace holds at most maxRescueSpansPerTrace spans.
+type errorRescueProcessor struct {
+	exporter sdktrace.SpanExporter
+	mu       sync.Mutex
+	pending  map[trace.TraceID]*rescueTrace
+	sweptAt  time.Time
+	batches  chan []sdktrace.ReadOnlySpan
+	done     chan struct{}
+}
+
+type rescueTrace struct {
+	spans   []sdktrace.ReadOnlySpan
+	failed  bool
+	started time.Time
+}
+
+const (
+	// maxRescueTraces bounds memory if local roots never end.
+	maxRescueTraces        = 10000
+	maxRescueSpansPerTrace = 1000
+	rescueTraceTTL         = time.Minute
+)
+
+func newErrorRescueProcessor(exporter sdktrace.SpanExporter) *errorRescueProcessor {
+	p := &errorRescueProcessor{
+		exporter: exporter,
+		pending:  map[trace.TraceID]*rescueTrace{},
+		batches:  make(chan []sdktrace.ReadOnlySpan, 64),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *errorRescueProcessor) run() {
+	defer close(p.done)
+	for batch := range p.batches {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := p.exporter.ExportSpans(ctx, batch); err != nil {
+			slog.Warn("exporting rescued error spans failed", "error", err)
+		}
+		cancel()
+	}
+}
+
+func (p *errorRescueProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {}
+
+func (p *errorRescueProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.SpanContext().IsSampled() {
+		return
+	}
+	tid := s.SpanContext().TraceID()
+	localRoot := !s.Parent().IsValid() || s.Parent().IsRemote()
+	now := time.Now()
+
+	p.mu.Lock()
+	var settled []*rescueTrace
+	if now.Sub(p.sweptAt) >= time.Second {
+		settled = p.expire(now)
+	}
+	t := p.pending[tid]
+	if t == nil && len(p.pending) >= maxRescueTraces {
+		p.mu.Unlock()
+		telemetryBudgetTotal.WithLabelValues("span", "dropped").Inc()
+		p.settle(settled)
+		return
+	}
+	if t == nil {
+		t = &rescueTrace{started: now}
+		p.pending[tid] = t
+	}
+	if len(t.spans) < maxRescueSpansPerTrace {
+		t.spans = append(t.spans, s)
+	} else {
+		telemetryBudgetTotal.WithLabelValues("span", "dropped").Inc()
+	}
+	if s.Status().Code == codes.Error {
+		t.failed = true
+	}
+	if localRoot {
+		delete(p.pending, tid)
+		settled = append(settled, t)
+	}
+	p.mu.Unlock()
+	p.settle(settled)
+}
+
+// expire removes the traces pending longer than rescueTraceTTL; p.mu is
+// held.
+func (p *errorRescueProcessor) expire(now time.Time) []*rescueTrace {
+	p.sweptAt = now
+	var expired []*rescueTrace
+	for tid, t := range p.pending {
+		if now.Sub(t.started) >= rescueTraceTTL {
+			delete(p.pending, tid)
+			expired = append(expired, t)
+		}
+	}
+	return expired
+}
+
+// settle exports the traces that failed and drops the rest.
+func (p *errorRescueProcessor) settle(traces []*rescueTrace) {
+	for _, t := range traces {
+		if !t.failed {
+			telemetryBudgetTotal.WithLabelValues("span", "dropped").Add(float64(len(t.spans)))
+			continue
+		}
+		select {
+		case p.batches <- t.spans:
+			telemetryBudgetTotal.WithLabelValues("span", "rescued").Add(float64(len(t.spans)))
+		default:
+			telemetryBudgetTotal.WithLabelValues("span", "dropped").Add(float64(len(t.spans)))
+		}
+	}
+}
+
+func (p *errorRescueProcessor) Shutdown(ctx context.Context) error {
+	close(p.batches)
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *errorRescueProcessor) ForceFlush(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Per-dependency bulkheads. Each dependency gets its own concurrency limit
+// from BULKHEAD_LIMITS (default "payment=10,downstream=20"); a call beyond
+// the limit is rejected immediately rather than queued, so a slow provider
+// exhausts only its own compartment instead of every server goroutine.
+// Dependencies without a limit are unbounded. /admin/bulkheads changes limits
+// at runtime.
+var errBulkheadFull = errors.New("bulkhead full")
+
+type bulkhead struct {
+	name     string
+	mu       sync.Mutex
+	limit    int
+	inflight int
+}
+
+var (
+	bulkheadsMu sync.Mutex
+	bulkheads   = map[string]*bulkhead{}
+)
+
+var (
+	bulkheadInflight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bulkhead_inflight",
+			Help: "Calls currently holding a bulkhead slot",
+		},
+		[]string{"dependency"},
+	)
+	bulkheadLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bulkhead_limit",
+			Help: "Bulkhead concurrency limit; 0 means unbounded",
+		},
+		[]string{"dependency"},
+	)
+	bulkheadRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bulkhead_rejected_total",
+			Help: "Calls rejected because the dependency's bulkhead was full",
+		},
+		[]string{"dependency"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(bulkheadInflight, bulkheadLimit, bulkheadRejected)
+}
+
+func loadBulkheadConfig() {
+	// A malformed BULKHEAD_LIMITS is reported by loadConfig.
+	limits, _ := parseBulkheadLimits(os.Getenv("BULKHEAD_LIMITS"))
+	for name, limit := range limits {
+		bulkheadFor(name).setLimit(limit)
+	}
+}
+
+func parseBulkheadLimits(spec string) (map[string]int, error) {
+	if spec == "" {
+		spec = "payment=10,downstream=20"
+	}
+	limits := map[string]int{}
+	for _, entry := range strings.Split(spec, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		limit, err := strconv.Atoi(value)
+		if name == "" || err != nil || limit < 0 {
+			return nil, fmt.Errorf("entry %q: want name=limit with a limit of 0 or more", entry)
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+func bulkheadFor(name string) *bulkhead {
+	bulkheadsMu.Lock()
+	defer bulkheadsMu.Unlock()
+	b, ok := bulkheads[name]
+	if !ok {
+		b = &bulkhead{name: name}
+		bulkheads[name] = b
+		bulkheadInflight.WithLabelValues(name).Set(0)
+		bulkheadLimit.WithLabelValues(name).Set(0)
+		bulkheadRejected.WithLabelValues(name)
+	}
+	return b
+}
+
+func (b *bulkhead) setLimit(limit int) {
+	b.mu.Lock()
+	b.limit = limit
+	b.mu.Unlock()
+	bulkheadLimit.WithLabelValues(b.name).Set(float64(limit))
+}
+
+// acquire takes a slot or fails with errBulkheadFull; release must be called
+// exactly once on success.
+func (b *bulkhead) acquire() (release func(), err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.inflight >= b.limit {
+		bulkheadRejected.WithLabelValues(b.name).Inc()
+		return nil, errBulkheadFull
+	}
+	b.inflight++
+	bulkheadInflight.WithLabelValues(b.name).Set(float64(b.inflight))
+	return func() {
+		b.mu.Lock()
+		b.inflight--
+		bulkheadInflight.WithLabelValues(b.name).Set(float64(b.inflight))
+		b.mu.Unlock()
+	}, nil
+}
+
+// handleAdminBulkheads lists bulkheads or sets a limit:
+// {"dependency": "payment", "limit": 2}.
+func handleAdminBulkheads(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Dependency string `json:"dependency"`
+			Limit      *int   `json:"limit"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Dependency == "" || req.Limit == nil || *req.Limit < 0 {
+			writeProblem(w, r, "dependency and a non-negative limit are required", http.StatusBadRequest)
+			return
+		}
+		bulkheadFor(req.Dependency).setLimit(*req.Limit)
+		slog.Warn("Admin: bulkhead limit updated", "dependency", req.Dependency, "limit", *req.Limit)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type status struct {
+		Dependency string `json:"dependency"`
+		Limit      int    `json:"limit"`
+		Inflight   int    `json:"inflight"`
+	}
+	var out []status
+	bulkheadsMu.Lock()
+	for name, b := range bulkheads {
+		b.mu.Lock()
+		out = append(out, status{name, b.limit, b.inflight})
+		b.mu.Unlock()
+	}
+	bulkheadsMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Dependency < out[j].Dependency })
+	writeJSON(w, http.StatusOK, out)
+}
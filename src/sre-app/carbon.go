@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Energy and carbon estimates, in the spirit of the Cloud Carbon Footprint
+// methodology and deliberately rough. Each request's CPU time (the same
+// self-time proxy the cost model uses) is turned into energy at
+// CARBON_WATTS_PER_CPU (default 3.5 W per busy vCPU) times CARBON_PUE
+// (default 1.2 for datacenter overhead), and into emissions at the grid
+// intensity of this replica's REGION. CARBON_INTENSITY maps regions to
+// gCO2e/kWh, e.g. "eu-north-1=30,eu-west-1=290,us-east-1=380"; regions not
+// listed use CARBON_INTENSITY_DEFAULT (default 440, roughly the global grid
+// average), so comparing regions shows where the same traffic is cleanest.
+var (
+	carbonIntensity = 440.0 // gCO2e/kWh for this replica's region
+	carbonRegion    string
+)
+
+var (
+	requestEnergyJoules = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "request_energy_joules_total",
+			Help: "Estimated energy used serving requests, by path",
+		},
+		[]string{"path"},
+	)
+	requestCarbonGrams = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "request_carbon_grams_total",
+			Help: "Estimated gCO2e emitted serving requests, by path and region",
+		},
+		[]string{"path", "region"},
+	)
+	carbonIntensityGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "carbon_intensity_grams_per_kwh",
+			Help: "Grid carbon intensity assumed for this replica's region",
+		},
+		[]string{"region"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestEnergyJoules, requestCarbonGrams, carbonIntensityGauge)
+}
+
+func loadCarbonConfig() {
+	carbonRegion = os.Getenv("REGION")
+	carbonIntensity = cfg.CarbonIntensityDefault
+	// A malformed CARBON_INTENSITY is reported by loadConfig.
+	regions, _ := parseCarbonIntensity(os.Getenv("CARBON_INTENSITY"))
+	if v, ok := regions[carbonRegion]; ok {
+		carbonIntensity = v
+	}
+	carbonIntensityGauge.WithLabelValues(carbonRegion).Set(carbonIntensity)
+}
+
+func parseCarbonIntensity(spec string) (map[string]float64, error) {
+	regions := map[string]float64{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		region, raw, ok := strings.Cut(entry, "=")
+		v, err := strconv.ParseFloat(raw, 64)
+		if !ok || region == "" || err != nil || v < 0 {
+			return nil, fmt.Errorf("entry %q: want region=gCO2e/kWh, 0 or more", entry)
+		}
+		regions[region] = v
+	}
+	return regions, nil
+}
+
+// recordEnergy charges a finished request's CPU time.
+func recordEnergy(route string, cpu time.Duration) {
+	joules := cpu.Seconds() * cfg.CarbonWattsPerCPU * cfg.CarbonPUE
+	requestEnergyJoules.WithLabelValues(route).Add(joules)
+	requestCarbonGrams.WithLabelValues(route, carbonRegion).Add(joules / 3.6e6 * carbonIntensity)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Cardinality guard. Guarded vectors track the label combinations they have
+// handed out; once a metric reaches METRIC_SERIES_CAP series (default 500,
+// 0 disables the guard) new combinations are folded into a single series
+// whose labels are all "other", and counted in telemetry_series_dropped_total.
+const overflowLabelValue = "other"
+
+var (
+	seriesCap atomic.Int64
+
+	telemetrySeries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "telemetry_series",
+			Help: "Number of label combinations admitted per guarded metric",
+		},
+		[]string{"metric"},
+	)
+	telemetrySeriesDroppedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "telemetry_series_dropped_total",
+			Help: "Total number of observations folded into the overflow series by the cardinality guard",
+		},
+		[]string{"metric"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(telemetrySeries)
+	prometheus.MustRegister(telemetrySeriesDroppedTotal)
+
+	seriesCap.Store(int64(cfg.MetricSeriesCap))
+}
+
+type seriesGuard struct {
+	metric   string
+	disabled atomic.Bool
+	mu       sync.Mutex
+	seen     map[string]struct{}
+}
+
+func newSeriesGuard(metric string) *seriesGuard {
+	return &seriesGuard{metric: metric, seen: map[string]struct{}{}}
+}
+
+// reset forgets every admitted combination; callers reset the vector too.
+func (g *seriesGuard) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.seen = map[string]struct{}{}
+	telemetrySeries.WithLabelValues(g.metric).Set(0)
+}
+
+// admit returns the label values to use for this observation.
+func (g *seriesGuard) admit(lvs []string) []string {
+	key := strings.Join(lvs, "\xff")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.seen[key]; ok {
+		return lvs
+	}
+	if limit := seriesCap.Load(); limit > 0 && !g.disabled.Load() && int64(len(g.seen)) >= limit {
+		telemetrySeriesDroppedTotal.WithLabelValues(g.metric).Inc()
+		out := make([]string, len(lvs))
+		for i := range out {
+			out[i] = overflowLabelValue
+		}
+		return out
+	}
+	g.seen[key] = struct{}{}
+	telemetrySeries.WithLabelValues(g.metric).Set(float64(len(g.seen)))
+	return lvs
+}
+
+type guardedCounterVec struct {
+	*prometheus.CounterVec
+	guard *seriesGuard
+}
+
+func guardCounterVec(metric string, vec *prometheus.CounterVec) guardedCounterVec {
+	return guardedCounterVec{CounterVec: vec, guard: newSeriesGuard(metric)}
+}
+
+func (v guardedCounterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	return v.CounterVec.WithLabelValues(v.guard.admit(lvs)...)
+}
+
+type guardedHistogramVec struct {
+	*prometheus.HistogramVec
+	guard *seriesGuard
+}
+
+func guardHistogramVec(metric string, vec *prometheus.HistogramVec) guardedHistogramVec {
+	return guardedHistogramVec{HistogramVec: vec, guard: newSeriesGuard(metric)}
+}
+
+func (v guardedHistogramVec) WithLabelValues(lvs ...string) prometheus.Observer {
+	return v.HistogramVec.WithLabelValues(v.guard.admit(lvs)...)
+}
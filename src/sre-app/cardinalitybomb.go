@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Cardinality explosion chaos. CARDINALITY_BOMB_RATE new series per second
+// are minted on app_user_requests_total by labelling it with unique user and
+// request IDs, the classic "someone put an ID in a label" incident. The
+// counter starts outside the cardinality guard; the fix is enabling it (and
+// resetting the damage) through /admin/chaos/cardinality.
+var (
+	cardinalityBombRate atomic.Int64
+
+	appUserRequestsTotal = guardCounterVec("app_user_requests_total", prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "app_user_requests_total",
+			Help: "Requests per user (deliberately high-cardinality when the cardinality bomb is armed)",
+		},
+		[]string{"user_id", "request_id"},
+	))
+)
+
+func init() {
+	prometheus.MustRegister(appUserRequestsTotal)
+}
+
+func startCardinalityBomb() {
+	cardinalityBombRate.Store(int64(cfg.CardinalityBombRate))
+	appUserRequestsTotal.guard.disabled.Store(!cfg.CardinalityBombGuard)
+	go runCardinalityBomb(context.Background())
+}
+
+func runCardinalityBomb(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for i := int64(0); i < cardinalityBombRate.Load(); i++ {
+			userID := fmt.Sprintf("user-%d", rand.Intn(1_000_000))
+			requestID := fmt.Sprintf("%016x", rand.Uint64())
+			appUserRequestsTotal.WithLabelValues(userID, requestID).Inc()
+		}
+	}
+}
+
+// handleAdminCardinality reports or changes the bomb, e.g.
+// {"rate": 200} to arm it, {"guard": true, "reset": true} to fix it.
+func handleAdminCardinality(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Rate  *int64 `json:"rate"`
+			Guard *bool  `json:"guard"`
+			Reset bool   `json:"reset"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Rate != nil {
+			cardinalityBombRate.Store(*req.Rate)
+		}
+		if req.Guard != nil {
+			appUserRequestsTotal.guard.disabled.Store(!*req.Guard)
+		}
+		if req.Reset {
+			appUserRequestsTotal.Reset()
+			appUserRequestsTotal.guard.reset()
+		}
+		slog.Warn("Admin: cardinality bomb updated", "rate", cardinalityBombRate.Load(), "guarded", !appUserRequestsTotal.guard.disabled.Load(), "reset", req.Reset)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"rate":       cardinalityBombRate.Load(),
+		"guard":      !appUserRequestsTotal.guard.disabled.Load(),
+		"series_cap": seriesCap.Load(),
+	})
+}
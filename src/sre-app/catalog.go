@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var catalogFlight = newFlightGroup("catalog")
+
+var catalogItems = []map[string]any{
+	{"sku": "sre-handbook", "name": "SRE Handbook", "price": 39.0},
+	{"sku": "pager-holster", "name": "Pager Holster", "price": 14.5},
+	{"sku": "coffee-beans", "name": "Coffee Beans (1kg)", "price": 22.0},
+	{"sku": "chaos-monkey-plush", "name": "Chaos Monkey Plush", "price": 18.0},
+}
+
+// handleCatalog is a deliberately expensive read: the listing query takes
+// ~120ms, which is what the response cache in front of it hides. Concurrent
+// misses share one query through catalogFlight. Its request metrics are
+// recorded by cached().
+func handleCatalog(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "handleCatalog")
+	defer span.End()
+
+	_, err, shared := catalogFlight.do("catalog_listing", func() (any, error) {
+		_, err := queryDatabase(ctx, "catalog_listing")
+		return catalogItems, err
+	})
+	span.SetAttributes(attribute.Bool("app.singleflight.shared", shared))
+
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusServiceUnavailable
+		writeProblem(w, r, "Catalog database unavailable", status)
+	} else {
+		writeJSON(w, status, catalogItems)
+	}
+}
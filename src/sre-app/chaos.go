@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tail-sampling hints. The chaos engine stamps these on the server span of
+// every request it touches so a collector tail_sampling processor can keep
+// interesting traces with plain attribute policies:
+//
+//	app.fault_injected = true   an error or latency fault was injected
+//	app.fault.error    = true   the injected fault failed the request
+//	app.fault.latency_ms        injected latency in milliseconds
+//	app.slow           = true   request took longer than SLOW_REQUEST_MS
+//
+// e.g. {type: boolean_attribute, boolean_attribute: {key: app.fault_injected, value: true}}
+const (
+	attrFaultInjected  = attribute.Key("app.fault_injected")
+	attrFaultError     = attribute.Key("app.fault.error")
+	attrFaultLatencyMs = attribute.Key("app.fault.latency_ms")
+	attrSlow           = attribute.Key("app.slow")
+)
+
+// markFault records an injected error on the current span and flags the
+// server span for tail sampling.
+func markFault(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	serverSpan(ctx).SetAttributes(attrFaultInjected.Bool(true), attrFaultError.Bool(true))
+	noteChaos(ctx, "error: %v", err)
+}
+
+func simulateWork(ctx context.Context) {
+	_, span := tracer.Start(ctx, "simulateWork")
+	defer span.End()
+
+	if latencyMs > 0 {
+		time.Sleep(time.Duration(latencyMs) * time.Millisecond)
+		span.SetAttributes(attribute.Int("simulated_latency_ms", latencyMs))
+		serverSpan(ctx).SetAttributes(attrFaultInjected.Bool(true), attrFaultLatencyMs.Int(latencyMs))
+		noteChaos(ctx, "latency: %dms", latencyMs)
+	}
+}
+
+func shouldError() bool {
+	if errorRate <= 0 {
+		return false
+	}
+	return rand.Intn(100) < errorRate
+}
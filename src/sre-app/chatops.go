@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Chatops notifications, so exercise participants see changes land in a
+// channel the way a real incident unfolds. With CHATOPS_WEBHOOK_URL (or
+// CHATOPS_WEBHOOK_URL_FILE: Slack and Discord webhook URLs are credentials)
+// every admin change, unlocked incident phase and alert remediation is
+// posted in CHATOPS_FORMAT: "slack" ({"text": ...}), "discord"
+// ({"content": ...}) or "generic" (the event's fields plus the rendered
+// "message"). CHATOPS_TEMPLATE is a text/template over .Kind, .Text, .Pod,
+// .Region and .Time, by default
+//
+//	[{{.Kind}}] {{.Pod}}: {{.Text}}
+//
+// Messages are sent in the background; failures are logged and counted. The
+// webhook URL appears in client spans and errors as its host alone.
+const defaultChatopsTemplate = "[{{.Kind}}] {{.Pod}}: {{.Text}}"
+
+type chatopsEvent struct {
+	Kind   string    `json:"kind"`
+	Text   string    `json:"text"`
+	Pod    string    `json:"pod"`
+	Region string    `json:"region"`
+	Time   time.Time `json:"time"`
+}
+
+var (
+	chatopsURL        = loadSecret("CHATOPS_WEBHOOK_URL")
+	chatopsTemplate   *template.Template
+	chatopsHTTPClient = &http.Client{
+		Transport: otelhttp.NewTransport(credentialURLTransport{http.DefaultTransport}),
+		Timeout:   5 * time.Second,
+	}
+
+	chatopsMessagesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chatops_messages_total",
+			Help: "Chatops webhook messages, by outcome (ok, failed)",
+		},
+		[]string{"outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(chatopsMessagesTotal)
+	// A malformed CHATOPS_TEMPLATE is reported by loadConfig.
+	chatopsTemplate, _ = parseChatopsTemplate(os.Getenv("CHATOPS_TEMPLATE"))
+}
+
+func parseChatopsTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultChatopsTemplate
+	}
+	return template.New("chatops").Option("missingkey=error").Parse(text)
+}
+
+// postChatops sends one event to the chatops webhook, if there is one.
+func postChatops(ctx context.Context, kind, text string) {
+	url := chatopsURL.get()
+	if url == "" || chatopsTemplate == nil {
+		return
+	}
+	event := chatopsEvent{Kind: kind, Text: text, Pod: podName(), Region: os.Getenv("REGION"), Time: time.Now().UTC()}
+	if err := sendChatops(ctx, url, event); err != nil {
+		chatopsMessagesTotal.WithLabelValues("failed").Inc()
+		slog.WarnContext(ctx, "Chatops message failed", "kind", kind, "error", err)
+		return
+	}
+	chatopsMessagesTotal.WithLabelValues("ok").Inc()
+}
+
+func sendChatops(ctx context.Context, url string, event chatopsEvent) error {
+	var message strings.Builder
+	if err := chatopsTemplate.Execute(&message, event); err != nil {
+		return err
+	}
+	var payload any
+	switch cfg.ChatopsFormat {
+	case "discord":
+		payload = map[string]string{"content": message.String()}
+	case "generic":
+		payload = struct {
+			chatopsEvent
+			Message string `json:"message"`
+		}{event, message.String()}
+	default:
+		payload = map[string]string{"text": message.String()}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := chatopsHTTPClient.Do(req)
+	if uerr := (*neturl.Error)(nil); errors.As(err, &uerr) {
+		uerr.URL = credentialURL(req.URL)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Checkout value, the business metric of the demo. Every successful checkout
+// builds a basket from the catalog and observes its total in
+// checkout_value_dollars with the request's trace ID as an exemplar, so a
+// Grafana panel on the histogram links straight from "the $10k order" to its
+// trace. CHECKOUT_WHALE_RATE (percent, default 1) turns that share of orders
+// into bulk purchases worth thousands, so the top buckets always have
+// something to find. /metrics serves OpenMetrics when asked, which is the
+// format that carries exemplars.
+var checkoutValue = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "checkout_value_dollars",
+	Help:    "Total value of successful checkouts in dollars",
+	Buckets: []float64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 25000},
+})
+
+func init() {
+	prometheus.MustRegister(checkoutValue)
+}
+
+// checkoutBasket picks the lines of an order from the catalog.
+func checkoutBasket() []orderLine {
+	n := 1 + rand.Intn(4)
+	quantity := func() int { return 1 + rand.Intn(3) }
+	if cfg.CheckoutWhaleRate > 0 && rand.Intn(100) < cfg.CheckoutWhaleRate {
+		n = len(catalogItems)
+		quantity = func() int { return 50 + rand.Intn(200) }
+	}
+	lines := make([]orderLine, n)
+	for i := range lines {
+		item := catalogItems[rand.Intn(len(catalogItems))]
+		lines[i] = orderLine{SKU: item["sku"].(string), Quantity: quantity(), UnitPrice: item["price"].(float64)}
+	}
+	return lines
+}
+
+// observeCheckoutValue records a successful order's value on the histogram
+// and the server span. Only sampled traces become exemplars; an exemplar
+// pointing at a dropped trace is a dead link.
+func observeCheckoutValue(ctx context.Context, items int, total float64) {
+	serverSpan(ctx).SetAttributes(attribute.Int("app.order.items", items), attribute.Float64("app.order.value", total))
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsSampled() {
+		checkoutValue.Observe(total)
+		return
+	}
+	checkoutValue.(prometheus.ExemplarObserver).ObserveWithExemplar(total, prometheus.Labels{
+		"trace_id": sc.TraceID().String(),
+		"span_id":  sc.SpanID().String(),
+	})
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Client IP resolution behind proxies. TRUSTED_PROXIES is a ","-separated
+// list of CIDRs (default: loopback and private ranges, where an in-cluster
+// ingress lives). CLIENT_IP_MODE picks how X-Forwarded-For is read:
+//
+//	rightmost  walk the hops from the socket peer leftwards, skipping
+//	           trusted proxies; the first untrusted address is the client.
+//	           XFF from an untrusted peer is ignored (the default)
+//	leftmost   believe the first hop, as naive code does: any client can
+//	           choose its own IP by sending X-Forwarded-For
+//	peer       ignore the headers and use the socket peer
+//
+// Every resolution is counted in client_ip_resolutions_total by outcome:
+// direct (no header), forwarded (resolved through trusted proxies),
+// untrusted_peer (a header from outside the proxies, i.e. spoofed),
+// extra_hops (hops left of the client that it sent itself) and malformed.
+//
+// PROXY_PROTOCOL (off, optional, required) accepts HAProxy PROXY v1 and v2
+// headers from trusted peers, as sent by L4 load balancers that cannot add
+// X-Forwarded-For; the header's source address then replaces the socket
+// peer. A header from an untrusted peer, a malformed one or a missing one
+// in required mode gets the connection rejected, counted in
+// proxy_protocol_headers_total.
+var (
+	trustedProxies []netip.Prefix
+
+	clientIPResolutions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "client_ip_resolutions_total",
+			Help: "Client IP resolutions by outcome (direct, forwarded, untrusted_peer, extra_hops, malformed)",
+		},
+		[]string{"outcome"},
+	)
+	proxyProtocolHeaders = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_protocol_headers_total",
+			Help: "PROXY protocol headers by outcome (accepted, absent, missing: required but absent, malformed, untrusted_peer)",
+		},
+		[]string{"outcome"},
+	)
+)
+
+const defaultTrustedProxies = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+
+func init() {
+	prometheus.MustRegister(clientIPResolutions, proxyProtocolHeaders)
+	// A malformed TRUSTED_PROXIES is reported by loadConfig.
+	trustedProxies, _ = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+}
+
+func parseTrustedProxies(spec string) ([]netip.Prefix, error) {
+	if spec == "" {
+		spec = defaultTrustedProxies
+	}
+	var prefixes []netip.Prefix
+	for _, raw := range strings.Split(spec, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if !strings.Contains(raw, "/") {
+			addr, err := netip.ParseAddr(raw)
+			if err != nil {
+				return nil, err
+			}
+			raw = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the request's client address according to
+// CLIENT_IP_MODE.
+func clientIP(r *http.Request) string {
+	ip, _ := resolveClientIP(r)
+	return ip
+}
+
+// resolveClientIP returns the client address and the outcome counted in
+// client_ip_resolutions_total.
+func resolveClientIP(r *http.Request) (ip, outcome string) {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) == 0 {
+		return peer, "direct"
+	}
+	switch cfg.ClientIPMode {
+	case "peer":
+		return peer, "direct"
+	case "leftmost":
+		return hops[0], "forwarded"
+	}
+	addr, err := netip.ParseAddr(peer)
+	if err != nil || !trustedProxy(addr) {
+		return peer, "untrusted_peer"
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			return client, "malformed"
+		}
+		client = addr.Unmap().String()
+		if !trustedProxy(addr) {
+			if i > 0 {
+				return client, "extra_hops"
+			}
+			return client, "forwarded"
+		}
+	}
+	return client, "forwarded"
+}
+
+// proxyListener reads PROXY protocol headers off accepted connections.
+type proxyListener struct {
+	net.Listener
+	required bool
+}
+
+func listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || cfg.ProxyProtocol == "off" {
+		return ln, err
+	}
+	return proxyListener{ln, cfg.ProxyProtocol == "required"}, nil
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), required: l.required}, nil
+}
+
+// proxyConn parses the header on first use, in the connection's own
+// goroutine rather than the accept loop.
+type proxyConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	required bool
+	once     sync.Once
+	source   net.Addr
+	err      error
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		outcome := "accepted"
+		c.source, c.err = c.readHeader()
+		switch {
+		case errors.Is(c.err, errNoProxyHeader) && c.required:
+			outcome = "missing"
+		case errors.Is(c.err, errNoProxyHeader):
+			outcome, c.err = "absent", nil
+		case errors.Is(c.err, errUntrustedProxy):
+			outcome = "untrusted_peer"
+		case c.err != nil:
+			outcome = "malformed"
+		}
+		proxyProtocolHeaders.WithLabelValues(outcome).Inc()
+	})
+}
+
+var (
+	errNoProxyHeader  = errors.New("no PROXY protocol header")
+	errUntrustedProxy = errors.New("PROXY protocol header from an untrusted peer")
+)
+
+func (c *proxyConn) readHeader() (net.Addr, error) {
+	start, err := c.reader.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	v1 := string(start) == "PROXY"
+	v2 := false
+	if !v1 {
+		sig, _ := c.reader.Peek(len(proxyV2Signature))
+		v2 = bytes.Equal(sig, proxyV2Signature)
+	}
+	if !v1 && !v2 {
+		return nil, errNoProxyHeader
+	}
+	if peer, err := netip.ParseAddrPort(c.Conn.RemoteAddr().String()); err != nil || !trustedProxy(peer.Addr()) {
+		return nil, errUntrustedProxy
+	}
+	if v1 {
+		return c.readV1()
+	}
+	return c.readV2()
+}
+
+// readV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n".
+func (c *proxyConn) readV1() (net.Addr, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err != nil || len(line) > 107 {
+		return nil, fmt.Errorf("PROXY v1 header too long or unterminated")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	port, perr := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil || perr != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source %s:%s", fields[2], fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readV2 parses the binary header: signature, version/command, family,
+// length, then the addresses.
+func (c *proxyConn) readV2() (net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(c.reader, head); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, fmt.Errorf("PROXY v2 header with version %d", head[12]>>4)
+	}
+	if head[12]&0x0f == 0 { // LOCAL: health checks from the proxy itself
+		return nil, nil
+	}
+	switch head[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 IPv4 addresses")
+		}
+		addr := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 IPv6 addresses")
+		}
+		addr := netip.AddrFrom16([16]byte(body[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[32:34]))), nil
+	}
+	return nil, nil
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
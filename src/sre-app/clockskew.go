@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Clock skew chaos. CLOCK_SKEW_RATE percent of spans and log lines are
+// shifted CLOCK_SKEW_MS (default 5m) into the past or the future, producing
+// the children-before-parents traces and out-of-order log streams that real
+// NTP drift causes.
+var (
+	clockSkewRate int
+	clockSkew     time.Duration
+
+	chaosClockSkewTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chaos_clock_skew_applied_total",
+			Help: "Total number of telemetry items emitted with a skewed timestamp",
+		},
+		[]string{"signal"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(chaosClockSkewTotal)
+}
+
+func loadClockSkewConfig() {
+	clockSkewRate = cfg.ClockSkewRate
+	clockSkew = time.Duration(cfg.ClockSkewMs) * time.Millisecond
+}
+
+// skewOffset returns a random ±clockSkew for the configured share of
+// telemetry items and zero for the rest.
+func skewOffset() time.Duration {
+	if clockSkewRate <= 0 || rand.Intn(100) >= clockSkewRate {
+		return 0
+	}
+	if rand.Intn(2) == 0 {
+		return -clockSkew
+	}
+	return clockSkew
+}
+
+// skewingExporter shifts whole spans (start, end and events) before they
+// reach the real exporter, as if they were recorded on a drifting host.
+type skewingExporter struct {
+	sdktrace.SpanExporter
+}
+
+type skewedSpan struct {
+	sdktrace.ReadOnlySpan
+	offset time.Duration
+}
+
+func (s skewedSpan) StartTime() time.Time { return s.ReadOnlySpan.StartTime().Add(s.offset) }
+func (s skewedSpan) EndTime() time.Time   { return s.ReadOnlySpan.EndTime().Add(s.offset) }
+
+func (s skewedSpan) Events() []sdktrace.Event {
+	events := s.ReadOnlySpan.Events()
+	out := make([]sdktrace.Event, len(events))
+	for i, ev := range events {
+		ev.Time = ev.Time.Add(s.offset)
+		out[i] = ev
+	}
+	return out
+}
+
+func (e skewingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	out := make([]sdktrace.ReadOnlySpan, len(spans))
+	for i, s := range spans {
+		if offset := skewOffset(); offset != 0 {
+			chaosClockSkewTotal.WithLabelValues("span").Inc()
+			s = skewedSpan{ReadOnlySpan: s, offset: offset}
+		}
+		out[i] = s
+	}
+	return e.SpanExporter.ExportSpans(ctx, out)
+}
+
+// skewingHandler re-dates individual log records in the past or future.
+type skewingHandler struct {
+	slog.Handler
+}
+
+func (h skewingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if offset := skewOffset(); offset != 0 {
+		chaosClockSkewTotal.WithLabelValues("log").Inc()
+		r.Time = r.Time.Add(offset)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h skewingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return skewingHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h skewingHandler) WithGroup(name string) slog.Handler {
+	return skewingHandler{h.Handler.WithGroup(name)}
+}
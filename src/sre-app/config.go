@@ -0,0 +1,690 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is every typed setting the app reads from the environment. It is
+// loaded once, before any init function runs, and each malformed or
+// out-of-range variable is recorded as a problem instead of silently
+// becoming its default; main refuses to start while there are problems and
+// --validate-config only reports them, for CI. Rule lists such as
+// ZONE_CHAOS are checked here with the parse funcs that later apply them;
+// free-form values such as URLs are still parsed where they are used.
+type Config struct {
+	ErrorRate     int
+	LatencyMs     int
+	SlowRequestMs int
+
+	BadReplicaPercent   int
+	BadReplicaErrorRate *int
+	BadReplicaLatencyMs *int
+
+	ClockSkewRate int
+	ClockSkewMs   int
+
+	LogLevel             slog.Level
+	LogFormat            string
+	LogStormRate         int
+	SuccessLogSampleRate int
+	ErrorSpanRescue      bool
+	ErrorRingSize        int
+	RedactionDisabled    bool
+	MetricExportInterval int
+	MetricSeriesCap      int
+	CardinalityBombRate  int
+	CardinalityBombGuard bool
+
+	MetricsChaosLatencyMs   int
+	MetricsChaosErrorRate   int
+	MetricsChaosExtraSeries int
+
+	FailoverThreshold     int
+	FailoverCooldownS     int
+	RemoteRegionRate      int
+	RemoteRegionLatencyMs int
+	LBStrategy            string
+	LBHashVnodes          int
+	Hedging               bool
+	HedgeDelayMs          int
+
+	MaxInflight             int
+	AdaptiveConcurrency     string
+	AdaptiveInitialLimit    float64
+	AdaptiveMinLimit        float64
+	AdaptiveMaxLimit        float64
+	AdaptiveLatencyTargetMs float64
+	Brownout                string
+
+	DBMaxOpenConns   int
+	DBPoolTimeoutMs  int
+	StoreShards      int
+	PaymentLatencyMs int
+	PaymentErrorRate int
+	PaymentRetries   int
+	S3MaxRetries     int
+	S3ThrottleRate   int
+
+	QueueCapacity        int
+	QueueMaxAttempts     int
+	QueueRetryBackoffMs  int
+	DLQCapacity          int
+	PoisonMessageRate    int
+	ConsumerErrorRate    int
+	Outbox               bool
+	OutboxRelayCrashRate int
+	OutboxPollIntervalMs int
+	OutboxBatchSize      int
+
+	JobWorkers           int
+	JobQueueSize         int
+	JobRetentionS        int
+	NotifyWorkers        int
+	NotifyQueueSize      int
+	NotifyMaxAttempts    int
+	NotifyRetryBackoffMs int
+	NotifyFailureRate    int
+	NotifyLatencyMs      int
+	ReconcilerIntervalMs int
+	ReconcilerMaxFixes   int
+	ReconcilerDriftRate  int
+	ReconcilerErrorRate  int
+
+	BatchMaxItems      int
+	UploadMaxBytes     int64
+	UploadFailureRate  int
+	StaticMaxAgeS      int
+	StaticCacheChaos   string
+	ResponseCache      bool
+	ResponseCacheTTLS  int
+	ResponseCacheSWRS  int
+	ResponseCacheMax   int
+	Singleflight       bool
+	CheckoutAPIVersion string
+	CheckoutAcceptV1   bool
+	CheckoutWhaleRate  int
+
+	StartupPolicy   string
+	StartupTimeoutS int
+
+	SecretsReloadIntervalS int
+
+	CostCPUMsUnits    float64
+	CostDBCallUnits   float64
+	CostEgressKBUnits float64
+
+	CarbonWattsPerCPU      float64
+	CarbonPUE              float64
+	CarbonIntensityDefault float64
+
+	DebugHeader bool
+
+	QueueTraceMode     string
+	QueueSyntheticRate float64
+
+	PropagationLossRate    int
+	PropagationCorruptRate int
+
+	SpanFloodRate  int
+	SpanFloodWidth int
+	SpanFloodDepth int
+
+	ExporterBlackhole      bool
+	TelemetrySpoolMaxBytes int64
+
+	TracesSecondaryInsecure bool
+
+	SLISlotSeconds int
+	SLOTarget      float64
+
+	StatsWindowSeconds int
+	StatsExactSamples  int
+
+	AnomalyIntervalSeconds int
+	AnomalyAlpha           float64
+	AnomalyZThreshold      float64
+	AnomalyWarmupIntervals int
+
+	IncidentPhaseSeconds int
+
+	ChatopsFormat string
+
+	ExperimentGuardrailErrorPP     float64
+	ExperimentGuardrailLatencyPct  float64
+	ExperimentGuardrailMinRequests int
+
+	LoadgenRate  float64
+	LoadgenUsers int
+
+	ClientIPMode  string
+	ProxyProtocol string
+
+	ACLDefault string
+
+	MaintenanceMode        bool
+	MaintenanceRetryAfterS int
+	MaintenanceSLOExcluded bool
+
+	ReadOnlyMode         string
+	ReadOnlyStatus       int
+	ReadOnlyAutoErrorPct float64
+	ReadOnlyCheckSeconds int
+
+	OrderStoreCapacity        int
+	ConsistencyCheckIntervalS int
+
+	QueueDuplicateRate int
+	QueueDedupe        bool
+	QueueDedupeWindow  int
+
+	OrderedProcessing        bool
+	OrderEventPartitions     int
+	OrderEventReorderRate    int
+	OrderEventReorderDelayMs int
+
+	SagaCompensationErrorRate int
+
+	GRPCPort           int
+	GRPCStreamBuffer   int
+	GRPCSlowConsumerMs int
+
+	DNSChaos             string
+	DNSLookupTimeoutMs   int
+	DNSWorkloadIntervalS int
+
+	OutboundTLSChaos string
+
+	TLSClientAuth string
+
+	QuotaDailyRequests int
+	QuotaMaxKeys       int
+
+	OIDCProviderLatencyMs int
+	OIDCProviderErrorRate int
+	OIDCLoginTimeoutMs    int
+
+	OIDCProviderConcurrency int
+	SessionTTLS             int
+	SessionTTLJitterPercent int
+	LoadgenSessions         bool
+
+	MemstatsMaxHoldMB int
+
+	FDChaosMax int
+
+	DiskChaosRateMBs int
+	DiskChaosMaxMB   int
+
+	FsyncBytes    int
+	FsyncSlowdown int
+
+	GOMAXPROCSFromQuota bool
+
+	ContentionHoldMs     int
+	MutexProfileFraction int
+	BlockProfileRate     int
+
+	StuckHandlerRate  int
+	WatchdogDeadlineS int
+	WatchdogIntervalS int
+
+	CrashAfterS          int
+	CrashExitCode        int
+	UnreadyAfterRequests int
+
+	InitDurationS   int
+	InitFailureRate int
+	InitFailureMode string
+
+	MigrateOnStartup       bool
+	MigrationInjectFailure bool
+
+	StoreMigrationMode        string
+	StoreShadowLatencyMs      int
+	StoreShadowWriteErrorRate int
+	StoreShadowDriftRate      int
+
+	LoadgenArrivals     string
+	LoadgenBurstFactor  float64
+	LoadgenBurstS       float64
+	LoadgenCalmS        float64
+	LoadgenModel        string
+	LoadgenMaxInflight  int
+	LoadgenConcurrency  int
+	LoadgenThinkMs      int
+	LoadgenPreset       string
+	QueueModelServers   int
+	QueueModelServiceMs int
+}
+
+var cfg, cfgProblems = loadConfig()
+
+// envReader parses variables and collects every problem it finds.
+type envReader struct {
+	problems []string
+}
+
+func (e *envReader) problem(name, format string, args ...any) {
+	e.problems = append(e.problems, name+": "+fmt.Sprintf(format, args...))
+}
+
+func (e *envReader) int(name string, def, lo, hi int) int {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	switch {
+	case err != nil:
+		e.problem(name, "%q is not an integer", raw)
+	case v < lo || v > hi:
+		e.problem(name, "%d is outside [%d, %d]", v, lo, hi)
+	default:
+		return v
+	}
+	return def
+}
+
+// optionalInt is int for variables whose absence means "leave as is".
+func (e *envReader) optionalInt(name string, lo, hi int) *int {
+	if strings.TrimSpace(os.Getenv(name)) == "" {
+		return nil
+	}
+	v := e.int(name, lo, lo, hi)
+	return &v
+}
+
+func (e *envReader) percent(name string, def int) int {
+	return e.int(name, def, 0, 100)
+}
+
+func (e *envReader) float(name string, def, lo, hi float64) float64 {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	switch {
+	case err != nil:
+		e.problem(name, "%q is not a number", raw)
+	case v < lo || v > hi:
+		e.problem(name, "%g is outside [%g, %g]", v, lo, hi)
+	default:
+		return v
+	}
+	return def
+}
+
+func (e *envReader) bool(name string, def bool) bool {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		e.problem(name, "%q is not a boolean (use true or false)", raw)
+		return def
+	}
+	return v
+}
+
+// oneOf accepts allowed values case-insensitively; the first is the default.
+func (e *envReader) oneOf(name string, allowed ...string) string {
+	raw := strings.ToLower(strings.TrimSpace(os.Getenv(name)))
+	if raw == "" {
+		return allowed[0]
+	}
+	for _, a := range allowed {
+		if raw == a {
+			return a
+		}
+	}
+	var names []string
+	for _, a := range allowed {
+		if a != "" {
+			names = append(names, a)
+		}
+	}
+	e.problem(name, "%q is not one of %s", raw, strings.Join(names, ", "))
+	return allowed[0]
+}
+
+const maxMs = 24 * 60 * 60 * 1000
+
+func loadConfig() (Config, []string) {
+	const unbounded = 1 << 30
+	e := &envReader{}
+	c := Config{
+		ErrorRate:     e.percent("ERROR_RATE", 0),
+		LatencyMs:     e.int("LATENCY_MS", 0, 0, maxMs),
+		SlowRequestMs: e.int("SLOW_REQUEST_MS", 500, 1, maxMs),
+
+		BadReplicaPercent:   e.percent("BAD_REPLICA_PERCENT", 0),
+		BadReplicaErrorRate: e.optionalInt("BAD_REPLICA_ERROR_RATE", 0, 100),
+		BadReplicaLatencyMs: e.optionalInt("BAD_REPLICA_LATENCY_MS", 0, maxMs),
+
+		ClockSkewRate: e.percent("CLOCK_SKEW_RATE", 0),
+		ClockSkewMs:   e.int("CLOCK_SKEW_MS", 5*60*1000, 1, maxMs),
+
+		LogFormat:            e.oneOf("LOG_FORMAT", "text", "json"),
+		LogStormRate:         e.int("LOG_STORM_RATE", 0, 0, unbounded),
+		SuccessLogSampleRate: e.percent("SUCCESS_LOG_SAMPLE_RATE", 10),
+		ErrorSpanRescue:      e.bool("ERROR_SPAN_RESCUE", true),
+		ErrorRingSize:        e.int("ERROR_RING_SIZE", 200, 1, 100000),
+		RedactionDisabled:    e.bool("REDACTION_DISABLED", false),
+		MetricExportInterval: e.int("OTEL_METRIC_EXPORT_INTERVAL", 60000, 1, maxMs),
+		MetricSeriesCap:      e.int("METRIC_SERIES_CAP", 500, 0, unbounded),
+		CardinalityBombRate:  e.int("CARDINALITY_BOMB_RATE", 0, 0, unbounded),
+		CardinalityBombGuard: e.bool("CARDINALITY_BOMB_GUARD", false),
+
+		MetricsChaosLatencyMs:   e.int("METRICS_CHAOS_LATENCY_MS", 0, 0, maxMs),
+		MetricsChaosErrorRate:   e.percent("METRICS_CHAOS_ERROR_RATE", 0),
+		MetricsChaosExtraSeries: e.int("METRICS_CHAOS_EXTRA_SERIES", 0, 0, metricsChaosMaxExtraSeries),
+
+		FailoverThreshold:     e.int("FAILOVER_THRESHOLD", 3, 1, 1000),
+		FailoverCooldownS:     e.int("FAILOVER_COOLDOWN_S", 30, 1, 86400),
+		RemoteRegionRate:      e.percent("REMOTE_REGION_RATE", 0),
+		RemoteRegionLatencyMs: e.int("REMOTE_REGION_LATENCY_MS", 0, 0, maxMs),
+		LBStrategy:            e.oneOf("LB_STRATEGY", "round-robin", "least-pending", "ewma", "hash"),
+		LBHashVnodes:          e.int("LB_HASH_VNODES", 100, 1, 10000),
+		Hedging:               e.bool("HEDGING", false),
+		HedgeDelayMs:          e.int("HEDGE_DELAY_MS", 0, 0, maxMs),
+
+		MaxInflight:             e.int("MAX_INFLIGHT", 0, 0, unbounded),
+		AdaptiveConcurrency:     e.oneOf("ADAPTIVE_CONCURRENCY", "off", "aimd", "vegas"),
+		AdaptiveInitialLimit:    e.float("ADAPTIVE_INITIAL_LIMIT", 20, 1, 1e6),
+		AdaptiveMinLimit:        e.float("ADAPTIVE_MIN_LIMIT", 5, 1, 1e6),
+		AdaptiveMaxLimit:        e.float("ADAPTIVE_MAX_LIMIT", 1000, 1, 1e6),
+		AdaptiveLatencyTargetMs: e.float("ADAPTIVE_LATENCY_TARGET_MS", 250, 1, maxMs),
+		Brownout:                e.oneOf("BROWNOUT", "auto", "on", "off"),
+
+		DBMaxOpenConns:   e.int("DB_MAX_OPEN_CONNS", 10, 1, 10000),
+		DBPoolTimeoutMs:  e.int("DB_POOL_TIMEOUT_MS", 1000, 1, maxMs),
+		StoreShards:      e.int("STORE_SHARDS", 4, 1, 1024),
+		PaymentLatencyMs: e.int("PAYMENT_LATENCY_MS", 80, 0, maxMs),
+		PaymentErrorRate: e.percent("PAYMENT_ERROR_RATE", 0),
+		PaymentRetries:   e.int("PAYMENT_RETRIES", 0, 0, 10),
+		S3MaxRetries:     e.int("S3_MAX_RETRIES", 3, 0, 20),
+		S3ThrottleRate:   e.percent("S3_THROTTLE_RATE", 0),
+
+		QueueCapacity:        e.int("QUEUE_CAPACITY", 1000, 1, 1000000),
+		QueueMaxAttempts:     e.int("QUEUE_MAX_ATTEMPTS", 3, 1, 100),
+		QueueRetryBackoffMs:  e.int("QUEUE_RETRY_BACKOFF_MS", 100, 1, maxMs),
+		DLQCapacity:          e.int("DLQ_CAPACITY", 1000, 1, 1000000),
+		PoisonMessageRate:    e.percent("POISON_MESSAGE_RATE", 0),
+		ConsumerErrorRate:    e.percent("CONSUMER_ERROR_RATE", 0),
+		Outbox:               e.bool("OUTBOX", true),
+		OutboxRelayCrashRate: e.percent("OUTBOX_RELAY_CRASH_RATE", 0),
+		OutboxPollIntervalMs: e.int("OUTBOX_POLL_INTERVAL_MS", 500, 1, maxMs),
+		OutboxBatchSize:      e.int("OUTBOX_BATCH_SIZE", 50, 1, 100000),
+
+		JobWorkers:           e.int("JOB_WORKERS", 4, 1, 1000),
+		JobQueueSize:         e.int("JOB_QUEUE_SIZE", 100, 1, 1000000),
+		JobRetentionS:        e.int("JOB_RETENTION_S", 600, 1, 7*86400),
+		NotifyWorkers:        e.int("NOTIFY_WORKERS", 2, 1, 1000),
+		NotifyQueueSize:      e.int("NOTIFY_QUEUE_SIZE", 1000, 1, 1000000),
+		NotifyMaxAttempts:    e.int("NOTIFY_MAX_ATTEMPTS", 5, 1, 100),
+		NotifyRetryBackoffMs: e.int("NOTIFY_RETRY_BACKOFF_MS", 200, 1, maxMs),
+		NotifyFailureRate:    e.percent("NOTIFY_FAILURE_RATE", 0),
+		NotifyLatencyMs:      e.int("NOTIFY_LATENCY_MS", 0, 0, maxMs),
+		ReconcilerIntervalMs: e.int("RECONCILER_INTERVAL_MS", 1000, 1, maxMs),
+		ReconcilerMaxFixes:   e.int("RECONCILER_MAX_FIXES", 2, 1, 10000),
+		ReconcilerDriftRate:  e.percent("RECONCILER_DRIFT_RATE", 0),
+		ReconcilerErrorRate:  e.percent("RECONCILER_ERROR_RATE", 0),
+
+		BatchMaxItems:      e.int("BATCH_MAX_ITEMS", 100, 1, 100000),
+		UploadMaxBytes:     int64(e.int("UPLOAD_MAX_BYTES", 10<<20, 1, unbounded)),
+		UploadFailureRate:  e.percent("UPLOAD_FAILURE_RATE", 0),
+		StaticMaxAgeS:      e.int("STATIC_MAX_AGE_S", 300, 0, 365*86400),
+		StaticCacheChaos:   e.oneOf("STATIC_CACHE_CHAOS", "", "per-pod", "rotate", "no-store"),
+		ResponseCache:      e.bool("RESPONSE_CACHE", true),
+		ResponseCacheTTLS:  e.int("RESPONSE_CACHE_TTL_S", 30, 1, 86400),
+		ResponseCacheSWRS:  e.int("RESPONSE_CACHE_SWR_S", 60, 0, 86400),
+		ResponseCacheMax:   e.int("RESPONSE_CACHE_MAX_ENTRIES", 1000, 1, 1000000),
+		Singleflight:       e.bool("SINGLEFLIGHT", true),
+		CheckoutAPIVersion: e.oneOf("CHECKOUT_API_VERSION", "v1", "v2"),
+		CheckoutAcceptV1:   e.bool("CHECKOUT_ACCEPT_V1", false),
+		CheckoutWhaleRate:  e.percent("CHECKOUT_WHALE_RATE", 1),
+
+		StartupPolicy:   e.oneOf("STARTUP_POLICY", "block", "degrade", "crash"),
+		StartupTimeoutS: e.int("STARTUP_TIMEOUT_S", 60, 1, 3600),
+
+		SecretsReloadIntervalS: e.int("SECRETS_RELOAD_INTERVAL_S", 10, 1, 86400),
+
+		CostCPUMsUnits:    e.float("COST_CPU_MS_UNITS", 0.01, 0, 1e6),
+		CostDBCallUnits:   e.float("COST_DB_CALL_UNITS", 0.5, 0, 1e6),
+		CostEgressKBUnits: e.float("COST_EGRESS_KB_UNITS", 0.02, 0, 1e6),
+
+		CarbonWattsPerCPU:      e.float("CARBON_WATTS_PER_CPU", 3.5, 0, 1000),
+		CarbonPUE:              e.float("CARBON_PUE", 1.2, 1, 5),
+		CarbonIntensityDefault: e.float("CARBON_INTENSITY_DEFAULT", 440, 0, 5000),
+
+		DebugHeader: e.bool("DEBUG_HEADER", false),
+
+		QueueTraceMode:     e.oneOf("QUEUE_TRACE_MODE", "child", "link"),
+		QueueSyntheticRate: e.float("QUEUE_SYNTHETIC_RATE", 0, 0, 1000),
+
+		PropagationLossRate:    e.percent("PROPAGATION_LOSS_RATE", 0),
+		PropagationCorruptRate: e.percent("PROPAGATION_CORRUPT_RATE", 0),
+
+		SpanFloodRate:  e.percent("SPAN_FLOOD_RATE", 0),
+		SpanFloodWidth: e.int("SPAN_FLOOD_WIDTH", 4, 1, 1000),
+		SpanFloodDepth: e.int("SPAN_FLOOD_DEPTH", 4, 1, 50),
+
+		ExporterBlackhole:      e.bool("EXPORTER_BLACKHOLE", false),
+		TelemetrySpoolMaxBytes: int64(e.int("TELEMETRY_SPOOL_MAX_BYTES", 64<<20, 1024, unbounded)),
+
+		TracesSecondaryInsecure: e.bool("TRACES_SECONDARY_INSECURE", true),
+
+		SLISlotSeconds: e.int("SLI_SLOT_S", 60, 1, 3600),
+		SLOTarget:      e.float("SLI_SLO_TARGET", 99.5, 0, 100),
+
+		StatsWindowSeconds: e.int("STATS_WINDOW_S", 300, 6, 86400),
+		StatsExactSamples:  e.int("STATS_EXACT_SAMPLES", 10000, 0, 1000000),
+
+		AnomalyIntervalSeconds: e.int("ANOMALY_INTERVAL_S", 10, 0, 3600),
+		AnomalyAlpha:           e.float("ANOMALY_ALPHA", 0.1, 0.001, 1),
+		AnomalyZThreshold:      e.float("ANOMALY_Z_THRESHOLD", 3, 0.5, 100),
+		AnomalyWarmupIntervals: e.int("ANOMALY_WARMUP_INTERVALS", 6, 1, 10000),
+
+		IncidentPhaseSeconds: e.int("INCIDENT_PHASE_S", 120, 1, 86400),
+
+		ChatopsFormat: e.oneOf("CHATOPS_FORMAT", "slack", "discord", "generic"),
+
+		ExperimentGuardrailErrorPP:     e.float("EXPERIMENT_GUARDRAIL_ERROR_PP", 1, 0, 100),
+		ExperimentGuardrailLatencyPct:  e.float("EXPERIMENT_GUARDRAIL_LATENCY_PCT", 20, 0, 10000),
+		ExperimentGuardrailMinRequests: e.int("EXPERIMENT_GUARDRAIL_MIN_REQUESTS", 100, 1, unbounded),
+
+		LoadgenRate:  e.float("LOADGEN_RATE", 0, 0, 10000),
+		LoadgenUsers: e.int("LOADGEN_USERS", 500, 1, 1000000),
+
+		ClientIPMode:  e.oneOf("CLIENT_IP_MODE", "rightmost", "leftmost", "peer"),
+		ProxyProtocol: e.oneOf("PROXY_PROTOCOL", "off", "optional", "required"),
+
+		ACLDefault: e.oneOf("IP_ACL_DEFAULT", "allow", "deny"),
+
+		MaintenanceMode:        e.bool("MAINTENANCE_MODE", false),
+		MaintenanceRetryAfterS: e.int("MAINTENANCE_RETRY_AFTER_S", 300, 0, 86400),
+		MaintenanceSLOExcluded: e.bool("MAINTENANCE_SLO_EXCLUDED", false),
+
+		ReadOnlyMode:         e.oneOf("READ_ONLY_MODE", "off", "on", "auto"),
+		ReadOnlyAutoErrorPct: e.float("READ_ONLY_AUTO_ERROR_PCT", 50, 1, 100),
+		ReadOnlyCheckSeconds: e.int("READ_ONLY_CHECK_S", 5, 1, 3600),
+
+		OrderStoreCapacity:        e.int("ORDER_STORE_CAPACITY", 10000, 1, 1000000),
+		ConsistencyCheckIntervalS: e.int("CONSISTENCY_CHECK_INTERVAL_S", 30, 0, 86400),
+
+		QueueDuplicateRate: e.int("QUEUE_DUPLICATE_RATE", 0, 0, 100),
+		QueueDedupe:        e.bool("QUEUE_DEDUPE", true),
+		QueueDedupeWindow:  e.int("QUEUE_DEDUPE_WINDOW", 10000, 1, 1000000),
+
+		OrderedProcessing:        e.bool("ORDERED_PROCESSING", true),
+		OrderEventPartitions:     e.int("ORDER_EVENT_PARTITIONS", 4, 1, 256),
+		OrderEventReorderRate:    e.int("ORDER_EVENT_REORDER_RATE", 0, 0, 100),
+		OrderEventReorderDelayMs: e.int("ORDER_EVENT_REORDER_DELAY_MS", 200, 1, maxMs),
+
+		SagaCompensationErrorRate: e.int("SAGA_COMPENSATION_ERROR_RATE", 0, 0, 100),
+
+		GRPCPort:           e.int("GRPC_PORT", 9090, 0, 65535),
+		GRPCStreamBuffer:   e.int("GRPC_STREAM_BUFFER", 64, 1, 100000),
+		GRPCSlowConsumerMs: e.int("GRPC_SLOW_CONSUMER_MS", 0, 0, maxMs),
+
+		DNSChaos:             e.oneOf("DNS_CHAOS", "off", "blackhole", "servfail", "nxdomain"),
+		DNSLookupTimeoutMs:   e.int("DNS_LOOKUP_TIMEOUT_MS", 2000, 1, maxMs),
+		DNSWorkloadIntervalS: e.int("DNS_WORKLOAD_INTERVAL_S", 15, 0, 86400),
+
+		OutboundTLSChaos: e.oneOf("OUTBOUND_TLS_CHAOS", "off", "expired", "hostname_mismatch", "unknown_ca"),
+
+		TLSClientAuth: e.oneOf("TLS_CLIENT_AUTH", "require", "verify_if_given"),
+
+		QuotaDailyRequests: e.int("QUOTA_DAILY_REQUESTS", 0, 0, 1000000000),
+		QuotaMaxKeys:       e.int("QUOTA_MAX_KEYS", 10000, 1, 10000000),
+
+		OIDCProviderLatencyMs: e.int("OIDC_PROVIDER_LATENCY_MS", 60, 0, maxMs),
+		OIDCProviderErrorRate: e.percent("OIDC_PROVIDER_ERROR_RATE", 0),
+		OIDCLoginTimeoutMs:    e.int("OIDC_LOGIN_TIMEOUT_MS", 3000, 1, maxMs),
+
+		OIDCProviderConcurrency: e.int("OIDC_PROVIDER_CONCURRENCY", 8, 1, 10000),
+		SessionTTLS:             e.int("SESSION_TTL_S", 1800, 1, 30*86400),
+		SessionTTLJitterPercent: e.percent("SESSION_TTL_JITTER_PERCENT", 0),
+		LoadgenSessions:         e.bool("LOADGEN_SESSIONS", false),
+
+		MemstatsMaxHoldMB: e.int("MEMSTATS_MAX_HOLD_MB", 1024, 1, 1<<20),
+
+		FDChaosMax: e.int("FD_CHAOS_MAX", 20000, 1, 1<<20),
+
+		DiskChaosRateMBs: e.int("DISK_CHAOS_RATE_MB_S", 0, 0, 1024),
+		DiskChaosMaxMB:   e.int("DISK_CHAOS_MAX_MB", 256, 1, 1<<20),
+
+		FsyncBytes:    e.int("FSYNC_BYTES", 4096, 1, 1<<20),
+		FsyncSlowdown: e.int("FSYNC_SLOWDOWN", 1, 0, 10000),
+
+		GOMAXPROCSFromQuota: e.bool("GOMAXPROCS_FROM_QUOTA", true),
+
+		ContentionHoldMs:     e.int("CONTENTION_HOLD_MS", 5, 0, maxMs),
+		MutexProfileFraction: e.int("MUTEX_PROFILE_FRACTION", 0, 0, 1000000),
+		BlockProfileRate:     e.int("BLOCK_PROFILE_RATE", 0, 0, 1000000000),
+
+		StuckHandlerRate:  e.percent("STUCK_HANDLER_RATE", 0),
+		WatchdogDeadlineS: e.int("WATCHDOG_DEADLINE_S", 30, 0, 86400),
+		WatchdogIntervalS: e.int("WATCHDOG_INTERVAL_S", 5, 1, 3600),
+
+		CrashAfterS:          e.int("CRASH_AFTER_S", 0, 0, 30*86400),
+		CrashExitCode:        e.int("CRASH_EXIT_CODE", 1, 0, 255),
+		UnreadyAfterRequests: e.int("UNREADY_AFTER_REQUESTS", 0, 0, 1<<40),
+
+		InitDurationS:   e.int("INIT_DURATION_S", 0, 0, 3600),
+		InitFailureRate: e.percent("INIT_FAILURE_RATE", 0),
+		InitFailureMode: e.oneOf("INIT_FAILURE_MODE", "exit", "hang"),
+
+		MigrateOnStartup:       e.bool("MIGRATE_ON_STARTUP", true),
+		MigrationInjectFailure: e.bool("MIGRATION_INJECT_FAILURE", false),
+
+		StoreMigrationMode:        e.oneOf("STORE_MIGRATION_MODE", storeMigrationModes...),
+		StoreShadowLatencyMs:      e.int("STORE_SHADOW_LATENCY_MS", 5, 0, maxMs),
+		StoreShadowWriteErrorRate: e.percent("STORE_SHADOW_WRITE_ERROR_RATE", 0),
+		StoreShadowDriftRate:      e.percent("STORE_SHADOW_DRIFT_RATE", 0),
+
+		LoadgenArrivals:     e.oneOf("LOADGEN_ARRIVALS", "constant", "poisson", "bursty"),
+		LoadgenBurstFactor:  e.float("LOADGEN_BURST_FACTOR", 3, 1, 1000),
+		LoadgenBurstS:       e.float("LOADGEN_BURST_S", 2, 0.01, 86400),
+		LoadgenCalmS:        e.float("LOADGEN_CALM_S", 8, 0.01, 86400),
+		LoadgenModel:        e.oneOf("LOADGEN_MODEL", "open", "closed"),
+		LoadgenMaxInflight:  e.int("LOADGEN_MAX_INFLIGHT", 64, 1, 1000000),
+		LoadgenConcurrency:  e.int("LOADGEN_CONCURRENCY", 10, 1, 10000),
+		LoadgenThinkMs:      e.int("LOADGEN_THINK_MS", 0, 0, maxMs),
+		LoadgenPreset:       e.oneOf("LOADGEN_PRESET", "", "mm1", "mmc"),
+		QueueModelServers:   e.int("QUEUE_MODEL_SERVERS", 1, 1, 10000),
+		QueueModelServiceMs: e.int("QUEUE_MODEL_SERVICE_MS", 10, 0, maxMs),
+	}
+
+	c.LogLevel = slog.LevelInfo
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := c.LogLevel.UnmarshalText([]byte(v)); err != nil {
+			e.problem("LOG_LEVEL", "%q is not one of debug, info, warn, error", v)
+		}
+	}
+	if c.AdaptiveMinLimit > c.AdaptiveMaxLimit {
+		e.problem("ADAPTIVE_MIN_LIMIT", "%g is above ADAPTIVE_MAX_LIMIT %g", c.AdaptiveMinLimit, c.AdaptiveMaxLimit)
+	}
+	if schedule := os.Getenv("RECONCILIATION_SCHEDULE"); schedule != "" {
+		if _, err := nextRun(schedule, time.Now()); err != nil {
+			e.problem("RECONCILIATION_SCHEDULE", "%v", err)
+		}
+	}
+	if schedule := os.Getenv("CRASH_SCHEDULE"); schedule != "" {
+		if _, err := nextRun(schedule, time.Now()); err != nil {
+			e.problem("CRASH_SCHEDULE", "%v", err)
+		}
+	}
+	if _, err := parseRelabelRules(os.Getenv("METRIC_RELABEL_RULES")); err != nil {
+		e.problem("METRIC_RELABEL_RULES", "%v", err)
+	}
+	if _, err := parseSLIWindows(os.Getenv("SLI_WINDOWS"), c.SLISlotSeconds); err != nil {
+		e.problem("SLI_WINDOWS", "%v", err)
+	}
+	if _, err := parseAlertRemediations(os.Getenv("ALERT_REMEDIATIONS")); err != nil {
+		e.problem("ALERT_REMEDIATIONS", "%v", err)
+	}
+	if _, err := parseChatopsTemplate(os.Getenv("CHATOPS_TEMPLATE")); err != nil {
+		e.problem("CHATOPS_TEMPLATE", "%v", err)
+	}
+	if _, err := parseLatencyRules(os.Getenv("LATENCY_RULES")); err != nil {
+		e.problem("LATENCY_RULES", "%v", err)
+	}
+	if _, err := parseExperiment(os.Getenv("EXPERIMENT_NAME"), os.Getenv("EXPERIMENT_ROUTES"), os.Getenv("EXPERIMENT_VARIANTS")); err != nil {
+		e.problem("EXPERIMENT_VARIANTS", "%v", err)
+	}
+	if _, err := parseLoadgenMix(os.Getenv("LOADGEN_PATHS"), os.Getenv("LOADGEN_USER_AGENTS"), os.Getenv("LOADGEN_GEOS"), c.LoadgenUsers); err != nil {
+		e.problem("LOADGEN", "%v", err)
+	}
+	if _, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		e.problem("TRUSTED_PROXIES", "%v", err)
+	}
+	c.ReadOnlyStatus, _ = strconv.Atoi(e.oneOf("READ_ONLY_STATUS", "503", "405"))
+	if spec, err := aclSource(); err != nil {
+		e.problem("IP_ACL_FILE", "%v", err)
+	} else if _, err := parseACLRules(spec); err != nil {
+		e.problem("IP_ACL", "%v", err)
+	}
+	if _, err := loadServingTLS(); err != nil {
+		e.problem("TLS_CERT_FILE", "%v", err)
+	}
+	if _, err := parseQuotaOverrides(os.Getenv("QUOTA_OVERRIDES")); err != nil {
+		e.problem("QUOTA_OVERRIDES", "%v", err)
+	}
+	if _, err := parseShardChaos(os.Getenv("SHARD_CHAOS"), c.StoreShards); err != nil {
+		e.problem("SHARD_CHAOS", "%v", err)
+	}
+	if _, err := parseZoneChaos(os.Getenv("ZONE_CHAOS")); err != nil {
+		e.problem("ZONE_CHAOS", "%v", err)
+	}
+	if _, err := parseBulkheadLimits(os.Getenv("BULKHEAD_LIMITS")); err != nil {
+		e.problem("BULKHEAD_LIMITS", "%v", err)
+	}
+	if _, err := parseQueryRegressions(os.Getenv("DB_QUERY_REGRESSIONS")); err != nil {
+		e.problem("DB_QUERY_REGRESSIONS", "%v", err)
+	}
+	if _, err := parseCarbonIntensity(os.Getenv("CARBON_INTENSITY")); err != nil {
+		e.problem("CARBON_INTENSITY", "%v", err)
+	}
+	if _, err := parseSchedulerChaos(os.Getenv("SCHEDULER_CHAOS")); err != nil {
+		e.problem("SCHEDULER_CHAOS", "%v", err)
+	}
+	if _, err := parseTraceHeaders(os.Getenv("TRACES_SECONDARY_HEADERS")); err != nil {
+		e.problem("TRACES_SECONDARY_HEADERS", "%v", err)
+	}
+	for _, name := range secretNames {
+		if file := os.Getenv(name + "_FILE"); file != "" {
+			if _, err := readSecretFile(file); err != nil {
+				e.problem(name+"_FILE", "%v", err)
+			}
+		}
+	}
+	return c, e.problems
+}
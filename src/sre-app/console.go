@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Console telemetry for air-gapped demos: OTEL_TRACES_EXPORTER=console and
+// OTEL_METRICS_EXPORTER=console print JSON lines to TELEMETRY_OUTPUT
+// (stdout by default, or a file path). Spans use the OTLP/JSON encoding so
+// students see exactly what a collector would receive.
+var (
+	consoleOnce sync.Once
+	consoleMu   sync.Mutex
+	consoleOut  io.Writer
+)
+
+func consoleWriter() io.Writer {
+	consoleOnce.Do(func() {
+		consoleOut = os.Stdout
+		if path := os.Getenv("TELEMETRY_OUTPUT"); path != "" && path != "stdout" {
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				log.Fatalf("failed to open TELEMETRY_OUTPUT: %v", err)
+			}
+			consoleOut = f
+		}
+	})
+	return consoleOut
+}
+
+func writeConsoleLine(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+	_, err = consoleWriter().Write(append(b, '\n'))
+	return err
+}
+
+type consoleSpanExporter struct{}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID    string         `json:"traceId"`
+	SpanID     string         `json:"spanId"`
+	TraceState string         `json:"traceState,omitempty"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            map[string]any `json:"status,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope map[string]string `json:"scope"`
+	Spans []otlpSpan        `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   map[string][]otlpKeyValue `json:"resource"`
+	ScopeSpans []*otlpScopeSpans         `json:"scopeSpans"`
+}
+
+// ExportSpans writes one ExportTraceServiceRequest per batch.
+func (consoleSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	rs := otlpResourceSpans{
+		Resource: map[string][]otlpKeyValue{"attributes": otlpAttributes(spans[0].Resource().Attributes())},
+	}
+	scopes := map[string]*otlpScopeSpans{}
+	for _, s := range spans {
+		name := s.InstrumentationScope().Name
+		ss, ok := scopes[name]
+		if !ok {
+			ss = &otlpScopeSpans{Scope: map[string]string{"name": name, "version": s.InstrumentationScope().Version}}
+			scopes[name] = ss
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+		}
+
+		span := otlpSpan{
+			TraceID:           s.SpanContext().TraceID().String(),
+			SpanID:            s.SpanContext().SpanID().String(),
+			Name:              s.Name(),
+			Kind:              int(s.SpanKind()), // trace.SpanKind values match the OTLP enum
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime().UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime().UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes()),
+		}
+		if s.Parent().IsValid() {
+			span.ParentSpanID = s.Parent().SpanID().String()
+		}
+		for _, ev := range s.Events() {
+			span.Events = append(span.Events, otlpEvent{
+				TimeUnixNano: strconv.FormatInt(ev.Time.UnixNano(), 10),
+				Name:         ev.Name,
+				Attributes:   otlpAttributes(ev.Attributes),
+			})
+		}
+		for _, l := range s.Links() {
+			span.Links = append(span.Links, otlpLink{
+				TraceID:    l.SpanContext.TraceID().String(),
+				SpanID:     l.SpanContext.SpanID().String(),
+				TraceState: l.SpanContext.TraceState().String(),
+				Attributes: otlpAttributes(l.Attributes),
+			})
+		}
+		switch s.Status().Code {
+		case codes.Ok:
+			span.Status = map[string]any{"code": 1}
+		case codes.Error:
+			span.Status = map[string]any{"code": 2, "message": s.Status().Description}
+		}
+		ss.Spans = append(ss.Spans, span)
+	}
+
+	return writeConsoleLine(map[string]any{"resourceSpans": []otlpResourceSpans{rs}})
+}
+
+func (consoleSpanExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		out = append(out, otlpKeyValue{Key: string(kv.Key), Value: otlpValue(kv.Value)})
+	}
+	return out
+}
+
+func otlpValue(v attribute.Value) map[string]any {
+	switch v.Type() {
+	case attribute.BOOL:
+		return map[string]any{"boolValue": v.AsBool()}
+	case attribute.INT64:
+		return map[string]any{"intValue": strconv.FormatInt(v.AsInt64(), 10)}
+	case attribute.FLOAT64:
+		return map[string]any{"doubleValue": v.AsFloat64()}
+	case attribute.STRING:
+		return map[string]any{"stringValue": v.AsString()}
+	}
+	// Slices are flattened to their string form to keep the encoder small.
+	return map[string]any{"stringValue": v.Emit()}
+}
+
+// runConsoleMetrics prints the Prometheus registry as JSON every
+// OTEL_METRIC_EXPORT_INTERVAL milliseconds (default 60s).
+func runConsoleMetrics(ctx context.Context) {
+	interval := time.Duration(cfg.MetricExportInterval) * time.Millisecond
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := exportConsoleMetrics(); err != nil {
+				log.Printf("console metrics export failed: %v", err)
+			}
+		}
+	}
+}
+
+func exportConsoleMetrics() error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+	out := make([]json.RawMessage, 0, len(families))
+	for _, mf := range families {
+		b, err := protojson.Marshal(mf)
+		if err != nil {
+			return fmt.Errorf("encoding %s: %w", mf.GetName(), err)
+		}
+		out = append(out, b)
+	}
+	return writeConsoleLine(map[string]any{
+		"timeUnixNano":   strconv.FormatInt(time.Now().UnixNano(), 10),
+		"metricFamilies": out,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Lock contention. /contention takes one process-wide mutex and holds it for
+// CONTENTION_HOLD_MS (default 5), like a handler that does I/O inside a
+// critical section: throughput tops out at 1000/hold_ms requests per second
+// however many CPUs there are, and latency is mostly waiting for the lock
+// while CPU stays idle. lock_wait_duration_seconds and lock_waiters show
+// the queue.
+//
+// MUTEX_PROFILE_FRACTION (runtime.SetMutexProfileFraction, default 0: off)
+// and BLOCK_PROFILE_RATE (runtime.SetBlockProfileRate in ns, default 0)
+// turn on the profiles that find it: go tool pprof on
+// /debug/pprof/mutex or /debug/pprof/block (behind the admin token) points
+// at handleContention. /admin/chaos/contention changes all three at
+// runtime.
+var (
+	contentionMu     sync.Mutex
+	contentionHoldMs atomic.Int64
+	mutexProfileRate atomic.Int64
+	blockProfileRate atomic.Int64
+
+	lockWaitDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lock_wait_duration_seconds",
+			Help:    "Time spent waiting to acquire a lock, by lock",
+			Buckets: []float64{.0001, .001, .005, .01, .05, .1, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"lock"},
+	)
+	lockHoldDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lock_hold_duration_seconds",
+			Help:    "Time a lock was held, by lock",
+			Buckets: []float64{.0001, .001, .005, .01, .05, .1, .5, 1},
+		},
+		[]string{"lock"},
+	)
+	lockWaiters = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lock_waiters",
+			Help: "Goroutines waiting for a lock, by lock",
+		},
+		[]string{"lock"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(lockWaitDuration, lockHoldDuration, lockWaiters)
+	contentionHoldMs.Store(int64(cfg.ContentionHoldMs))
+	setProfileRates(int64(cfg.MutexProfileFraction), int64(cfg.BlockProfileRate))
+	lockWaiters.WithLabelValues("contention")
+}
+
+func setProfileRates(mutex, block int64) {
+	mutexProfileRate.Store(mutex)
+	blockProfileRate.Store(block)
+	runtime.SetMutexProfileFraction(int(mutex))
+	runtime.SetBlockProfileRate(int(block))
+}
+
+func handleContention(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	_, span := tracer.Start(r.Context(), "handleContention")
+	defer span.End()
+
+	waiters := lockWaiters.WithLabelValues("contention")
+	waiters.Inc()
+	contentionMu.Lock()
+	waiters.Dec()
+	acquired := time.Now()
+	time.Sleep(time.Duration(contentionHoldMs.Load()) * time.Millisecond)
+	contentionMu.Unlock()
+	held := time.Since(acquired)
+
+	wait := acquired.Sub(start)
+	lockWaitDuration.WithLabelValues("contention").Observe(wait.Seconds())
+	lockHoldDuration.WithLabelValues("contention").Observe(held.Seconds())
+	span.SetAttributes(
+		attribute.Float64("app.lock.wait_ms", float64(wait.Microseconds())/1000),
+		attribute.Float64("app.lock.hold_ms", float64(held.Microseconds())/1000),
+	)
+	fmt.Fprintf(w, "waited %s for the lock, held it %s\n", wait.Round(time.Microsecond), held.Round(time.Microsecond))
+
+	httpRequestsTotal.WithLabelValues("/contention", strconv.Itoa(http.StatusOK)).Inc()
+	httpRequestDuration.WithLabelValues("/contention").Observe(time.Since(start).Seconds())
+}
+
+// handleAdminContention reports or sets contention and profiling:
+// {"hold_ms": 50, "mutex_profile_fraction": 5, "block_profile_rate": 10000}.
+func handleAdminContention(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			HoldMs               *int64 `json:"hold_ms"`
+			MutexProfileFraction *int64 `json:"mutex_profile_fraction"`
+			BlockProfileRate     *int64 `json:"block_profile_rate"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.HoldMs != nil && *req.HoldMs >= 0 {
+			contentionHoldMs.Store(*req.HoldMs)
+		}
+		mutex, block := mutexProfileRate.Load(), blockProfileRate.Load()
+		if req.MutexProfileFraction != nil && *req.MutexProfileFraction >= 0 {
+			mutex = *req.MutexProfileFraction
+		}
+		if req.BlockProfileRate != nil && *req.BlockProfileRate >= 0 {
+			block = *req.BlockProfileRate
+		}
+		setProfileRates(mutex, block)
+		slog.Warn("Admin: lock contention updated", "hold_ms", contentionHoldMs.Load(), "mutex_profile_fraction", mutex, "block_profile_rate", block)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"hold_ms":                contentionHoldMs.Load(),
+		"mutex_profile_fraction": mutexProfileRate.Load(),
+		"block_profile_rate":     blockProfileRate.Load(),
+	})
+}
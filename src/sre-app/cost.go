@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Per-request cost accounting with a synthetic cost model. Each request is
+// charged for the resources it used: CPU time (its self time from the
+// latency budget, a proxy since Go can't meter CPU per goroutine), database
+// calls, and response bytes sent. COST_CPU_MS_UNITS, COST_DB_CALL_UNITS and
+// COST_EGRESS_KB_UNITS (defaults 0.01, 0.5 and 0.02) price each; the sum is
+// exported per path so cost per request is
+// rate(request_cost_units_total) / rate(http_requests_total), and an N+1
+// query regression shows up as a cost anomaly before it shows up as latency.
+var (
+	requestCostUnits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "request_cost_units_total",
+			Help: "Synthetic cost units charged to requests, by path",
+		},
+		[]string{"path"},
+	)
+	requestCostResources = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "request_cost_resource_total",
+			Help: "Resources charged to requests by path and resource (cpu_ms, db_calls, egress_bytes)",
+		},
+		[]string{"path", "resource"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestCostUnits, requestCostResources)
+}
+
+type requestCostKey struct{}
+
+type requestCost struct {
+	dbCalls atomic.Int64
+}
+
+func withRequestCost(ctx context.Context) (context.Context, *requestCost) {
+	c := &requestCost{}
+	return context.WithValue(ctx, requestCostKey{}, c), c
+}
+
+// countDBCall charges a database call to the request. Calls made outside a
+// request are ignored.
+func countDBCall(ctx context.Context) {
+	if c, ok := ctx.Value(requestCostKey{}).(*requestCost); ok {
+		c.dbCalls.Add(1)
+	}
+}
+
+// record prices a finished request and exports the result.
+func (c *requestCost) record(span trace.Span, route string, cpu time.Duration, egressBytes int) {
+	cpuMs := float64(cpu.Microseconds()) / 1000
+	dbCalls := float64(c.dbCalls.Load())
+	units := cpuMs*cfg.CostCPUMsUnits + dbCalls*cfg.CostDBCallUnits + float64(egressBytes)/1024*cfg.CostEgressKBUnits
+
+	requestCostUnits.WithLabelValues(route).Add(units)
+	requestCostResources.WithLabelValues(route, "cpu_ms").Add(cpuMs)
+	requestCostResources.WithLabelValues(route, "db_calls").Add(dbCalls)
+	requestCostResources.WithLabelValues(route, "egress_bytes").Add(float64(egressBytes))
+	span.SetAttributes(
+		attribute.Float64("app.cost.units", units),
+		attribute.Int64("app.cost.db_calls", int64(dbCalls)),
+	)
+}
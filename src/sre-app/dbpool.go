@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Simulated database connection pool. The checkout "database" is still a
+// sleep, but it now goes through a bounded pool (DB_MAX_OPEN_CONNS, default
+// 10; DB_POOL_TIMEOUT_MS, default 1000) that reports sql.DBStats, so pool
+// exhaustion behaves and graphs like database/sql would. Chaos controls on
+// /admin/chaos/dbpool shrink the pool, leak (hold) connections and slow
+// every query down.
+var errPoolTimeout = errors.New("database connection pool exhausted")
+
+var (
+	dbPool        *simPool
+	dbSlowQueryMs atomic.Int64
+)
+
+type simPool struct {
+	mu           sync.Mutex
+	maxOpen      int
+	inUse        int
+	waiters      []chan struct{} // FIFO; dispatch counts a woken waiter as in use
+	timeout      time.Duration
+	waitCount    int64
+	waitDuration time.Duration
+	timeouts     int64
+}
+
+func newSimPool(maxOpen int, timeout time.Duration) *simPool {
+	return &simPool{maxOpen: maxOpen, timeout: timeout}
+}
+
+func loadDBPoolConfig() {
+	dbPool = newSimPool(cfg.DBMaxOpenConns, time.Duration(cfg.DBPoolTimeoutMs)*time.Millisecond)
+	prometheus.MustRegister(newDBStatsCollector("checkout", dbPool.Stats))
+}
+
+// acquire blocks until a connection is free, the pool timeout expires or
+// ctx is done, queueing behind earlier callers. A caller that gives up
+// leaves the queue at once rather than holding its place.
+func (p *simPool) acquire(ctx context.Context) (release func(), waited time.Duration, err error) {
+	p.mu.Lock()
+	if p.inUse < p.maxOpen && len(p.waiters) == 0 {
+		p.inUse++
+		p.mu.Unlock()
+		return p.releaser(), 0, nil
+	}
+	start := time.Now()
+	p.waitCount++
+	turn := make(chan struct{})
+	p.waiters = append(p.waiters, turn)
+	p.mu.Unlock()
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case <-turn:
+	case <-timer.C:
+		err = errPoolTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	waited = time.Since(start)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.waitDuration += waited
+	if err != nil {
+		if i := slices.Index(p.waiters, turn); i >= 0 {
+			p.waiters = slices.Delete(p.waiters, i, i+1)
+		} else {
+			// Handed a connection just as it gave up: pass it on.
+			p.inUse--
+			p.dispatch()
+		}
+		if err == errPoolTimeout {
+			p.timeouts++
+		}
+		return nil, waited, err
+	}
+	return p.releaser(), waited, nil
+}
+
+func (p *simPool) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.inUse--
+			p.dispatch()
+		})
+	}
+}
+
+// dispatch hands free connections to the head of the queue; p.mu is held.
+func (p *simPool) dispatch() {
+	for p.inUse < p.maxOpen && len(p.waiters) > 0 {
+		close(p.waiters[0])
+		p.waiters = p.waiters[1:]
+		p.inUse++
+	}
+}
+
+func (p *simPool) resize(maxOpen int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxOpen = maxOpen
+	p.dispatch()
+}
+
+// Stats reports the pool in database/sql terms; every slot counts as an
+// open connection, idle when not in use.
+func (p *simPool) Stats() sql.DBStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idle := p.maxOpen - p.inUse
+	if idle < 0 {
+		idle = 0
+	}
+	return sql.DBStats{
+		MaxOpenConnections: p.maxOpen,
+		OpenConnections:    p.inUse + idle,
+		InUse:              p.inUse,
+		Idle:               idle,
+		WaitCount:          p.waitCount,
+		WaitDuration:       p.waitDuration,
+	}
+}
+
+func (p *simPool) timeoutCount() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.timeouts
+}
+
+// hold leaks n connections for d, like a handler that forgot to Close rows.
+func (p *simPool) hold(n int, d time.Duration) {
+	for i := 0; i < n; i++ {
+		go func() {
+			release, _, err := p.acquire(context.Background())
+			if err != nil {
+				return
+			}
+			time.Sleep(d)
+			release()
+		}()
+	}
+}
+
+// dbStatsCollector exports any sql.DBStats source, so a real *sql.DB can be
+// registered the same way via db.Stats.
+type dbStatsCollector struct {
+	stats func() sql.DBStats
+	pool  *simPool
+
+	maxOpen, open, inUse, idle, waitCount, waitDuration, timeouts *prometheus.Desc
+}
+
+func newDBStatsCollector(name string, stats func() sql.DBStats) *dbStatsCollector {
+	labels := prometheus.Labels{"db_name": name}
+	return &dbStatsCollector{
+		stats:        stats,
+		pool:         dbPool,
+		maxOpen:      prometheus.NewDesc("db_pool_max_open_connections", "Maximum number of open connections to the database", nil, labels),
+		open:         prometheus.NewDesc("db_pool_open_connections", "Number of established connections, in use and idle", nil, labels),
+		inUse:        prometheus.NewDesc("db_pool_in_use_connections", "Number of connections currently in use", nil, labels),
+		idle:         prometheus.NewDesc("db_pool_idle_connections", "Number of idle connections", nil, labels),
+		waitCount:    prometheus.NewDesc("db_pool_wait_count_total", "Total number of connections waited for", nil, labels),
+		waitDuration: prometheus.NewDesc("db_pool_wait_duration_seconds_total", "Total time blocked waiting for a new connection", nil, labels),
+		timeouts:     prometheus.NewDesc("db_pool_timeouts_total", "Total number of connection requests that timed out", nil, labels),
+	}
+}
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.maxOpen
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waitCount
+	ch <- c.waitDuration
+	ch <- c.timeouts
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stats()
+	ch <- prometheus.MustNewConstMetric(c.maxOpen, prometheus.GaugeValue, float64(s.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(s.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(s.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(s.Idle))
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(s.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, s.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(c.pool.timeoutCount()))
+}
+
+// handleAdminDBPool reports or changes pool chaos, e.g.
+// {"max_open": 2}, {"hold": 8, "hold_seconds": 30} or {"slow_query_ms": 400}.
+func handleAdminDBPool(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			MaxOpen     *int   `json:"max_open"`
+			Hold        int    `json:"hold"`
+			HoldSeconds int    `json:"hold_seconds"`
+			SlowQueryMs *int64 `json:"slow_query_ms"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.MaxOpen != nil {
+			if *req.MaxOpen < 1 {
+				writeProblem(w, r, "max_open must be >= 1", http.StatusBadRequest)
+				return
+			}
+			dbPool.resize(*req.MaxOpen)
+		}
+		if req.Hold > 0 {
+			if req.HoldSeconds <= 0 {
+				req.HoldSeconds = 30
+			}
+			dbPool.hold(req.Hold, time.Duration(req.HoldSeconds)*time.Second)
+		}
+		if req.SlowQueryMs != nil {
+			dbSlowQueryMs.Store(*req.SlowQueryMs)
+		}
+		slog.Warn("Admin: database pool chaos updated", "max_open", req.MaxOpen, "hold", req.Hold, "hold_seconds", req.HoldSeconds, "slow_query_ms", dbSlowQueryMs.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"stats":         dbPool.Stats(),
+		"timeouts":      dbPool.timeoutCount(),
+		"slow_query_ms": dbSlowQueryMs.Load(),
+	})
+}
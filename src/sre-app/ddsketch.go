@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// ddsketch is a DDSketch (Masson, Rim & Lee): values fall into
+// logarithmically sized buckets, so every quantile it returns is within a
+// fixed relative error of the true value however skewed the distribution.
+// Where a t-digest is most accurate at the tails, a DDSketch is equally
+// accurate everywhere. Not safe for concurrent use.
+type ddsketch struct {
+	gamma    float64
+	logGamma float64
+	buckets  map[int]int64
+	zeros    int64
+	count    int64
+}
+
+// ddsketchMinValue is where values stop being told apart from zero.
+const ddsketchMinValue = 1e-9
+
+func newDDSketch(relativeAccuracy float64) *ddsketch {
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return &ddsketch{gamma: gamma, logGamma: math.Log(gamma), buckets: map[int]int64{}}
+}
+
+func (d *ddsketch) add(x float64) {
+	d.count++
+	if x <= ddsketchMinValue {
+		d.zeros++
+		return
+	}
+	d.buckets[int(math.Ceil(math.Log(x)/d.logGamma))]++
+}
+
+// merge folds o into d; both must share the relative accuracy.
+func (d *ddsketch) merge(o *ddsketch) {
+	for i, n := range o.buckets {
+		d.buckets[i] += n
+	}
+	d.zeros += o.zeros
+	d.count += o.count
+}
+
+// quantile estimates the q-quantile; NaN when empty.
+func (d *ddsketch) quantile(q float64) float64 {
+	if d.count == 0 {
+		return math.NaN()
+	}
+	rank := int64(q * float64(d.count-1))
+	if rank < d.zeros {
+		return 0
+	}
+	indexes := make([]int, 0, len(d.buckets))
+	for i := range d.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	cumulative := d.zeros
+	for _, i := range indexes {
+		cumulative += d.buckets[i]
+		if cumulative > rank {
+			return 2 * math.Pow(d.gamma, float64(i)) / (d.gamma + 1)
+		}
+	}
+	return 2 * math.Pow(d.gamma, float64(indexes[len(indexes)-1])) / (d.gamma + 1)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Debug echo for workshops. With DEBUG_HEADER=true, a request carrying
+// "X-Debug: 1" gets its trace ID, the chaos decisions applied to it and its
+// timing breakdown back as response headers (X-Debug-Trace-Id,
+// X-Debug-Pod, X-Debug-Chaos and a standard Server-Timing that browser
+// devtools render). "X-Debug: json" instead wraps the response in a JSON
+// envelope with the same details and the original body. Debug responses are
+// buffered so the headers can carry the final timings; leave it off where
+// clients shouldn't see internals.
+type debugInfoKey struct{}
+
+type debugInfo struct {
+	mu    sync.Mutex
+	chaos []string
+}
+
+// noteChaos records a chaos decision for the request's debug echo. It is a
+// no-op unless the request asked for one.
+func noteChaos(ctx context.Context, format string, args ...any) {
+	if d, ok := ctx.Value(debugInfoKey{}).(*debugInfo); ok {
+		d.mu.Lock()
+		d.chaos = append(d.chaos, fmt.Sprintf(format, args...))
+		d.mu.Unlock()
+	}
+}
+
+// debugMode returns "headers", "json" or "" for r.
+func debugMode(r *http.Request) string {
+	if !cfg.DebugHeader {
+		return ""
+	}
+	switch strings.ToLower(r.Header.Get("X-Debug")) {
+	case "1", "true", "on":
+		return "headers"
+	case "json":
+		return "json"
+	}
+	return ""
+}
+
+// debugWriter holds the response back until the debug details are known.
+type debugWriter struct {
+	http.ResponseWriter
+	mode   string
+	info   *debugInfo
+	status int
+	body   bytes.Buffer
+}
+
+func newDebugWriter(ctx context.Context, w http.ResponseWriter, mode string) (context.Context, *debugWriter) {
+	d := &debugWriter{ResponseWriter: w, mode: mode, info: &debugInfo{}, status: http.StatusOK}
+	return context.WithValue(ctx, debugInfoKey{}, d.info), d
+}
+
+func (d *debugWriter) WriteHeader(code int) { d.status = code }
+
+func (d *debugWriter) Write(b []byte) (int, error) { return d.body.Write(b) }
+
+// flush sends the held response with the debug details attached.
+func (d *debugWriter) flush(span trace.Span, total, self time.Duration) {
+	d.info.mu.Lock()
+	chaos := append([]string(nil), d.info.chaos...)
+	d.info.mu.Unlock()
+	traceID := span.SpanContext().TraceID().String()
+	ms := func(v time.Duration) float64 { return float64(v.Microseconds()) / 1000 }
+
+	h := d.ResponseWriter.Header()
+	h.Set("X-Debug-Trace-Id", traceID)
+	h.Set("X-Debug-Pod", podName())
+	h.Set("Server-Timing", fmt.Sprintf("total;dur=%.1f, self;dur=%.1f, downstream;dur=%.1f", ms(total), ms(self), ms(total-self)))
+	if len(chaos) > 0 {
+		h.Set("X-Debug-Chaos", strings.Join(chaos, "; "))
+	}
+
+	if d.mode != "json" {
+		h.Set("Content-Length", strconv.Itoa(d.body.Len()))
+		d.ResponseWriter.WriteHeader(d.status)
+		d.ResponseWriter.Write(d.body.Bytes())
+		return
+	}
+	contentType := h.Get("Content-Type")
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	if chaos == nil {
+		chaos = []string{}
+	}
+	envelope := map[string]any{
+		"status":       d.status,
+		"content_type": contentType,
+		"body":         d.body.String(),
+		"debug": map[string]any{
+			"trace_id": traceID,
+			"pod":      podName(),
+			"chaos":    chaos,
+			"timing_ms": map[string]float64{
+				"total":      ms(total),
+				"self":       ms(self),
+				"downstream": ms(total - self),
+			},
+		},
+	}
+	d.ResponseWriter.WriteHeader(d.status)
+	json.NewEncoder(d.ResponseWriter).Encode(envelope)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// At-least-once delivery chaos. QUEUE_DUPLICATE_RATE (percent) makes the
+// "broker" deliver that share of processed messages a second time, up to a
+// second later, as it does when an ack is lost. The consumer's idempotency
+// layer remembers the last QUEUE_DEDUPE_WINDOW message IDs (default 10000);
+// with QUEUE_DEDUPE=false it still recognises duplicates but processes them
+// anyway, the bug this exists to show: orders_fulfilled_total runs ahead of
+// the orders actually placed and customers get every notification twice.
+// Duplicates that arrive after their ID has left the window slip through
+// either way. /admin/chaos/duplicates changes both at runtime.
+var (
+	duplicateRate atomic.Int64
+	queueDedupe   atomic.Bool
+
+	queueRedeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_redeliveries_total",
+			Help: "Messages delivered again after being processed (QUEUE_DUPLICATE_RATE)",
+		},
+		[]string{"queue"},
+	)
+	idempotencyDuplicates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "idempotency_duplicates_total",
+			Help: "Duplicate messages recognised by the consumer, by action (skipped, processed: deduplication disabled)",
+		},
+		[]string{"queue", "action"},
+	)
+	ordersFulfilled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "orders_fulfilled_total",
+		Help: "Order events the consumer fulfilled; above the orders placed when duplicates get through",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queueRedeliveries, idempotencyDuplicates, ordersFulfilled)
+	duplicateRate.Store(int64(cfg.QueueDuplicateRate))
+	queueDedupe.Store(cfg.QueueDedupe)
+	for _, action := range []string{"skipped", "processed"} {
+		idempotencyDuplicates.WithLabelValues(ordersQueue, action)
+	}
+}
+
+// maybeRedeliver puts a processed message back on the queue at
+// QUEUE_DUPLICATE_RATE.
+func maybeRedeliver(msg queueMessage) {
+	if rate := duplicateRate.Load(); rate == 0 || rand.Int63n(100) >= rate {
+		return
+	}
+	msg.Attempts, msg.Redelivered = 0, true
+	time.AfterFunc(time.Duration(rand.Intn(1000))*time.Millisecond, func() {
+		msg.EnqueuedAt = time.Now()
+		select {
+		case orderQueue <- msg:
+			queueRedeliveries.WithLabelValues(ordersQueue).Inc()
+		default:
+			queueMessagesTotal.WithLabelValues(ordersQueue, "publish", "queue_full").Inc()
+		}
+	})
+}
+
+func handleAdminDuplicates(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Rate   *int64 `json:"rate"`
+			Dedupe *bool  `json:"dedupe"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Rate != nil {
+			if *req.Rate < 0 || *req.Rate > 100 {
+				writeProblem(w, r, "rate must be 0-100", http.StatusBadRequest)
+				return
+			}
+			duplicateRate.Store(*req.Rate)
+		}
+		if req.Dedupe != nil {
+			queueDedupe.Store(*req.Dedupe)
+		}
+		slog.Warn("Admin: duplicate delivery chaos updated", "rate", duplicateRate.Load(), "dedupe", queueDedupe.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"rate":          duplicateRate.Load(),
+		"dedupe":        queueDedupe.Load(),
+		"dedupe_window": cfg.QueueDedupeWindow,
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Disk pressure. DISK_CHAOS_RATE_MB_S (or /admin/chaos/disk) writes that
+// many MiB of junk per second into DISK_CHAOS_DIR (default the temp dir; in
+// the lab the /scratch emptyDir) until DISK_CHAOS_MAX_MB (default 256) is
+// written, so the volume fills the way runaway logs or a stuck cache do.
+// The lab's 200Mi sizeLimit is below the default cap: past it the kubelet
+// evicts the pod for ephemeral storage. {"clean": true} deletes the junk.
+//
+// disk_volume_* export the capacity of the volume holding DISK_CHAOS_DIR,
+// for the usual disk alert:
+//
+//	disk_volume_available_bytes / disk_volume_size_bytes < 0.1
+const diskChaosFileMB = 16
+
+var (
+	diskChaosRate     atomic.Int64 // MiB per second
+	diskChaosDir      = os.TempDir()
+	diskChaosMu       sync.Mutex
+	diskChaosFiles    []string
+	diskChaosWritten  atomic.Int64 // bytes
+	diskChaosFileSize int64        // bytes in the newest junk file
+
+	diskChaosWrittenBytes = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "disk_chaos_written_bytes",
+			Help: "Junk currently on disk from disk chaos",
+		},
+		func() float64 { return float64(diskChaosWritten.Load()) },
+	)
+	diskChaosWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "disk_chaos_write_errors_total",
+		Help: "Disk chaos writes that failed, usually with ENOSPC once the volume is full",
+	})
+)
+
+func init() {
+	if dir := os.Getenv("DISK_CHAOS_DIR"); dir != "" {
+		diskChaosDir = dir
+	}
+	diskChaosRate.Store(int64(cfg.DiskChaosRateMBs))
+	volume := prometheus.Labels{"path": diskChaosDir}
+	statfs := func(f func(s *syscall.Statfs_t) float64) func() float64 {
+		return func() float64 {
+			var s syscall.Statfs_t
+			if syscall.Statfs(diskChaosDir, &s) != nil {
+				return 0
+			}
+			return f(&s)
+		}
+	}
+	prometheus.MustRegister(diskChaosWrittenBytes, diskChaosWriteErrors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "disk_volume_size_bytes",
+			Help:        "Size of the volume holding DISK_CHAOS_DIR",
+			ConstLabels: volume,
+		}, statfs(func(s *syscall.Statfs_t) float64 { return float64(s.Blocks) * float64(s.Bsize) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "disk_volume_available_bytes",
+			Help:        "Bytes available to the app on the volume holding DISK_CHAOS_DIR",
+			ConstLabels: volume,
+		}, statfs(func(s *syscall.Statfs_t) float64 { return float64(s.Bavail) * float64(s.Bsize) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "disk_volume_inodes_free",
+			Help:        "Free inodes on the volume holding DISK_CHAOS_DIR",
+			ConstLabels: volume,
+		}, statfs(func(s *syscall.Statfs_t) float64 { return float64(s.Ffree) })),
+	)
+	go runDiskChaos()
+}
+
+func runDiskChaos() {
+	chunk := make([]byte, 1<<20)
+	for i := range chunk {
+		chunk[i] = byte(i)
+	}
+	for range time.Tick(time.Second) {
+		for n := diskChaosRate.Load(); n > 0; n-- {
+			if diskChaosWritten.Load()+int64(len(chunk)) > int64(cfg.DiskChaosMaxMB)<<20 {
+				break
+			}
+			if err := appendDiskChaos(chunk); err != nil {
+				diskChaosWriteErrors.Inc()
+				slog.Error("Disk chaos write failed", "dir", diskChaosDir, "error", err)
+				break
+			}
+		}
+	}
+}
+
+// appendDiskChaos adds chunk to the newest junk file, starting a new one
+// every diskChaosFileMB. A write that fails part-way, as at ENOSPC, is
+// truncated back so the file ends on a whole chunk; if that fails too, the
+// bytes left behind still count towards the file's size.
+func appendDiskChaos(chunk []byte) error {
+	diskChaosMu.Lock()
+	defer diskChaosMu.Unlock()
+	if len(diskChaosFiles) == 0 || diskChaosFileSize >= diskChaosFileMB<<20 {
+		diskChaosFiles = append(diskChaosFiles, filepath.Join(diskChaosDir, fmt.Sprintf("sre-app-junk-%d-%03d.bin", os.Getpid(), len(diskChaosFiles))))
+		diskChaosFileSize = 0
+	}
+	f, err := os.OpenFile(diskChaosFiles[len(diskChaosFiles)-1], os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	n, err := f.Write(chunk)
+	if err != nil && n > 0 && f.Truncate(diskChaosFileSize) == nil {
+		n = 0
+	}
+	diskChaosFileSize += int64(n)
+	diskChaosWritten.Add(int64(n))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// cleanDiskChaos deletes the junk files.
+func cleanDiskChaos() {
+	diskChaosMu.Lock()
+	defer diskChaosMu.Unlock()
+	for _, name := range diskChaosFiles {
+		os.Remove(name)
+	}
+	diskChaosFiles = nil
+	diskChaosFileSize = 0
+	diskChaosWritten.Store(0)
+}
+
+// handleAdminDisk reports or sets disk chaos: {"rate_mb_s": 20},
+// {"rate_mb_s": 0, "clean": true}.
+func handleAdminDisk(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			RateMBs *int64 `json:"rate_mb_s"`
+			Clean   bool   `json:"clean"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.RateMBs != nil && *req.RateMBs >= 0 {
+			diskChaosRate.Store(*req.RateMBs)
+		}
+		if req.Clean {
+			cleanDiskChaos()
+		}
+		slog.Warn("Admin: disk chaos updated", "rate_mb_s", diskChaosRate.Load(), "clean", req.Clean)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"dir":           diskChaosDir,
+		"rate_mb_s":     diskChaosRate.Load(),
+		"written_bytes": diskChaosWritten.Load(),
+		"max_mb":        cfg.DiskChaosMaxMB,
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Retry-then-DLQ handling for the orders consumer. A message that fails
+// QUEUE_MAX_ATTEMPTS times (default 3, exponential backoff from
+// QUEUE_RETRY_BACKOFF_MS, default 100) is parked on the dead-letter queue,
+// capped at DLQ_CAPACITY (default 1000, oldest dropped). Retries happen inline,
+// so a burst of poison messages also backs up the main queue.
+// POISON_MESSAGE_RATE (percent) corrupts published bodies so they can never
+// be processed; CONSUMER_ERROR_RATE (percent) adds transient failures that
+// usually succeed on retry.
+type deadLetter struct {
+	ID           string    `json:"id"`
+	Body         string    `json:"body"`
+	Attempts     int       `json:"attempts"`
+	Error        string    `json:"error"`
+	DeadLettered time.Time `json:"dead_lettered_at"`
+
+	msg queueMessage
+}
+
+var poisonBody = []byte(`{"order_id": "\u0000`)
+
+var (
+	queueMaxAttempts  = 3
+	queueRetryBackoff = 100 * time.Millisecond
+	dlqCapacity       = 1000
+	poisonRate        atomic.Int64
+	consumerErrorRate atomic.Int64
+
+	dlqMu sync.Mutex
+	dlq   []deadLetter
+)
+
+var (
+	dlqDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "queue_dlq_depth",
+			Help: "Messages parked on the dead-letter queue",
+		},
+		[]string{"queue"},
+	)
+	dlqOldestAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "queue_dlq_oldest_age_seconds",
+		Help: "Age of the oldest dead-lettered message",
+	}, func() float64 {
+		dlqMu.Lock()
+		defer dlqMu.Unlock()
+		if len(dlq) == 0 {
+			return 0
+		}
+		return time.Since(dlq[0].DeadLettered).Seconds()
+	})
+)
+
+func init() {
+	prometheus.MustRegister(dlqDepth, dlqOldestAge)
+}
+
+func loadDLQConfig() {
+	queueMaxAttempts = cfg.QueueMaxAttempts
+	queueRetryBackoff = time.Duration(cfg.QueueRetryBackoffMs) * time.Millisecond
+	dlqCapacity = cfg.DLQCapacity
+	poisonRate.Store(int64(cfg.PoisonMessageRate))
+	consumerErrorRate.Store(int64(cfg.ConsumerErrorRate))
+	dlqDepth.WithLabelValues(ordersQueue).Set(0)
+}
+
+// processOrderMessage is the consumer's business logic.
+func processOrderMessage(msg queueMessage) error {
+	var order struct {
+		OrderID int64 `json:"order_id"`
+	}
+	if err := json.Unmarshal(msg.Body, &order); err != nil {
+		return fmt.Errorf("decode order event: %w", err)
+	}
+	time.Sleep(time.Duration(5+rand.Intn(15)) * time.Millisecond)
+	if rate := consumerErrorRate.Load(); rate > 0 && rand.Int63n(100) < rate {
+		return fmt.Errorf("order %d: fulfilment service unavailable", order.OrderID)
+	}
+	return nil
+}
+
+// consumeWithRetry reports whether msg was processed; otherwise it has been
+// dead-lettered.
+func consumeWithRetry(ctx context.Context, span trace.Span, msg queueMessage) bool {
+	var err error
+	for msg.Attempts < queueMaxAttempts {
+		if msg.Attempts > 0 {
+			queueMessagesTotal.WithLabelValues(ordersQueue, "consume", "retried").Inc()
+			time.Sleep(queueRetryBackoff << (msg.Attempts - 1))
+		}
+		msg.Attempts++
+		if err = processOrderMessage(msg); err == nil {
+			span.SetAttributes(attribute.Int("app.message.attempts", msg.Attempts))
+			queueMessagesTotal.WithLabelValues(ordersQueue, "consume", "processed").Inc()
+			return true
+		}
+		span.AddEvent("processing failed", trace.WithAttributes(
+			attribute.Int("app.message.attempt", msg.Attempts),
+			attribute.String("exception.message", err.Error()),
+		))
+	}
+
+	span.SetAttributes(attribute.Int("app.message.attempts", msg.Attempts), attribute.Bool("app.message.dead_lettered", true))
+	span.RecordError(err)
+	span.SetStatus(codes.Error, "dead-lettered")
+	queueMessagesTotal.WithLabelValues(ordersQueue, "consume", "dead_lettered").Inc()
+	slog.ErrorContext(ctx, "Message dead-lettered", "queue", ordersQueue, "message_id", msg.ID, "attempts", msg.Attempts, "error", err)
+
+	dlqMu.Lock()
+	dlq = append(dlq, deadLetter{ID: msg.ID, Body: string(msg.Body), Attempts: msg.Attempts, Error: err.Error(), DeadLettered: time.Now(), msg: msg})
+	if len(dlq) > dlqCapacity {
+		dlq = dlq[len(dlq)-dlqCapacity:]
+	}
+	dlqDepth.WithLabelValues(ordersQueue).Set(float64(len(dlq)))
+	dlqMu.Unlock()
+	return false
+}
+
+// handleAdminDLQ lists dead letters, sets the poison/consumer error rates, or
+// empties the DLQ: {"redrive": true} re-enqueues every message with a fresh
+// attempt count, {"purge": true} drops them.
+func handleAdminDLQ(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			PoisonRate        *int64 `json:"poison_rate"`
+			ConsumerErrorRate *int64 `json:"consumer_error_rate"`
+			Redrive           bool   `json:"redrive"`
+			Purge             bool   `json:"purge"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.PoisonRate != nil {
+			poisonRate.Store(*req.PoisonRate)
+		}
+		if req.ConsumerErrorRate != nil {
+			consumerErrorRate.Store(*req.ConsumerErrorRate)
+		}
+		redriven := 0
+		if req.Redrive || req.Purge {
+			dlqMu.Lock()
+			parked := dlq
+			dlq = nil
+			dlqDepth.WithLabelValues(ordersQueue).Set(0)
+			dlqMu.Unlock()
+			for _, d := range parked {
+				if !req.Redrive {
+					break
+				}
+				d.msg.Attempts = 0
+				d.msg.EnqueuedAt = time.Now()
+				select {
+				case orderQueue <- d.msg:
+					redriven++
+				default:
+				}
+			}
+		}
+		slog.Warn("Admin: dead-letter queue updated", "poison_rate", poisonRate.Load(), "consumer_error_rate", consumerErrorRate.Load(), "redriven", redriven, "purge", req.Purge)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dlqMu.Lock()
+	messages := append([]deadLetter{}, dlq...)
+	dlqMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"poison_rate":         poisonRate.Load(),
+		"consumer_error_rate": consumerErrorRate.Load(),
+		"depth":               len(messages),
+		"messages":            messages,
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DNS resolution with resolver chaos. Downstream calls resolve their host
+// through appResolver in a "dns.lookup" span, and every
+// DNS_WORKLOAD_INTERVAL_S (default 15, 0 disables) a workload resolves each
+// of DNS_WORKLOAD_NAMES (","-separated; default the downstream hosts, or
+// kubernetes.default.svc.cluster.local without any). Lookups give up after
+// DNS_LOOKUP_TIMEOUT_MS (default 2000) and are counted in dns_lookups_total
+// by outcome (ok, nxdomain, servfail, timeout, error).
+//
+// DNS_CHAOS (or /admin/chaos/dns) swaps the nameserver for a broken one:
+//
+//	blackhole  queries go to an address that never answers: every lookup
+//	           times out and downstream calls stall for the whole timeout
+//	servfail   an in-process nameserver answers SERVFAIL
+//	nxdomain   it answers NXDOMAIN, the "it's always DNS" outage where
+//	           names that resolved a minute ago no longer exist
+//
+// /etc/hosts entries keep resolving, as they do when the real resolver
+// breaks.
+var (
+	dnsChaos      atomic.Value // string: off, blackhole, servfail, nxdomain
+	dnsTimeout    = 2 * time.Second
+	dnsBrokenOnce sync.Once
+	dnsBrokenAddr string // the SERVFAIL/NXDOMAIN nameserver, once started
+	dnsBlackhole  = "192.0.2.53:53"
+
+	appResolver = &net.Resolver{PreferGo: true, Dial: dialNameserver}
+
+	dnsLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_lookups_total",
+			Help: "DNS lookups by name and outcome (ok, nxdomain, servfail, timeout, error)",
+		},
+		[]string{"name", "outcome"},
+	)
+	dnsLookupDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dns_lookup_duration_seconds",
+			Help:    "Time to resolve a name, successful or not",
+			Buckets: []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 2.5, 5},
+		},
+		[]string{"name"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(dnsLookups, dnsLookupDuration)
+	dnsChaos.Store(cfg.DNSChaos)
+	dnsTimeout = time.Duration(cfg.DNSLookupTimeoutMs) * time.Millisecond
+}
+
+// dnsTransport dials downstream hosts through lookupHost.
+var dnsTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		addrs, err := lookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, net.JoinHostPort(addrs[0], port))
+	}
+	return t
+}()
+
+// dialNameserver sends the Go resolver's queries to the real nameserver or,
+// under chaos, a broken one.
+func dialNameserver(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	switch dnsChaos.Load().(string) {
+	case "blackhole":
+		address = dnsBlackhole
+	case "servfail", "nxdomain":
+		dnsBrokenOnce.Do(startBrokenNameserver)
+		if dnsBrokenAddr != "" {
+			network, address = "udp", dnsBrokenAddr
+		}
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// startBrokenNameserver answers every query with the chaos mode's error code.
+func startBrokenNameserver() {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		slog.Error("Broken nameserver failed to start", "error", err)
+		return
+	}
+	dnsBrokenAddr = conn.LocalAddr().String()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if reply := brokenDNSReply(buf[:n]); reply != nil {
+				conn.WriteTo(reply, peer)
+			}
+		}
+	}()
+}
+
+// brokenDNSReply echoes a query's header and question with the response
+// bit and a SERVFAIL (2) or NXDOMAIN (3) code.
+func brokenDNSReply(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5 // root label, QTYPE, QCLASS
+	if end > len(query) {
+		return nil
+	}
+	rcode := uint16(2)
+	if dnsChaos.Load().(string) == "nxdomain" {
+		rcode = 3
+	}
+	reply := append([]byte(nil), query[:end]...)
+	flags := binary.BigEndian.Uint16(query[2:4])&0x0100 | 0x8080 | rcode // keep RD, set QR and RA
+	binary.BigEndian.PutUint16(reply[2:4], flags)
+	binary.BigEndian.PutUint16(reply[4:6], 1)
+	clear(reply[6:12]) // no answer, authority or additional records
+	return reply
+}
+
+// lookupHost resolves host in a "dns.lookup" span.
+func lookupHost(ctx context.Context, host string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "dns.lookup", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("dns.question.name", host),
+	))
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	start := time.Now()
+	addrs, err := appResolver.LookupHost(ctx, host)
+	dnsLookupDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
+	outcome := dnsOutcome(err)
+	dnsLookups.WithLabelValues(host, outcome).Inc()
+	span.SetAttributes(attribute.String("app.dns.outcome", outcome), attribute.Int("app.dns.answers", len(addrs)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	return addrs, nil
+}
+
+func dnsOutcome(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case !errors.As(err, &dnsErr):
+		return "error"
+	case dnsErr.IsTimeout:
+		return "timeout"
+	case dnsErr.IsNotFound:
+		return "nxdomain"
+	case dnsErr.IsTemporary:
+		return "servfail"
+	}
+	return "error"
+}
+
+// dnsWorkloadNames returns DNS_WORKLOAD_NAMES or the downstream hosts.
+func dnsWorkloadNames() []string {
+	spec := os.Getenv("DNS_WORKLOAD_NAMES")
+	if spec == "" {
+		spec = strings.Join([]string{os.Getenv("DOWNSTREAM_URL"), os.Getenv("DOWNSTREAM_SECONDARY_URL"), os.Getenv("DOWNSTREAM_URLS"), os.Getenv("REMOTE_REGION_URL")}, ",")
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, raw := range strings.Split(spec, ",") {
+		name := strings.TrimSpace(raw)
+		if u, err := url.Parse(name); err == nil && u.Hostname() != "" {
+			name = u.Hostname()
+		}
+		if name == "" || seen[name] || net.ParseIP(name) != nil {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		names = []string{"kubernetes.default.svc.cluster.local"}
+	}
+	return names
+}
+
+func startDNSWorkload() {
+	if cfg.DNSWorkloadIntervalS == 0 {
+		return
+	}
+	names := dnsWorkloadNames()
+	go func() {
+		for range time.Tick(time.Duration(cfg.DNSWorkloadIntervalS) * time.Second) {
+			ctx, span := tracer.Start(context.Background(), "dns.workload", trace.WithAttributes(attribute.Int("app.dns.names", len(names))))
+			for _, name := range names {
+				lookupHost(ctx, name)
+			}
+			span.End()
+		}
+	}()
+}
+
+func handleAdminDNS(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Mode *string `json:"mode"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Mode != nil {
+			switch *req.Mode {
+			case "off", "blackhole", "servfail", "nxdomain":
+				dnsChaos.Store(*req.Mode)
+			default:
+				writeProblem(w, r, "mode must be off, blackhole, servfail or nxdomain", http.StatusBadRequest)
+				return
+			}
+			slog.Warn("Admin: DNS chaos updated", "mode", *req.Mode)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"mode":           dnsChaos.Load(),
+		"timeout_ms":     dnsTimeout.Milliseconds(),
+		"workload_names": dnsWorkloadNames(),
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Downstream calls. /checkout calls DOWNSTREAM_URL when set, failing over to
+// DOWNSTREAM_SECONDARY_URL after FAILOVER_THRESHOLD consecutive failures, or
+// balances across DOWNSTREAM_URLS (see balancer.go); with
+// REMOTE_REGION_URL, REMOTE_REGION_RATE percent of those calls cross to the
+// "remote region" and pay REMOTE_REGION_LATENCY_MS of synthetic WAN latency.
+var (
+	downstreamFailover   *failoverClient
+	remoteRegionURL      string
+	remoteRegionRate     int
+	remoteRegionLatency  int
+	downstreamHTTPClient = &http.Client{
+		Transport: otelhttp.NewTransport(tlsChaosRoundTripper{dnsTransport}),
+		Timeout:   5 * time.Second,
+	}
+)
+
+var (
+	downstreamRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "downstream_requests_total",
+			Help: "Total number of downstream HTTP calls",
+		},
+		[]string{"target", "status"},
+	)
+	downstreamRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "downstream_request_duration_seconds",
+			Help:    "Duration of downstream HTTP calls in seconds, including synthetic WAN latency",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(downstreamRequestsTotal)
+	prometheus.MustRegister(downstreamRequestDuration)
+}
+
+func loadDownstreamConfig() {
+	downstreamFailover = newFailoverClient(os.Getenv("DOWNSTREAM_URL"), os.Getenv("DOWNSTREAM_SECONDARY_URL"),
+		cfg.FailoverThreshold, time.Duration(cfg.FailoverCooldownS)*time.Second)
+	remoteRegionURL = os.Getenv("REMOTE_REGION_URL")
+	remoteRegionRate = cfg.RemoteRegionRate
+	remoteRegionLatency = cfg.RemoteRegionLatencyMs
+}
+
+// callDownstream returns the downstream status code, or 0 when no
+// downstream is configured.
+func callDownstream(ctx context.Context) (int, error) {
+	target := "local"
+	var backend, url string
+	var lbCall *balancerCall
+	switch {
+	case remoteRegionURL != "" && rand.Intn(100) < remoteRegionRate:
+		target, backend, url = "remote", "remote", remoteRegionURL
+		noteChaos(ctx, "downstream: routed to remote region")
+	case downstreamBalancer != nil:
+		if lbCall = downstreamBalancer.pick(ctx); lbCall != nil {
+			backend, url = lbCall.backend.name, lbCall.backend.url
+		}
+	default:
+		backend, url = downstreamFailover.pick()
+	}
+	if url == "" {
+		return 0, nil
+	}
+
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "downstream_call")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("app.downstream.target", target),
+		attribute.String("app.downstream.backend", backend),
+	)
+
+	release, err := bulkheadFor("downstream").acquire()
+	if err != nil {
+		// The call never left the process, so it says nothing about the
+		// backend: hand back the pick without judging it.
+		switch {
+		case lbCall != nil:
+			lbCall.cancel()
+		case target == "local":
+			downstreamFailover.abandon(backend)
+		}
+		downstreamRequestsTotal.WithLabelValues(target, "bulkhead_rejected").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	defer release()
+	healthy := false
+	if lbCall != nil {
+		defer func() { lbCall.done(healthy) }()
+	}
+
+	if target == "remote" && remoteRegionLatency > 0 {
+		time.Sleep(time.Duration(remoteRegionLatency) * time.Millisecond)
+		span.SetAttributes(attribute.Int("app.wan_latency_ms", remoteRegionLatency))
+	}
+
+	status, err := downstreamGet(ctx, url)
+	addDownstreamTime(ctx, time.Since(start))
+	healthy = err == nil && status < 500
+	if target == "local" && lbCall == nil {
+		downstreamFailover.report(backend, healthy)
+	}
+	downstreamRequestDuration.WithLabelValues(target).Observe(time.Since(start).Seconds())
+	if err != nil {
+		label := "error"
+		if reason := tlsErrorReason(err); reason != "" {
+			label = "tls_error"
+			outboundTLSErrors.WithLabelValues(target, reason).Inc()
+			span.SetAttributes(attribute.String("app.tls.error_reason", reason))
+		}
+		downstreamRequestsTotal.WithLabelValues(target, label).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	downstreamRequestsTotal.WithLabelValues(target, strconv.Itoa(status)).Inc()
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	return status, nil
+}
+
+func doDownstreamGet(ctx context.Context, url string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("building downstream request: %w", err)
+	}
+	resp, err := downstreamHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// A/B experiments, for practising experiment observability: is the new
+// variant hurting anyone? EXPERIMENT_VARIANTS is a ";"-separated list of
+// weighted variants, each optionally with its own behaviour:
+//
+//	control=90; treatment=10,latency_ms=150,error_pct=2
+//
+// The first variant is the control. Requests to EXPERIMENT_ROUTES (default
+// /checkout) are assigned by hash of their routing key (session or tenant,
+// else client IP), so a user stays in one variant; the variant is returned
+// in X-Experiment-Variant and recorded as app.experiment.variant. Each
+// variant gets its own SLI ring (see sli.go), exposed per SLI_WINDOWS window
+// as experiment_sli_success_ratio and experiment_sli_latency_p99_seconds,
+// and experiment_guardrail_breached flags a treatment whose error ratio is
+// more than EXPERIMENT_GUARDRAIL_ERROR_PP percentage points (default 1) or
+// whose p99 is more than EXPERIMENT_GUARDRAIL_LATENCY_PCT percent (default
+// 20) above the control's, once both have EXPERIMENT_GUARDRAIL_MIN_REQUESTS
+// requests (default 100) in the window. EXPERIMENT_NAME (default "ab_test")
+// labels the series; /admin/experiment replaces the experiment at runtime,
+// starting its SLIs afresh.
+type experimentVariant struct {
+	name       string
+	experiment string // the experiment's name, fixed once a request is assigned
+	weight     int
+	latencyMs  int
+	errorPct   int
+	series     *sliSeries
+}
+
+type experiment struct {
+	name     string
+	routes   []string
+	variants []*experimentVariant
+	weights  int
+}
+
+var (
+	activeExperiment atomic.Pointer[experiment]
+
+	experimentRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "experiment_requests_total",
+			Help: "Requests in an experiment, by variant and outcome (ok, error: 5xx)",
+		},
+		[]string{"experiment", "variant", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(experimentRequests, experimentCollector{})
+	// A malformed EXPERIMENT_VARIANTS is reported by loadConfig.
+	exp, _ := parseExperiment(os.Getenv("EXPERIMENT_NAME"), os.Getenv("EXPERIMENT_ROUTES"), os.Getenv("EXPERIMENT_VARIANTS"))
+	startExperiment(exp)
+}
+
+// startExperiment gives each variant a fresh SLI ring and makes exp the
+// active experiment.
+func startExperiment(exp *experiment) {
+	if exp != nil && len(sliWindows) > 0 {
+		for _, v := range exp.variants {
+			v.series = newSLISeries()
+		}
+	}
+	activeExperiment.Store(exp)
+}
+
+// parseExperiment returns nil for an empty variant list: no experiment.
+func parseExperiment(name, routes, spec string) (*experiment, error) {
+	if name == "" {
+		name = "ab_test"
+	}
+	if routes == "" {
+		routes = "/checkout"
+	}
+	exp := &experiment{name: name}
+	for _, route := range strings.Split(routes, ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			exp.routes = append(exp.routes, route)
+		}
+	}
+	for _, raw := range strings.Split(spec, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		fields := strings.Split(raw, ",")
+		variantName, weight, ok := strings.Cut(strings.TrimSpace(fields[0]), "=")
+		v := &experimentVariant{name: variantName, experiment: name}
+		var err error
+		if v.weight, err = strconv.Atoi(weight); !ok || variantName == "" || err != nil || v.weight < 0 {
+			return nil, fmt.Errorf("variant %q: want name=weight[,latency_ms=N][,error_pct=N]", raw)
+		}
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			n, err := strconv.Atoi(value)
+			switch {
+			case key == "latency_ms" && err == nil && n >= 0 && n <= 60000:
+				v.latencyMs = n
+			case key == "error_pct" && err == nil && n >= 0 && n <= 100:
+				v.errorPct = n
+			default:
+				return nil, fmt.Errorf("variant %q: bad setting %q (latency_ms 0-60000, error_pct 0-100)", raw, field)
+			}
+		}
+		if slices.ContainsFunc(exp.variants, func(o *experimentVariant) bool { return o.name == v.name }) {
+			return nil, fmt.Errorf("variant %q is listed twice", v.name)
+		}
+		exp.variants = append(exp.variants, v)
+		exp.weights += v.weight
+	}
+	if len(exp.variants) == 0 {
+		return nil, nil
+	}
+	if exp.weights == 0 {
+		return nil, fmt.Errorf("variant weights add up to 0")
+	}
+	return exp, nil
+}
+
+// assignVariant picks r's variant, or nil when route is not in an experiment.
+func assignVariant(route string, r *http.Request) *experimentVariant {
+	exp := activeExperiment.Load()
+	if exp == nil || !slices.Contains(exp.routes, route) {
+		return nil
+	}
+	key := routingKey(r)
+	if key == "" {
+		key = clientIP(r)
+	}
+	bucket := int(hashKey(exp.name+"/"+key) % uint32(exp.weights))
+	for _, v := range exp.variants {
+		if bucket < v.weight {
+			return v
+		}
+		bucket -= v.weight
+	}
+	return exp.variants[len(exp.variants)-1]
+}
+
+// serve runs h with the variant's behaviour; a nil variant just runs h.
+func (v *experimentVariant) serve(ctx context.Context, w http.ResponseWriter, r *http.Request, h http.HandlerFunc) {
+	if v == nil {
+		h(w, r)
+		return
+	}
+	w.Header().Set("X-Experiment-Variant", v.name)
+	serverSpan(ctx).SetAttributes(
+		attribute.String("app.experiment", v.experiment),
+		attribute.String("app.experiment.variant", v.name),
+	)
+	if v.latencyMs > 0 {
+		time.Sleep(time.Duration(v.latencyMs) * time.Millisecond)
+		noteChaos(ctx, "experiment variant %s: %dms", v.name, v.latencyMs)
+	}
+	if v.errorPct > 0 && rand.Intn(100) < v.errorPct {
+		markFault(ctx, fmt.Errorf("experiment variant %s failed", v.name))
+		writeProblem(w, r, "experiment variant "+v.name+" failed", http.StatusInternalServerError)
+		return
+	}
+	h(w, r)
+}
+
+// recordExperiment counts a finished request against its variant.
+func recordExperiment(v *experimentVariant, status int, elapsed time.Duration) {
+	if v == nil {
+		return
+	}
+	outcome := "ok"
+	if status >= http.StatusInternalServerError {
+		outcome = "error"
+	}
+	experimentRequests.WithLabelValues(v.experiment, v.name, outcome).Inc()
+	if v.series != nil {
+		v.series.record(status, elapsed)
+	}
+}
+
+var (
+	experimentSuccessDesc = prometheus.NewDesc("experiment_sli_success_ratio",
+		"Share of the variant's requests in the sliding window that did not fail with a 5xx", []string{"experiment", "variant", "window"}, nil)
+	experimentLatencyDesc = prometheus.NewDesc("experiment_sli_latency_p99_seconds",
+		"The variant's p99 latency in the sliding window (t-digest)", []string{"experiment", "variant", "window"}, nil)
+	experimentGuardrailDesc = prometheus.NewDesc("experiment_guardrail_breached",
+		"1 when a treatment variant is worse than the control beyond the guardrail threshold", []string{"experiment", "variant", "window", "guardrail"}, nil)
+)
+
+type experimentCollector struct{}
+
+func (experimentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- experimentSuccessDesc
+	ch <- experimentLatencyDesc
+	ch <- experimentGuardrailDesc
+}
+
+func (experimentCollector) Collect(ch chan<- prometheus.Metric) {
+	exp := activeExperiment.Load()
+	if exp == nil || len(sliWindows) == 0 {
+		return
+	}
+	now := time.Now().Unix() / int64(cfg.SLISlotSeconds)
+	var control map[string]sliAggregate
+	for i, v := range exp.variants {
+		if v.series == nil {
+			continue
+		}
+		windows := map[string]sliAggregate{}
+		for _, a := range v.series.aggregate(now) {
+			windows[a.window] = a
+			errorRatio := float64(a.errors) / float64(a.total)
+			ch <- prometheus.MustNewConstMetric(experimentSuccessDesc, prometheus.GaugeValue, 1-errorRatio, exp.name, v.name, a.window)
+			ch <- prometheus.MustNewConstMetric(experimentLatencyDesc, prometheus.GaugeValue, a.tdigestP99, exp.name, v.name, a.window)
+			c, ok := control[a.window]
+			if i == 0 || !ok || c.total < int64(cfg.ExperimentGuardrailMinRequests) || a.total < int64(cfg.ExperimentGuardrailMinRequests) {
+				continue
+			}
+			errorDelta := 100 * (errorRatio - float64(c.errors)/float64(c.total))
+			latencyDelta := 100 * (a.tdigestP99 - c.tdigestP99) / c.tdigestP99
+			ch <- prometheus.MustNewConstMetric(experimentGuardrailDesc, prometheus.GaugeValue,
+				boolGauge(errorDelta > cfg.ExperimentGuardrailErrorPP), exp.name, v.name, a.window, "error_ratio")
+			if !math.IsNaN(latencyDelta) && !math.IsInf(latencyDelta, 0) {
+				ch <- prometheus.MustNewConstMetric(experimentGuardrailDesc, prometheus.GaugeValue,
+					boolGauge(latencyDelta > cfg.ExperimentGuardrailLatencyPct), exp.name, v.name, a.window, "latency_p99")
+			}
+		}
+		if i == 0 {
+			control = windows
+		}
+	}
+}
+
+// boolGauge is a gauge value for b.
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var experimentMu sync.Mutex // serialises admin replacements
+
+func handleAdminExperiment(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Name     *string `json:"name"`
+			Routes   *string `json:"routes"`
+			Variants *string `json:"variants"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		experimentMu.Lock()
+		name, routes, variants := experimentSpec(activeExperiment.Load())
+		if req.Name != nil {
+			name = *req.Name
+		}
+		if req.Routes != nil {
+			routes = *req.Routes
+		}
+		if req.Variants != nil {
+			variants = *req.Variants
+		}
+		exp, err := parseExperiment(name, routes, variants)
+		if err != nil {
+			experimentMu.Unlock()
+			writeProblem(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		startExperiment(exp)
+		experimentMu.Unlock()
+		slog.Warn("Admin: experiment updated", "name", name, "routes", routes, "variants", variants)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, routes, variants := experimentSpec(activeExperiment.Load())
+	writeJSON(w, http.StatusOK, map[string]any{"name": name, "routes": routes, "variants": variants})
+}
+
+// experimentSpec renders exp back into its EXPERIMENT_* settings.
+func experimentSpec(exp *experiment) (name, routes, variants string) {
+	if exp == nil {
+		return os.Getenv("EXPERIMENT_NAME"), os.Getenv("EXPERIMENT_ROUTES"), ""
+	}
+	specs := make([]string, 0, len(exp.variants))
+	for _, v := range exp.variants {
+		spec := fmt.Sprintf("%s=%d", v.name, v.weight)
+		if v.latencyMs > 0 {
+			spec += fmt.Sprintf(",latency_ms=%d", v.latencyMs)
+		}
+		if v.errorPct > 0 {
+			spec += fmt.Sprintf(",error_pct=%d", v.errorPct)
+		}
+		specs = append(specs, spec)
+	}
+	return exp.name, strings.Join(exp.routes, ","), strings.Join(specs, "; ")
+}
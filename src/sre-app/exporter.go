@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const defaultOTLPEndpoint = "observability-tempo.monitoring.svc.cluster.local:4317" // Direct to Tempo/Collector
+
+// newTraceExporter picks the span exporter from OTEL_TRACES_EXPORTER:
+//
+//	otlp    (default) OTLP/gRPC to OTEL_EXPORTER_OTLP_ENDPOINT or Tempo
+//	zipkin  Zipkin v2 JSON to OTEL_EXPORTER_ZIPKIN_ENDPOINT
+//	jaeger  OTLP/gRPC to OTEL_EXPORTER_JAEGER_ENDPOINT; the Thrift exporter is
+//	        gone from OTel Go and Jaeger >= 1.35 ingests OTLP natively
+//	console OTLP/JSON lines to TELEMETRY_OUTPUT, no collector needed
+func newTraceExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	name := traceExporterName()
+	switch name {
+	case "otlp":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithInsecure()}
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(defaultOTLPEndpoint))
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case "zipkin":
+		endpoint := os.Getenv("OTEL_EXPORTER_ZIPKIN_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "http://localhost:9411/api/v2/spans"
+		}
+		return newZipkinExporter(endpoint), nil
+	case "jaeger":
+		endpoint := os.Getenv("OTEL_EXPORTER_JAEGER_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "jaeger-collector.monitoring.svc.cluster.local:4317"
+		}
+		return otlptracegrpc.New(ctx, otlptracegrpc.WithInsecure(), otlptracegrpc.WithEndpoint(endpoint))
+	case "console":
+		return consoleSpanExporter{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q", name)
+	}
+}
+
+// newSecondaryTraceExporter returns the optional second trace backend, for
+// dual-writing during a migration: OTLP/gRPC to TRACES_SECONDARY_ENDPOINT with
+// TRACES_SECONDARY_HEADERS ("key=value,...", e.g. a vendor API key) and
+// plaintext unless TRACES_SECONDARY_INSECURE=false. It gets its own batcher,
+// so a slow or failing backend only drops its own copy, and its health
+// metrics are labelled TRACES_SECONDARY_NAME (default "secondary").
+func newSecondaryTraceExporter(ctx context.Context) (sdktrace.SpanExporter, string, error) {
+	endpoint := os.Getenv("TRACES_SECONDARY_ENDPOINT")
+	if endpoint == "" {
+		return nil, "", nil
+	}
+	name := os.Getenv("TRACES_SECONDARY_NAME")
+	if name == "" {
+		name = "secondary"
+	}
+	if name == traceExporterName() {
+		return nil, "", fmt.Errorf("TRACES_SECONDARY_NAME %q clashes with the primary exporter", name)
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if cfg.TracesSecondaryInsecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	headers, err := parseTraceHeaders(os.Getenv("TRACES_SECONDARY_HEADERS"))
+	if err != nil {
+		return nil, "", fmt.Errorf("TRACES_SECONDARY_HEADERS: %w", err)
+	}
+	if len(headers) > 0 {
+		opts = append(opts, otlptracegrpc.WithHeaders(headers))
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	return exporter, name, err
+}
+
+// parseTraceHeaders parses "key=value,..." export headers. Values are often
+// API keys, so errors name the entry by position only.
+func parseTraceHeaders(raw string) (map[string]string, error) {
+	headers := map[string]string{}
+	if raw == "" {
+		return headers, nil
+	}
+	for i, pair := range strings.Split(raw, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			return nil, fmt.Errorf("entry %d: want key=value", i+1)
+		}
+		headers[k] = strings.TrimSpace(v)
+	}
+	return headers, nil
+}
+
+func traceExporterName() string {
+	if name := strings.ToLower(strings.TrimSpace(os.Getenv("OTEL_TRACES_EXPORTER"))); name != "" {
+		return name
+	}
+	return "otlp"
+}
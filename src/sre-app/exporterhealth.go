@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Telemetry pipeline health. The SDK reports export failures through the
+// global OTel error handler, which by default prints to stderr and moves on;
+// here every error is counted and logged (at most once per
+// otelErrorLogInterval, an unreachable collector fails every batch), and
+// every export is measured so dropped spans show up as a number instead of
+// a gap in Tempo, with per-exporter up and last-success gauges for when
+// traces go to more than one backend. EXPORTER_BLACKHOLE=true, or
+// /admin/chaos/exporter for one exporter or all, makes exports behave as if
+// the collector's address black-holed packets: each batch hangs until the
+// export timeout and fails, the batch queue backs up and the SDK starts
+// dropping spans.
+const otelErrorLogInterval = 10 * time.Second
+
+var (
+	otelErrorLastLog atomic.Int64
+
+	exporterBlackholesMu sync.Mutex
+	exporterBlackholes   = map[string]*atomic.Bool{}
+)
+
+var (
+	otelExportFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "otel_export_failures_total",
+			Help: "Failed telemetry export batches, by signal and exporter",
+		},
+		[]string{"signal", "exporter"},
+	)
+	otelExportedSpans = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "otel_exported_spans_total",
+			Help: "Spans handed to the exporter, by exporter and outcome (ok, failed); failed spans go to the telemetry spool when TELEMETRY_SPOOL_DIR is set and are lost otherwise, and replayed ones count again",
+		},
+		[]string{"exporter", "outcome"},
+	)
+	otelExportDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "otel_export_duration_seconds",
+			Help:    "Duration of span export batches",
+			Buckets: []float64{.005, .01, .05, .1, .5, 1, 5, 10, 30},
+		},
+		[]string{"exporter"},
+	)
+	otelExporterUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "otel_exporter_up",
+			Help: "1 if the exporter's last batch was delivered",
+		},
+		[]string{"exporter"},
+	)
+	otelExporterLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "otel_exporter_last_success_timestamp_seconds",
+			Help: "Unix time of the exporter's last delivered batch",
+		},
+		[]string{"exporter"},
+	)
+	otelErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "otel_sdk_errors_total",
+		Help: "Errors reported to the OpenTelemetry global error handler",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(otelExportFailures, otelExportedSpans, otelExportDuration, otelExporterUp, otelExporterLastSuccess, otelErrors)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(handleOTelError))
+}
+
+func handleOTelError(err error) {
+	otelErrors.Inc()
+	now := time.Now().UnixNano()
+	last := otelErrorLastLog.Load()
+	if now-last < int64(otelErrorLogInterval) || !otelErrorLastLog.CompareAndSwap(last, now) {
+		return
+	}
+	slog.Error("OpenTelemetry error, telemetry may be dropped", "error", err)
+}
+
+var errExporterBlackhole = errors.New("export timed out: collector unreachable (blackhole chaos)")
+
+// monitoredExporter measures every export batch of the exporter it wraps.
+type monitoredExporter struct {
+	sdktrace.SpanExporter
+	name      string
+	blackhole *atomic.Bool
+}
+
+func newMonitoredExporter(name string, exporter sdktrace.SpanExporter) monitoredExporter {
+	otelExportFailures.WithLabelValues("traces", name)
+	otelExportedSpans.WithLabelValues(name, "ok")
+	otelExportedSpans.WithLabelValues(name, "failed")
+	otelExporterUp.WithLabelValues(name).Set(1)
+	blackhole := &atomic.Bool{}
+	blackhole.Store(cfg.ExporterBlackhole)
+	exporterBlackholesMu.Lock()
+	exporterBlackholes[name] = blackhole
+	exporterBlackholesMu.Unlock()
+	return monitoredExporter{SpanExporter: exporter, name: name, blackhole: blackhole}
+}
+
+func (e monitoredExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	start := time.Now()
+	var err error
+	if e.blackhole.Load() {
+		err = blackhole(ctx)
+	} else {
+		err = e.SpanExporter.ExportSpans(ctx, spans)
+	}
+	otelExportDuration.WithLabelValues(e.name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		otelExportFailures.WithLabelValues("traces", e.name).Inc()
+		otelExportedSpans.WithLabelValues(e.name, "failed").Add(float64(len(spans)))
+		otelExporterUp.WithLabelValues(e.name).Set(0)
+		return err
+	}
+	otelExportedSpans.WithLabelValues(e.name, "ok").Add(float64(len(spans)))
+	otelExporterUp.WithLabelValues(e.name).Set(1)
+	otelExporterLastSuccess.WithLabelValues(e.name).SetToCurrentTime()
+	return nil
+}
+
+// blackhole waits out the export deadline, as a connect to a dropped route
+// would.
+func blackhole(ctx context.Context) error {
+	wait := 10 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		wait = time.Until(deadline)
+	}
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+	}
+	return errExporterBlackhole
+}
+
+// handleAdminExporter reports or sets exporter chaos:
+// {"blackhole": true} for every exporter, or with "exporter": "secondary"
+// for one.
+func handleAdminExporter(w http.ResponseWriter, r *http.Request) {
+	exporterBlackholesMu.Lock()
+	defer exporterBlackholesMu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Exporter  string `json:"exporter"`
+			Blackhole *bool  `json:"blackhole"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := exporterBlackholes[req.Exporter]; req.Exporter != "" && !ok {
+			writeProblem(w, r, "unknown exporter "+req.Exporter, http.StatusBadRequest)
+			return
+		}
+		if req.Blackhole != nil {
+			for name, blackhole := range exporterBlackholes {
+				if req.Exporter == "" || req.Exporter == name {
+					blackhole.Store(*req.Blackhole)
+				}
+			}
+		}
+		defer func() { slog.Warn("Admin: exporter chaos updated", "blackhole", exporterBlackholeModes()) }()
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"blackhole": exporterBlackholeModes(),
+	})
+}
+
+// exporterBlackholeModes reports blackhole chaos per exporter; callers hold
+// exporterBlackholesMu.
+func exporterBlackholeModes() map[string]bool {
+	modes := map[string]bool{}
+	for name, blackhole := range exporterBlackholes {
+		modes[name] = blackhole.Load()
+	}
+	return modes
+}
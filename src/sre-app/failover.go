@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	downstreamActiveBackend = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "downstream_active_backend",
+			Help: "1 for the downstream backend currently preferred by the failover client",
+		},
+		[]string{"backend"},
+	)
+	downstreamFailoversTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "downstream_failovers_total",
+			Help: "Total number of failover client switches between backends",
+		},
+		[]string{"from", "to"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(downstreamActiveBackend)
+	prometheus.MustRegister(downstreamFailoversTotal)
+}
+
+// failoverClient prefers the primary downstream and moves to the secondary
+// after threshold consecutive failures. While on the secondary it lets one
+// probe request through to the primary every cooldown, failing back as soon
+// as a probe succeeds.
+type failoverClient struct {
+	mu        sync.Mutex
+	urls      map[string]string
+	threshold int
+	cooldown  time.Duration
+
+	active       string
+	failures     int
+	lastProbeAt  time.Time
+	probeRunning bool
+}
+
+func newFailoverClient(primary, secondary string, threshold int, cooldown time.Duration) *failoverClient {
+	f := &failoverClient{
+		urls:      map[string]string{"primary": primary, "secondary": secondary},
+		threshold: threshold,
+		cooldown:  cooldown,
+		active:    "primary",
+	}
+	f.exportActive()
+	return f
+}
+
+// pick returns the backend name and URL for the next call.
+func (f *failoverClient) pick() (string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.active == "secondary" && !f.probeRunning && time.Since(f.lastProbeAt) >= f.cooldown {
+		f.probeRunning = true
+		f.lastProbeAt = time.Now()
+		return "primary", f.urls["primary"]
+	}
+	return f.active, f.urls[f.active]
+}
+
+// report feeds the outcome of a call made to backend back into the state machine.
+func (f *failoverClient) report(backend string, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if backend == "primary" && f.active == "secondary" {
+		f.probeRunning = false
+		if ok {
+			f.switchTo("primary")
+		}
+		return
+	}
+	if backend != f.active {
+		return
+	}
+	if ok {
+		f.failures = 0
+		return
+	}
+
+	f.failures++
+	if f.active == "primary" && f.urls["secondary"] != "" && f.failures >= f.threshold {
+		f.lastProbeAt = time.Now()
+		f.switchTo("secondary")
+	}
+}
+
+// abandon returns a pick for backend that was never sent, so a probe that
+// did not run does not hold up the next one.
+func (f *failoverClient) abandon(backend string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if backend == "primary" && f.active == "secondary" {
+		f.probeRunning = false
+		f.lastProbeAt = time.Time{}
+	}
+}
+
+func (f *failoverClient) switchTo(backend string) {
+	log.Printf("Downstream failover: %s -> %s (consecutive failures: %d)", f.active, backend, f.failures)
+	downstreamFailoversTotal.WithLabelValues(f.active, backend).Inc()
+	f.active = backend
+	f.failures = 0
+	f.exportActive()
+}
+
+func (f *failoverClient) exportActive() {
+	for _, backend := range []string{"primary", "secondary"} {
+		v := 0.0
+		if backend == f.active {
+			v = 1
+		}
+		downstreamActiveBackend.WithLabelValues(backend).Set(v)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// File descriptor exhaustion. /admin/chaos/fds opens and holds descriptors,
+// {"kind": "files", "count": 5000} (/dev/null) or {"kind": "sockets", ...}
+// (loopback connections, two descriptors each), up to FD_CHAOS_MAX in total
+// (default 20000). Near the process limit the app starts failing the way
+// real leaks make it fail: "too many open files" on accept, outbound dials
+// and file opens, while CPU and memory look fine. {"release": true} closes
+// them all.
+//
+// The default registry already exports process_open_fds and
+// process_max_fds; the alert to teach is the ratio, not the count:
+//
+//	process_open_fds / process_max_fds > 0.8
+var (
+	fdChaosMu    sync.Mutex
+	fdChaosHeld  = map[string][]io.Closer{}
+	fdChaosPeers net.Listener // accepts the socket kind's connections
+
+	// The accepted ends, under their own lock so accepting never waits
+	// for holdFDs.
+	fdChaosPeerMu    sync.Mutex
+	fdChaosPeerConns []net.Conn
+
+	fdChaosHeldGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "fd_chaos_held",
+			Help: "Descriptors held open by FD chaos, by kind (files, sockets)",
+		},
+		[]string{"kind"},
+	)
+	fdChaosOpenErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "fd_chaos_open_errors_total",
+			Help: "Descriptors FD chaos failed to open, by reason (emfile, other)",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(fdChaosHeldGauge, fdChaosOpenErrors)
+	for _, kind := range []string{"files", "sockets"} {
+		fdChaosHeldGauge.WithLabelValues(kind)
+	}
+}
+
+// fdHeld counts held descriptors; fdChaosMu must be held.
+func fdHeld() int {
+	return len(fdChaosHeld["files"]) + 2*len(fdChaosHeld["sockets"])
+}
+
+// openFD opens one descriptor of kind: a file or a connected socket pair.
+func openFD(kind string) (io.Closer, error) {
+	if kind == "files" {
+		return os.Open(os.DevNull)
+	}
+	if fdChaosPeers == nil {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		fdChaosPeers = ln
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					continue
+				}
+				fdChaosPeerMu.Lock()
+				fdChaosPeerConns = append(fdChaosPeerConns, conn)
+				fdChaosPeerMu.Unlock()
+			}
+		}()
+	}
+	return net.Dial("tcp", fdChaosPeers.Addr().String())
+}
+
+// holdFDs opens up to n more descriptors of kind and returns how many it
+// opened and the error that stopped it early.
+func holdFDs(kind string, n int) (int, error) {
+	fdChaosMu.Lock()
+	defer fdChaosMu.Unlock()
+	defer func() { fdChaosHeldGauge.WithLabelValues(kind).Set(float64(len(fdChaosHeld[kind]))) }()
+	opened := 0
+	for ; opened < n; opened++ {
+		c, err := openFD(kind)
+		if err != nil {
+			reason := "other"
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				reason = "emfile"
+			}
+			fdChaosOpenErrors.WithLabelValues(reason).Inc()
+			return opened, err
+		}
+		fdChaosHeld[kind] = append(fdChaosHeld[kind], c)
+	}
+	return opened, nil
+}
+
+// releaseFDs closes every held descriptor.
+func releaseFDs() {
+	fdChaosMu.Lock()
+	defer fdChaosMu.Unlock()
+	for kind, held := range fdChaosHeld {
+		for _, c := range held {
+			c.Close()
+		}
+		delete(fdChaosHeld, kind)
+	}
+	fdChaosPeerMu.Lock()
+	for _, c := range fdChaosPeerConns {
+		c.Close()
+	}
+	fdChaosPeerConns = nil
+	fdChaosPeerMu.Unlock()
+	for _, kind := range []string{"files", "sockets"} {
+		fdChaosHeldGauge.WithLabelValues(kind).Set(0)
+	}
+}
+
+func handleAdminFDs(w http.ResponseWriter, r *http.Request) {
+	var opened int
+	var openErr error
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Kind    string `json:"kind"`
+			Count   int    `json:"count"`
+			Release bool   `json:"release"`
+		}{Kind: "files"}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Kind != "files" && req.Kind != "sockets" {
+			writeProblem(w, r, "kind must be files or sockets", http.StatusBadRequest)
+			return
+		}
+		if req.Release {
+			releaseFDs()
+		}
+		if req.Count > 0 {
+			fdChaosMu.Lock()
+			room := cfg.FDChaosMax - fdHeld()
+			fdChaosMu.Unlock()
+			per := 1
+			if req.Kind == "sockets" {
+				per = 2
+			}
+			if req.Count*per > room {
+				writeProblem(w, r, fmt.Sprintf("count would exceed FD_CHAOS_MAX: room for %d more descriptors", room), http.StatusBadRequest)
+				return
+			}
+			opened, openErr = holdFDs(req.Kind, req.Count)
+		}
+		slog.Warn("Admin: FD chaos updated", "kind", req.Kind, "opened", opened, "released", req.Release, "error", openErr)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fdChaosMu.Lock()
+	report := map[string]any{
+		"files":   len(fdChaosHeld["files"]),
+		"sockets": len(fdChaosHeld["sockets"]),
+		"held":    fdHeld(),
+		"max":     cfg.FDChaosMax,
+	}
+	fdChaosMu.Unlock()
+	if r.Method != http.MethodGet {
+		report["opened"] = opened
+	}
+	if openErr != nil {
+		report["error"] = openErr.Error()
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Durable-write workload. Requests to FSYNC_ROUTES (","-separated, default
+// none) append FSYNC_BYTES (default 4096) to a write-ahead log in
+// DISK_CHAOS_DIR and fsync it before the handler runs, in a "disk.fsync"
+// span with the write, the wait for the log and the fsync as separate
+// timings, so slow storage shows up in traces as its own phase rather than
+// as handler time. The log is shared and appended under a lock, like a
+// database without group commit: one slow fsync queues every request behind
+// it. It is truncated past 64 MiB.
+//
+// FSYNC_SLOWDOWN (or /admin/chaos/fsync) is a slow-disk multiplier: each
+// fsync is stretched to that many times its real duration, counted from at
+// least 1ms since an emptyDir on a fast node syncs in microseconds.
+const fsyncLogMax = 64 << 20
+
+var (
+	fsyncRoutes   atomic.Pointer[[]string]
+	fsyncBytes    atomic.Int64
+	fsyncSlowdown atomic.Int64 // 0 and 1 both mean real speed
+
+	fsyncMu   sync.Mutex
+	fsyncFile *os.File
+	fsyncSize int64
+
+	diskOpDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "disk_operation_duration_seconds",
+			Help:    "Durable-write workload phases by operation (wait, write, fsync)",
+			Buckets: []float64{.0001, .0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		},
+		[]string{"operation"},
+	)
+	diskWorkloadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "disk_workload_errors_total",
+		Help: "Durable writes that failed to open, write or fsync the log",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(diskOpDuration, diskWorkloadErrors)
+	routes := splitRoutes(os.Getenv("FSYNC_ROUTES"))
+	fsyncRoutes.Store(&routes)
+	fsyncBytes.Store(int64(cfg.FsyncBytes))
+	fsyncSlowdown.Store(int64(cfg.FsyncSlowdown))
+}
+
+func splitRoutes(spec string) []string {
+	routes := []string{}
+	for _, route := range strings.Split(spec, ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// durableWrite runs the workload for route, if it is one of FSYNC_ROUTES.
+func durableWrite(ctx context.Context, route string) {
+	if !slices.Contains(*fsyncRoutes.Load(), route) {
+		return
+	}
+	ctx, span := tracer.Start(ctx, "disk.fsync")
+	defer span.End()
+
+	start := time.Now()
+	fsyncMu.Lock()
+	defer fsyncMu.Unlock()
+	wait := time.Since(start)
+	diskOpDuration.WithLabelValues("wait").Observe(wait.Seconds())
+
+	err := func() error {
+		if fsyncFile == nil || fsyncSize > fsyncLogMax {
+			if fsyncFile != nil {
+				fsyncFile.Close()
+			}
+			f, err := os.Create(filepath.Join(diskChaosDir, fmt.Sprintf("sre-app-wal-%d.log", os.Getpid())))
+			if err != nil {
+				return err
+			}
+			fsyncFile, fsyncSize = f, 0
+		}
+		written := time.Now()
+		n, err := fsyncFile.Write(make([]byte, fsyncBytes.Load()))
+		fsyncSize += int64(n)
+		diskOpDuration.WithLabelValues("write").Observe(time.Since(written).Seconds())
+		if err != nil {
+			return err
+		}
+
+		synced := time.Now()
+		err = fsyncFile.Sync()
+		took := time.Since(synced)
+		if slowdown := fsyncSlowdown.Load(); slowdown > 1 {
+			stretched := time.Duration(slowdown) * max(took, time.Millisecond)
+			noteChaos(ctx, "fsync: slowed %dx", slowdown)
+			time.Sleep(stretched - took)
+			took = stretched
+		}
+		diskOpDuration.WithLabelValues("fsync").Observe(took.Seconds())
+		span.SetAttributes(attribute.Float64("app.disk.fsync_ms", float64(took.Microseconds())/1000))
+		return err
+	}()
+	span.SetAttributes(
+		attribute.Float64("app.disk.wait_ms", float64(wait.Microseconds())/1000),
+		attribute.Int64("app.disk.bytes", fsyncBytes.Load()),
+	)
+	if err != nil {
+		diskWorkloadErrors.Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// handleAdminFsync reports or sets the workload:
+// {"routes": "/checkout", "bytes": 16384, "slowdown": 50}.
+func handleAdminFsync(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Routes   *string `json:"routes"`
+			Bytes    *int64  `json:"bytes"`
+			Slowdown *int64  `json:"slowdown"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Routes != nil {
+			routes := splitRoutes(*req.Routes)
+			fsyncRoutes.Store(&routes)
+		}
+		if req.Bytes != nil && *req.Bytes > 0 && *req.Bytes <= 1<<20 {
+			fsyncBytes.Store(*req.Bytes)
+		}
+		if req.Slowdown != nil && *req.Slowdown >= 0 {
+			fsyncSlowdown.Store(*req.Slowdown)
+		}
+		slog.Warn("Admin: fsync workload updated", "routes", *fsyncRoutes.Load(), "bytes", fsyncBytes.Load(), "slowdown", fsyncSlowdown.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"routes":   *fsyncRoutes.Load(),
+		"bytes":    fsyncBytes.Load(),
+		"slowdown": fsyncSlowdown.Load(),
+	})
+}
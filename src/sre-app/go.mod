@@ -9,4 +9,7 @@ require (
 	go.opentelemetry.io/otel/sdk v1.24.0
 	go.opentelemetry.io/otel/trace v1.24.0
 	github.com/prometheus/client_golang v1.19.0
+	github.com/prometheus/client_model v0.5.0
+	google.golang.org/grpc v1.61.1
+	google.golang.org/protobuf v1.32.0
 )
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Grafana annotations. With GRAFANA_URL (e.g. http://grafana.observability)
+// and a service account token in GRAFANA_API_TOKEN (or GRAFANA_API_TOKEN_FILE),
+// the app marks its own events on every dashboard through the annotations
+// HTTP API, tagged "sre-app" and with the pod name so a panel can filter on
+// them: pod starts (tag "deploy") and every successful change made through
+// /admin (tag "chaos" for /admin/chaos/*, "config" otherwise, plus the
+// endpoint's name), so injected faults line up with the graphs they bend.
+// Without GRAFANA_URL annotating is a no-op.
+var (
+	grafanaURL        = strings.TrimRight(os.Getenv("GRAFANA_URL"), "/")
+	grafanaHTTPClient = &http.Client{
+		Transport: otelhttp.NewTransport(http.DefaultTransport),
+		Timeout:   5 * time.Second,
+	}
+
+	grafanaAnnotationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grafana_annotations_total",
+			Help: "Annotations sent to Grafana, by outcome (ok, failed)",
+		},
+		[]string{"outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(grafanaAnnotationsTotal)
+}
+
+// annotateGrafana creates an annotation at now and returns its ID, or 0
+// when annotations are off.
+func annotateGrafana(ctx context.Context, text string, tags ...string) (int64, error) {
+	if grafanaURL == "" {
+		return 0, nil
+	}
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	err := grafanaRequest(ctx, http.MethodPost, "/api/annotations", map[string]any{
+		"time": time.Now().UnixMilli(),
+		"tags": append([]string{"sre-app", podName()}, tags...),
+		"text": text,
+	}, &created)
+	return created.ID, err
+}
+
+// endGrafanaAnnotation turns annotation id into a region ending now.
+func endGrafanaAnnotation(ctx context.Context, id int64) error {
+	if grafanaURL == "" || id == 0 {
+		return nil
+	}
+	return grafanaRequest(ctx, http.MethodPatch, "/api/annotations/"+strconv.FormatInt(id, 10),
+		map[string]any{"timeEnd": time.Now().UnixMilli()}, nil)
+}
+
+// annotateStartup marks the pod coming up.
+func annotateStartup() {
+	go func() {
+		if _, err := annotateGrafana(context.Background(), "Pod "+podName()+" started", "deploy"); err != nil {
+			slog.Warn("Grafana annotation failed", "error", err)
+		}
+	}()
+}
+
+func grafanaRequest(ctx context.Context, method, endpoint string, body, out any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, grafanaURL+endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := grafanaToken.get(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := grafanaHTTPClient.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			err = fmt.Errorf("grafana %s %s: %s: %s", method, endpoint, resp.Status, bytes.TrimSpace(msg))
+		} else if out != nil {
+			err = json.NewDecoder(resp.Body).Decode(out)
+		}
+	}
+	if err != nil {
+		grafanaAnnotationsTotal.WithLabelValues("failed").Inc()
+		return err
+	}
+	grafanaAnnotationsTotal.WithLabelValues("ok").Inc()
+	return nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// gRPC order status service on GRPC_PORT (default 9090, 0 disables), using
+// well-known protobuf types so clients need no generated code:
+//
+//	sreapp.orders.v1.OrderStatus/Get    unary: Int64Value order ID -> Struct
+//	sreapp.orders.v1.OrderStatus/Watch  server streaming: Int64Value order ID
+//	                                    (0: every order) -> Struct per status
+//	                                    change from the lifecycle events in
+//	                                    orderevents.go
+//
+// Each Watch stream has a buffer of GRPC_STREAM_BUFFER updates (default 64)
+// between the event workers and the stream. Sending blocks once HTTP/2 flow
+// control runs out of window, i.e. the client reads slower than updates
+// arrive; the buffer then fills and further updates for that stream are
+// dropped rather than stalling the workers. grpc_stream_send_duration_seconds
+// shows the time spent blocked and grpc_stream_buffered_messages the backlog.
+// GRPC_SLOW_CONSUMER_MS stalls every stream that long per update, the slow
+// consumer without needing a slow client; /admin/chaos/grpc changes it at
+// runtime.
+const orderStatusService = "sreapp.orders.v1.OrderStatus"
+
+type orderWatcher struct {
+	orderID int64 // 0 watches every order
+	updates chan orderEvent
+}
+
+var (
+	grpcSlowConsumerMs atomic.Int64
+
+	orderWatchersMu sync.Mutex
+	orderWatchers   = map[*orderWatcher]struct{}{}
+
+	grpcHandled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_server_handled_total",
+			Help: "gRPC calls completed, by method and status code",
+		},
+		[]string{"grpc_method", "grpc_code"},
+	)
+	grpcStreamsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grpc_server_streams_active",
+		Help: "Open server-streaming calls",
+	})
+	grpcStreamMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_stream_messages_total",
+			Help: "Stream updates by outcome (sent, dropped: the stream's buffer was full)",
+		},
+		[]string{"grpc_method", "outcome"},
+	)
+	grpcStreamSend = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "grpc_stream_send_duration_seconds",
+		Help:    "Time a stream spent sending one update, including waiting for flow-control window",
+		Buckets: []float64{.0001, .001, .01, .05, .1, .5, 1, 5},
+	})
+	grpcStreamBuffered = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "grpc_stream_buffered_messages",
+		Help: "Updates waiting in stream buffers, over all open streams",
+	}, func() float64 {
+		orderWatchersMu.Lock()
+		defer orderWatchersMu.Unlock()
+		n := 0
+		for w := range orderWatchers {
+			n += len(w.updates)
+		}
+		return float64(n)
+	})
+)
+
+func init() {
+	prometheus.MustRegister(grpcHandled, grpcStreamsActive, grpcStreamMessages, grpcStreamSend, grpcStreamBuffered)
+	grpcSlowConsumerMs.Store(int64(cfg.GRPCSlowConsumerMs))
+}
+
+type orderStatusServer interface {
+	get(context.Context, *wrapperspb.Int64Value) (*structpb.Struct, error)
+	watch(*wrapperspb.Int64Value, grpc.ServerStream) error
+}
+
+var orderStatusDesc = grpc.ServiceDesc{
+	ServiceName: orderStatusService,
+	HandlerType: (*orderStatusServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Get",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			in := new(wrapperspb.Int64Value)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req any) (any, error) {
+				return srv.(orderStatusServer).get(ctx, req.(*wrapperspb.Int64Value))
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + orderStatusService + "/Get"}, handler)
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Watch",
+		ServerStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			in := new(wrapperspb.Int64Value)
+			if err := stream.RecvMsg(in); err != nil {
+				return err
+			}
+			return srv.(orderStatusServer).watch(in, stream)
+		},
+	}},
+}
+
+type orderStatusImpl struct{}
+
+func (orderStatusImpl) get(_ context.Context, req *wrapperspb.Int64Value) (*structpb.Struct, error) {
+	orderEventMu.Lock()
+	seq, ok := orderEventLast[req.GetValue()]
+	orderEventMu.Unlock()
+	if !ok {
+		return nil, status.Errorf(grpccodes.NotFound, "order %d has no status yet", req.GetValue())
+	}
+	return orderStatusMessage(orderEvent{OrderID: req.GetValue(), Seq: seq, Type: orderEventTypes[seq-1]})
+}
+
+func (orderStatusImpl) watch(req *wrapperspb.Int64Value, stream grpc.ServerStream) error {
+	w := &orderWatcher{orderID: req.GetValue(), updates: make(chan orderEvent, cfg.GRPCStreamBuffer)}
+	orderWatchersMu.Lock()
+	orderWatchers[w] = struct{}{}
+	orderWatchersMu.Unlock()
+	grpcStreamsActive.Inc()
+	defer func() {
+		orderWatchersMu.Lock()
+		delete(orderWatchers, w)
+		orderWatchersMu.Unlock()
+		grpcStreamsActive.Dec()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case ev := <-w.updates:
+			if ms := grpcSlowConsumerMs.Load(); ms > 0 {
+				time.Sleep(time.Duration(ms) * time.Millisecond)
+			}
+			msg, err := orderStatusMessage(ev)
+			if err != nil {
+				return status.Error(grpccodes.Internal, err.Error())
+			}
+			start := time.Now()
+			if err := stream.SendMsg(msg); err != nil {
+				return err
+			}
+			grpcStreamSend.Observe(time.Since(start).Seconds())
+			grpcStreamMessages.WithLabelValues("Watch", "sent").Inc()
+			if w.orderID != 0 && ev.Seq == len(orderEventTypes) {
+				return nil // the watched order is delivered
+			}
+		}
+	}
+}
+
+func orderStatusMessage(ev orderEvent) (*structpb.Struct, error) {
+	return structpb.NewStruct(map[string]any{
+		"order_id": strconv.FormatInt(ev.OrderID, 10),
+		"status":   ev.Type,
+		"seq":      ev.Seq,
+	})
+}
+
+// broadcastOrderStatus hands an applied event to the streams watching it
+// without ever blocking the event worker.
+func broadcastOrderStatus(ev orderEvent) {
+	orderWatchersMu.Lock()
+	defer orderWatchersMu.Unlock()
+	for w := range orderWatchers {
+		if w.orderID != 0 && w.orderID != ev.OrderID {
+			continue
+		}
+		select {
+		case w.updates <- ev:
+		default:
+			grpcStreamMessages.WithLabelValues("Watch", "dropped").Inc()
+		}
+	}
+}
+
+// grpcMetadataCarrier reads trace context from incoming metadata.
+type grpcMetadataCarrier metadata.MD
+
+func (c grpcMetadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+func (c grpcMetadataCarrier) Set(key, value string) { metadata.MD(c).Set(key, value) }
+func (c grpcMetadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// grpcServerSpan starts the server span for a call, continuing the caller's
+// trace, and returns the bare method name.
+func grpcServerSpan(ctx context.Context, fullMethod string) (context.Context, trace.Span, string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, grpcMetadataCarrier(md))
+	service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	ctx, span := tracer.Start(ctx, service+"/"+method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		semconv.RPCSystemGRPC,
+		semconv.RPCService(service),
+		semconv.RPCMethod(method),
+	))
+	return ctx, span, method
+}
+
+func endGRPCSpan(span trace.Span, method string, err error) {
+	code := status.Code(err)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	grpcHandled.WithLabelValues(method, code.String()).Inc()
+}
+
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s tracedServerStream) Context() context.Context { return s.ctx }
+
+func startGRPCServer() {
+	if cfg.GRPCPort == 0 {
+		return
+	}
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, span, method := grpcServerSpan(ctx, info.FullMethod)
+			resp, err := handler(ctx, req)
+			endGRPCSpan(span, method, err)
+			return resp, err
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, span, method := grpcServerSpan(ss.Context(), info.FullMethod)
+			span.SetAttributes(attribute.Bool("app.grpc.server_streaming", info.IsServerStream))
+			err := handler(srv, tracedServerStream{ss, ctx})
+			endGRPCSpan(span, method, err)
+			return err
+		}),
+	)
+	srv.RegisterService(&orderStatusDesc, orderStatusImpl{})
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(cfg.GRPCPort))
+	if err != nil {
+		slog.Error("gRPC server failed to listen", "port", cfg.GRPCPort, "error", err)
+		return
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			slog.Error("gRPC server stopped", "error", err)
+		}
+	}()
+	slog.Info("gRPC server listening", "port", cfg.GRPCPort, "service", orderStatusService)
+}
+
+func handleAdminGRPC(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			SlowConsumerMs *int64 `json:"slow_consumer_ms"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.SlowConsumerMs != nil {
+			if *req.SlowConsumerMs < 0 || *req.SlowConsumerMs > maxMs {
+				writeProblem(w, r, "slow_consumer_ms must be 0-86400000", http.StatusBadRequest)
+				return
+			}
+			grpcSlowConsumerMs.Store(*req.SlowConsumerMs)
+		}
+		slog.Warn("Admin: gRPC stream chaos updated", "slow_consumer_ms", grpcSlowConsumerMs.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	orderWatchersMu.Lock()
+	streams := len(orderWatchers)
+	orderWatchersMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"slow_consumer_ms": grpcSlowConsumerMs.Load(),
+		"stream_buffer":    cfg.GRPCStreamBuffer,
+		"active_streams":   streams,
+	})
+}
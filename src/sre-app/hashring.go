@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sticky routing for LB_STRATEGY=hash. The routing key is X-Session-ID,
+// then X-Tenant-ID, then the "session" cookie; requests without one fall
+// back to round-robin. Keys map to backends on a consistent-hash ring with
+// LB_HASH_VNODES virtual nodes per backend (default 100), so changing the
+// backend set through /admin/lb only moves the keys owned by the changed
+// backends, and a heavy tenant stays pinned to (and overloads) one replica.
+type routingKeyKey struct{}
+
+type ringPoint struct {
+	hash    uint32
+	backend *lbBackend
+}
+
+var lbHashVnodes = 100
+
+var (
+	lbRingChanges = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "downstream_lb_ring_changes_total",
+		Help: "Changes to the load-balanced backend set",
+	})
+	lbRebalanceMovedRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "downstream_lb_rebalance_moved_ratio",
+		Help: "Share of recently seen routing keys that changed backend at the last ring change",
+	})
+	lbStickyMoves = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "downstream_lb_sticky_moves_total",
+			Help: "Calls whose routing key landed on a different backend than last time",
+		},
+		[]string{"from", "to"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(lbRingChanges, lbRebalanceMovedRatio, lbStickyMoves)
+	lbHashVnodes = cfg.LBHashVnodes
+}
+
+func routingKey(r *http.Request) string {
+	if v := r.Header.Get("X-Session-ID"); v != "" {
+		return v
+	}
+	if v := r.Header.Get("X-Tenant-ID"); v != "" {
+		return v
+	}
+	if c, err := r.Cookie("session"); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+func withRoutingKey(ctx context.Context, r *http.Request) context.Context {
+	if key := routingKey(r); key != "" {
+		return context.WithValue(ctx, routingKeyKey{}, key)
+	}
+	return ctx
+}
+
+// hashKey is FNV-1a with murmur3's finaliser: plain FNV clusters keys that
+// differ only in their last bytes ("s1", "s2", "host#1"), which skews the ring.
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// buildRing rebuilds the ring from b.backends; callers hold b.mu.
+func (b *balancer) buildRing() {
+	b.ring = b.ring[:0]
+	for _, be := range b.backends {
+		for i := 0; i < lbHashVnodes; i++ {
+			b.ring = append(b.ring, ringPoint{hashKey(be.url + "#" + strconv.Itoa(i)), be})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+}
+
+// lookup returns the backend owning key; callers hold b.mu.
+func (b *balancer) lookup(key string) *lbBackend {
+	h := hashKey(key)
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	if i == len(b.ring) {
+		i = 0
+	}
+	return b.ring[i].backend
+}
+
+// remember records key's backend and counts a sticky move when it changed;
+// callers hold b.mu.
+func (b *balancer) remember(key string, be *lbBackend) {
+	if prev, ok := b.assignments[key]; ok && prev != be.name {
+		lbStickyMoves.WithLabelValues(prev, be.name).Inc()
+	}
+	if len(b.assignments) >= 10000 {
+		b.assignments = map[string]string{}
+	}
+	b.assignments[key] = be.name
+}
+
+// setBackends swaps the backend set, keeping stats for URLs that stay, and
+// reports how many remembered keys the new ring moves.
+func (b *balancer) setBackends(urls []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	existing := map[string]*lbBackend{}
+	for _, be := range b.backends {
+		existing[be.url] = be
+	}
+	var next []*lbBackend
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%q is not an absolute URL", raw)
+		}
+		be, ok := existing[raw]
+		if !ok {
+			be = &lbBackend{name: u.Host, url: raw}
+			lbBackendPending.WithLabelValues(u.Host).Set(0)
+		}
+		next = append(next, be)
+	}
+	b.backends = next
+	b.buildRing()
+
+	moved := 0
+	for key, prev := range b.assignments {
+		if b.lookup(key).name != prev {
+			moved++
+		}
+	}
+	if len(b.assignments) > 0 {
+		lbRebalanceMovedRatio.Set(float64(moved) / float64(len(b.assignments)))
+	}
+	lbRingChanges.Inc()
+	return nil
+}
+
+// handleAdminLB reports the balancer or changes it:
+// {"strategy": "hash"}, {"backends": ["http://a:8080", "http://b:8080"]}.
+func handleAdminLB(w http.ResponseWriter, r *http.Request) {
+	b := downstreamBalancer
+	if b == nil {
+		writeProblem(w, r, "load balancing is off; set DOWNSTREAM_URLS", http.StatusConflict)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Strategy *string  `json:"strategy"`
+			Backends []string `json:"backends"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Strategy != nil {
+			switch *req.Strategy {
+			case "round-robin", "least-pending", "ewma", "hash":
+				b.mu.Lock()
+				b.strategy = *req.Strategy
+				b.mu.Unlock()
+			default:
+				writeProblem(w, r, "strategy must be round-robin, least-pending, ewma or hash", http.StatusBadRequest)
+				return
+			}
+		}
+		if len(req.Backends) > 0 {
+			if err := b.setBackends(req.Backends); err != nil {
+				writeProblem(w, r, "invalid backend: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		slog.Warn("Admin: load balancer updated", "strategy", req.Strategy, "backends", req.Backends)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var backends []map[string]any
+	for _, be := range b.backends {
+		backends = append(backends, map[string]any{"name": be.name, "url": be.url, "pending": be.pending, "ewma_s": be.ewma})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"strategy":     b.strategy,
+		"backends":     backends,
+		"tracked_keys": len(b.assignments),
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Health endpoints. /healthz is liveness and only fails if the process is
+// wedged; /readyz stays 503 while any readiness gate is blocked, listing
+// the reasons so "why isn't it Ready" can be answered with curl.
+var (
+	readiness = &readinessGates{blocked: map[string]string{}}
+
+	appReady = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "app_ready",
+		Help: "1 while the readiness probe is passing",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(appReady)
+	appReady.Set(1)
+}
+
+type readinessGates struct {
+	mu      sync.Mutex
+	blocked map[string]string
+}
+
+// block marks the gate name as failing readiness with a human reason.
+func (g *readinessGates) block(name, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.blocked[name] = reason
+	appReady.Set(0)
+}
+
+func (g *readinessGates) unblock(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.blocked, name)
+	if len(g.blocked) == 0 {
+		appReady.Set(1)
+	}
+}
+
+func (g *readinessGates) status() (bool, map[string]string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make(map[string]string, len(g.blocked))
+	for k, v := range g.blocked {
+		out[k] = v
+	}
+	return len(out) == 0, out
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, blocked := readiness.status()
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]any{"ready": ready, "blocked": blocked})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Request hedging for idempotent downstream GETs. With HEDGING=true a
+// duplicate request is sent if the first hasn't answered after the observed
+// p95 latency (or HEDGE_DELAY_MS when set) and the first successful answer
+// wins; the loser is cancelled.
+var (
+	hedgingEnabled bool
+	hedgeDelayMs   int
+	hedgeLatencies = newLatencyWindow(200)
+
+	downstreamHedgesSentTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "downstream_hedges_sent_total",
+		Help: "Total number of hedged duplicate downstream requests sent",
+	})
+	downstreamHedgesWonTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "downstream_hedges_won_total",
+		Help: "Total number of hedged requests that answered before the original",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(downstreamHedgesSentTotal)
+	prometheus.MustRegister(downstreamHedgesWonTotal)
+}
+
+func loadHedgingConfig() {
+	hedgingEnabled = cfg.Hedging
+	hedgeDelayMs = cfg.HedgeDelayMs
+}
+
+// latencyWindow keeps the most recent downstream latencies for the p95.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, 0, size)}
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+}
+
+// quantile returns false until enough samples exist to trust it.
+func (w *latencyWindow) quantile(q float64) (time.Duration, bool) {
+	w.mu.Lock()
+	sorted := append([]time.Duration(nil), w.samples...)
+	w.mu.Unlock()
+	if len(sorted) < 20 {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(q*float64(len(sorted)-1))], true
+}
+
+func hedgeDelay() (time.Duration, bool) {
+	if hedgeDelayMs > 0 {
+		return time.Duration(hedgeDelayMs) * time.Millisecond, true
+	}
+	return hedgeLatencies.quantile(0.95)
+}
+
+type hedgeResult struct {
+	status int
+	err    error
+	hedged bool
+}
+
+// downstreamGet performs the GET, hedging it when enabled.
+func downstreamGet(ctx context.Context, url string) (int, error) {
+	delay, ok := hedgeDelay()
+	if !hedgingEnabled || !ok {
+		start := time.Now()
+		status, err := doDownstreamGet(ctx, url)
+		if err == nil {
+			hedgeLatencies.add(time.Since(start))
+		}
+		return status, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 2)
+	attempt := func(hedged bool) {
+		start := time.Now()
+		status, err := doDownstreamGet(ctx, url)
+		if err == nil && !hedged {
+			hedgeLatencies.add(time.Since(start))
+		}
+		results <- hedgeResult{status: status, err: err, hedged: hedged}
+	}
+
+	go attempt(false)
+	inFlight := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var last hedgeResult
+	for inFlight > 0 {
+		select {
+		case <-timer.C:
+			downstreamHedgesSentTotal.Inc()
+			trace.SpanFromContext(ctx).AddEvent("hedge_sent")
+			go attempt(true)
+			inFlight++
+		case res := <-results:
+			inFlight--
+			if res.err == nil {
+				if res.hedged {
+					downstreamHedgesWonTotal.Inc()
+				}
+				return res.status, nil
+			}
+			last = res
+		}
+	}
+	return last.status, last.err
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Incident simulation, for game days. POST /admin/incident {"action":
+// "start"} runs a scripted multi-phase failure of the payment dependency,
+// each phase lasting INCIDENT_PHASE_S seconds (default 120) or "phase_s":
+//
+//	dependency_slow   the provider's latency climbs to 1.5s
+//	retries_amplify   it starts declining 40% of charges and the client
+//	                  retries each decline three times
+//	saturation        latency reaches 3s, the payment bulkhead fills and
+//	                  checkouts are rejected
+//	recovery          the provider and client settings are restored
+//
+// The ground-truth timeline is served at /incident/truth. Started with
+// "lock_truth": true, that endpoint answers 423 Locked, and phase changes
+// stay out of the logs, Grafana and chatops, until the exercise ends, so the
+// responders have to work it out from telemetry; {"action": "stop"} skips
+// to recovery. The game master sees everything on GET /admin/incident.
+type incidentPhase struct {
+	name        string
+	description string
+	latencyMs   int64
+	errorRate   int64
+	retries     int64
+}
+
+var incidentPhases = []incidentPhase{
+	{"dependency_slow", "Payment provider latency rises to 1.5s", 1500, 0, 0},
+	{"retries_amplify", "Provider declines 40% of charges; the client retries each decline 3 times", 1500, 40, 3},
+	{"saturation", "Provider latency reaches 3s; the payment bulkhead saturates and checkouts are rejected", 3000, 40, 3},
+}
+
+type incidentEvent struct {
+	Phase       string     `json:"phase"`
+	Description string     `json:"description"`
+	StartedAt   time.Time  `json:"started_at"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+}
+
+var incident struct {
+	sync.Mutex
+	running   bool
+	locked    bool
+	startedAt time.Time
+	endedAt   time.Time
+	timeline  []incidentEvent
+	stop      chan struct{}
+}
+
+var incidentRunning = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "incident_running",
+	Help: "1 while a simulated incident is in progress",
+})
+
+func init() {
+	prometheus.MustRegister(incidentRunning)
+}
+
+func startIncident(phase time.Duration, lock bool) bool {
+	incident.Lock()
+	defer incident.Unlock()
+	if incident.running {
+		return false
+	}
+	incident.running, incident.locked = true, lock
+	incident.startedAt, incident.endedAt = time.Now(), time.Time{}
+	incident.timeline = nil
+	incident.stop = make(chan struct{})
+	incidentRunning.Set(1)
+	slog.Warn("Incident simulation started", "phase_duration", phase, "truth_locked", lock)
+	go runIncident(phase, incident.stop)
+	return true
+}
+
+func runIncident(phase time.Duration, stop chan struct{}) {
+	baseline := incidentPhase{
+		latencyMs: paymentLatencyMs.Load(),
+		errorRate: paymentErrorRate.Load(),
+		retries:   paymentRetries.Load(),
+	}
+	apply := func(p incidentPhase) {
+		paymentLatencyMs.Store(p.latencyMs)
+		paymentErrorRate.Store(p.errorRate)
+		paymentRetries.Store(p.retries)
+	}
+
+phases:
+	for _, p := range incidentPhases {
+		apply(p)
+		enterIncidentPhase(p.name, p.description)
+		select {
+		case <-time.After(phase):
+		case <-stop:
+			break phases
+		}
+	}
+	apply(baseline)
+	enterIncidentPhase("recovery", "Provider latency, error rate and client retries restored")
+	select {
+	case <-time.After(phase):
+	case <-stop:
+	}
+
+	incident.Lock()
+	defer incident.Unlock()
+	now := time.Now()
+	incident.timeline[len(incident.timeline)-1].EndedAt = &now
+	incident.running, incident.endedAt = false, now
+	incidentRunning.Set(0)
+	slog.Warn("Incident simulation ended", "duration", now.Sub(incident.startedAt).Round(time.Second))
+}
+
+func enterIncidentPhase(name, description string) {
+	incident.Lock()
+	now := time.Now()
+	if n := len(incident.timeline); n > 0 {
+		incident.timeline[n-1].EndedAt = &now
+	}
+	incident.timeline = append(incident.timeline, incidentEvent{Phase: name, Description: description, StartedAt: now})
+	locked := incident.locked
+	incident.Unlock()
+	if locked {
+		return
+	}
+	slog.Warn("Incident phase", "phase", name, "description", description)
+	go func() {
+		text := "Incident: " + name + ": " + description
+		if _, err := annotateGrafana(context.Background(), text, "incident", name); err != nil {
+			slog.Warn("Grafana annotation failed", "error", err)
+		}
+		postChatops(context.Background(), "incident", text)
+	}()
+}
+
+// incidentReport describes the current or last exercise.
+func incidentReport() map[string]any {
+	if incident.startedAt.IsZero() {
+		return map[string]any{"status": "none"}
+	}
+	status := "finished"
+	if incident.running {
+		status = "running"
+	}
+	report := map[string]any{
+		"status":       status,
+		"truth_locked": incident.locked && incident.running,
+		"started_at":   incident.startedAt,
+		"timeline":     append([]incidentEvent{}, incident.timeline...),
+	}
+	if !incident.endedAt.IsZero() {
+		report["ended_at"] = incident.endedAt
+	}
+	return report
+}
+
+// handleIncidentTruth serves the ground truth, once it may be told.
+func handleIncidentTruth(w http.ResponseWriter, r *http.Request) {
+	incident.Lock()
+	defer incident.Unlock()
+	if incident.running && incident.locked {
+		writeJSON(w, http.StatusLocked, map[string]any{
+			"status":     "running",
+			"started_at": incident.startedAt,
+			"message":    "the ground truth is locked until the exercise ends",
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, incidentReport())
+}
+
+// handleAdminIncident reports the exercise or drives it:
+// {"action": "start", "phase_s": 60, "lock_truth": true} or {"action": "stop"}.
+func handleAdminIncident(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Action    string `json:"action"`
+			PhaseS    *int   `json:"phase_s"`
+			LockTruth bool   `json:"lock_truth"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch req.Action {
+		case "start":
+			phase := time.Duration(cfg.IncidentPhaseSeconds) * time.Second
+			if req.PhaseS != nil && *req.PhaseS > 0 {
+				phase = time.Duration(*req.PhaseS) * time.Second
+			}
+			if !startIncident(phase, req.LockTruth) {
+				writeProblem(w, r, "an incident is already running", http.StatusConflict)
+				return
+			}
+		case "stop":
+			incident.Lock()
+			if incident.running {
+				select {
+				case <-incident.stop:
+				default:
+					close(incident.stop)
+				}
+			}
+			incident.Unlock()
+			slog.Warn("Admin: incident simulation stopped")
+		default:
+			writeProblem(w, r, `action must be "start" or "stop"`, http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	incident.Lock()
+	defer incident.Unlock()
+	writeJSON(w, http.StatusOK, incidentReport())
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Init phase, for startup-probe demos. Before the app counts as started it
+// runs a few initialization steps, as a real service connects to its
+// dependencies, migrates its schema and warms its caches:
+//
+//	INIT_DURATION_S    how long the steps take in total (default 0)
+//	INIT_FAILURE_RATE  percent chance that one of them, picked at random,
+//	                   fails (default 0)
+//	INIT_FAILURE_MODE  exit (default): log the error and exit 1, the
+//	                   CrashLoopBackOff of a bad migration; hang: the step
+//	                   never returns, the cold dependency that leaves the
+//	                   pod unready until the startup probe gives up on it
+//
+// /startupz fails until the steps are done and is what the startup probe
+// checks; until then the "init" readiness gate also keeps /readyz failing.
+// Every step logs a structured "startup: ..." line and runs in its own span
+// under "startup.init", so a pod that won't become Ready can be triaged from
+// its logs and /readyz alone. Steps with real work, the schema migrations,
+// run it after their share of INIT_DURATION_S.
+type initStep struct {
+	name  string
+	share float64 // of INIT_DURATION_S
+	err   string  // reported when the step fails
+	run   func(context.Context) error
+}
+
+var initSteps = []initStep{
+	{"connect_dependencies", 0.3, "dial tcp 10.96.0.15:5432: connect: connection refused", nil},
+	{"migrate_schema", 0.2, "migration 0004_add_order_created_at_index: canceling statement due to lock timeout", runMigrations},
+	{"warm_cache", 0.5, "cache warm-up: catalog returned 503 Service Unavailable", nil},
+}
+
+var (
+	initMu      sync.Mutex
+	initStarted time.Time
+	initStepNow string
+	initDone    bool
+
+	appStarted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "app_started",
+		Help: "1 once the init phase has completed and /startupz passes",
+	})
+	initDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "app_init_duration_seconds",
+		Help: "Time spent in the init phase so far, or in total once it completed",
+	})
+	initStepDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "app_init_step_duration_seconds",
+			Help: "Time each init step took",
+		},
+		[]string{"step"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(appStarted, initDuration, initStepDuration)
+}
+
+// runInitPhase runs the steps in the background so /startupz, /readyz and
+// /metrics are served while they do.
+func runInitPhase() {
+	initMu.Lock()
+	initStarted = time.Now()
+	initMu.Unlock()
+	readiness.block("init", "init phase running")
+
+	failing := -1
+	if cfg.InitFailureRate > 0 && rand.Intn(100) < cfg.InitFailureRate {
+		failing = rand.Intn(len(initSteps))
+	}
+	slog.Info("startup: init phase started",
+		"steps", len(initSteps),
+		"duration_s", cfg.InitDurationS,
+		"failure_rate", cfg.InitFailureRate,
+		"failure_mode", cfg.InitFailureMode,
+	)
+
+	go func() {
+		ctx, span := tracer.Start(context.Background(), "startup.init")
+		defer span.End()
+		for i, step := range initSteps {
+			if err := runInitStep(ctx, i, step, i == failing); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				span.End() // os.Exit skips the deferred one
+				initFailed(step, err)
+				return
+			}
+		}
+		initMu.Lock()
+		initDone, initStepNow = true, ""
+		took := time.Since(initStarted)
+		initMu.Unlock()
+		initDuration.Set(took.Seconds())
+		appStarted.Set(1)
+		readiness.unblock("init")
+		slog.Info("startup: init phase completed", "took", took.Round(time.Millisecond).String())
+	}()
+}
+
+func runInitStep(ctx context.Context, i int, step initStep, fail bool) error {
+	ctx, span := tracer.Start(ctx, "startup."+step.name)
+	defer span.End()
+	span.SetAttributes(attribute.Int("app.init.step_index", i+1))
+
+	initMu.Lock()
+	initStepNow = step.name
+	initMu.Unlock()
+	readiness.block("init", "init phase running: "+step.name)
+	slog.Info("startup: init step started", "step", step.name, "index", i+1, "of", len(initSteps))
+
+	start := time.Now()
+	time.Sleep(time.Duration(float64(cfg.InitDurationS) * step.share * float64(time.Second)))
+	if fail && cfg.InitFailureMode == "hang" {
+		readiness.block("init", "init phase stuck: "+step.name)
+		for range time.Tick(10 * time.Second) {
+			initDuration.Set(time.Since(initStarted).Seconds())
+			slog.Warn("startup: init step still waiting", "step", step.name, "waiting", time.Since(start).Round(time.Second).String())
+		}
+	}
+	var err error
+	if fail {
+		err = errors.New(step.err)
+	} else if step.run != nil {
+		err = step.run(ctx)
+	}
+	took := time.Since(start)
+	initStepDuration.WithLabelValues(step.name).Set(took.Seconds())
+	initDuration.Add(took.Seconds())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	slog.Info("startup: init step completed", "step", step.name, "took", took.Round(time.Millisecond).String())
+	return nil
+}
+
+func initFailed(step initStep, err error) {
+	msg := "init step " + step.name + " failed: " + err.Error()
+	slog.Error("startup: init step failed, exiting", "step", step.name, "error", err.Error(), "exit_code", 1)
+	os.WriteFile("/dev/termination-log", []byte(msg), 0o644)
+	if tp, ok := otel.GetTracerProvider().(interface{ ForceFlush(context.Context) error }); ok {
+		tp.ForceFlush(context.Background())
+	}
+	os.Exit(1)
+}
+
+// handleStartupz is the startup probe: 503 until the init phase completes.
+func handleStartupz(w http.ResponseWriter, r *http.Request) {
+	initMu.Lock()
+	defer initMu.Unlock()
+	if initDone {
+		writeJSON(w, http.StatusOK, map[string]any{"started": true})
+		return
+	}
+	writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+		"started":   false,
+		"step":      initStepNow,
+		"elapsed_s": int(time.Since(initStarted).Seconds()),
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Long-running jobs. POST /jobs ({"steps": 10, "step_ms": 200}, both optional)
+// queues a job and answers 202 with its ID; GET /jobs/{id} reports status and
+// progress. Jobs run on a worker pool of JOB_WORKERS (default 4) fed by a
+// queue of JOB_QUEUE_SIZE (default 100). Each run is its own trace, linked to
+// the submitting request, with a span event per progress step; ERROR_RATE
+// applies once per job. Finished jobs are kept for JOB_RETENTION_S (default 600).
+// steps is at most maxJobSteps and step_ms at most maxJobStepMs, so one job
+// holds a worker for under 17 minutes.
+const (
+	maxJobSteps  = 1000
+	maxJobStepMs = 1000
+)
+
+type job struct {
+	ID         string    `json:"id"`
+	State      string    `json:"state"`
+	Progress   float64   `json:"progress"`
+	Steps      int       `json:"steps"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	StartedAt  time.Time `json:"started_at,omitzero"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+
+	stepDelay time.Duration
+	submitter trace.SpanContext
+}
+
+var (
+	jobPool      *workerPool
+	jobRetention = 10 * time.Minute
+	jobSeq       atomic.Int64
+
+	jobsMu sync.Mutex
+	jobs   = map[string]*job{}
+)
+
+var (
+	jobsSubmitted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "jobs_submitted_total",
+			Help: "Job submissions by outcome (accepted, rejected)",
+		},
+		[]string{"outcome"},
+	)
+	jobsCompleted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "jobs_completed_total",
+			Help: "Finished jobs by outcome (succeeded, failed)",
+		},
+		[]string{"outcome"},
+	)
+	jobTimeToComplete = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "job_time_to_complete_seconds",
+			Help:    "Time from submission to a job finishing, including queue wait",
+			Buckets: []float64{.5, 1, 2, 5, 10, 20, 30, 60, 120, 300},
+		},
+		[]string{"outcome"},
+	)
+	jobQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "job_queue_wait_seconds",
+		Help:    "Time a job waited for a free worker",
+		Buckets: []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60},
+	})
+	jobsByState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "jobs",
+			Help: "Retained jobs by state",
+		},
+		[]string{"state"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(jobsSubmitted, jobsCompleted, jobTimeToComplete, jobQueueWait, jobsByState)
+}
+
+func startJobs() {
+	jobRetention = time.Duration(cfg.JobRetentionS) * time.Second
+	jobPool = newWorkerPool("jobs", cfg.JobWorkers, cfg.JobQueueSize)
+}
+
+// handleJobs accepts job submissions.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	_, span := tracer.Start(r.Context(), "handleJobs")
+	defer span.End()
+
+	status := http.StatusAccepted
+	defer func() {
+		httpRequestsTotal.WithLabelValues("/jobs", strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues("/jobs").Observe(time.Since(start).Seconds())
+	}()
+
+	if r.Method != http.MethodPost {
+		status = http.StatusMethodNotAllowed
+		w.Header().Set("Allow", "POST")
+		writeProblem(w, r, "method not allowed", status)
+		return
+	}
+	req := struct {
+		Steps  int `json:"steps"`
+		StepMs int `json:"step_ms"`
+	}{Steps: 10, StepMs: 200}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		status = http.StatusBadRequest
+		writeProblem(w, r, "invalid JSON body: "+err.Error(), status)
+		return
+	}
+	if req.Steps <= 0 || req.Steps > maxJobSteps || req.StepMs < 0 || req.StepMs > maxJobStepMs {
+		status = http.StatusBadRequest
+		writeProblem(w, r, fmt.Sprintf("steps must be between 1 and %d and step_ms between 0 and %d", maxJobSteps, maxJobStepMs), status)
+		return
+	}
+
+	j := &job{
+		ID:        fmt.Sprintf("%s-%d", podName(), jobSeq.Add(1)),
+		State:     "queued",
+		Steps:     req.Steps,
+		CreatedAt: time.Now(),
+		stepDelay: time.Duration(req.StepMs) * time.Millisecond,
+		submitter: span.SpanContext(),
+	}
+	jobsMu.Lock()
+	pruneJobs()
+	jobs[j.ID] = j
+	jobsMu.Unlock()
+
+	if err := jobPool.submit(func() { runJob(j) }); err != nil {
+		jobsMu.Lock()
+		delete(jobs, j.ID)
+		jobsMu.Unlock()
+		jobsSubmitted.WithLabelValues("rejected").Inc()
+		status = http.StatusServiceUnavailable
+		span.RecordError(errPoolQueueFull)
+		w.Header().Set("Retry-After", "5")
+		writeProblem(w, r, errPoolQueueFull.Error(), status)
+		return
+	}
+	jobsSubmitted.WithLabelValues("accepted").Inc()
+	span.SetAttributes(attribute.String("app.job.id", j.ID))
+	updateJobGauges()
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJSON(w, status, snapshotJob(j))
+}
+
+// handleJob reports a job's status; while it is unfinished Retry-After
+// suggests a polling interval.
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	_, span := tracer.Start(r.Context(), "handleJob")
+	defer span.End()
+
+	status := http.StatusOK
+	defer func() {
+		httpRequestsTotal.WithLabelValues("/jobs/{id}", strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues("/jobs/{id}").Observe(time.Since(start).Seconds())
+	}()
+
+	id := r.PathValue("id")
+	span.SetAttributes(attribute.String("app.job.id", id))
+	jobsMu.Lock()
+	j, ok := jobs[id]
+	jobsMu.Unlock()
+	if !ok {
+		status = http.StatusNotFound
+		writeProblem(w, r, "job not found", status)
+		return
+	}
+	snap := snapshotJob(j)
+	if snap.State == "queued" || snap.State == "running" {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJSON(w, status, snap)
+}
+
+func snapshotJob(j *job) job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return *j
+}
+
+func runJob(j *job) {
+	ctx, span := tracer.Start(context.Background(), "job.run",
+		trace.WithLinks(trace.Link{SpanContext: j.submitter}),
+		trace.WithAttributes(attribute.String("app.job.id", j.ID), attribute.Int("app.job.steps", j.Steps)))
+	defer span.End()
+
+	jobsMu.Lock()
+	j.State = "running"
+	j.StartedAt = time.Now()
+	jobsMu.Unlock()
+	jobQueueWait.Observe(j.StartedAt.Sub(j.CreatedAt).Seconds())
+	updateJobGauges()
+
+	failAt := -1
+	if shouldError() {
+		failAt = rand.Intn(j.Steps)
+	}
+	var err error
+	for step := 0; step < j.Steps; step++ {
+		time.Sleep(j.stepDelay)
+		if step == failAt {
+			err = fmt.Errorf("artificial failure at step %d of job %s", step+1, j.ID)
+			break
+		}
+		progress := float64(step+1) / float64(j.Steps)
+		span.AddEvent("progress", trace.WithAttributes(attribute.Int("app.job.step", step+1), attribute.Float64("app.job.progress", progress)))
+		jobsMu.Lock()
+		j.Progress = progress
+		jobsMu.Unlock()
+	}
+
+	outcome := "succeeded"
+	if err != nil {
+		outcome = "failed"
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		serverSpan(ctx).SetAttributes(attrFaultInjected.Bool(true), attrFaultError.Bool(true))
+	}
+	jobsMu.Lock()
+	j.State = outcome
+	j.FinishedAt = time.Now()
+	if err != nil {
+		j.Error = err.Error()
+	}
+	jobsMu.Unlock()
+	jobsCompleted.WithLabelValues(outcome).Inc()
+	jobTimeToComplete.WithLabelValues(outcome).Observe(j.FinishedAt.Sub(j.CreatedAt).Seconds())
+	updateJobGauges()
+}
+
+// pruneJobs drops finished jobs past retention; callers hold jobsMu.
+func pruneJobs() {
+	for id, j := range jobs {
+		if !j.FinishedAt.IsZero() && time.Since(j.FinishedAt) > jobRetention {
+			delete(jobs, id)
+		}
+	}
+}
+
+func updateJobGauges() {
+	counts := map[string]int{"queued": 0, "running": 0, "succeeded": 0, "failed": 0}
+	jobsMu.Lock()
+	for _, j := range jobs {
+		counts[j.State]++
+	}
+	jobsMu.Unlock()
+	for state, n := range counts {
+		jobsByState.WithLabelValues(state).Set(float64(n))
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Latency budget accounting. Every dependency call made while serving a
+// request reports its wall time, so the request can be split into time spent
+// in this service ("self") and time spent waiting on dependencies
+// ("downstream"), both as a histogram and as server span attributes.
+var latencyBudgetSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "request_latency_budget_seconds",
+		Help:    "Request time split into self and downstream components, in seconds",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"path", "component"},
+)
+
+func init() {
+	prometheus.MustRegister(latencyBudgetSeconds)
+}
+
+type latencyBudgetKey struct{}
+
+type latencyBudget struct {
+	downstream atomic.Int64 // nanoseconds
+}
+
+func withLatencyBudget(ctx context.Context) (context.Context, *latencyBudget) {
+	b := &latencyBudget{}
+	return context.WithValue(ctx, latencyBudgetKey{}, b), b
+}
+
+// addDownstreamTime charges d to the request's downstream budget. Calls made
+// outside a request are ignored.
+func addDownstreamTime(ctx context.Context, d time.Duration) {
+	if b, ok := ctx.Value(latencyBudgetKey{}).(*latencyBudget); ok {
+		b.downstream.Add(int64(d))
+	}
+}
+
+// self is the part of total not spent waiting on dependencies. Overlapping
+// dependency calls can exceed the total, so it is floored at zero.
+func (b *latencyBudget) self(total time.Duration) time.Duration {
+	return max(total-time.Duration(b.downstream.Load()), 0)
+}
+
+// record observes the split for a finished request.
+func (b *latencyBudget) record(span trace.Span, route string, total time.Duration) {
+	downstream := time.Duration(b.downstream.Load())
+	self := b.self(total)
+	latencyBudgetSeconds.WithLabelValues(route, "self").Observe(self.Seconds())
+	latencyBudgetSeconds.WithLabelValues(route, "downstream").Observe(downstream.Seconds())
+	span.SetAttributes(
+		attribute.Int64("app.latency.self_ms", self.Milliseconds()),
+		attribute.Int64("app.latency.downstream_ms", downstream.Milliseconds()),
+	)
+}
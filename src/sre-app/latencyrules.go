@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Localized latency, for "only mobile clients are slow" incidents where
+// LATENCY_MS would slow everyone. LATENCY_RULES is a ";"-separated list of
+// rules, each a ","-separated set of conditions and the latency to add to
+// requests that meet all of them:
+//
+//	ua=<regex>          User-Agent
+//	tenant=<regex>      X-Tenant-ID ("" when absent)
+//	method=<regex>      HTTP method
+//	size=<bucket>       request payload: none, small (<1KiB), medium (<64KiB), large
+//
+// e.g. "ua=.*(iPhone|Android).*:800; tenant=acme,method=POST:300". Regexes
+// are anchored and cannot contain "," or ";". The first matching rule wins.
+// Every request's server span carries app.tenant and app.request.size_bucket
+// so the slow slice can be found by grouping on span attributes; a delayed
+// request also gets app.fault.latency_rule. /admin/chaos/latency-rules
+// replaces the rules at runtime.
+type latencyRule struct {
+	raw     string
+	ua      *regexp.Regexp
+	tenant  *regexp.Regexp
+	method  *regexp.Regexp
+	size    string
+	latency time.Duration
+}
+
+var (
+	latencyRules atomic.Pointer[[]latencyRule]
+
+	latencyRuleHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chaos_latency_rule_hits_total",
+			Help: "Requests delayed by a LATENCY_RULES rule, by rule",
+		},
+		[]string{"rule"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(latencyRuleHits)
+	// A malformed LATENCY_RULES is reported by loadConfig.
+	rules, _ := parseLatencyRules(os.Getenv("LATENCY_RULES"))
+	latencyRules.Store(&rules)
+}
+
+func parseLatencyRules(spec string) ([]latencyRule, error) {
+	var rules []latencyRule
+	for _, raw := range strings.Split(spec, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		i := strings.LastIndex(raw, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("rule %q: want conditions:latency_ms", raw)
+		}
+		ms, err := strconv.Atoi(raw[i+1:])
+		if err != nil || ms <= 0 || ms > 60000 {
+			return nil, fmt.Errorf("rule %q: latency must be 1-60000 ms", raw)
+		}
+		rule := latencyRule{raw: raw, latency: time.Duration(ms) * time.Millisecond}
+		for _, cond := range strings.Split(raw[:i], ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(cond), "=")
+			if !ok {
+				return nil, fmt.Errorf("rule %q: condition %q: want key=value", raw, cond)
+			}
+			var target **regexp.Regexp
+			switch key {
+			case "ua":
+				target = &rule.ua
+			case "tenant":
+				target = &rule.tenant
+			case "method":
+				target = &rule.method
+			case "size":
+				switch value {
+				case "none", "small", "medium", "large":
+					rule.size = value
+				default:
+					return nil, fmt.Errorf("rule %q: unknown size %q (use none, small, medium or large)", raw, value)
+				}
+				continue
+			default:
+				return nil, fmt.Errorf("rule %q: unknown condition %q (use ua, tenant, method or size)", raw, key)
+			}
+			if *target, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, fmt.Errorf("rule %q: %v", raw, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func payloadSizeBucket(r *http.Request) string {
+	switch n := r.ContentLength; {
+	case n <= 0:
+		return "none"
+	case n < 1<<10:
+		return "small"
+	case n < 64<<10:
+		return "medium"
+	default:
+		return "large"
+	}
+}
+
+func (rule latencyRule) matches(r *http.Request, size string) bool {
+	return (rule.ua == nil || rule.ua.MatchString(r.UserAgent())) &&
+		(rule.tenant == nil || rule.tenant.MatchString(r.Header.Get("X-Tenant-ID"))) &&
+		(rule.method == nil || rule.method.MatchString(r.Method)) &&
+		(rule.size == "" || rule.size == size)
+}
+
+// applyLatencyRules tags the server span with the attributes the rules
+// match on and sleeps for the first matching rule.
+func applyLatencyRules(ctx context.Context, r *http.Request) {
+	size := payloadSizeBucket(r)
+	span := serverSpan(ctx)
+	span.SetAttributes(
+		attribute.String("app.tenant", r.Header.Get("X-Tenant-ID")),
+		attribute.String("app.request.size_bucket", size),
+	)
+	for _, rule := range *latencyRules.Load() {
+		if !rule.matches(r, size) {
+			continue
+		}
+		_, sleep := tracer.Start(ctx, "injectedLatency")
+		time.Sleep(rule.latency)
+		sleep.End()
+		ms := int(rule.latency.Milliseconds())
+		span.SetAttributes(attrFaultInjected.Bool(true), attrFaultLatencyMs.Int(ms),
+			attribute.String("app.fault.latency_rule", rule.raw))
+		latencyRuleHits.WithLabelValues(rule.raw).Inc()
+		noteChaos(ctx, "latency rule %q: %dms", rule.raw, ms)
+		return
+	}
+}
+
+func handleAdminLatencyRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Rules *string `json:"rules"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Rules != nil {
+			rules, err := parseLatencyRules(*req.Rules)
+			if err != nil {
+				writeProblem(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			latencyRules.Store(&rules)
+			slog.Warn("Admin: latency rules updated", "rules", *req.Rules)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rules := []string{}
+	for _, rule := range *latencyRules.Load() {
+		rules = append(rules, rule.raw)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"rules": rules})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Per-endpoint concurrency, for checking Little's Law (L = λW) against the
+// latency histograms. in_flight{path} is how many requests to each route are
+// being served and http_arrivals_total{path} counts them as they arrive,
+// before admission, so shed requests are arrivals too. Under steady load
+// the three sides agree:
+//
+//	L  avg_over_time(in_flight{path="/checkout"}[5m])
+//	λ  rate(http_arrivals_total{path="/checkout"}[5m])
+//	W  rate(http_request_duration_seconds_sum{path="/checkout"}[5m])
+//	     / rate(http_request_duration_seconds_count{path="/checkout"}[5m])
+//
+// A request is in flight from arrival until its response, while the
+// histogram times the handler alone, so L above λW is time spent before the
+// handler runs: latency rules, the fsync workload, stuck handlers.
+var (
+	inFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "in_flight",
+			Help: "Requests currently being served, by route",
+		},
+		[]string{"path"},
+	)
+	httpArrivals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_arrivals_total",
+			Help: "Requests received, counted on arrival before admission or shedding, by route",
+		},
+		[]string{"path"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(inFlight, httpArrivals)
+}
+
+// trackArrival counts a request to route as arrived and in flight; call the
+// result when it has been answered.
+func trackArrival(route string) func() {
+	httpArrivals.WithLabelValues(route).Inc()
+	gauge := inFlight.WithLabelValues(route)
+	gauge.Inc()
+	return gauge.Dec
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Self-traffic, so dashboards have something to show without an external
+// load generator. LOADGEN_RATE requests per second (default 0: off) go to
+// LOADGEN_TARGET (default http://localhost:8080) from a population of
+// LOADGEN_USERS synthetic users (default 500). Each user has a stable
+// X-Session-ID, client class, country and client IP drawn from weighted
+// distributions:
+//
+//	LOADGEN_PATHS        /=60,/catalog=30,/checkout=10
+//	LOADGEN_USER_AGENTS  desktop=55,mobile=35,bot=5,api=5
+//	LOADGEN_GEOS         US=35,DE=15,GB=10,FR=10,BR=10,IN=10,JP=10
+//
+// The IP comes from a representative range for the country and is sent as
+// X-Forwarded-For, the country as X-Geo-Country, as an ingress with GeoIP
+// would; api users also send an X-API-Key of their own, so quotas see a
+// population of keys. Every instrumented request, synthetic or not, is then classified:
+// app.client.class and app.geo.country on the server span and
+// http_requests_by_segment_total{client_class,country}. /admin/loadgen
+// changes the rate and distributions at runtime, and the arrival process and
+// concurrency model described in arrivals.go.
+var (
+	loadgenUserAgents = map[string][]string{
+		"desktop": {
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_5) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15",
+			"Mozilla/5.0 (X11; Linux x86_64; rv:127.0) Gecko/20100101 Firefox/127.0",
+		},
+		"mobile": {
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36",
+		},
+		"bot": {
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)",
+		},
+		"api": {
+			"okhttp/4.12.0",
+			"python-requests/2.32.3",
+		},
+	}
+
+	loadgenGeoRanges = map[string]string{
+		"US": "3.0.0.0/9",
+		"DE": "79.192.0.0/10",
+		"GB": "86.128.0.0/10",
+		"FR": "90.0.0.0/9",
+		"BR": "177.0.0.0/9",
+		"IN": "117.192.0.0/10",
+		"JP": "126.0.0.0/9",
+		"AU": "1.120.0.0/13",
+		"CA": "24.48.0.0/13",
+		"MX": "187.128.0.0/10",
+	}
+)
+
+type weighted struct {
+	name   string
+	weight int
+}
+
+// loadgenMix is the generator's current settings.
+type loadgenMix struct {
+	paths, userAgents, geos []weighted
+	users                   int
+}
+
+var (
+	loadgenRate   atomic.Int64 // requests per minute, so fractional rates survive
+	loadgenConfig atomic.Pointer[loadgenMix]
+	loadgenClient = &http.Client{Timeout: 10 * time.Second}
+
+	loadgenArrivals    atomic.Value // constant, poisson, bursty
+	loadgenModel       atomic.Value // open, closed
+	loadgenMaxInflight atomic.Int64
+	loadgenInflight    atomic.Int64
+	loadgenConcurrency atomic.Int64
+	loadgenThinkMs     atomic.Int64
+
+	loadgenRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "loadgen_requests_total",
+			Help: "Self-traffic requests, by path and outcome (status code, error, skipped: too many in flight)",
+		},
+		[]string{"path", "outcome"},
+	)
+	requestsBySegment = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_by_segment_total",
+			Help: "Instrumented requests by client class (desktop, mobile, bot, api, other) and X-Geo-Country",
+		},
+		[]string{"client_class", "country"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(loadgenRequests, requestsBySegment)
+}
+
+// parseWeights parses "name=weight,...", restricted to known names when
+// known is non-nil.
+func parseWeights(spec string, known func(string) bool) ([]weighted, error) {
+	var out []weighted
+	total := 0
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, raw, ok := strings.Cut(item, "=")
+		weight, err := strconv.Atoi(raw)
+		if !ok || name == "" || err != nil || weight < 0 {
+			return nil, fmt.Errorf("%q: want name=weight", item)
+		}
+		if known != nil && !known(name) {
+			return nil, fmt.Errorf("%q: unknown name %q", item, name)
+		}
+		out = append(out, weighted{name, weight})
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("weights add up to 0")
+	}
+	return out, nil
+}
+
+func pickWeighted(rng *rand.Rand, items []weighted) string {
+	total := 0
+	for _, it := range items {
+		total += it.weight
+	}
+	n := rng.Intn(total)
+	for _, it := range items {
+		if n < it.weight {
+			return it.name
+		}
+		n -= it.weight
+	}
+	return items[len(items)-1].name
+}
+
+// parseLoadgenMix reads the LOADGEN_* distributions, with the defaults
+// for empty ones.
+func parseLoadgenMix(paths, userAgents, geos string, users int) (*loadgenMix, error) {
+	if paths == "" {
+		paths = "/=60,/catalog=30,/checkout=10"
+	}
+	if userAgents == "" {
+		userAgents = "desktop=55,mobile=35,bot=5,api=5"
+	}
+	if geos == "" {
+		geos = "US=35,DE=15,GB=10,FR=10,BR=10,IN=10,JP=10"
+	}
+	mix := &loadgenMix{users: users}
+	var err error
+	if mix.paths, err = parseWeights(paths, func(p string) bool { return strings.HasPrefix(p, "/") }); err != nil {
+		return nil, fmt.Errorf("LOADGEN_PATHS: %v", err)
+	}
+	if mix.userAgents, err = parseWeights(userAgents, func(c string) bool { return loadgenUserAgents[c] != nil }); err != nil {
+		return nil, fmt.Errorf("LOADGEN_USER_AGENTS: %v", err)
+	}
+	if mix.geos, err = parseWeights(geos, func(c string) bool { return loadgenGeoRanges[c] != "" }); err != nil {
+		return nil, fmt.Errorf("LOADGEN_GEOS: %v", err)
+	}
+	return mix, nil
+}
+
+// loadgenUser is one synthetic user; the same id always yields the same
+// user for a given mix.
+type loadgenUser struct {
+	session, userAgent, ip, country string
+	apiKey                          string // api class only
+}
+
+func (mix *loadgenMix) user(id int) loadgenUser {
+	rng := rand.New(rand.NewSource(int64(id)))
+	class := pickWeighted(rng, mix.userAgents)
+	agents := loadgenUserAgents[class]
+	country := pickWeighted(rng, mix.geos)
+	_, network, _ := net.ParseCIDR(loadgenGeoRanges[country])
+	ones, bits := network.Mask.Size()
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, base+uint32(rng.Int63n(int64(1)<<(bits-ones))))
+	u := loadgenUser{
+		session:   fmt.Sprintf("loadgen-%04d", id),
+		userAgent: agents[rng.Intn(len(agents))],
+		ip:        ip.String(),
+		country:   country,
+	}
+	if class == "api" {
+		u.apiKey = fmt.Sprintf("lg-api-%04d", id)
+	}
+	return u
+}
+
+func startLoadgen() {
+	paths := os.Getenv("LOADGEN_PATHS")
+	loadgenArrivals.Store(cfg.LoadgenArrivals)
+	loadgenModel.Store(cfg.LoadgenModel)
+	loadgenMaxInflight.Store(int64(cfg.LoadgenMaxInflight))
+	loadgenConcurrency.Store(int64(cfg.LoadgenConcurrency))
+	loadgenThinkMs.Store(int64(cfg.LoadgenThinkMs))
+	if preset := cfg.LoadgenPreset; preset != "" {
+		if paths == "" {
+			paths = loadgenPresetPaths
+		}
+		if preset == "mm1" {
+			mmcStation.resize(1)
+		}
+		loadgenArrivals.Store("poisson")
+		loadgenModel.Store("open")
+		loadgenMaxInflight.Store(loadgenPresetMaxInflight)
+		slog.Info("Load generator preset", "preset", preset, "paths", paths, "rho", queueModelRho(cfg.LoadgenRate))
+	}
+	// Malformed LOADGEN_* settings are reported by loadConfig.
+	mix, _ := parseLoadgenMix(paths, os.Getenv("LOADGEN_USER_AGENTS"), os.Getenv("LOADGEN_GEOS"), cfg.LoadgenUsers)
+	loadgenConfig.Store(mix)
+	loadgenRate.Store(int64(math.Round(cfg.LoadgenRate * 60)))
+	go runLoadgen()
+}
+
+// runLoadgen sends requests at the current rate, spaced by the arrival
+// process, with at most LOADGEN_MAX_INFLIGHT outstanding; in the closed
+// model it runs the closed-loop users instead.
+func runLoadgen() {
+	target := strings.TrimSuffix(os.Getenv("LOADGEN_TARGET"), "/")
+	if target == "" {
+		target = "http://localhost:8080"
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	arrivals := &arrivalProcess{}
+	next := time.Now()
+	for {
+		perMinute := loadgenRate.Load()
+		if perMinute <= 0 {
+			time.Sleep(time.Second)
+			next = time.Now()
+			continue
+		}
+		if loadgenModel.Load().(string) == "closed" {
+			runClosedLoadgen(target)
+			next = time.Now()
+			continue
+		}
+		// Arrivals are scheduled on absolute time so the rate holds however
+		// long each iteration takes; after a stall they restart from now
+		// rather than flooding to catch up.
+		if next = arrivals.next(rng, next, float64(perMinute)/60); time.Since(next) > time.Second {
+			next = time.Now()
+		}
+		time.Sleep(time.Until(next))
+		mix := loadgenConfig.Load()
+		path := pickWeighted(rng, mix.paths)
+		if loadgenInflight.Add(1) > loadgenMaxInflight.Load() {
+			loadgenInflight.Add(-1)
+			loadgenRequests.WithLabelValues(path, "skipped").Inc()
+			continue
+		}
+		u := mix.user(rng.Intn(mix.users))
+		go func() {
+			defer loadgenInflight.Add(-1)
+			sendLoadgenRequest(target, path, u)
+		}()
+	}
+}
+
+// sendLoadgenRequest is deliberately untraced, so the request arrives as a
+// root server span like traffic from outside.
+func sendLoadgenRequest(target, path string, u loadgenUser) {
+	req, err := http.NewRequest(http.MethodGet, target+path, nil)
+	if err != nil {
+		loadgenRequests.WithLabelValues(path, "error").Inc()
+		return
+	}
+	req.Header.Set("User-Agent", u.userAgent)
+	req.Header.Set("X-Forwarded-For", u.ip)
+	req.Header.Set("X-Geo-Country", u.country)
+	req.Header.Set("X-Session-ID", u.session)
+	if u.apiKey != "" {
+		req.Header.Set("X-API-Key", u.apiKey)
+	}
+	var token string
+	if cfg.LoadgenSessions {
+		if t, ok := loadgenSessions.Load(u.session); ok {
+			token = t.(string)
+		} else if token = loadgenLogin(target, u); token == "" {
+			return
+		}
+		req.AddCookie(&http.Cookie{Name: "session", Value: token})
+	}
+	start := time.Now()
+	resp, err := loadgenClient.Do(req)
+	if err != nil {
+		loadgenRequests.WithLabelValues(path, "error").Inc()
+		return
+	}
+	loadgenDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+	resp.Body.Close()
+	loadgenRequests.WithLabelValues(path, strconv.Itoa(resp.StatusCode)).Inc()
+	if token != "" && resp.StatusCode == http.StatusUnauthorized {
+		loadgenSessions.CompareAndDelete(u.session, token)
+	}
+}
+
+// classifyUserAgent buckets a User-Agent into a dashboard-sized segment.
+func classifyUserAgent(ua string) string {
+	lower := strings.ToLower(ua)
+	switch {
+	case strings.Contains(lower, "bot") || strings.Contains(lower, "spider") || strings.Contains(lower, "crawl"):
+		return "bot"
+	case strings.Contains(lower, "mobile") || strings.Contains(lower, "android") || strings.Contains(lower, "iphone"):
+		return "mobile"
+	case strings.HasPrefix(lower, "mozilla/"):
+		return "desktop"
+	case strings.Contains(lower, "okhttp") || strings.Contains(lower, "python-requests") ||
+		strings.Contains(lower, "curl") || strings.Contains(lower, "go-http-client"):
+		return "api"
+	default:
+		return "other"
+	}
+}
+
+// geoCountry returns X-Geo-Country when it is an ISO 3166 alpha-2 code.
+func geoCountry(r *http.Request) string {
+	c := r.Header.Get("X-Geo-Country")
+	if len(c) != 2 || c[0] < 'A' || c[0] > 'Z' || c[1] < 'A' || c[1] > 'Z' {
+		return "unknown"
+	}
+	return c
+}
+
+func recordClientSegment(span trace.Span, r *http.Request) {
+	class, country := classifyUserAgent(r.UserAgent()), geoCountry(r)
+	span.SetAttributes(attribute.String("app.client.class", class), attribute.String("app.geo.country", country))
+	requestsBySegment.WithLabelValues(class, country).Inc()
+}
+
+var loadgenMu sync.Mutex // serialises admin changes to the mix
+
+func handleAdminLoadgen(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Rate       *float64 `json:"rate"`
+			Paths      *string  `json:"paths"`
+			UserAgents *string  `json:"user_agents"`
+			Geos       *string  `json:"geos"`
+			Users      *int     `json:"users"`
+
+			Arrivals    *string `json:"arrivals"`
+			Model       *string `json:"model"`
+			MaxInflight *int64  `json:"max_inflight"`
+			Concurrency *int64  `json:"concurrency"`
+			ThinkMs     *int64  `json:"think_ms"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Rate != nil && (*req.Rate < 0 || *req.Rate > 10000) {
+			writeProblem(w, r, "rate must be 0-10000 requests per second", http.StatusBadRequest)
+			return
+		}
+		if req.Users != nil && (*req.Users < 1 || *req.Users > 1000000) {
+			writeProblem(w, r, "users must be 1-1000000", http.StatusBadRequest)
+			return
+		}
+		if req.Arrivals != nil && *req.Arrivals != "constant" && *req.Arrivals != "poisson" && *req.Arrivals != "bursty" {
+			writeProblem(w, r, "arrivals must be constant, poisson or bursty", http.StatusBadRequest)
+			return
+		}
+		if req.Model != nil && *req.Model != "open" && *req.Model != "closed" {
+			writeProblem(w, r, "model must be open or closed", http.StatusBadRequest)
+			return
+		}
+		loadgenMu.Lock()
+		paths, userAgents, geos, users := loadgenSpec(loadgenConfig.Load())
+		if req.Paths != nil {
+			paths = *req.Paths
+		}
+		if req.UserAgents != nil {
+			userAgents = *req.UserAgents
+		}
+		if req.Geos != nil {
+			geos = *req.Geos
+		}
+		if req.Users != nil {
+			users = *req.Users
+		}
+		mix, err := parseLoadgenMix(paths, userAgents, geos, users)
+		if err != nil {
+			loadgenMu.Unlock()
+			writeProblem(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		loadgenConfig.Store(mix)
+		loadgenMu.Unlock()
+		if req.Rate != nil {
+			loadgenRate.Store(int64(math.Round(*req.Rate * 60)))
+		}
+		if req.Arrivals != nil {
+			loadgenArrivals.Store(*req.Arrivals)
+		}
+		if req.Model != nil {
+			loadgenModel.Store(*req.Model)
+		}
+		if req.MaxInflight != nil && *req.MaxInflight >= 1 {
+			loadgenMaxInflight.Store(*req.MaxInflight)
+		}
+		if req.Concurrency != nil && *req.Concurrency >= 1 && *req.Concurrency <= 10000 {
+			loadgenConcurrency.Store(*req.Concurrency)
+		}
+		if req.ThinkMs != nil && *req.ThinkMs >= 0 {
+			loadgenThinkMs.Store(*req.ThinkMs)
+		}
+		slog.Warn("Admin: load generator updated", "rate", float64(loadgenRate.Load())/60,
+			"paths", paths, "user_agents", userAgents, "geos", geos, "users", users,
+			"arrivals", loadgenArrivals.Load(), "model", loadgenModel.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	paths, userAgents, geos, users := loadgenSpec(loadgenConfig.Load())
+	writeJSON(w, http.StatusOK, map[string]any{
+		"rate":        float64(loadgenRate.Load()) / 60,
+		"paths":       paths,
+		"user_agents": userAgents,
+		"geos":        geos,
+		"users":       users,
+
+		"arrivals":     loadgenArrivals.Load(),
+		"model":        loadgenModel.Load(),
+		"max_inflight": loadgenMaxInflight.Load(),
+		"concurrency":  loadgenConcurrency.Load(),
+		"think_ms":     loadgenThinkMs.Load(),
+		"inflight":     loadgenInflight.Load(),
+	})
+}
+
+func loadgenSpec(mix *loadgenMix) (paths, userAgents, geos string, users int) {
+	join := func(items []weighted) string {
+		parts := make([]string, len(items))
+		for i, it := range items {
+			parts[i] = fmt.Sprintf("%s=%d", it.name, it.weight)
+		}
+		return strings.Join(parts, ",")
+	}
+	return join(mix.paths), join(mix.userAgents), join(mix.geos), mix.users
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// logLevel is shared by every handler so the level can be changed at runtime.
+var logLevel = new(slog.LevelVar)
+
+var logMessagesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "log_messages_total",
+		Help: "Total number of log lines emitted, by level",
+	},
+	[]string{"level"},
+)
+
+func init() {
+	prometheus.MustRegister(logMessagesTotal)
+}
+
+// initLogger installs slog as the default logger (LOG_FORMAT=text|json,
+// LOG_LEVEL=debug|info|warn|error). The std log package is routed through
+// it too, so log.Printf calls come out at INFO.
+func initLogger() {
+	setLogLevel(cfg.LogLevel)
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if cfg.LogFormat == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	if clockSkewRate > 0 {
+		h = skewingHandler{h}
+	}
+	h = requestIDHandler{h}
+	slog.SetDefault(slog.New(countingHandler{redactingHandler{h}}))
+	watchLogLevelSignals()
+}
+
+// countingHandler feeds log_messages_total for log-volume alerting.
+type countingHandler struct {
+	slog.Handler
+}
+
+func (h countingHandler) Handle(ctx context.Context, r slog.Record) error {
+	logMessagesTotal.WithLabelValues(strings.ToLower(r.Level.String())).Inc()
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h countingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return countingHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h countingHandler) WithGroup(name string) slog.Handler {
+	return countingHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var logLevelInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "log_level",
+		Help: "1 for the currently active log level",
+	},
+	[]string{"level"},
+)
+
+func init() {
+	prometheus.MustRegister(logLevelInfo)
+}
+
+func setLogLevel(l slog.Level) {
+	logLevel.Set(l)
+	for _, known := range []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError} {
+		v := 0.0
+		if known == l {
+			v = 1
+		}
+		logLevelInfo.WithLabelValues(strings.ToLower(known.String())).Set(v)
+	}
+}
+
+// watchLogLevelSignals handles SIGHUP: with LOG_LEVEL_FILE (e.g. a mounted
+// ConfigMap key) the level is re-read from it, otherwise SIGHUP toggles
+// between DEBUG and the startup level.
+func watchLogLevelSignals() {
+	startup := logLevel.Level()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			next := startup
+			if path := os.Getenv("LOG_LEVEL_FILE"); path != "" {
+				b, err := os.ReadFile(path)
+				if err != nil {
+					slog.Error("SIGHUP: reading LOG_LEVEL_FILE", "error", err)
+					continue
+				}
+				if err := next.UnmarshalText([]byte(strings.TrimSpace(string(b)))); err != nil {
+					slog.Error("SIGHUP: invalid level in LOG_LEVEL_FILE", "error", err)
+					continue
+				}
+			} else if logLevel.Level() != slog.LevelDebug {
+				next = slog.LevelDebug
+			}
+			setLogLevel(next)
+			slog.Warn("SIGHUP: log level changed", "level", next.String())
+		}
+	}()
+}
+
+// handleAdminLogLevel reports (GET) or changes (PUT/POST) the log level,
+// e.g. {"level": "debug"}.
+func handleAdminLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Level string `json:"level"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(req.Level)); err != nil {
+			writeProblem(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setLogLevel(l)
+		slog.Warn("Admin: log level changed", "level", l.String())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": strings.ToLower(logLevel.Level().String())})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Log storm chaos. LOG_STORM_RATE lines/sec of useless chatter at the
+// LOG_STORM_LEVELS mix (default "debug,info,warn,error"), adjustable at
+// runtime through /admin/chaos/logstorm, to exercise log-volume alerts,
+// Loki rate limits and ingestion cost.
+var (
+	logStormRate   atomic.Int64
+	logStormMu     sync.RWMutex
+	logStormLevels = []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError}
+
+	logStormLinesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chaos_log_storm_lines_total",
+			Help: "Total number of noise log lines emitted by the log storm",
+		},
+		[]string{"level"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(logStormLinesTotal)
+}
+
+var logStormMessages = []string{
+	"cache heartbeat ok",
+	"polling upstream for changes",
+	"connection pool stats refreshed",
+	"retrying idempotent no-op",
+	"feature flag evaluated",
+	"GC hint ignored",
+}
+
+func startLogStorm() {
+	logStormRate.Store(int64(cfg.LogStormRate))
+	if v := os.Getenv("LOG_STORM_LEVELS"); v != "" {
+		if levels, err := parseLevels(strings.Split(v, ",")); err == nil {
+			logStormLevels = levels
+		} else {
+			slog.Warn("ignoring LOG_STORM_LEVELS", "error", err)
+		}
+	}
+	go runLogStorm(context.Background())
+}
+
+func parseLevels(names []string) ([]slog.Level, error) {
+	levels := make([]slog.Level, 0, len(names))
+	for _, name := range names {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+			return nil, err
+		}
+		levels = append(levels, l)
+	}
+	return levels, nil
+}
+
+// runLogStorm emits in 100ms slices so high rates stay smooth.
+func runLogStorm(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	var carry float64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		rate := logStormRate.Load()
+		if rate <= 0 {
+			carry = 0
+			continue
+		}
+
+		carry += float64(rate) / 10
+		n := int(carry)
+		carry -= float64(n)
+
+		logStormMu.RLock()
+		levels := logStormLevels
+		logStormMu.RUnlock()
+		for i := 0; i < n; i++ {
+			level := levels[rand.Intn(len(levels))]
+			if !slog.Default().Enabled(ctx, level) {
+				continue
+			}
+			slog.Log(ctx, level, logStormMessages[rand.Intn(len(logStormMessages))],
+				"component", "log-storm",
+				"seq", rand.Int63(),
+			)
+			logStormLinesTotal.WithLabelValues(strings.ToLower(level.String())).Inc()
+		}
+	}
+}
+
+// handleAdminLogStorm reports (GET) or changes (PUT/POST) the storm,
+// e.g. {"rate": 500, "levels": ["info", "error"]}; rate 0 stops it.
+func handleAdminLogStorm(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Rate   *int64   `json:"rate"`
+			Levels []string `json:"levels"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Levels) > 0 {
+			levels, err := parseLevels(req.Levels)
+			if err != nil {
+				writeProblem(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logStormMu.Lock()
+			logStormLevels = levels
+			logStormMu.Unlock()
+		}
+		if req.Rate != nil {
+			logStormRate.Store(*req.Rate)
+		}
+		slog.Info("Admin: log storm updated", "rate", logStormRate.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logStormMu.RLock()
+	levels := make([]string, len(logStormLevels))
+	for i, l := range logStormLevels {
+		levels[i] = strings.ToLower(l.String())
+	}
+	logStormMu.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]any{"rate": logStormRate.Load(), "levels": levels})
+}
@@ -2,107 +2,224 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
-	"math/rand"
+	"log/slog"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	tracer    trace.Tracer
-	errorRate int
-	latencyMs int
+	tracer        trace.Tracer
+	errorRate     int
+	latencyMs     int
+	slowRequestMs int
 )
 
 // Metrics
 var (
-	httpRequestsTotal = prometheus.NewCounterVec(
+	httpRequestsTotal = guardCounterVec("http_requests_total", prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_requests_total",
 			Help: "Total number of HTTP requests",
 		},
 		[]string{"path", "status"},
-	)
-	httpRequestDuration = prometheus.NewHistogramVec(
+	))
+	httpRequestDuration = guardHistogramVec("http_request_duration_seconds", prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "http_request_duration_seconds",
 			Help:    "Duration of HTTP requests in seconds",
 			Buckets: prometheus.DefBuckets,
 		},
 		[]string{"path"},
+	))
+	appInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "app_info",
+			Help: "Static identity of this instance (always 1)",
+		},
+		[]string{"region", "cluster"},
 	)
 )
 
 func init() {
 	prometheus.MustRegister(httpRequestsTotal)
 	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(appInfo)
 }
 
 func initTracer() func(context.Context) error {
 	ctx := context.Background()
 
-	exporter, err := otlptracegrpc.New(ctx,
-		otlptracegrpc.WithInsecure(),
-		otlptracegrpc.WithEndpoint("observability-tempo.monitoring.svc.cluster.local:4317"), // Direct to Tempo/Collector
-	)
+	exporter, err := newTraceExporter(ctx)
 	if err != nil {
 		log.Fatalf("failed to create trace exporter: %v", err)
 	}
+	exporter = decorateExporter(newSpoolingExporter(newMonitoredExporter(traceExporterName(), exporter)))
+	secondary, secondaryName, err := newSecondaryTraceExporter(ctx)
+	if err != nil {
+		log.Fatalf("failed to create secondary trace exporter: %v", err)
+	}
 
-	res, err := resource.New(ctx,
-		resource.WithAttributes(
-			semconv.ServiceNameKey.String("sre-observability-app"),
-			semconv.ServiceVersionKey.String("1.0.0"),
-			attribute.String("environment", "lab"),
-		),
-	)
+	res, err := newResource(ctx)
 	if err != nil {
 		log.Fatalf("failed to create resource: %v", err)
 	}
 
-	tp := sdktrace.NewTracerProvider(
+	if err := initSampler(); err != nil {
+		log.Fatalf("failed to configure sampler: %v", err)
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(traceSampler),
 		sdktrace.WithBatcher(exporter),
 		sdktrace.WithResource(res),
-	)
+	}
+	if secondary != nil {
+		opts = append(opts, sdktrace.WithBatcher(decorateExporter(newMonitoredExporter(secondaryName, secondary))))
+		log.Printf("Dual-exporting traces to %s", os.Getenv("TRACES_SECONDARY_ENDPOINT"))
+	}
+	if errorSpanRescue {
+		opts = append(opts, sdktrace.WithSpanProcessor(newErrorRescueProcessor(exporter)))
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
 	otel.SetTracerProvider(tp)
-	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetTextMapPropagator(lossyPropagator{propagation.NewCompositeTextMapPropagator(propagatorsFromEnv(), requestIDPropagator{})})
 
 	tracer = tp.Tracer("sre-observability-app")
 
 	return tp.Shutdown
 }
 
+// decorateExporter applies the span rewriting every backend should see.
+func decorateExporter(exporter sdktrace.SpanExporter) sdktrace.SpanExporter {
+	if clockSkewRate > 0 {
+		exporter = skewingExporter{exporter}
+	}
+	return redactingExporter{exporter}
+}
+
 func main() {
+	validateOnly := flag.Bool("validate-config", false, "check the environment configuration, print any problems and exit")
+	flag.Parse()
+	if len(cfgProblems) > 0 {
+		fmt.Fprintf(os.Stderr, "invalid configuration (%d problems):\n", len(cfgProblems))
+		for _, p := range cfgProblems {
+			fmt.Fprintln(os.Stderr, "  "+p)
+		}
+		os.Exit(1)
+	}
+	if *validateOnly {
+		fmt.Println("configuration OK")
+		return
+	}
+
+	loadClockSkewConfig()
+	loadRedactionConfig()
+	loadBudgetConfig()
+	initLogger()
+
 	shutdown := initTracer()
 	defer shutdown(context.Background())
 
 	// Env configs
-	errorRate, _ = strconv.Atoi(os.Getenv("ERROR_RATE")) // 0-100
-	latencyMs, _ = strconv.Atoi(os.Getenv("LATENCY_MS")) // milliseconds
+	errorRate = cfg.ErrorRate
+	latencyMs = cfg.LatencyMs
+	slowRequestMs = cfg.SlowRequestMs
+	applyBadReplicaMode()
+	applyZoneChaos()
+	loadDownstreamConfig()
+	loadBalancerConfig()
+	loadHedgingConfig()
+	loadSheddingConfig()
+	loadAdaptiveConfig()
+	loadBulkheadConfig()
+	loadDBPoolConfig()
+	loadQueryConfig()
+	loadShardConfig()
+	loadS3Config()
+	loadDLQConfig()
+	loadMaintenanceConfig()
+	startReadOnlyMonitor()
+	startConsistencyChecker()
+	startOrderEvents()
+	startGRPCServer()
+	startDNSWorkload()
+	startQueue()
+	startOutbox()
+	startJobs()
+	startNotifications()
+	startScheduler()
+	startReconciler()
+	startSecretReloader()
+	startACLReloader()
+	loadCarbonConfig()
+	startAnomalyDetector()
+	annotateStartup()
+	appInfo.WithLabelValues(os.Getenv("REGION"), os.Getenv("CLUSTER")).Set(1)
+
+	startLogStorm()
+	startCardinalityBomb()
+	startBrownoutController()
+	startLoadgen()
+	gateStartup()
+	runInitPhase()
+	startSelfTermination()
+	if os.Getenv("OTEL_METRICS_EXPORTER") == "console" {
+		go runConsoleMetrics(context.Background())
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.Handle("/", otelhttp.NewHandler(http.HandlerFunc(handleRoot), "root"))
-	mux.Handle("/checkout", otelhttp.NewHandler(http.HandlerFunc(handleCheckout), "checkout"))
+	mux.Handle("/metrics", metricsChaos(promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(relabelingGatherer{prometheus.DefaultGatherer}, promhttp.HandlerOpts{EnableOpenMetrics: true}))))
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/startupz", handleStartupz)
+	mux.HandleFunc("/stats", handleStats)
+	mux.Handle("/alerts/webhook", instrument("/alerts/webhook", handleAlertWebhook))
+	mux.HandleFunc("/incident/truth", handleIncidentTruth)
+	mux.HandleFunc("/runbook", handleRunbook)
+	mux.Handle("/", instrument("/", handleRoot))
+	mux.Handle("/checkout", instrument("/checkout", handleCheckout))
+	mux.Handle("/catalog", instrument("/catalog", cached("/catalog", nil, handleCatalog)))
+	mux.Handle("/orders/batch", instrument("/orders/batch", handleOrdersBatch))
+	mux.Handle("/orders", instrument("/orders", handleOrders))
+	mux.Handle("/orders/{id}", instrument("/orders/{id}", handleOrder))
+	mux.Handle("/jobs", instrument("/jobs", handleJobs))
+	mux.Handle("/jobs/{id}", instrument("/jobs/{id}", handleJob))
+	mux.Handle("/upload", instrument("/upload", handleUpload))
+	mux.Handle("/static/", instrument("/static/", handleStatic))
+	mux.Handle("/cdn/static/", instrument("/cdn/static/", handleCDN))
+	mux.Handle("/login", instrument("/login", handleLogin))
+	mux.Handle("/debug/memstats", adminOnly(handleMemstats))
+	mux.Handle("/contention", instrument("/contention", handleContention))
+	mux.Handle("/mmc", instrument("/mmc", handleMMC))
+	mux.Handle("/debug/pprof/", adminOnly(pprof.Index))
+	mux.Handle("/debug/pprof/cmdline", adminOnly(pprof.Cmdline))
+	mux.Handle("/debug/pprof/profile", adminOnly(pprof.Profile))
+	mux.Handle("/debug/pprof/symbol", adminOnly(pprof.Symbol))
+	mux.Handle("/debug/pprof/trace", adminOnly(pprof.Trace))
+	registerAdminRoutes(mux)
 
 	log.Println("Starting SRE App on :8080")
-	log.Printf("Config: ERROR_RATE=%d%%, LATENCY_MS=%dms\n", errorRate, latencyMs)
-	if err := http.ListenAndServe(":8080", mux); err != nil {
+	log.Printf("Config: ERROR_RATE=%d%%, LATENCY_MS=%dms, REGION=%s, CLUSTER=%s\n", errorRate, latencyMs, os.Getenv("REGION"), os.Getenv("CLUSTER"))
+	ln, err := listen(":8080")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := http.Serve(withTLS(ln), mux); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -117,9 +234,8 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 	status := http.StatusOK
 	if shouldError() {
 		status = http.StatusInternalServerError
-		span.SetAttributes(attribute.Bool("error", true))
-		span.RecordError(fmt.Errorf("artificial chaos error"))
-		http.Error(w, "Chaos Monkey struck!", status)
+		markFault(ctx, fmt.Errorf("artificial chaos error"))
+		writeProblem(w, r, "Chaos Monkey struck!", status)
 		log.Printf("Error injected 500")
 	} else {
 		fmt.Fprintf(w, "Hello from SRE App! TraceID: %s\n", span.SpanContext().TraceID().String())
@@ -135,40 +251,51 @@ func handleCheckout(w http.ResponseWriter, r *http.Request) {
 	ctx, span := tracer.Start(r.Context(), "handleCheckout")
 	defer span.End()
 
+	w.Header().Set("Checkout-API-Version", checkoutAPIVersion.Load().(string))
+	customer, err := decodeCheckoutRequest(r)
+	if err != nil {
+		span.RecordError(err)
+		writeProblem(w, r, err.Error(), http.StatusBadRequest)
+		httpRequestsTotal.WithLabelValues("/checkout", strconv.Itoa(http.StatusBadRequest)).Inc()
+		httpRequestDuration.WithLabelValues("/checkout").Observe(time.Since(start).Seconds())
+		return
+	}
+
+	// Customer identity is deliberately PII so the redaction layer has work to do
+	if customer != "" {
+		span.SetAttributes(attribute.String("app.customer.email", customer))
+		slog.InfoContext(ctx, "checkout started for "+customer, "email", customer)
+	}
+
 	// Simulate a database call
-	dbCtx, dbSpan := tracer.Start(ctx, "database_query")
-	time.Sleep(time.Duration(20+rand.Intn(50)) * time.Millisecond)
-	dbSpan.SetAttributes(attribute.String("db.system", "postgres"), attribute.String("db.statement", "SELECT * FROM cart"))
-	dbSpan.End()
+	dbCtx, dbErr := queryDatabase(ctx, "cart_by_customer")
+	if dbErr == nil {
+		_, dbErr = queryDatabase(ctx, "inventory_check")
+	}
 
 	simulateWork(dbCtx)
 
 	status := http.StatusOK
-	if shouldError() {
+	lines := checkoutBasket()
+	if dbErr != nil {
+		status = http.StatusServiceUnavailable
+		writeProblem(w, r, "Checkout database unavailable", status)
+	} else if dsStatus, err := callDownstream(ctx); err != nil || dsStatus >= 500 {
+		status = http.StatusBadGateway
+		writeProblem(w, r, "Checkout dependency failed", status)
+	} else if shouldError() {
 		status = http.StatusInternalServerError
-		http.Error(w, "Checkout failed", status)
+		markFault(ctx, fmt.Errorf("artificial checkout failure for customer %q", customer))
+		writeProblem(w, r, "Checkout failed", status)
+	} else if err := runCheckoutSaga(ctx, lines); err != nil {
+		var detail string
+		status, detail = checkoutSagaFailure(err)
+		writeProblem(w, r, detail, status)
 	} else {
-		fmt.Fprintf(w, "Checkout successful")
+		writeCheckoutResponse(ctx, w, span.SpanContext().TraceID().String(), lines)
 	}
 
 	duration := time.Since(start).Seconds()
 	httpRequestsTotal.WithLabelValues("/checkout", strconv.Itoa(status)).Inc()
 	httpRequestDuration.WithLabelValues("/checkout").Observe(duration)
 }
-
-func simulateWork(ctx context.Context) {
-	_, span := tracer.Start(ctx, "simulateWork")
-	defer span.End()
-
-	if latencyMs > 0 {
-		time.Sleep(time.Duration(latencyMs) * time.Millisecond)
-		span.SetAttributes(attribute.Int("simulated_latency_ms", latencyMs))
-	}
-}
-
-func shouldError() bool {
-	if errorRate <= 0 {
-		return false
-	}
-	return rand.Intn(100) < errorRate
-}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Planned maintenance. With MAINTENANCE_MODE=true (or after PUT
+// /admin/maintenance {"enabled": true}) user traffic gets a 503 with
+// Retry-After: MAINTENANCE_RETRY_AFTER_S (default 300). Health, readiness,
+// metrics and the admin API are not instrumented routes and keep working;
+// /alerts/webhook stays open too. Requests carrying
+// X-Maintenance-Bypass: <MAINTENANCE_BYPASS_TOKEN> (or _FILE) go through,
+// for smoke-testing the maintenance work. Turned-away requests count as
+// errors in the in-app SLIs unless MAINTENANCE_SLO_EXCLUDED=true, so both
+// sides of the "does planned downtime burn the budget?" argument can be
+// shown.
+const maintenanceBypassHeader = "X-Maintenance-Bypass"
+
+var (
+	maintenanceEnabled    atomic.Bool
+	maintenanceRetryAfter atomic.Int64
+	maintenanceToken      = loadSecret("MAINTENANCE_BYPASS_TOKEN")
+
+	maintenanceActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "maintenance_mode",
+		Help: "1 while maintenance mode turns user traffic away",
+	})
+	maintenanceRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "maintenance_requests_total",
+			Help: "Requests during maintenance, by path and outcome (turned_away, bypassed)",
+		},
+		[]string{"path", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(maintenanceActive, maintenanceRequests)
+}
+
+func loadMaintenanceConfig() {
+	maintenanceRetryAfter.Store(int64(cfg.MaintenanceRetryAfterS))
+	setMaintenance(cfg.MaintenanceMode)
+}
+
+func setMaintenance(on bool) {
+	maintenanceEnabled.Store(on)
+	if on {
+		maintenanceActive.Set(1)
+	} else {
+		maintenanceActive.Set(0)
+	}
+}
+
+// maintenanceAllows answers user traffic with a 503 during maintenance.
+func maintenanceAllows(w http.ResponseWriter, r *http.Request, route string) bool {
+	if !maintenanceEnabled.Load() || route == "/alerts/webhook" {
+		return true
+	}
+	token := maintenanceToken.get()
+	if given := r.Header.Get(maintenanceBypassHeader); token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+		maintenanceRequests.WithLabelValues(route, "bypassed").Inc()
+		return true
+	}
+	maintenanceRequests.WithLabelValues(route, "turned_away").Inc()
+	w.Header().Set("Retry-After", strconv.FormatInt(maintenanceRetryAfter.Load(), 10))
+	writeProblem(w, r, "down for planned maintenance", http.StatusServiceUnavailable)
+	return false
+}
+
+func handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Enabled     *bool `json:"enabled"`
+			RetryAfterS *int  `json:"retry_after_s"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.RetryAfterS != nil {
+			if *req.RetryAfterS < 0 || *req.RetryAfterS > 86400 {
+				writeProblem(w, r, "retry_after_s must be 0-86400", http.StatusBadRequest)
+				return
+			}
+			maintenanceRetryAfter.Store(int64(*req.RetryAfterS))
+		}
+		if req.Enabled != nil {
+			setMaintenance(*req.Enabled)
+		}
+		slog.Warn("Admin: maintenance mode updated", "enabled", maintenanceEnabled.Load(), "retry_after_s", maintenanceRetryAfter.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"enabled":        maintenanceEnabled.Load(),
+		"retry_after_s":  maintenanceRetryAfter.Load(),
+		"bypass_enabled": maintenanceToken.get() != "",
+		"slo_excluded":   cfg.MaintenanceSLOExcluded,
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GOMAXPROCS and CFS throttling. Go before 1.25 sizes GOMAXPROCS from the
+// node's CPUs, not the container's CPU limit, so a pod limited to 500m on a
+// 32-core node runs 32 Ps that burn the quota early in every 100ms period
+// and then sit throttled for the rest of it: latency spikes with CPU usage
+// far below the limit. At startup the app does what go.uber.org/automaxprocs
+// does, setting GOMAXPROCS to the cgroup quota rounded down (at least 1),
+// unless GOMAXPROCS is set in the environment or GOMAXPROCS_FROM_QUOTA=false
+// keeps the runtime default to stage the incident. /admin/gomaxprocs changes
+// it at runtime, {"procs": 0} going back to the quota-derived value.
+//
+// The quota, the period and the throttling counters come from the cgroup's
+// cpu.max and cpu.stat (v2) or cpu.cfs_* and cpu.stat (v1); the fix shows as
+// cpu_cgroup_throttled_periods_total flattening when GOMAXPROCS drops:
+//
+//	rate(cpu_cgroup_throttled_periods_total[5m]) / rate(cpu_cgroup_periods_total[5m])
+type cpuQuota struct {
+	quotaUs, periodUs float64 // quotaUs < 0: no limit
+}
+
+type cpuStat struct {
+	periods, throttled float64
+	throttledS         float64
+}
+
+var (
+	goMaxProcs = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "go_maxprocs",
+			Help: "Current GOMAXPROCS",
+		},
+		func() float64 { return float64(runtime.GOMAXPROCS(0)) },
+	)
+	cgroupCPULimit = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "cpu_cgroup_limit_cores",
+			Help: "CPU limit from the cgroup quota divided by its period; 0 without a limit",
+		},
+		func() float64 {
+			q, ok := readCPUQuota()
+			if !ok || q.quotaUs < 0 {
+				return 0
+			}
+			return q.quotaUs / q.periodUs
+		},
+	)
+	cgroupCPUPeriod = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "cpu_cgroup_period_seconds",
+			Help: "CFS enforcement period of the cgroup",
+		},
+		func() float64 {
+			q, _ := readCPUQuota()
+			return q.periodUs / 1e6
+		},
+	)
+)
+
+// cpuStatCollector reads cpu.stat once per scrape for its three counters.
+type cpuStatCollector struct{}
+
+var (
+	cgroupPeriodsDesc    = prometheus.NewDesc("cpu_cgroup_periods_total", "CFS enforcement periods the cgroup had runnable threads in", nil, nil)
+	cgroupThrottledDesc  = prometheus.NewDesc("cpu_cgroup_throttled_periods_total", "CFS periods in which the cgroup was throttled", nil, nil)
+	cgroupThrottledSDesc = prometheus.NewDesc("cpu_cgroup_throttled_seconds_total", "Time the cgroup's threads spent throttled", nil, nil)
+)
+
+func (cpuStatCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cgroupPeriodsDesc
+	ch <- cgroupThrottledDesc
+	ch <- cgroupThrottledSDesc
+}
+
+func (cpuStatCollector) Collect(ch chan<- prometheus.Metric) {
+	s, ok := readCPUStat()
+	if !ok {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(cgroupPeriodsDesc, prometheus.CounterValue, s.periods)
+	ch <- prometheus.MustNewConstMetric(cgroupThrottledDesc, prometheus.CounterValue, s.throttled)
+	ch <- prometheus.MustNewConstMetric(cgroupThrottledSDesc, prometheus.CounterValue, s.throttledS)
+}
+
+func init() {
+	prometheus.MustRegister(goMaxProcs, cgroupCPULimit, cgroupCPUPeriod, cpuStatCollector{})
+	if os.Getenv("GOMAXPROCS") != "" || !cfg.GOMAXPROCSFromQuota {
+		return
+	}
+	if procs, ok := quotaMaxProcs(); ok {
+		prev := runtime.GOMAXPROCS(procs)
+		slog.Info("GOMAXPROCS set from the CPU quota", "gomaxprocs", procs, "was", prev)
+	}
+}
+
+func readCgroupFile(name string) (string, bool) {
+	raw, err := os.ReadFile("/sys/fs/cgroup/" + name)
+	return strings.TrimSpace(string(raw)), err == nil
+}
+
+// readCPUQuota reads the quota from cgroup v2, or v1.
+func readCPUQuota() (cpuQuota, bool) {
+	if raw, ok := readCgroupFile("cpu.max"); ok {
+		quota, period, _ := strings.Cut(raw, " ")
+		q := cpuQuota{quotaUs: -1}
+		q.periodUs, _ = strconv.ParseFloat(period, 64)
+		if quota != "max" {
+			q.quotaUs, _ = strconv.ParseFloat(quota, 64)
+		}
+		return q, q.periodUs > 0
+	}
+	quota, ok1 := readCgroupFile("cpu/cpu.cfs_quota_us")
+	period, ok2 := readCgroupFile("cpu/cpu.cfs_period_us")
+	var q cpuQuota
+	q.quotaUs, _ = strconv.ParseFloat(quota, 64)
+	q.periodUs, _ = strconv.ParseFloat(period, 64)
+	return q, ok1 && ok2 && q.periodUs > 0
+}
+
+func readCPUStat() (cpuStat, bool) {
+	raw, ok := readCgroupFile("cpu.stat")
+	throttledUnit := 1e-6 // v2 throttled_usec
+	if !ok {
+		if raw, ok = readCgroupFile("cpu/cpu.stat"); !ok {
+			return cpuStat{}, false
+		}
+		throttledUnit = 1e-9 // v1 throttled_time is in ns
+	}
+	var s cpuStat
+	for _, line := range strings.Split(raw, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		n, _ := strconv.ParseFloat(value, 64)
+		switch key {
+		case "nr_periods":
+			s.periods = n
+		case "nr_throttled":
+			s.throttled = n
+		case "throttled_usec", "throttled_time":
+			s.throttledS = n * throttledUnit
+		}
+	}
+	return s, true
+}
+
+// quotaMaxProcs is the quota in whole CPUs, at least 1, or false without a
+// limit.
+func quotaMaxProcs() (int, bool) {
+	q, ok := readCPUQuota()
+	if !ok || q.quotaUs < 0 {
+		return 0, false
+	}
+	return max(1, int(math.Floor(q.quotaUs/q.periodUs))), true
+}
+
+// handleAdminGOMAXPROCS reports or sets GOMAXPROCS: {"procs": 32} to stage
+// throttling, {"procs": 0} for the quota-derived value.
+func handleAdminGOMAXPROCS(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Procs *int `json:"procs"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Procs != nil {
+			procs := *req.Procs
+			if procs == 0 {
+				var ok bool
+				if procs, ok = quotaMaxProcs(); !ok {
+					procs = runtime.NumCPU()
+				}
+			}
+			if procs < 1 || procs > 1024 {
+				writeProblem(w, r, fmt.Sprintf("procs must be between 0 and 1024, got %d", procs), http.StatusBadRequest)
+				return
+			}
+			prev := runtime.GOMAXPROCS(procs)
+			slog.Warn("Admin: GOMAXPROCS updated", "gomaxprocs", procs, "was", prev)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := map[string]any{
+		"gomaxprocs": runtime.GOMAXPROCS(0),
+		"num_cpu":    runtime.NumCPU(),
+	}
+	if q, ok := readCPUQuota(); ok && q.quotaUs >= 0 {
+		report["limit_cores"] = q.quotaUs / q.periodUs
+	}
+	if s, ok := readCPUStat(); ok {
+		report["throttled_periods"] = s.throttled
+		report["periods"] = s.periods
+	}
+	writeJSON(w, http.StatusOK, report)
+}
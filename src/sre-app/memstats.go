@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Heap versus RSS, for OOM triage exercises. /debug/memstats (behind the
+// admin token) reports the runtime's view of memory next to the kernel's
+// RSS, the process_resident_memory_bytes that the OOM killer and
+// container_memory_working_set_bytes follow, and POST actions move them
+// apart:
+//
+//	{"action": "allocate", "mb": 256}  allocate and touch 256 MiB and hold it
+//	{"action": "free"}                 drop everything held: the heap shrinks
+//	                                   at the next GC, RSS does not yet
+//	{"action": "gc"}                   runtime.GC(): heap_inuse falls, the
+//	                                   pages become heap_idle
+//	{"action": "free_os_memory"}       debug.FreeOSMemory(): idle pages are
+//	                                   returned (heap_released) and RSS drops
+//
+// The lesson is that a falling go_memstats_heap_inuse_bytes does not mean
+// the pod's memory falls with it: the scavenger returns idle pages lazily,
+// so RSS lags the heap and it is RSS that gets the pod OOMKilled. Holdings
+// are capped at MEMSTATS_MAX_HOLD_MB (default 1024).
+var (
+	memHeldMu sync.Mutex
+	memHeld   [][]byte
+
+	memHeldBytes = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "memstats_held_bytes",
+			Help: "Memory held by /debug/memstats allocate actions",
+		},
+		func() float64 {
+			memHeldMu.Lock()
+			defer memHeldMu.Unlock()
+			return float64(heldBytes())
+		},
+	)
+	memActions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "memstats_actions_total",
+			Help: "/debug/memstats actions by action (allocate, free, gc, free_os_memory)",
+		},
+		[]string{"action"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(memHeldBytes, memActions)
+}
+
+// heldBytes sums the holdings; memHeldMu must be held.
+func heldBytes() int {
+	n := 0
+	for _, b := range memHeld {
+		n += len(b)
+	}
+	return n
+}
+
+// residentBytes reads RSS from /proc/self/statm, or returns 0 off Linux.
+func residentBytes() uint64 {
+	raw, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, _ := strconv.ParseUint(fields[1], 10, 64)
+	return pages * uint64(os.Getpagesize())
+}
+
+func memReport() map[string]any {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	memHeldMu.Lock()
+	held := heldBytes()
+	memHeldMu.Unlock()
+	return map[string]any{
+		"rss_bytes":           residentBytes(),
+		"held_bytes":          held,
+		"heap_alloc_bytes":    m.HeapAlloc,
+		"heap_inuse_bytes":    m.HeapInuse,
+		"heap_idle_bytes":     m.HeapIdle,
+		"heap_released_bytes": m.HeapReleased,
+		"heap_sys_bytes":      m.HeapSys,
+		"sys_bytes":           m.Sys,
+		"next_gc_bytes":       m.NextGC,
+		"num_gc":              m.NumGC,
+		"memory_limit_bytes":  debug.SetMemoryLimit(-1),
+	}
+}
+
+func handleMemstats(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Action string `json:"action"`
+			MB     int    `json:"mb"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch req.Action {
+		case "allocate":
+			memHeldMu.Lock()
+			room := cfg.MemstatsMaxHoldMB<<20 - heldBytes()
+			if req.MB <= 0 || req.MB > room>>20 {
+				memHeldMu.Unlock()
+				writeProblem(w, r, fmt.Sprintf("mb must be between 1 and %d (MEMSTATS_MAX_HOLD_MB less what is held)", room>>20), http.StatusBadRequest)
+				return
+			}
+			b := make([]byte, req.MB<<20)
+			for i := 0; i < len(b); i += os.Getpagesize() {
+				b[i] = 1 // touch every page so it is resident
+			}
+			memHeld = append(memHeld, b)
+			memHeldMu.Unlock()
+		case "free":
+			memHeldMu.Lock()
+			memHeld = nil
+			memHeldMu.Unlock()
+		case "gc":
+			runtime.GC()
+		case "free_os_memory":
+			debug.FreeOSMemory()
+		default:
+			writeProblem(w, r, "action must be allocate, free, gc or free_os_memory", http.StatusBadRequest)
+			return
+		}
+		memActions.WithLabelValues(req.Action).Inc()
+		slog.Warn("Admin: memstats action", "action", req.Action, "mb", req.MB)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, memReport())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Scrape chaos, for demonstrating up, scrape_duration_seconds and
+// scrape_samples_scraped alerts from the target side.
+// METRICS_CHAOS_LATENCY_MS delays every /metrics response (past the
+// scrape_timeout it becomes a failed scrape), METRICS_CHAOS_ERROR_RATE
+// (percent) answers that share of scrapes with a 500, and
+// METRICS_CHAOS_EXTRA_SERIES pads the payload with that many synthetic
+// chaos_metrics_bloat series to trip sample_limit or body_size_limit, up to
+// metricsChaosMaxExtraSeries. All three are adjustable through
+// /admin/chaos/metrics.
+const metricsChaosMaxExtraSeries = 100000
+
+var (
+	metricsChaosLatencyMs atomic.Int64
+	metricsChaosErrorRate atomic.Int64
+	metricsChaosExtra     atomic.Int64
+)
+
+var metricsBloatDesc = prometheus.NewDesc("chaos_metrics_bloat",
+	"Synthetic series added to every scrape by METRICS_CHAOS_EXTRA_SERIES", []string{"series"}, nil)
+
+// metricsBloat is an unchecked collector: it describes nothing so its series
+// count can change between scrapes.
+type metricsBloat struct{}
+
+func (metricsBloat) Describe(chan<- *prometheus.Desc) {}
+
+func (metricsBloat) Collect(ch chan<- prometheus.Metric) {
+	n := metricsChaosExtra.Load()
+	for i := int64(0); i < n; i++ {
+		ch <- prometheus.MustNewConstMetric(metricsBloatDesc, prometheus.GaugeValue, float64(i), strconv.FormatInt(i, 10))
+	}
+}
+
+func init() {
+	prometheus.MustRegister(metricsBloat{})
+	metricsChaosLatencyMs.Store(int64(cfg.MetricsChaosLatencyMs))
+	metricsChaosErrorRate.Store(int64(cfg.MetricsChaosErrorRate))
+	metricsChaosExtra.Store(int64(cfg.MetricsChaosExtraSeries))
+}
+
+// metricsChaos wraps the /metrics handler.
+func metricsChaos(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ms := metricsChaosLatencyMs.Load(); ms > 0 {
+			select {
+			case <-time.After(time.Duration(ms) * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if rate := metricsChaosErrorRate.Load(); rate > 0 && rand.Int63n(100) < rate {
+			writeProblem(w, r, "metrics collection failed (chaos)", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAdminMetricsChaos reports or sets scrape chaos:
+// {"latency_ms": 15000, "error_rate": 30, "extra_series": 50000}.
+func handleAdminMetricsChaos(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			LatencyMs   *int64 `json:"latency_ms"`
+			ErrorRate   *int64 `json:"error_rate"`
+			ExtraSeries *int64 `json:"extra_series"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ExtraSeries != nil && (*req.ExtraSeries < 0 || *req.ExtraSeries > metricsChaosMaxExtraSeries) {
+			writeProblem(w, r, fmt.Sprintf("extra_series must be between 0 and %d", metricsChaosMaxExtraSeries), http.StatusBadRequest)
+			return
+		}
+		if req.LatencyMs != nil {
+			metricsChaosLatencyMs.Store(*req.LatencyMs)
+		}
+		if req.ErrorRate != nil {
+			metricsChaosErrorRate.Store(*req.ErrorRate)
+		}
+		if req.ExtraSeries != nil {
+			metricsChaosExtra.Store(*req.ExtraSeries)
+		}
+		slog.Warn("Admin: metrics endpoint chaos updated", "latency_ms", metricsChaosLatencyMs.Load(),
+			"error_rate", metricsChaosErrorRate.Load(), "extra_series", metricsChaosExtra.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"latency_ms":   metricsChaosLatencyMs.Load(),
+		"error_rate":   metricsChaosErrorRate.Load(),
+		"extra_series": metricsChaosExtra.Load(),
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrument wraps a route handler in an otelhttp server span named
+// "METHOD route" and enriches it with the v1.24 HTTP semantic conventions
+// that Tempo's service graphs and APM views key on.
+func instrument(route string, h http.HandlerFunc) http.Handler {
+	enriched := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer trackArrival(route)()
+		span := trace.SpanFromContext(r.Context())
+		ctx, budget := withLatencyBudget(context.WithValue(r.Context(), serverSpanKey{}, span))
+		ctx, cost := withRequestCost(ctx)
+		ctx = withRoutingKey(ctx, r)
+		ctx, requestID := withRequestID(ctx, w, r)
+		var debug *debugWriter
+		if mode := debugMode(r); mode != "" {
+			ctx, debug = newDebugWriter(ctx, w, mode)
+			w = debug
+		}
+		r = r.WithContext(ctx)
+		floodSpans(ctx)
+		client, resolution := resolveClientIP(r)
+		clientIPResolutions.WithLabelValues(resolution).Inc()
+		span.SetAttributes(
+			semconv.HTTPRoute(route),
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			semconv.ClientAddress(client),
+			semconv.UserAgentOriginal(r.UserAgent()),
+			attribute.String("app.request_id", requestID),
+		)
+		recordClientSegment(span, r)
+		if r.ContentLength > 0 {
+			span.SetAttributes(semconv.HTTPRequestBodySize(int(r.ContentLength)))
+		}
+
+		priority := requestPriority(r)
+		span.SetAttributes(attribute.String("app.priority", priority))
+
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		variant := assignVariant(route, r)
+		turnedAway, refused := false, false
+		release, admitted := admitRequest(priority)
+		if admitted {
+			func() {
+				defer release()
+				defer watchHandler(route)()
+				if !aclAllows(rw, r, client) {
+					return
+				}
+				if turnedAway = !maintenanceAllows(rw, r, route); turnedAway {
+					return
+				}
+				if refused = !readOnlyAllows(rw, r, route); refused {
+					return
+				}
+				if !quotaAllows(rw, r) {
+					return
+				}
+				if !sessionAllows(rw, r, route) {
+					return
+				}
+				applyLatencyRules(ctx, r)
+				durableWrite(ctx, route)
+				maybeGetStuck(ctx)
+				variant.serve(ctx, rw, r, h)
+			}()
+		} else {
+			shedRequest(rw, r, route, priority)
+		}
+		recordPriorityOutcome(priority, rw.status, !admitted)
+		noteRequestServed()
+
+		span.SetAttributes(
+			semconv.HTTPResponseStatusCode(rw.status),
+			semconv.HTTPResponseBodySize(rw.bytes),
+		)
+		elapsed := time.Since(start)
+		if elapsed > time.Duration(slowRequestMs)*time.Millisecond {
+			span.SetAttributes(attrSlow.Bool(true))
+		}
+		if admitted {
+			observeConcurrency(elapsed, rw.status, inflightCount.Load())
+		}
+		budget.record(span, route, elapsed)
+		cpu := budget.self(elapsed)
+		cost.record(span, route, cpu, rw.bytes)
+		recordEnergy(route, cpu)
+		if !turnedAway || !cfg.MaintenanceSLOExcluded {
+			recordSLI(route, rw.status, elapsed)
+		}
+		recordQuantiles(route, elapsed)
+		recordRequestKind(route, r.Method, rw.status, refused)
+		recordExperiment(variant, rw.status, elapsed)
+		observeAnomalySignals(rw.status, elapsed)
+		if debug != nil {
+			debug.flush(span, elapsed, cpu)
+		}
+		logRequest(r.Context(), route, rw.status, elapsed)
+	})
+
+	return otelhttp.NewHandler(enriched, route,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + route
+		}),
+	)
+}
+
+type serverSpanKey struct{}
+
+// serverSpan returns the request's server span from anywhere below it in
+// the span tree, falling back to the current span outside instrument().
+func serverSpan(ctx context.Context) trace.Span {
+	if span, ok := ctx.Value(serverSpanKey{}).(trace.Span); ok {
+		return span
+	}
+	return trace.SpanFromContext(ctx)
+}
+
+// responseRecorder captures the status code and body size written by a handler.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rw *responseRecorder) WriteHeader(code int) {
+	if !rw.wroteHeader {
+		rw.status = code
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
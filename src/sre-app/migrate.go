@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// Schema migrations, golang-migrate style. The numbered
+// migrations/NNNN_name.up.sql files are embedded in the binary and applied
+// in order by the init phase's migrate_schema step, each in a
+// "db.migration" span under "db.migrate". The applied version is kept in a
+// schema_migrations (version, dirty) table: a migration is marked dirty
+// before it runs and clean after, so one that fails leaves the schema dirty
+// at its version and every later start refuses to migrate until the
+// version is forced by hand.
+//
+//	DATABASE_URL              Postgres to migrate (a secret, so also
+//	                          DATABASE_URL_FILE); unset, the simulated
+//	                          checkout database, which starts empty with
+//	                          every process
+//	DATABASE_DRIVER           database/sql driver for DATABASE_URL (default
+//	                          pgx); none is linked in, so a real database
+//	                          needs its blank import added to main.go
+//	MIGRATE_ON_STARTUP        run the migrations at all (default true)
+//	MIGRATION_INJECT_FAILURE  append a migration that always fails (default
+//	                          false): the new version crash-loops and the
+//	                          rollout stalls
+//
+//go:embed migrations/*.up.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// injectedMigrationSQL references a column no earlier migration creates.
+const injectedMigrationSQL = "ALTER TABLE orders ALTER COLUMN shipped_at SET NOT NULL;"
+
+var (
+	migrationsApplied = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "migrations_applied_total",
+		Help: "Schema migrations applied successfully",
+	})
+	migrationsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "migrations_failed_total",
+		Help: "Schema migrations that failed and left the schema dirty",
+	})
+	schemaVersion = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "schema_migration_version",
+		Help: "Schema version the database is at",
+	})
+	schemaDirty = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "schema_migration_dirty",
+		Help: "1 while the schema is dirty from a failed migration",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(migrationsApplied, migrationsFailed, schemaVersion, schemaDirty)
+}
+
+// loadMigrations parses the embedded files, in version order, plus the
+// injected failure when MIGRATION_INJECT_FAILURE is set.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	var out []migration
+	for _, entry := range entries {
+		base := strings.TrimSuffix(entry.Name(), ".up.sql")
+		num, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %s: name is not NNNN_name.up.sql", entry.Name())
+		}
+		body, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, migration{version: version, name: name, sql: string(body)})
+	}
+	if cfg.MigrationInjectFailure {
+		last := 0
+		if len(out) > 0 {
+			last = out[len(out)-1].version
+		}
+		out = append(out, migration{version: last + 1, name: "injected_failure", sql: injectedMigrationSQL})
+	}
+	return out, nil
+}
+
+// migrationTarget is the database the runner migrates.
+type migrationTarget interface {
+	// version reports the schema version and whether it is dirty.
+	version(ctx context.Context) (int, bool, error)
+	setVersion(ctx context.Context, version int, dirty bool) error
+	exec(ctx context.Context, statement string) error
+}
+
+// sqlTarget migrates a real database through database/sql.
+type sqlTarget struct{ db *sql.DB }
+
+func (t sqlTarget) version(ctx context.Context) (int, bool, error) {
+	if _, err := t.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)"); err != nil {
+		return 0, false, err
+	}
+	var version int
+	var dirty bool
+	err := t.db.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+func (t sqlTarget) setVersion(ctx context.Context, version int, dirty bool) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)", version, dirty); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (t sqlTarget) exec(ctx context.Context, statement string) error {
+	_, err := t.db.ExecContext(ctx, statement)
+	return err
+}
+
+// simTarget migrates the simulated checkout database: each statement takes
+// a pooled connection and a few milliseconds, plus any /admin/chaos/dbpool
+// slowdown, and the injected migration fails as Postgres would.
+type simTarget struct {
+	mu             sync.Mutex
+	currentVersion int
+	dirty          bool
+}
+
+func (t *simTarget) version(context.Context) (int, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.currentVersion, t.dirty, nil
+}
+
+func (t *simTarget) setVersion(_ context.Context, version int, dirty bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.currentVersion, t.dirty = version, dirty
+	return nil
+}
+
+func (t *simTarget) exec(ctx context.Context, statement string) error {
+	release, _, err := dbPool.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	for range strings.Count(statement, ";") {
+		time.Sleep(time.Duration(15+dbSlowQueryMs.Load()) * time.Millisecond)
+	}
+	if statement == injectedMigrationSQL {
+		return errors.New(`ERROR: column "shipped_at" of relation "orders" does not exist (SQLSTATE 42703)`)
+	}
+	return nil
+}
+
+func migrationTargetFromEnv() (migrationTarget, string, error) {
+	url := databaseURL.get()
+	if url == "" {
+		return &simTarget{}, "simulated", nil
+	}
+	driver := os.Getenv("DATABASE_DRIVER")
+	if driver == "" {
+		driver = "pgx"
+	}
+	db, err := sql.Open(driver, url)
+	if err != nil {
+		return nil, driver, err
+	}
+	return sqlTarget{db}, driver, nil
+}
+
+// runMigrations is the init phase's migrate_schema step.
+func runMigrations(ctx context.Context) (err error) {
+	if !cfg.MigrateOnStartup {
+		slog.Info("startup: migrations skipped", "reason", "MIGRATE_ON_STARTUP=false")
+		return nil
+	}
+	ctx, span := tracer.Start(ctx, "db.migrate")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	target, driver, err := migrationTargetFromEnv()
+	if err != nil {
+		return fmt.Errorf("open database (driver %s): %w", driver, err)
+	}
+	if db, ok := target.(sqlTarget); ok {
+		defer db.db.Close()
+	}
+	span.SetAttributes(semconv.DBSystemPostgreSQL, semconv.DBName("checkout"), attribute.String("app.migration.driver", driver))
+
+	current, dirty, err := target.version(ctx)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	schemaVersion.Set(float64(current))
+	if dirty {
+		schemaDirty.Set(1)
+		return fmt.Errorf("dirty database version %d: fix it and force the version", current)
+	}
+	span.SetAttributes(attribute.Int("app.migration.from_version", current))
+
+	applied := 0
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, target, m); err != nil {
+			return err
+		}
+		current = m.version
+		applied++
+	}
+	span.SetAttributes(attribute.Int("app.migration.to_version", current), attribute.Int("app.migration.applied", applied))
+	slog.Info("startup: schema up to date", "version", current, "applied", applied, "driver", driver)
+	return nil
+}
+
+func applyMigration(ctx context.Context, target migrationTarget, m migration) (err error) {
+	ctx, span := tracer.Start(ctx, "db.migration")
+	defer span.End()
+	span.SetAttributes(
+		semconv.DBSystemPostgreSQL,
+		semconv.DBStatement(m.sql),
+		attribute.Int("app.migration.version", m.version),
+		attribute.String("app.migration.name", m.name),
+	)
+	slog.Info("startup: applying migration", "version", m.version, "name", m.name)
+
+	start := time.Now()
+	if err = target.setVersion(ctx, m.version, true); err == nil {
+		if err = target.exec(ctx, m.sql); err == nil {
+			err = target.setVersion(ctx, m.version, false)
+		}
+	}
+	if err != nil {
+		migrationsFailed.Inc()
+		schemaVersion.Set(float64(m.version))
+		schemaDirty.Set(1)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+	}
+	migrationsApplied.Inc()
+	schemaVersion.Set(float64(m.version))
+	slog.Info("startup: migration applied", "version", m.version, "name", m.name, "took", time.Since(start).Round(time.Millisecond).String())
+	return nil
+}
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS orders (
+    id          bigserial PRIMARY KEY,
+    customer_id text        NOT NULL,
+    total       numeric(12, 2) NOT NULL,
+    created_at  timestamptz NOT NULL DEFAULT now()
+);
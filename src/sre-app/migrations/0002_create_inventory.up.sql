@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS products (
+    sku      text PRIMARY KEY,
+    name     text    NOT NULL,
+    category text    NOT NULL,
+    price    numeric(12, 2) NOT NULL,
+    score    real    NOT NULL DEFAULT 0,
+    active   boolean NOT NULL DEFAULT true
+);
+CREATE TABLE IF NOT EXISTS inventory (
+    sku       text PRIMARY KEY REFERENCES products (sku),
+    available integer NOT NULL DEFAULT 0,
+    reserved  integer NOT NULL DEFAULT 0
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id            uuid PRIMARY KEY,
+    aggregate_id  text  NOT NULL,
+    type          text  NOT NULL,
+    payload       jsonb NOT NULL,
+    trace_context jsonb,
+    created_at    timestamptz NOT NULL DEFAULT now()
+);
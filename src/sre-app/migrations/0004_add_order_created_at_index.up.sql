@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS orders_created_at_idx ON orders (created_at);
+CREATE INDEX IF NOT EXISTS orders_customer_id_idx ON orders (customer_id);
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Order notifications. Once the orders consumer has processed an order, an
+// "order completed" notification is queued on the "notifications" worker
+// pool (NOTIFY_WORKERS, default 2; NOTIFY_QUEUE_SIZE, default 1000) and sent
+// to NOTIFY_SINK: an http(s) URL receives a JSON webhook POST, and
+// smtp://host:port (MailHog in the lab) receives an email. Failed sends are
+// retried up to NOTIFY_MAX_ATTEMPTS (default 5) with exponential backoff from
+// NOTIFY_RETRY_BACKOFF_MS (default 200). Delivery latency is measured from
+// the order being placed, so a slow or failing sink shows up as a lagging
+// pipeline. NOTIFY_FAILURE_RATE (percent) and NOTIFY_LATENCY_MS add sink
+// chaos, adjustable through /admin/chaos/notifications.
+var (
+	notifySink         *url.URL
+	notifyChannel      string
+	notifyPool         *workerPool
+	notifyMaxAttempts  = 5
+	notifyRetryBackoff = 200 * time.Millisecond
+	notifyFailureRate  atomic.Int64
+	notifyLatencyMs    atomic.Int64
+	notifyHTTPClient   = &http.Client{
+		Transport: otelhttp.NewTransport(credentialURLTransport{http.DefaultTransport}),
+		Timeout:   5 * time.Second,
+	}
+)
+
+var (
+	notificationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "notifications_total",
+			Help: "Order notifications by channel and outcome (delivered, failed, dropped)",
+		},
+		[]string{"channel", "outcome"},
+	)
+	notificationDeliveryLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "notification_delivery_latency_seconds",
+			Help:    "Time from an order being placed to its notification being delivered",
+			Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+		},
+		[]string{"channel"},
+	)
+	notificationAttempts = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "notification_attempts",
+			Help:    "Send attempts per notification, delivered or not",
+			Buckets: []float64{1, 2, 3, 4, 5, 8, 10},
+		},
+		[]string{"channel"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(notificationsTotal, notificationDeliveryLatency, notificationAttempts)
+}
+
+func startNotifications() {
+	sink := os.Getenv("NOTIFY_SINK")
+	if sink == "" {
+		return
+	}
+	u, err := url.Parse(sink)
+	switch {
+	case err != nil || u.Host == "":
+		slog.Error("Ignoring invalid NOTIFY_SINK", "value", sink)
+		return
+	case u.Scheme == "smtp":
+		notifyChannel = "email"
+	case u.Scheme == "http" || u.Scheme == "https":
+		notifyChannel = "webhook"
+	default:
+		slog.Error("NOTIFY_SINK must be an http(s) or smtp URL", "value", sink)
+		return
+	}
+	notifySink = u
+
+	notifyMaxAttempts = cfg.NotifyMaxAttempts
+	notifyRetryBackoff = time.Duration(cfg.NotifyRetryBackoffMs) * time.Millisecond
+	notifyFailureRate.Store(int64(cfg.NotifyFailureRate))
+	notifyLatencyMs.Store(int64(cfg.NotifyLatencyMs))
+	notifyPool = newWorkerPool("notifications", cfg.NotifyWorkers, cfg.NotifyQueueSize)
+	for _, outcome := range []string{"delivered", "failed", "dropped"} {
+		notificationsTotal.WithLabelValues(notifyChannel, outcome)
+	}
+}
+
+// notifyOrderCompleted queues the notification for a processed order event.
+func notifyOrderCompleted(ctx context.Context, msg queueMessage) {
+	if notifySink == nil {
+		return
+	}
+	var order struct {
+		OrderID  int64     `json:"order_id"`
+		PlacedAt time.Time `json:"placed_at"`
+	}
+	json.Unmarshal(msg.Body, &order)
+	link := trace.Link{SpanContext: trace.SpanContextFromContext(ctx)}
+	err := notifyPool.submit(func() { sendNotification(link, order.OrderID, order.PlacedAt) })
+	if err != nil {
+		notificationsTotal.WithLabelValues(notifyChannel, "dropped").Inc()
+		slog.WarnContext(ctx, "Dropping order notification", "order_id", order.OrderID, "error", err)
+	}
+}
+
+func sendNotification(link trace.Link, orderID int64, placedAt time.Time) {
+	ctx, span := tracer.Start(context.Background(), "notification.send",
+		trace.WithLinks(link),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("app.notification.channel", notifyChannel),
+			attribute.Int64("app.order.id", orderID),
+		))
+	defer span.End()
+
+	var err error
+	attempts := 0
+	for attempts < notifyMaxAttempts {
+		if attempts > 0 {
+			time.Sleep(notifyRetryBackoff << (attempts - 1))
+		}
+		attempts++
+		if err = deliverNotification(ctx, orderID); err == nil {
+			break
+		}
+		span.AddEvent("delivery failed", trace.WithAttributes(
+			attribute.Int("app.notification.attempt", attempts),
+			attribute.String("exception.message", err.Error()),
+		))
+	}
+	span.SetAttributes(attribute.Int("app.notification.attempts", attempts))
+	notificationAttempts.WithLabelValues(notifyChannel).Observe(float64(attempts))
+	if err != nil {
+		notificationsTotal.WithLabelValues(notifyChannel, "failed").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "Order notification undeliverable", "order_id", orderID, "attempts", attempts, "error", err)
+		return
+	}
+	notificationsTotal.WithLabelValues(notifyChannel, "delivered").Inc()
+	if !placedAt.IsZero() {
+		notificationDeliveryLatency.WithLabelValues(notifyChannel).Observe(time.Since(placedAt).Seconds())
+	}
+}
+
+// deliverNotification makes one attempt against the sink.
+func deliverNotification(ctx context.Context, orderID int64) error {
+	if latency := notifyLatencyMs.Load(); latency > 0 {
+		time.Sleep(time.Duration(latency) * time.Millisecond)
+	}
+	if rate := notifyFailureRate.Load(); rate > 0 && rand.Int63n(100) < rate {
+		trace.SpanFromContext(ctx).SetAttributes(attrFaultInjected.Bool(true))
+		return fmt.Errorf("notification sink unavailable (injected)")
+	}
+
+	if notifyChannel == "email" {
+		to := fmt.Sprintf("customer-%d@example.com", orderID)
+		body := fmt.Sprintf("To: %s\r\nFrom: orders@example.com\r\nSubject: Order %d completed\r\n\r\nYour order %d has been processed.\r\n", to, orderID, orderID)
+		return smtp.SendMail(notifySink.Host, nil, "orders@example.com", []string{to}, []byte(body))
+	}
+	payload, _ := json.Marshal(map[string]any{"event": "order.completed", "order_id": orderID, "pod": podName()})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, notifySink.String(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := notifyHTTPClient.Do(req)
+	if uerr := (*url.Error)(nil); errors.As(err, &uerr) {
+		uerr.URL = credentialURL(req.URL)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// handleAdminNotifications reports or sets sink chaos:
+// {"failure_rate": 50, "latency_ms": 2000}.
+func handleAdminNotifications(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			FailureRate *int64 `json:"failure_rate"`
+			LatencyMs   *int64 `json:"latency_ms"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.FailureRate != nil {
+			notifyFailureRate.Store(*req.FailureRate)
+		}
+		if req.LatencyMs != nil && *req.LatencyMs >= 0 {
+			notifyLatencyMs.Store(*req.LatencyMs)
+		}
+		slog.Warn("Admin: notification chaos updated", "failure_rate", notifyFailureRate.Load(), "latency_ms", notifyLatencyMs.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sink := ""
+	if notifySink != nil {
+		sink = notifySink.Redacted()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"sink":         sink,
+		"channel":      notifyChannel,
+		"failure_rate": notifyFailureRate.Load(),
+		"latency_ms":   notifyLatencyMs.Load(),
+		"max_attempts": notifyMaxAttempts,
+	})
+}
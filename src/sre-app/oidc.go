@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Simulated OIDC login. /login runs the authorization code flow against a mock
+// identity provider: the authorize step returns a code for the user (?user=,
+// else X-Session-ID), the token step exchanges it for tokens, and the app
+// answers with them and a session (sessions.go). Each provider call is an
+// "oidc.<step>" client span with peer.service=identity-provider taking
+// OIDC_PROVIDER_LATENCY_MS (default 60, jittered like the payment provider)
+// and failing OIDC_PROVIDER_ERROR_RATE percent of the time with a 503. The
+// whole login gives up after OIDC_LOGIN_TIMEOUT_MS (default 3000) with a 504;
+// provider errors are a 502. The provider serves OIDC_PROVIDER_CONCURRENCY
+// calls at a time (default 8); the rest queue, and the wait counts against the
+// login timeout.
+//
+// The rest of the API never calls the provider, so a provider outage
+// (/admin/chaos/oidc) has its own signature: oidc_logins_total{outcome}
+// and /login's error rate and latency go bad while every other route stays
+// green, and nothing recovers until the provider does.
+var (
+	oidcLatencyMs     atomic.Int64
+	oidcErrorRate     atomic.Int64
+	oidcLoginTimeout  atomic.Int64 // ms
+	oidcProviderSlots chan struct{}
+
+	errOIDCProvider = errors.New("identity provider returned 503")
+
+	oidcLogins = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oidc_logins_total",
+			Help: "Login attempts by outcome (success, provider_error, timeout)",
+		},
+		[]string{"outcome"},
+	)
+	oidcProviderDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "oidc_provider_request_duration_seconds",
+			Help:    "Calls to the identity provider by step (authorize, token) and outcome (ok, error, timeout)",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"step", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(oidcLogins, oidcProviderDuration)
+	oidcLatencyMs.Store(int64(cfg.OIDCProviderLatencyMs))
+	oidcErrorRate.Store(int64(cfg.OIDCProviderErrorRate))
+	oidcLoginTimeout.Store(int64(cfg.OIDCLoginTimeoutMs))
+	oidcProviderSlots = make(chan struct{}, cfg.OIDCProviderConcurrency)
+	for _, outcome := range []string{"success", "provider_error", "timeout"} {
+		oidcLogins.WithLabelValues(outcome)
+	}
+}
+
+type oidcTokens struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// oidcProviderCall is one request to the identity provider.
+func oidcProviderCall(ctx context.Context, step string) error {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "oidc."+step, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("peer.service", "identity-provider"),
+	))
+	defer span.End()
+	defer func() { addDownstreamTime(ctx, time.Since(start)) }()
+
+	outcome := "ok"
+	defer func() {
+		oidcProviderDuration.WithLabelValues(step, outcome).Observe(time.Since(start).Seconds())
+	}()
+	select {
+	case oidcProviderSlots <- struct{}{}:
+		defer func() { <-oidcProviderSlots }()
+	case <-ctx.Done():
+		outcome = "timeout"
+		span.RecordError(ctx.Err())
+		span.SetStatus(codes.Error, "login timed out queueing for the identity provider")
+		return ctx.Err()
+	}
+	span.SetAttributes(attribute.Float64("app.oidc.queue_ms", float64(time.Since(start).Microseconds())/1000))
+	latency := oidcLatencyMs.Load()
+	select {
+	case <-time.After(time.Duration(latency/2+mrand.Int63n(latency+1)) * time.Millisecond):
+	case <-ctx.Done():
+		outcome = "timeout"
+		span.RecordError(ctx.Err())
+		span.SetStatus(codes.Error, "login timed out waiting for the identity provider")
+		return ctx.Err()
+	}
+	if rate := oidcErrorRate.Load(); rate > 0 && mrand.Int63n(100) < rate {
+		outcome = "error"
+		noteChaos(ctx, "oidc %s: %v", step, errOIDCProvider)
+		span.RecordError(errOIDCProvider)
+		span.SetStatus(codes.Error, errOIDCProvider.Error())
+		return errOIDCProvider
+	}
+	return nil
+}
+
+// oidcLogin runs the code flow for user.
+func oidcLogin(ctx context.Context, user string) (oidcTokens, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(oidcLoginTimeout.Load())*time.Millisecond)
+	defer cancel()
+	for _, step := range []string{"authorize", "token"} {
+		if err := oidcProviderCall(ctx, step); err != nil {
+			return oidcTokens{}, err
+		}
+	}
+	tokens := oidcTokens{
+		AccessToken: randomToken(),
+		IDToken:     "mock." + fingerprint(user) + "." + randomToken(),
+		TokenType:   "Bearer",
+	}
+	tokens.ExpiresIn = int(createSession(tokens.AccessToken, user).Seconds())
+	return tokens, nil
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := tracer.Start(r.Context(), "handleLogin")
+	defer span.End()
+
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		user = r.Header.Get("X-Session-ID")
+	}
+	if user == "" {
+		user = "anonymous"
+	}
+	tokens, err := oidcLogin(ctx, user)
+	status := http.StatusOK
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+		oidcLogins.WithLabelValues("timeout").Inc()
+		markFault(ctx, fmt.Errorf("login: identity provider timed out"))
+		writeProblem(w, r, "identity provider did not answer in time", status)
+	case err != nil:
+		status = http.StatusBadGateway
+		oidcLogins.WithLabelValues("provider_error").Inc()
+		markFault(ctx, fmt.Errorf("login: %w", err))
+		writeProblem(w, r, "login failed: "+err.Error(), status)
+	default:
+		oidcLogins.WithLabelValues("success").Inc()
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: tokens.AccessToken, Path: "/", MaxAge: tokens.ExpiresIn, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		writeJSON(w, status, tokens)
+	}
+	httpRequestsTotal.WithLabelValues("/login", strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues("/login").Observe(time.Since(start).Seconds())
+}
+
+// handleAdminOIDC reports or sets identity provider chaos:
+// {"latency_ms": 5000, "error_rate": 100, "login_timeout_ms": 3000}.
+func handleAdminOIDC(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			LatencyMs      *int64 `json:"latency_ms"`
+			ErrorRate      *int64 `json:"error_rate"`
+			LoginTimeoutMs *int64 `json:"login_timeout_ms"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case req.LatencyMs != nil && *req.LatencyMs < 0:
+			writeProblem(w, r, "latency_ms must not be negative", http.StatusBadRequest)
+			return
+		case req.ErrorRate != nil && (*req.ErrorRate < 0 || *req.ErrorRate > 100):
+			writeProblem(w, r, "error_rate must be between 0 and 100", http.StatusBadRequest)
+			return
+		case req.LoginTimeoutMs != nil && *req.LoginTimeoutMs <= 0:
+			writeProblem(w, r, "login_timeout_ms must be positive", http.StatusBadRequest)
+			return
+		}
+		if req.LatencyMs != nil {
+			oidcLatencyMs.Store(*req.LatencyMs)
+		}
+		if req.ErrorRate != nil {
+			oidcErrorRate.Store(*req.ErrorRate)
+		}
+		if req.LoginTimeoutMs != nil {
+			oidcLoginTimeout.Store(*req.LoginTimeoutMs)
+		}
+		slog.Warn("Admin: identity provider chaos updated", "latency_ms", oidcLatencyMs.Load(), "error_rate", oidcErrorRate.Load(), "login_timeout_ms", oidcLoginTimeout.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"latency_ms":       oidcLatencyMs.Load(),
+		"error_rate":       oidcErrorRate.Load(),
+		"login_timeout_ms": oidcLoginTimeout.Load(),
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Order lifecycle events with per-key ordering. Every fulfilled order emits
+// picked, packed, shipped and delivered (sequence 1-4, keyed by order ID).
+// With ORDERED_PROCESSING=true (the default) they run on
+// ORDER_EVENT_PARTITIONS workers (default 4), each order hashed to one
+// partition, the way a partitioned log keeps per-key order while keys
+// proceed in parallel; with false any worker takes any event, so events of
+// one order race each other. The worker keeps the last sequence applied per
+// order and counts violations in event_ordering_violations_total:
+//
+//	stale  the event is older than one already applied; it is dropped, the
+//	       customer would otherwise see "packed" after "shipped"
+//	gap    the event skips ahead of a missing one, which arrives stale later
+//
+// ORDER_EVENT_REORDER_RATE (percent) holds that share of events back by
+// ORDER_EVENT_REORDER_DELAY_MS (default 200) before publishing, so later
+// events of the same order overtake them even in ordered mode.
+// /admin/chaos/ordering changes both at runtime.
+type orderEvent struct {
+	OrderID int64
+	Seq     int
+	Type    string
+}
+
+var orderEventTypes = []string{"picked", "packed", "shipped", "delivered"}
+
+var (
+	orderEventsOrdered atomic.Bool
+	orderEventReorder  atomic.Int64
+	orderEventDelay    time.Duration
+
+	orderEventPartitions []chan orderEvent
+	orderEventShared     chan orderEvent
+
+	orderEventMu   sync.Mutex
+	orderEventLast = map[int64]int{} // order ID -> last sequence applied
+	orderEventRing []int64
+	orderEventNext int
+
+	orderEventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "order_events_total",
+			Help: "Order lifecycle events by outcome (applied, stale: dropped as out of order, dropped: partition full)",
+		},
+		[]string{"outcome"},
+	)
+	eventOrderingViolations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "event_ordering_violations_total",
+			Help: "Order lifecycle events that arrived out of sequence, by kind (stale, gap)",
+		},
+		[]string{"kind"},
+	)
+	orderEventsReordered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "order_events_reordered_total",
+		Help: "Order lifecycle events held back by ORDER_EVENT_REORDER_RATE",
+	})
+	orderEventDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "order_event_partition_depth",
+			Help: "Events waiting per partition (shared: unordered mode)",
+		},
+		[]string{"partition"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(orderEventsTotal, eventOrderingViolations, orderEventsReordered, orderEventDepth)
+	for _, kind := range []string{"stale", "gap"} {
+		eventOrderingViolations.WithLabelValues(kind)
+	}
+}
+
+func startOrderEvents() {
+	orderEventsOrdered.Store(cfg.OrderedProcessing)
+	orderEventReorder.Store(int64(cfg.OrderEventReorderRate))
+	orderEventDelay = time.Duration(cfg.OrderEventReorderDelayMs) * time.Millisecond
+	orderEventRing = make([]int64, 10000)
+	orderEventShared = make(chan orderEvent, 1000)
+	orderEventPartitions = make([]chan orderEvent, cfg.OrderEventPartitions)
+	for i := range orderEventPartitions {
+		orderEventPartitions[i] = make(chan orderEvent, 1000)
+		go runOrderEventWorker(strconv.Itoa(i), orderEventPartitions[i])
+		// As many workers again share one queue for unordered mode.
+		go runOrderEventWorker("shared", orderEventShared)
+	}
+}
+
+// publishOrderEvents emits an order's lifecycle after fulfilment.
+func publishOrderEvents(body []byte) {
+	var order struct {
+		OrderID int64 `json:"order_id"`
+	}
+	if json.Unmarshal(body, &order) != nil || orderEventPartitions == nil {
+		return
+	}
+	for i, typ := range orderEventTypes {
+		ev := orderEvent{OrderID: order.OrderID, Seq: i + 1, Type: typ}
+		if rate := orderEventReorder.Load(); rate > 0 && rand.Int63n(100) < rate {
+			orderEventsReordered.Inc()
+			time.AfterFunc(orderEventDelay, func() { dispatchOrderEvent(ev) })
+			continue
+		}
+		dispatchOrderEvent(ev)
+	}
+}
+
+func dispatchOrderEvent(ev orderEvent) {
+	ch := orderEventShared
+	if orderEventsOrdered.Load() {
+		ch = orderEventPartitions[uint64(ev.OrderID)%uint64(len(orderEventPartitions))]
+	}
+	select {
+	case ch <- ev:
+	default:
+		orderEventsTotal.WithLabelValues("dropped").Inc()
+	}
+}
+
+func runOrderEventWorker(partition string, events chan orderEvent) {
+	depth := orderEventDepth.WithLabelValues(partition)
+	for ev := range events {
+		depth.Set(float64(len(events)))
+		time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
+		applyOrderEvent(ev)
+	}
+}
+
+// applyOrderEvent moves the order to ev unless a later event got there
+// first.
+func applyOrderEvent(ev orderEvent) {
+	orderEventMu.Lock()
+	last, known := orderEventLast[ev.OrderID]
+	if !known {
+		if old := orderEventRing[orderEventNext]; old != 0 {
+			delete(orderEventLast, old)
+		}
+		orderEventRing[orderEventNext] = ev.OrderID
+		orderEventNext = (orderEventNext + 1) % len(orderEventRing)
+	}
+	stale := ev.Seq <= last
+	if !stale {
+		orderEventLast[ev.OrderID] = ev.Seq
+	}
+	orderEventMu.Unlock()
+
+	switch {
+	case stale:
+		eventOrderingViolations.WithLabelValues("stale").Inc()
+		orderEventsTotal.WithLabelValues("stale").Inc()
+		slog.Warn("Dropping out-of-order event", "order_id", ev.OrderID, "event", ev.Type, "seq", ev.Seq, "last_seq", last)
+		return
+	case ev.Seq > last+1:
+		eventOrderingViolations.WithLabelValues("gap").Inc()
+	}
+	orderEventsTotal.WithLabelValues("applied").Inc()
+	broadcastOrderStatus(ev)
+}
+
+func handleAdminOrdering(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Ordered     *bool  `json:"ordered"`
+			ReorderRate *int64 `json:"reorder_rate"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ReorderRate != nil {
+			if *req.ReorderRate < 0 || *req.ReorderRate > 100 {
+				writeProblem(w, r, "reorder_rate must be 0-100", http.StatusBadRequest)
+				return
+			}
+			orderEventReorder.Store(*req.ReorderRate)
+		}
+		if req.Ordered != nil {
+			orderEventsOrdered.Store(*req.Ordered)
+		}
+		slog.Warn("Admin: order event ordering updated", "ordered", orderEventsOrdered.Load(), "reorder_rate", orderEventReorder.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"ordered":          orderEventsOrdered.Load(),
+		"reorder_rate":     orderEventReorder.Load(),
+		"reorder_delay_ms": orderEventDelay.Milliseconds(),
+		"partitions":       len(orderEventPartitions),
+	})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Order store and consistency checker. placeOrder keeps the last
+// ORDER_STORE_CAPACITY orders (default 10000) with their lines in memory,
+// standing in for the orders table. Every CONSISTENCY_CHECK_INTERVAL_S
+// (default 30; 0 disables) a checker scans them for broken invariants:
+//
+//	total     the order total equals the sum of quantity × unit price
+//	quantity  every line has a positive quantity
+//	lines     the order has at least one line
+//
+// Each newly broken record counts once in data_inconsistencies_total and
+// data_inconsistent_records is the current count, so data-quality alerts
+// can fire while every request still returns 200. /admin/chaos/corruption
+// damages records: {"records": 5, "invariant": "total"}; {"repair": true}
+// recomputes them from their lines.
+type orderLine struct {
+	SKU       string  `json:"sku"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+}
+
+type storedOrder struct {
+	ID       int64       `json:"id"`
+	Lines    []orderLine `json:"lines"`
+	Total    float64     `json:"total"`
+	PlacedAt time.Time   `json:"placed_at"`
+}
+
+var orderInvariants = []string{"total", "quantity", "lines"}
+
+var (
+	orderStoreMu   sync.Mutex
+	orderStore     = map[int64]*storedOrder{}
+	orderStoreRing []int64 // insertion order, for eviction
+	orderStoreNext int
+	inconsistent   = map[int64]string{} // order ID -> broken invariant, as of the last check
+
+	dataInconsistencies = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_inconsistencies_total",
+			Help: "Stored orders found breaking an invariant (total, quantity, lines), counted once per record",
+		},
+		[]string{"invariant"},
+	)
+	dataInconsistentRecords = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "data_inconsistent_records",
+			Help: "Stored orders breaking each invariant at the last consistency check",
+		},
+		[]string{"invariant"},
+	)
+	consistencyChecks = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "consistency_check_duration_seconds",
+		Help:    "Duration of consistency checker scans",
+		Buckets: []float64{.0001, .001, .01, .05, .1, .5, 1},
+	})
+	consistencyLastCheck = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consistency_last_check_timestamp_seconds",
+		Help: "Unix time of the last consistency check",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(dataInconsistencies, dataInconsistentRecords, consistencyChecks, consistencyLastCheck)
+	for _, inv := range orderInvariants {
+		dataInconsistencies.WithLabelValues(inv)
+		dataInconsistentRecords.WithLabelValues(inv)
+	}
+}
+
+// orderTotals returns how many items lines hold and what they cost.
+func orderTotals(lines []orderLine) (int, float64) {
+	items, total := 0, 0.0
+	for _, l := range lines {
+		items += l.Quantity
+		total += float64(l.Quantity) * l.UnitPrice
+	}
+	return items, math.Round(total*100) / 100
+}
+
+// catalogPrice returns the list price of sku, or 0 for an unknown one.
+func catalogPrice(sku string) float64 {
+	for _, item := range catalogItems {
+		if item["sku"] == sku {
+			return item["price"].(float64)
+		}
+	}
+	return 0
+}
+
+func storeOrder(id int64, lines []orderLine) {
+	_, total := orderTotals(lines)
+	o := storedOrder{ID: id, Lines: append([]orderLine(nil), lines...), Total: total, PlacedAt: time.Now()}
+	start := time.Now()
+	orderStoreMu.Lock()
+	if orderStoreRing == nil {
+		orderStoreRing = make([]int64, cfg.OrderStoreCapacity)
+	}
+	if old := orderStoreRing[orderStoreNext]; old != 0 {
+		delete(orderStore, old)
+		delete(inconsistent, old)
+		shadowStore.forget(old)
+	}
+	orderStoreRing[orderStoreNext] = id
+	orderStoreNext = (orderStoreNext + 1) % len(orderStoreRing)
+	orderStore[id] = &o
+	// The shadow's copy is taken before corruptOrders can reach o.
+	shadow := o
+	shadow.Lines = slices.Clone(o.Lines)
+	orderStoreMu.Unlock()
+	storeBackendDuration.WithLabelValues("primary", "write").Observe(time.Since(start).Seconds())
+	dualWrite(shadow)
+}
+
+// brokenInvariant returns the first invariant o breaks, or "".
+func (o *storedOrder) brokenInvariant() string {
+	if len(o.Lines) == 0 {
+		return "lines"
+	}
+	for _, l := range o.Lines {
+		if l.Quantity <= 0 {
+			return "quantity"
+		}
+	}
+	if _, total := orderTotals(o.Lines); math.Abs(total-o.Total) > 0.005 {
+		return "total"
+	}
+	return ""
+}
+
+func checkConsistency() {
+	start := time.Now()
+	orderStoreMu.Lock()
+	counts := map[string]int{}
+	found := map[int64]string{}
+	for id, o := range orderStore {
+		inv := o.brokenInvariant()
+		if inv == "" {
+			continue
+		}
+		found[id] = inv
+		counts[inv]++
+		if inconsistent[id] != inv {
+			dataInconsistencies.WithLabelValues(inv).Inc()
+			slog.Warn("Data inconsistency found", "order_id", id, "invariant", inv)
+		}
+	}
+	inconsistent = found
+	orderStoreMu.Unlock()
+	for _, inv := range orderInvariants {
+		dataInconsistentRecords.WithLabelValues(inv).Set(float64(counts[inv]))
+	}
+	consistencyChecks.Observe(time.Since(start).Seconds())
+	consistencyLastCheck.SetToCurrentTime()
+}
+
+func startConsistencyChecker() {
+	if cfg.ConsistencyCheckIntervalS == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(cfg.ConsistencyCheckIntervalS) * time.Second) {
+			checkConsistency()
+		}
+	}()
+}
+
+// corruptOrders breaks invariant on up to n random stored orders.
+func corruptOrders(n int, invariant string) int {
+	orderStoreMu.Lock()
+	defer orderStoreMu.Unlock()
+	corrupted := 0
+	for _, o := range orderStore { // map order is random enough
+		if corrupted == n {
+			break
+		}
+		if o.brokenInvariant() != "" {
+			continue
+		}
+		switch invariant {
+		case "total":
+			o.Total = math.Round((o.Total+1+rand.Float64()*100)*100) / 100
+		case "quantity":
+			o.Lines[rand.Intn(len(o.Lines))].Quantity = -1 - rand.Intn(3)
+		case "lines":
+			o.Lines = nil
+		}
+		corrupted++
+	}
+	return corrupted
+}
+
+// repairOrders recomputes totals and drops unusable lines.
+func repairOrders() int {
+	orderStoreMu.Lock()
+	defer orderStoreMu.Unlock()
+	repaired := 0
+	for _, o := range orderStore {
+		if o.brokenInvariant() == "" {
+			continue
+		}
+		lines := o.Lines[:0]
+		for _, l := range o.Lines {
+			if l.Quantity > 0 {
+				lines = append(lines, l)
+			}
+		}
+		o.Lines = lines
+		_, o.Total = orderTotals(lines)
+		repaired++
+	}
+	return repaired
+}
+
+func handleAdminCorruption(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Records   int    `json:"records"`
+			Invariant string `json:"invariant"`
+			Repair    bool   `json:"repair"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Repair {
+			slog.Warn("Admin: stored orders repaired", "records", repairOrders())
+			break
+		}
+		if req.Invariant == "" {
+			req.Invariant = "total"
+		}
+		if req.Records <= 0 || (req.Invariant != "total" && req.Invariant != "quantity" && req.Invariant != "lines") {
+			writeProblem(w, r, fmt.Sprintf("records must be positive and invariant one of %v", orderInvariants), http.StatusBadRequest)
+			return
+		}
+		slog.Warn("Admin: stored orders corrupted", "records", corruptOrders(req.Records, req.Invariant), "invariant", req.Invariant)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	orderStoreMu.Lock()
+	stored, known := len(orderStore), len(inconsistent)
+	sample := []int64{}
+	for id := range inconsistent {
+		if len(sample) == 20 {
+			break
+		}
+		sample = append(sample, id)
+	}
+	orderStoreMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"stored_orders":             stored,
+		"inconsistent_at_last_scan": known,
+		"sample_inconsistent_ids":   sample,
+	})
+}
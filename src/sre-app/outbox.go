@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Transactional outbox. placeOrder writes the order row and its OrderPlaced
+// event in one simulated transaction, storing the trace context alongside the
+// event. A relay polls the outbox every OUTBOX_POLL_INTERVAL_MS (default 500)
+// and publishes up to OUTBOX_BATCH_SIZE (default 50) events to the orders
+// queue, continuing the checkout trace. OUTBOX_RELAY_CRASH_RATE (percent)
+// makes the relay "crash" after publishing but before marking the row sent,
+// so the event is published again and the consumer has to dedupe it.
+// OUTBOX=false drops events entirely.
+//
+// The order receipt rides in the same record: the relay uploads it to S3
+// before publishing the event, so an S3 brownout shows up as relay lag
+// rather than slow checkouts. Without the outbox it is uploaded in the
+// background.
+type outboxEvent struct {
+	ID             string
+	OrderID        int64
+	Type           string
+	Payload        []byte
+	ReceiptPending bool
+	TraceContext   propagation.MapCarrier
+	CreatedAt      time.Time
+}
+
+var (
+	outboxEnabled   bool
+	outboxCrashRate int
+	outboxSeq       atomic.Int64
+
+	outboxMu      sync.Mutex
+	outboxPending []outboxEvent
+)
+
+var (
+	outboxRelayed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outbox_events_relayed_total",
+			Help: "Outbox relay attempts by outcome (published, queue_full, relay_crash)",
+		},
+		[]string{"outcome"},
+	)
+	outboxRelayLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "outbox_relay_lag_seconds",
+		Help:    "Time from the order commit to its event being published",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(outboxRelayed, outboxRelayLag,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "outbox_pending_events",
+			Help: "Committed events not yet published",
+		}, func() float64 {
+			outboxMu.Lock()
+			defer outboxMu.Unlock()
+			return float64(len(outboxPending))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "outbox_oldest_pending_age_seconds",
+			Help: "Age of the oldest unpublished outbox event",
+		}, func() float64 {
+			outboxMu.Lock()
+			defer outboxMu.Unlock()
+			if len(outboxPending) == 0 {
+				return 0
+			}
+			return time.Since(outboxPending[0].CreatedAt).Seconds()
+		}),
+	)
+}
+
+func startOutbox() {
+	outboxEnabled = cfg.Outbox
+	if !outboxEnabled {
+		return
+	}
+	outboxCrashRate = cfg.OutboxRelayCrashRate
+	go func() {
+		for range time.Tick(time.Duration(cfg.OutboxPollIntervalMs) * time.Millisecond) {
+			relayOutbox(cfg.OutboxBatchSize)
+		}
+	}()
+}
+
+// placeOrder commits the order and its outbox event together; if either
+// insert fails neither is visible. The receipt upload is left to the relay,
+// is best effort and never fails the order.
+func placeOrder(ctx context.Context, lines []orderLine) error {
+	ctx, span := tracer.Start(ctx, "place_order")
+	defer span.End()
+
+	if _, err := queryDatabase(ctx, "order_insert"); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	orderID := rand.Int63n(1 << 40)
+	payload, _ := json.Marshal(map[string]any{"order_id": orderID, "placed_at": time.Now()})
+	span.SetAttributes(attribute.Int64("app.order.id", orderID))
+
+	if outboxEnabled {
+		if _, err := queryDatabase(ctx, "outbox_insert"); err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+		event := outboxEvent{
+			ID:             fmt.Sprintf("%s-%d", podName(), outboxSeq.Add(1)),
+			OrderID:        orderID,
+			Type:           "OrderPlaced",
+			Payload:        payload,
+			ReceiptPending: s3Endpoint != nil,
+			TraceContext:   propagation.MapCarrier{},
+			CreatedAt:      time.Now(),
+		}
+		otel.GetTextMapPropagator().Inject(ctx, event.TraceContext)
+		span.SetAttributes(attribute.String("app.outbox.event_id", event.ID))
+
+		outboxMu.Lock()
+		outboxPending = append(outboxPending, event)
+		outboxMu.Unlock()
+	}
+
+	storeOrder(orderID, lines)
+	if !outboxEnabled {
+		go storeReceipt(context.WithoutCancel(ctx), orderID, payload)
+	}
+	return nil
+}
+
+// relayOutbox publishes the oldest pending events in order, stopping at the
+// first failure so the outbox preserves per-order ordering.
+func relayOutbox(batch int) {
+	outboxMu.Lock()
+	events := outboxPending[:min(batch, len(outboxPending))]
+	events = append([]outboxEvent(nil), events...)
+	outboxMu.Unlock()
+
+	sent := 0
+	for _, event := range events {
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), event.TraceContext)
+		if event.ReceiptPending {
+			storeReceipt(ctx, event.OrderID, event.Payload)
+			markReceiptStored(event.ID)
+		}
+		if err := publishMessage(ctx, event.ID, event.Payload); err != nil {
+			outboxRelayed.WithLabelValues("queue_full").Inc()
+			slog.WarnContext(ctx, "Outbox relay could not publish", "event_id", event.ID, "error", err)
+			break
+		}
+		if outboxCrashRate > 0 && rand.Intn(100) < outboxCrashRate {
+			// Published but never marked sent: the next poll publishes it again.
+			outboxRelayed.WithLabelValues("relay_crash").Inc()
+			slog.WarnContext(ctx, "Outbox relay crashed before marking event sent", "event_id", event.ID)
+			break
+		}
+		outboxRelayed.WithLabelValues("published").Inc()
+		outboxRelayLag.Observe(time.Since(event.CreatedAt).Seconds())
+		sent++
+	}
+
+	outboxMu.Lock()
+	outboxPending = outboxPending[sent:]
+	outboxMu.Unlock()
+}
+
+// markReceiptStored records that id's receipt is uploaded, so a relay that
+// has to publish the event again does not upload it again.
+func markReceiptStored(id string) {
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	for i := range outboxPending {
+		if outboxPending[i].ID == id {
+			outboxPending[i].ReceiptPending = false
+			return
+		}
+	}
+}
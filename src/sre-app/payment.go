@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Simulated payment provider, called by /checkout through the "payment"
+// bulkhead. PAYMENT_LATENCY_MS (default 80) and PAYMENT_ERROR_RATE (percent)
+// set its behaviour; /admin/chaos/payment changes them at runtime, which is
+// how the "slow payment provider" scenario is staged. Declines are retried
+// up to PAYMENT_RETRIES times (default 0) straight away, each retry taking
+// another bulkhead slot: the naive client that turns a flaky provider into
+// a retry storm.
+var (
+	paymentLatencyMs atomic.Int64
+	paymentErrorRate atomic.Int64
+	paymentRetries   atomic.Int64
+)
+
+func init() {
+	paymentLatencyMs.Store(int64(cfg.PaymentLatencyMs))
+	paymentErrorRate.Store(int64(cfg.PaymentErrorRate))
+	paymentRetries.Store(int64(cfg.PaymentRetries))
+}
+
+func chargePayment(ctx context.Context) error {
+	var err error
+	for attempt := int64(0); attempt <= paymentRetries.Load(); attempt++ {
+		if err = chargeAttempt(ctx, attempt); err == nil || errors.Is(err, errBulkheadFull) {
+			return err
+		}
+	}
+	return err
+}
+
+func chargeAttempt(ctx context.Context, attempt int64) error {
+	start := time.Now()
+	_, span := tracer.Start(ctx, "payment.charge", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	defer func() { addDownstreamTime(ctx, time.Since(start)) }()
+	span.SetAttributes(attribute.String("peer.service", "payment-provider"))
+	if attempt > 0 {
+		span.SetAttributes(attribute.Int64("app.payment.retry", attempt))
+	}
+
+	release, err := bulkheadFor("payment").acquire()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.Bool("app.bulkhead.rejected", true))
+		return err
+	}
+	defer release()
+
+	latency := paymentLatencyMs.Load()
+	time.Sleep(time.Duration(latency/2+rand.Int63n(latency+1)) * time.Millisecond)
+	if rate := paymentErrorRate.Load(); rate > 0 && rand.Int63n(100) < rate {
+		err := fmt.Errorf("payment provider declined with 503")
+		noteChaos(ctx, "payment: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// handleAdminPayment reports or sets provider chaos:
+// {"latency_ms": 3000, "error_rate": 10, "retries": 3}.
+func handleAdminPayment(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			LatencyMs *int64 `json:"latency_ms"`
+			ErrorRate *int64 `json:"error_rate"`
+			Retries   *int64 `json:"retries"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.LatencyMs != nil && *req.LatencyMs >= 0 {
+			paymentLatencyMs.Store(*req.LatencyMs)
+		}
+		if req.ErrorRate != nil {
+			paymentErrorRate.Store(*req.ErrorRate)
+		}
+		if req.Retries != nil && *req.Retries >= 0 {
+			paymentRetries.Store(*req.Retries)
+		}
+		slog.Warn("Admin: payment provider chaos updated", "latency_ms", paymentLatencyMs.Load(), "error_rate", paymentErrorRate.Load(), "retries", paymentRetries.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"latency_ms": paymentLatencyMs.Load(),
+		"error_rate": paymentErrorRate.Load(),
+		"retries":    paymentRetries.Load(),
+	})
+}
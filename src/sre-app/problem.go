@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Error responses are RFC 7807 application/problem+json documents rather
+// than plain text, so clients and support tooling can parse them:
+//
+//	{"type": "/problems/service-unavailable", "title": "Service Unavailable",
+//	 "status": 503, "detail": "bulkhead full", "instance": "/checkout",
+//	 "trace_id": "...", "request_id": "..."}
+//
+// The type is derived from the status; trace_id and request_id are the
+// extension members a support ticket needs to find the request again.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance"`
+	TraceID   string `json:"trace_id,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeProblem replaces http.Error, with the same argument order.
+func writeProblem(w http.ResponseWriter, r *http.Request, detail string, status int) {
+	title := http.StatusText(status)
+	p := problem{
+		Type:      "/problems/" + strings.ToLower(strings.ReplaceAll(title, " ", "-")),
+		Title:     title,
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: requestIDFromContext(r.Context()),
+	}
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		p.TraceID = sc.TraceID().String()
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
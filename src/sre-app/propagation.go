@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// propagatorsFromEnv reads OTEL_PROPAGATORS (tracecontext, baggage, b3,
+// b3multi, jaeger, none). B3 and Jaeger are implemented below so Istio/Envoy
+// and legacy Zipkin services can join lab traces.
+func propagatorsFromEnv() propagation.TextMapPropagator {
+	names := os.Getenv("OTEL_PROPAGATORS")
+	if names == "" {
+		names = "tracecontext,baggage"
+	}
+
+	var props []propagation.TextMapPropagator
+	for _, name := range strings.Split(names, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "tracecontext":
+			props = append(props, propagation.TraceContext{})
+		case "baggage":
+			props = append(props, propagation.Baggage{})
+		case "b3":
+			props = append(props, b3Propagator{singleHeader: true})
+		case "b3multi":
+			props = append(props, b3Propagator{})
+		case "jaeger":
+			props = append(props, jaegerPropagator{})
+		case "none":
+			return propagation.NewCompositeTextMapPropagator()
+		case "":
+		default:
+			log.Printf("Ignoring unknown propagator %q in OTEL_PROPAGATORS", name)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(props...)
+}
+
+const (
+	b3SingleHeader   = "b3"
+	b3TraceIDHeader  = "x-b3-traceid"
+	b3SpanIDHeader   = "x-b3-spanid"
+	b3SampledHeader  = "x-b3-sampled"
+	b3FlagsHeader    = "x-b3-flags"
+	b3ParentIDHeader = "x-b3-parentspanid"
+)
+
+// b3Propagator speaks Zipkin's B3 format. Extraction accepts both the single
+// and multi header forms; injection uses the form it was configured with.
+type b3Propagator struct {
+	singleHeader bool
+}
+
+func (p b3Propagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+
+	sampled := "0"
+	if sc.IsSampled() {
+		sampled = "1"
+	}
+
+	if p.singleHeader {
+		carrier.Set(b3SingleHeader, fmt.Sprintf("%s-%s-%s", sc.TraceID(), sc.SpanID(), sampled))
+		return
+	}
+	carrier.Set(b3TraceIDHeader, sc.TraceID().String())
+	carrier.Set(b3SpanIDHeader, sc.SpanID().String())
+	carrier.Set(b3SampledHeader, sampled)
+}
+
+func (p b3Propagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	if h := carrier.Get(b3SingleHeader); h != "" {
+		if sc, ok := parseB3Single(h); ok {
+			return trace.ContextWithRemoteSpanContext(ctx, sc)
+		}
+		return ctx
+	}
+
+	sampled := carrier.Get(b3SampledHeader)
+	if carrier.Get(b3FlagsHeader) == "1" {
+		sampled = "d"
+	}
+	if sc, ok := b3SpanContext(carrier.Get(b3TraceIDHeader), carrier.Get(b3SpanIDHeader), sampled); ok {
+		return trace.ContextWithRemoteSpanContext(ctx, sc)
+	}
+	return ctx
+}
+
+func (p b3Propagator) Fields() []string {
+	if p.singleHeader {
+		return []string{b3SingleHeader}
+	}
+	return []string{b3TraceIDHeader, b3SpanIDHeader, b3SampledHeader, b3FlagsHeader, b3ParentIDHeader}
+}
+
+// parseB3Single parses {TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}.
+// A bare sampling state ("0") carries no span context and is ignored.
+func parseB3Single(h string) (trace.SpanContext, bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) < 2 || len(parts) > 4 {
+		return trace.SpanContext{}, false
+	}
+	sampled := ""
+	if len(parts) >= 3 {
+		sampled = parts[2]
+	}
+	return b3SpanContext(parts[0], parts[1], sampled)
+}
+
+func b3SpanContext(traceID, spanID, sampled string) (trace.SpanContext, bool) {
+	tid, sid, ok := parseHexIDs(traceID, spanID)
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+
+	var flags trace.TraceFlags
+	switch strings.ToLower(sampled) {
+	case "1", "d", "true":
+		flags = trace.FlagsSampled
+	case "", "0", "false":
+	default:
+		return trace.SpanContext{}, false
+	}
+
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    tid,
+		SpanID:     sid,
+		TraceFlags: flags,
+		Remote:     true,
+	}), true
+}
+
+const jaegerHeader = "uber-trace-id"
+
+// jaegerPropagator speaks the uber-trace-id format
+// ({trace-id}:{span-id}:{parent-span-id}:{flags}). Jaeger baggage
+// (uberctx-*) is not translated; use the W3C baggage propagator for that.
+type jaegerPropagator struct{}
+
+func (jaegerPropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	flags := "0"
+	if sc.IsSampled() {
+		flags = "1"
+	}
+	carrier.Set(jaegerHeader, fmt.Sprintf("%s:%s:0:%s", sc.TraceID(), sc.SpanID(), flags))
+}
+
+func (jaegerPropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	h := carrier.Get(jaegerHeader)
+	if h == "" {
+		return ctx
+	}
+	parts := strings.Split(h, ":")
+	if len(parts) != 4 {
+		return ctx
+	}
+	tid, sid, ok := parseHexIDs(parts[0], parts[1])
+	if !ok {
+		return ctx
+	}
+	bits, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return ctx
+	}
+
+	var flags trace.TraceFlags
+	if bits&0x01 != 0 {
+		flags = trace.FlagsSampled
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    tid,
+		SpanID:     sid,
+		TraceFlags: flags,
+		Remote:     true,
+	}))
+}
+
+func (jaegerPropagator) Fields() []string {
+	return []string{jaegerHeader}
+}
+
+// parseHexIDs accepts the shortened IDs Zipkin and Jaeger clients emit
+// (64-bit trace IDs, unpadded hex) by left-padding them to W3C width.
+func parseHexIDs(traceID, spanID string) (trace.TraceID, trace.SpanID, bool) {
+	if len(traceID) == 0 || len(traceID) > 32 || len(spanID) == 0 || len(spanID) > 16 {
+		return trace.TraceID{}, trace.SpanID{}, false
+	}
+	tid, err := trace.TraceIDFromHex(strings.Repeat("0", 32-len(traceID)) + strings.ToLower(traceID))
+	if err != nil {
+		return trace.TraceID{}, trace.SpanID{}, false
+	}
+	sid, err := trace.SpanIDFromHex(strings.Repeat("0", 16-len(spanID)) + strings.ToLower(spanID))
+	if err != nil {
+		return trace.TraceID{}, trace.SpanID{}, false
+	}
+	return tid, sid, true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Propagation loss chaos. Every outbound inject (HTTP clients, queue
+// headers) goes through lossyPropagator. PROPAGATION_LOSS_RATE (percent)
+// sends no trace context at all, so the callee starts a fresh trace and the
+// caller's trace ends at a client span with no children.
+// PROPAGATION_CORRUPT_RATE (percent) sends a context with a random trace ID,
+// so the callee's spans land in a trace whose root never arrives ("root span
+// not yet received" in Tempo). Extraction is untouched; baggage still flows
+// on dropped calls. /admin/chaos/propagation adjusts both at runtime.
+var (
+	propagationLossRate    atomic.Int64
+	propagationCorruptRate atomic.Int64
+
+	propagationChaosTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chaos_propagation_faults_total",
+			Help: "Outbound trace context injections sabotaged by chaos, by fault (dropped, corrupted)",
+		},
+		[]string{"fault"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(propagationChaosTotal)
+	propagationLossRate.Store(int64(cfg.PropagationLossRate))
+	propagationCorruptRate.Store(int64(cfg.PropagationCorruptRate))
+}
+
+type lossyPropagator struct {
+	propagation.TextMapPropagator
+}
+
+func (p lossyPropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		p.TextMapPropagator.Inject(ctx, carrier)
+		return
+	}
+	roll := rand.Int63n(100)
+	loss, corrupt := propagationLossRate.Load(), propagationCorruptRate.Load()
+	switch {
+	case roll < loss:
+		propagationFault(ctx, "dropped")
+		p.TextMapPropagator.Inject(trace.ContextWithSpanContext(ctx, trace.SpanContext{}), carrier)
+	case roll < loss+corrupt:
+		propagationFault(ctx, "corrupted")
+		var traceID trace.TraceID
+		rand.Read(traceID[:])
+		p.TextMapPropagator.Inject(trace.ContextWithSpanContext(ctx, sc.WithTraceID(traceID)), carrier)
+	default:
+		p.TextMapPropagator.Inject(ctx, carrier)
+	}
+}
+
+func propagationFault(ctx context.Context, fault string) {
+	propagationChaosTotal.WithLabelValues(fault).Inc()
+	trace.SpanFromContext(ctx).SetAttributes(attrFaultInjected.Bool(true), attribute.String("app.propagation.fault", fault))
+	noteChaos(ctx, "propagation: %s", fault)
+}
+
+// handleAdminPropagation reports or sets propagation chaos:
+// {"loss_rate": 20, "corrupt_rate": 5}.
+func handleAdminPropagation(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			LossRate    *int64 `json:"loss_rate"`
+			CorruptRate *int64 `json:"corrupt_rate"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.LossRate != nil {
+			propagationLossRate.Store(*req.LossRate)
+		}
+		if req.CorruptRate != nil {
+			propagationCorruptRate.Store(*req.CorruptRate)
+		}
+		slog.Warn("Admin: propagation chaos updated", "loss_rate", propagationLossRate.Load(), "corrupt_rate", propagationCorruptRate.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"loss_rate":    propagationLossRate.Load(),
+		"corrupt_rate": propagationCorruptRate.Load(),
+	})
+}
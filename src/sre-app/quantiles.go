@@ -0,0 +1,201 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Client-side latency quantiles, for comparing estimators against
+// histogram_quantile. Each route keeps a sliding window of STATS_WINDOW_S
+// seconds (default 300, advanced in sixths) with a t-digest, a DDSketch
+// (1% relative error), the http_request_duration_seconds bucket counts
+// and up to STATS_EXACT_SAMPLES raw latencies (default 10000, 0 disables),
+// which give the true quantile until the window outgrows them. /stats
+// reports p50 to p999 from every estimator with its error against the exact
+// value, and latency_quantile_seconds exposes the same numbers for Grafana to
+// plot next to histogram_quantile over the raw buckets.
+const (
+	statsSubwindows  = 6
+	ddsketchAccuracy = 0.01
+)
+
+var statsQuantiles = []struct {
+	label string
+	q     float64
+}{{"p50", 0.5}, {"p90", 0.9}, {"p95", 0.95}, {"p99", 0.99}, {"p999", 0.999}}
+
+type statsSubwindow struct {
+	index        int64
+	digest       *tdigest
+	sketch       *ddsketch
+	bucketCounts []int64
+	samples      []float64
+	count        int64
+}
+
+type routeStats struct {
+	mu   sync.Mutex
+	subs [statsSubwindows]statsSubwindow
+}
+
+var (
+	routeStatsMu sync.Mutex
+	statsByRoute = map[string]*routeStats{}
+)
+
+func init() {
+	prometheus.MustRegister(quantileCollector{})
+}
+
+func statsSubwindowIndex(now time.Time) int64 {
+	return now.UnixMilli() / (int64(cfg.StatsWindowSeconds) * 1000 / statsSubwindows)
+}
+
+// recordQuantiles adds one request latency to its route's estimators.
+func recordQuantiles(route string, elapsed time.Duration) {
+	routeStatsMu.Lock()
+	s, ok := statsByRoute[route]
+	if !ok {
+		s = &routeStats{}
+		statsByRoute[route] = s
+	}
+	routeStatsMu.Unlock()
+
+	index := statsSubwindowIndex(time.Now())
+	seconds := elapsed.Seconds()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := &s.subs[index%statsSubwindows]
+	if sub.index != index || sub.digest == nil {
+		*sub = statsSubwindow{
+			index:        index,
+			digest:       newTDigest(sliCompression),
+			sketch:       newDDSketch(ddsketchAccuracy),
+			bucketCounts: make([]int64, len(sliBuckets)+1),
+		}
+	}
+	sub.count++
+	sub.digest.add(seconds)
+	sub.sketch.add(seconds)
+	sub.bucketCounts[sort.SearchFloat64s(sliBuckets, seconds)]++
+	if len(sub.samples) < cfg.StatsExactSamples/statsSubwindows {
+		sub.samples = append(sub.samples, seconds)
+	}
+}
+
+// quantileEstimates is one route's window: count, and per quantile label
+// the estimate of each estimator ("exact" only while every sample fits).
+type quantileEstimates struct {
+	count     int64
+	quantiles map[string]map[string]float64
+}
+
+func (s *routeStats) estimates(now time.Time) quantileEstimates {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := statsSubwindowIndex(now)
+	digest := newTDigest(sliCompression)
+	sketch := newDDSketch(ddsketchAccuracy)
+	buckets := make([]int64, len(sliBuckets)+1)
+	var samples []float64
+	var count int64
+	complete := true
+	for i := range s.subs {
+		sub := &s.subs[i]
+		if sub.digest == nil || current-sub.index >= statsSubwindows {
+			continue
+		}
+		count += sub.count
+		digest.merge(sub.digest)
+		sketch.merge(sub.sketch)
+		for j, n := range sub.bucketCounts {
+			buckets[j] += n
+		}
+		samples = append(samples, sub.samples...)
+		complete = complete && int64(len(sub.samples)) == sub.count
+	}
+	sort.Float64s(samples)
+	out := quantileEstimates{count: count, quantiles: map[string]map[string]float64{}}
+	if count == 0 {
+		return out
+	}
+	for _, sq := range statsQuantiles {
+		byEstimator := map[string]float64{
+			"tdigest":   digest.quantile(sq.q),
+			"ddsketch":  sketch.quantile(sq.q),
+			"histogram": histogramQuantile(sq.q, buckets),
+		}
+		if complete {
+			byEstimator["exact"] = samples[int(sq.q*float64(len(samples)-1))]
+		}
+		out.quantiles[sq.label] = byEstimator
+	}
+	return out
+}
+
+func snapshotRouteStats() map[string]*routeStats {
+	routeStatsMu.Lock()
+	defer routeStatsMu.Unlock()
+	routes := make(map[string]*routeStats, len(statsByRoute))
+	for route, s := range statsByRoute {
+		routes[route] = s
+	}
+	return routes
+}
+
+// handleStats reports every route's quantiles, with each estimator's
+// relative error against the exact value when there is one.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	paths := map[string]any{}
+	for route, s := range snapshotRouteStats() {
+		e := s.estimates(now)
+		quantiles := map[string]any{}
+		for label, byEstimator := range e.quantiles {
+			entry := map[string]any{"estimates": byEstimator}
+			if exact, ok := byEstimator["exact"]; ok && exact > 0 {
+				errors := map[string]float64{}
+				for estimator, v := range byEstimator {
+					if estimator != "exact" {
+						errors[estimator] = math.Round((v-exact)/exact*1e4) / 1e4
+					}
+				}
+				entry["relative_error"] = errors
+			}
+			quantiles[label] = entry
+		}
+		paths[route] = map[string]any{"count": e.count, "quantiles": quantiles}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"window_s":      cfg.StatsWindowSeconds,
+		"exact_samples": cfg.StatsExactSamples,
+		"paths":         paths,
+	})
+}
+
+var latencyQuantileDesc = prometheus.NewDesc("latency_quantile_seconds",
+	"Request latency quantiles over the STATS_WINDOW_S window, by estimator (tdigest, ddsketch, histogram, exact)",
+	[]string{"path", "quantile", "estimator"}, nil)
+
+type quantileCollector struct{}
+
+func (quantileCollector) Describe(ch chan<- *prometheus.Desc) { ch <- latencyQuantileDesc }
+
+func (quantileCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for route, s := range snapshotRouteStats() {
+		e := s.estimates(now)
+		for _, sq := range statsQuantiles {
+			for estimator, v := range e.quantiles[sq.label] {
+				ch <- prometheus.MustNewConstMetric(latencyQuantileDesc, prometheus.GaugeValue, v,
+					route, strconv.FormatFloat(sq.q, 'g', -1, 64), estimator)
+			}
+		}
+	}
+}
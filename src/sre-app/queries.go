@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// Simulated query repertoire. Each fingerprint has its own log-normal latency
+// distribution, so a single regressed query shows up as one line moving on
+// db_query_duration_seconds{fingerprint} rather than "the database is slow".
+// DB_QUERY_REGRESSIONS ("cart_by_customer=250,order_insert=40") adds extra
+// milliseconds to individual fingerprints; /admin/chaos/queries changes them
+// at runtime.
+type queryProfile struct {
+	Fingerprint string  `json:"fingerprint"`
+	Statement   string  `json:"statement"`
+	Operation   string  `json:"operation"`
+	Table       string  `json:"table"`
+	MedianMs    float64 `json:"median_ms"`
+	// Sigma is the log-normal shape; larger values mean a fatter tail.
+	Sigma float64 `json:"sigma"`
+}
+
+var queryRepertoire = map[string]queryProfile{
+	"cart_by_customer": {
+		Statement: "SELECT id, sku, quantity FROM cart WHERE customer_id = $1",
+		Operation: "SELECT", Table: "cart", MedianMs: 30, Sigma: 0.3,
+	},
+	"inventory_check": {
+		Statement: "SELECT sku, available FROM inventory WHERE sku = ANY($1) FOR UPDATE",
+		Operation: "SELECT", Table: "inventory", MedianMs: 8, Sigma: 0.5,
+	},
+	"inventory_reserve": {
+		Statement: "UPDATE inventory SET available = available - $2, reserved = reserved + $2 WHERE sku = $1 AND available >= $2",
+		Operation: "UPDATE", Table: "inventory", MedianMs: 6, Sigma: 0.4,
+	},
+	"inventory_release": {
+		Statement: "UPDATE inventory SET available = available + $2, reserved = reserved - $2 WHERE sku = $1",
+		Operation: "UPDATE", Table: "inventory", MedianMs: 6, Sigma: 0.4,
+	},
+	"order_insert": {
+		Statement: "INSERT INTO orders (customer_id, total, created_at) VALUES ($1, $2, now()) RETURNING id",
+		Operation: "INSERT", Table: "orders", MedianMs: 12, Sigma: 0.4,
+	},
+	"catalog_listing": {
+		Statement: "SELECT p.sku, p.name, p.price, s.available FROM products p JOIN inventory s USING (sku) WHERE p.active ORDER BY p.name",
+		Operation: "SELECT", Table: "products", MedianMs: 120, Sigma: 0.5,
+	},
+	"outbox_insert": {
+		Statement: "INSERT INTO outbox (id, aggregate_id, type, payload, trace_context) VALUES ($1, $2, $3, $4, $5)",
+		Operation: "INSERT", Table: "outbox", MedianMs: 4, Sigma: 0.4,
+	},
+	"recommendations_by_category": {
+		Statement: "SELECT sku FROM products WHERE category = $1 ORDER BY score DESC LIMIT $2",
+		Operation: "SELECT", Table: "products", MedianMs: 25, Sigma: 0.9,
+	},
+	"order_reconciliation": {
+		Statement: "SELECT o.id, o.total, p.amount FROM orders o LEFT JOIN payments p ON p.order_id = o.id WHERE o.created_at > now() - interval '1 day'",
+		Operation: "SELECT", Table: "orders", MedianMs: 400, Sigma: 0.4,
+	},
+}
+
+var (
+	queryRegressionsMu sync.RWMutex
+	queryRegressions   = map[string]int{}
+)
+
+var dbQueryDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Simulated database query latency by query fingerprint",
+		Buckets: []float64{.002, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	},
+	[]string{"fingerprint"},
+)
+
+func init() {
+	prometheus.MustRegister(dbQueryDuration)
+	for name, q := range queryRepertoire {
+		q.Fingerprint = name
+		queryRepertoire[name] = q
+	}
+}
+
+func loadQueryConfig() {
+	// A malformed DB_QUERY_REGRESSIONS is reported by loadConfig.
+	regressions, _ := parseQueryRegressions(os.Getenv("DB_QUERY_REGRESSIONS"))
+	for name, extra := range regressions {
+		queryRegressions[name] = extra
+	}
+}
+
+func parseQueryRegressions(spec string) (map[string]int, error) {
+	regressions := map[string]int{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, ms, _ := strings.Cut(entry, "=")
+		extra, err := strconv.Atoi(ms)
+		if _, known := queryRepertoire[name]; !known {
+			return nil, fmt.Errorf("entry %q: unknown query fingerprint %q", entry, name)
+		}
+		if err != nil || extra < 0 || extra > 60000 {
+			return nil, fmt.Errorf("entry %q: want fingerprint=ms with ms 0-60000", entry)
+		}
+		regressions[name] = extra
+	}
+	return regressions, nil
+}
+
+func queryRegression(fingerprint string) int {
+	queryRegressionsMu.RLock()
+	defer queryRegressionsMu.RUnlock()
+	return queryRegressions[fingerprint]
+}
+
+// latency samples the fingerprint's distribution plus any injected regression.
+func (q queryProfile) latency() time.Duration {
+	ms := q.MedianMs * math.Exp(q.Sigma*rand.NormFloat64())
+	ms += float64(queryRegression(q.Fingerprint) + int(dbSlowQueryMs.Load()))
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// queryDatabase runs a simulated query from the repertoire on a pooled
+// connection and returns the query span's context.
+func queryDatabase(ctx context.Context, fingerprint string) (_ context.Context, err error) {
+	q := queryRepertoire[fingerprint]
+	start := time.Now()
+	dbCtx, span := tracer.Start(ctx, q.Operation+" "+q.Table)
+	defer func() {
+		span.End()
+		addDownstreamTime(ctx, time.Since(start))
+		observeDatabaseHealth(err)
+	}()
+	span.SetAttributes(
+		semconv.DBSystemPostgreSQL,
+		semconv.DBName("checkout"),
+		semconv.DBStatement(q.Statement),
+		semconv.DBOperation(q.Operation),
+		semconv.DBSQLTable(q.Table),
+		attribute.String("db.query.fingerprint", fingerprint),
+	)
+
+	countDBCall(ctx)
+	release, waited, err := dbPool.acquire(dbCtx)
+	span.SetAttributes(attribute.Int64("db.pool.wait_ms", waited.Milliseconds()))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return dbCtx, err
+	}
+	defer release()
+
+	shard := pickShard(ctx)
+	penalty, shardErr := shardPenalty(shard)
+	span.SetAttributes(attribute.Int("app.db.shard", shard))
+	if penalty > 0 || shardErr != nil {
+		noteChaos(ctx, "shard %d: +%dms, error=%v", shard, penalty.Milliseconds(), shardErr != nil)
+	}
+
+	queryStart := time.Now()
+	time.Sleep(q.latency() + penalty)
+	elapsed := time.Since(queryStart).Seconds()
+	dbQueryDuration.WithLabelValues(fingerprint).Observe(elapsed)
+	shardQueryDuration.WithLabelValues(strconv.Itoa(shard)).Observe(elapsed)
+	if shardErr != nil {
+		shardQueriesTotal.WithLabelValues(strconv.Itoa(shard), "error").Inc()
+		span.RecordError(shardErr)
+		span.SetStatus(codes.Error, shardErr.Error())
+		return dbCtx, shardErr
+	}
+	shardQueriesTotal.WithLabelValues(strconv.Itoa(shard), "ok").Inc()
+	return dbCtx, nil
+}
+
+// handleAdminQueries lists the repertoire or regresses one fingerprint, e.g.
+// {"fingerprint": "cart_by_customer", "extra_ms": 300}; {"reset": true}
+// clears every regression.
+func handleAdminQueries(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Fingerprint string `json:"fingerprint"`
+			ExtraMs     *int   `json:"extra_ms"`
+			Reset       bool   `json:"reset"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		queryRegressionsMu.Lock()
+		if req.Reset {
+			queryRegressions = map[string]int{}
+		}
+		if req.ExtraMs != nil {
+			if _, ok := queryRepertoire[req.Fingerprint]; !ok {
+				queryRegressionsMu.Unlock()
+				writeProblem(w, r, "unknown fingerprint "+strconv.Quote(req.Fingerprint), http.StatusBadRequest)
+				return
+			}
+			queryRegressions[req.Fingerprint] = *req.ExtraMs
+		}
+		queryRegressionsMu.Unlock()
+		slog.Warn("Admin: query regressions updated", "fingerprint", req.Fingerprint, "extra_ms", req.ExtraMs, "reset", req.Reset)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type entry struct {
+		queryProfile
+		ExtraMs int `json:"extra_ms"`
+	}
+	var out []entry
+	for name, q := range queryRepertoire {
+		out = append(out, entry{q, queryRegression(name)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Fingerprint < out[j].Fingerprint })
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// In-process message queue standing in for a broker. Messages carry the
+// producer's trace context in their headers. With QUEUE_TRACE_MODE=child
+// (the default) the consumer continues the producer's trace; with "link" it
+// starts a new root trace linked to the producer, the shape the messaging
+// conventions recommend once consumers batch or lag far behind.
+// QUEUE_SYNTHETIC_RATE (messages/sec) adds orders from an untraced "partner
+// feed" whose headers carry a made-up traceparent, as an external producer
+// would, so consumer spans show up under a parent Tempo never receives.
+// QUEUE_CAPACITY (default 1000) bounds the backlog; the consumer is
+// idempotent on message ID because delivery is at-least-once (see
+// delivery.go).
+const ordersQueue = "orders"
+
+var errQueueFull = errors.New("queue full")
+
+type queueMessage struct {
+	ID         string
+	Body       []byte
+	Headers    propagation.MapCarrier
+	EnqueuedAt time.Time
+	Attempts   int
+
+	Redelivered bool
+}
+
+var orderQueue chan queueMessage
+
+var (
+	queueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "queue_depth",
+			Help: "Messages waiting in the queue",
+		},
+		[]string{"queue"},
+	)
+	queueMessagesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_messages_total",
+			Help: "Queue messages by operation (publish, consume) and outcome",
+		},
+		[]string{"queue", "operation", "outcome"},
+	)
+	queueConsumeLag = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "queue_consume_lag_seconds",
+			Help:    "Time between enqueue and the consumer picking a message up",
+			Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30},
+		},
+		[]string{"queue"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth, queueMessagesTotal, queueConsumeLag)
+}
+
+func startQueue() {
+	orderQueue = make(chan queueMessage, cfg.QueueCapacity)
+	go consumeOrders()
+	if cfg.QueueSyntheticRate > 0 {
+		go runPartnerFeed(cfg.QueueSyntheticRate)
+	}
+}
+
+// runPartnerFeed publishes synthetic orders with foreign trace context.
+func runPartnerFeed(perSecond float64) {
+	var seq int64
+	for range time.Tick(time.Duration(float64(time.Second) / perSecond)) {
+		seq++
+		var traceID [16]byte
+		var spanID [8]byte
+		rand.Read(traceID[:])
+		rand.Read(spanID[:])
+		body, _ := json.Marshal(map[string]any{"order_id": rand.Int63n(1 << 40), "placed_at": time.Now(), "source": "partner-feed"})
+		msg := queueMessage{
+			ID:   fmt.Sprintf("partner-%s-%d", podName(), seq),
+			Body: body,
+			Headers: propagation.MapCarrier{
+				"traceparent": fmt.Sprintf("00-%x-%x-01", traceID, spanID),
+				"tracestate":  "partner=feed",
+			},
+			EnqueuedAt: time.Now(),
+		}
+		select {
+		case orderQueue <- msg:
+			queueMessagesTotal.WithLabelValues(ordersQueue, "publish", "ok").Inc()
+		default:
+			queueMessagesTotal.WithLabelValues(ordersQueue, "publish", "queue_full").Inc()
+		}
+	}
+}
+
+// consumerSpan starts the span for processing msg according to
+// QUEUE_TRACE_MODE. Baggage from the headers is kept either way.
+func consumerSpan(msg queueMessage) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), msg.Headers)
+	opts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindConsumer)}
+	if cfg.QueueTraceMode == "link" {
+		opts = append(opts, trace.WithNewRoot(), trace.WithLinks(trace.LinkFromContext(ctx)))
+	}
+	ctx, span := tracer.Start(ctx, ordersQueue+" process", opts...)
+	span.SetAttributes(
+		semconv.MessagingSystemKey.String("inprocess"),
+		semconv.MessagingDestinationName(ordersQueue),
+		semconv.MessagingOperationDeliver,
+		semconv.MessagingMessageID(msg.ID),
+		semconv.MessagingMessageBodySize(len(msg.Body)),
+		attribute.Int("messaging.message.delivery_attempt", msg.Attempts+1),
+		attribute.Bool("app.message.redelivered", msg.Redelivered),
+	)
+	return ctx, span
+}
+
+// publishMessage enqueues body under a producer span that becomes the
+// consumer's parent. It never blocks: a full queue is an error.
+func publishMessage(ctx context.Context, id string, body []byte) error {
+	ctx, span := tracer.Start(ctx, ordersQueue+" publish", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	span.SetAttributes(
+		semconv.MessagingSystemKey.String("inprocess"),
+		semconv.MessagingDestinationName(ordersQueue),
+		semconv.MessagingOperationPublish,
+		semconv.MessagingMessageID(id),
+		semconv.MessagingMessageBodySize(len(body)),
+	)
+
+	if rate := poisonRate.Load(); rate > 0 && rand.Int63n(100) < rate {
+		body = poisonBody
+		span.SetAttributes(attribute.Bool("app.message.poison", true))
+	}
+	msg := queueMessage{ID: id, Body: body, Headers: propagation.MapCarrier{}, EnqueuedAt: time.Now()}
+	otel.GetTextMapPropagator().Inject(ctx, msg.Headers)
+	select {
+	case orderQueue <- msg:
+		queueMessagesTotal.WithLabelValues(ordersQueue, "publish", "ok").Inc()
+		queueDepth.WithLabelValues(ordersQueue).Set(float64(len(orderQueue)))
+		return nil
+	default:
+		queueMessagesTotal.WithLabelValues(ordersQueue, "publish", "queue_full").Inc()
+		span.RecordError(errQueueFull)
+		return errQueueFull
+	}
+}
+
+func consumeOrders() {
+	seen := newDedupeSet(cfg.QueueDedupeWindow)
+	for msg := range orderQueue {
+		queueDepth.WithLabelValues(ordersQueue).Set(float64(len(orderQueue)))
+		queueConsumeLag.WithLabelValues(ordersQueue).Observe(time.Since(msg.EnqueuedAt).Seconds())
+
+		ctx, span := consumerSpan(msg)
+		if !seen.add(msg.ID) {
+			span.SetAttributes(attribute.Bool("app.message.duplicate", true))
+			if queueDedupe.Load() {
+				idempotencyDuplicates.WithLabelValues(ordersQueue, "skipped").Inc()
+				queueMessagesTotal.WithLabelValues(ordersQueue, "consume", "duplicate").Inc()
+				slog.DebugContext(ctx, "Skipping duplicate message", "queue", ordersQueue, "message_id", msg.ID)
+				span.End()
+				continue
+			}
+			idempotencyDuplicates.WithLabelValues(ordersQueue, "processed").Inc()
+			slog.WarnContext(ctx, "Processing duplicate message, deduplication is off", "queue", ordersQueue, "message_id", msg.ID)
+		}
+		if consumeWithRetry(ctx, span, msg) {
+			ordersFulfilled.Inc()
+			notifyOrderCompleted(ctx, msg)
+			publishOrderEvents(msg.Body)
+			maybeRedeliver(msg)
+		} else {
+			// Dead letters may be redriven, so they must not count as seen.
+			seen.forget(msg.ID)
+		}
+		span.End()
+	}
+}
+
+// dedupeSet remembers the last n message IDs.
+type dedupeSet struct {
+	ids   map[string]int // id -> its slot in order
+	order []string
+	next  int
+}
+
+func newDedupeSet(n int) *dedupeSet {
+	return &dedupeSet{ids: make(map[string]int, n), order: make([]string, n)}
+}
+
+// add reports whether id is new.
+func (d *dedupeSet) add(id string) bool {
+	if _, ok := d.ids[id]; ok {
+		return false
+	}
+	if old := d.order[d.next]; old != "" {
+		delete(d.ids, old)
+	}
+	d.order[d.next] = id
+	d.ids[id] = d.next
+	d.next = (d.next + 1) % len(d.order)
+	return true
+}
+
+// forget removes id, clearing its slot so a later eviction does not remove
+// the id again after it has been re-added.
+func (d *dedupeSet) forget(id string) {
+	if slot, ok := d.ids[id]; ok {
+		d.order[slot] = ""
+		delete(d.ids, id)
+	}
+}
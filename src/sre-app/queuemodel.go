@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// M/M/c station, for queueing-theory exercises. /mmc waits its turn for one
+// of QUEUE_MODEL_SERVERS servers (default 1) in an unbounded FIFO queue,
+// then holds it for an exponentially distributed service time with mean
+// QUEUE_MODEL_SERVICE_MS (default 10). Fed Poisson arrivals
+// (LOADGEN_PRESET=mm1 or mmc) it is an M/M/c queue with utilization
+// ρ = λS/c: waiting stays short until ρ nears 1 and then grows without
+// bound, ρ/(1-ρ) service times on average for M/M/1, which is the knee of
+// the latency curve. queue_model_wait_seconds and
+// queue_model_service_seconds split the latency into its two parts; a
+// request whose caller gives up while queued leaves the queue unobserved.
+// /admin/queuemodel changes c and S at runtime.
+type station struct {
+	mu      sync.Mutex
+	servers int
+	busy    int
+	waiting []chan struct{}
+}
+
+var (
+	mmcStation       = &station{}
+	mmcServiceMeanMs atomic.Int64
+
+	queueModelWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "queue_model_wait_seconds",
+		Help:    "Time /mmc requests waited in the queue for a server",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+	queueModelService = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "queue_model_service_seconds",
+		Help:    "Time /mmc requests held a server",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	})
+	queueModelBusy = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "queue_model_busy_servers",
+			Help: "Servers of the /mmc station currently serving a request",
+		},
+		func() float64 {
+			busy, _, _ := mmcStation.snapshot()
+			return float64(busy)
+		},
+	)
+	queueModelServers = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "queue_model_servers",
+			Help: "Servers of the /mmc station (c)",
+		},
+		func() float64 {
+			_, servers, _ := mmcStation.snapshot()
+			return float64(servers)
+		},
+	)
+	queueModelQueueLength = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "queue_model_queue_length",
+			Help: "Requests waiting for a server of the /mmc station",
+		},
+		func() float64 {
+			_, _, queued := mmcStation.snapshot()
+			return float64(queued)
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queueModelWait, queueModelService, queueModelBusy, queueModelServers, queueModelQueueLength)
+	mmcStation.resize(cfg.QueueModelServers)
+	mmcServiceMeanMs.Store(int64(cfg.QueueModelServiceMs))
+}
+
+// acquire takes a server, queueing behind earlier arrivals, or leaves the
+// queue with ctx's error once the caller has given up.
+func (s *station) acquire(ctx context.Context) error {
+	s.mu.Lock()
+	if s.busy < s.servers && len(s.waiting) == 0 {
+		s.busy++
+		s.mu.Unlock()
+		return nil
+	}
+	turn := make(chan struct{})
+	s.waiting = append(s.waiting, turn)
+	s.mu.Unlock()
+	select {
+	case <-turn: // dispatch counted us as busy
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := slices.Index(s.waiting, turn); i >= 0 {
+		s.waiting = slices.Delete(s.waiting, i, i+1)
+	} else {
+		// Handed a server just as it gave up: pass it on.
+		s.busy--
+		s.dispatch()
+	}
+	return ctx.Err()
+}
+
+func (s *station) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy--
+	s.dispatch()
+}
+
+func (s *station) resize(servers int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers = servers
+	s.dispatch()
+}
+
+// dispatch hands free servers to the head of the queue; s.mu is held.
+func (s *station) dispatch() {
+	for s.busy < s.servers && len(s.waiting) > 0 {
+		close(s.waiting[0])
+		s.waiting = s.waiting[1:]
+		s.busy++
+	}
+}
+
+func (s *station) snapshot() (busy, servers, queued int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.busy, s.servers, len(s.waiting)
+}
+
+func handleMMC(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	_, span := tracer.Start(r.Context(), "handleMMC")
+	defer span.End()
+
+	if err := mmcStation.acquire(r.Context()); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "caller gave up queueing for a server")
+		writeProblem(w, r, "gave up waiting for a server", http.StatusServiceUnavailable)
+		httpRequestsTotal.WithLabelValues("/mmc", strconv.Itoa(http.StatusServiceUnavailable)).Inc()
+		httpRequestDuration.WithLabelValues("/mmc").Observe(time.Since(start).Seconds())
+		return
+	}
+	acquired := time.Now()
+	service := time.Duration(rand.ExpFloat64() * float64(mmcServiceMeanMs.Load()) * float64(time.Millisecond))
+	time.Sleep(service)
+	mmcStation.release()
+	held := time.Since(acquired)
+
+	wait := acquired.Sub(start)
+	queueModelWait.Observe(wait.Seconds())
+	queueModelService.Observe(held.Seconds())
+	span.SetAttributes(
+		attribute.Float64("app.queue.wait_ms", float64(wait.Microseconds())/1000),
+		attribute.Float64("app.queue.service_ms", float64(held.Microseconds())/1000),
+	)
+	fmt.Fprintf(w, "waited %s for a server, served in %s\n", wait.Round(time.Microsecond), held.Round(time.Microsecond))
+
+	httpRequestsTotal.WithLabelValues("/mmc", strconv.Itoa(http.StatusOK)).Inc()
+	httpRequestDuration.WithLabelValues("/mmc").Observe(time.Since(start).Seconds())
+}
+
+// handleAdminQueueModel reports or sets the station:
+// {"servers": 4, "service_ms": 20}. The report includes the utilization
+// the load generator's current rate would give if it all went to /mmc.
+func handleAdminQueueModel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Servers   *int   `json:"servers"`
+			ServiceMs *int64 `json:"service_ms"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Servers != nil && *req.Servers >= 1 && *req.Servers <= 10000 {
+			mmcStation.resize(*req.Servers)
+		}
+		if req.ServiceMs != nil && *req.ServiceMs >= 0 {
+			mmcServiceMeanMs.Store(*req.ServiceMs)
+		}
+		_, servers, _ := mmcStation.snapshot()
+		slog.Warn("Admin: queue model updated", "servers", servers, "service_ms", mmcServiceMeanMs.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	busy, servers, queued := mmcStation.snapshot()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"servers":          servers,
+		"service_ms":       mmcServiceMeanMs.Load(),
+		"busy":             busy,
+		"queued":           queued,
+		"loadgen_rho":      queueModelRho(float64(loadgenRate.Load()) / 60),
+		"loadgen_rate_rps": float64(loadgenRate.Load()) / 60,
+	})
+}
+
+// queueModelRho is the station's utilization at perSecond arrivals.
+func queueModelRho(perSecond float64) float64 {
+	_, servers, _ := mmcStation.snapshot()
+	return perSecond * float64(mmcServiceMeanMs.Load()) / 1000 / float64(servers)
+}
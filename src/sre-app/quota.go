@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Per-API-key quotas. Requests carrying X-API-Key draw from a token bucket
+// per key that holds QUOTA_DAILY_REQUESTS tokens (default 0: quotas off)
+// and refills continuously at that many per day, so a key can burst through
+// its whole day and then gets one request per 86400/limit seconds.
+// QUOTA_OVERRIDES ("partner-key=100000,trial-key=50") sets other limits for
+// individual keys. Requests without a key are not metered. Buckets live in
+// the pod, so behind N replicas a key effectively gets up to N times its
+// quota.
+//
+// Keys are whatever clients send, so the buckets are bounded: a bucket that
+// has refilled is the same as a new one and is dropped, and once
+// QUOTA_MAX_KEYS (default 10000) keys hold partly spent buckets, further
+// keys without an override share a single overflow bucket at the default
+// limit. Minting fresh keys therefore buys a client one full bucket each
+// only until the table is full.
+//
+// Every metered response has RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset (seconds until the bucket is full again); an empty bucket
+// gets a 429 with Retry-After. Keys appear in metrics only as a short
+// fingerprint, per key under the METRIC_SERIES_CAP cardinality guard.
+// /admin/quotas reports the buckets and changes limits or refills keys.
+type quotaBucket struct {
+	limit   float64
+	tokens  float64
+	updated time.Time
+}
+
+var (
+	quotaDefault   atomic.Int64
+	quotaMu        sync.Mutex
+	quotaOverrides = map[string]int64{}
+	quotaBuckets   = map[string]*quotaBucket{}
+	quotaOverflow  *quotaBucket // shared by new keys once quotaBuckets is full
+	quotaSweptAt   time.Time
+
+	apiKeyRequests = guardCounterVec("api_key_requests_total", prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_key_requests_total",
+			Help: "Metered requests by API key fingerprint and outcome (allowed, exhausted)",
+		},
+		[]string{"api_key", "outcome"},
+	))
+	apiKeyQuotaRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "api_key_quota_remaining",
+			Help: "Requests left in each API key's bucket, for keys admitted by the cardinality guard",
+		},
+		[]string{"api_key"},
+	)
+	apiKeyQuotaGuard    = newSeriesGuard("api_key_quota_remaining")
+	quotaExhaustedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "quota_exhausted_requests_total",
+		Help: "Requests refused with 429 because their API key's quota was used up, over all keys",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(apiKeyRequests, apiKeyQuotaRemaining, quotaExhaustedTotal)
+	quotaDefault.Store(int64(cfg.QuotaDailyRequests))
+	// A malformed QUOTA_OVERRIDES is reported by loadConfig.
+	if overrides, err := parseQuotaOverrides(os.Getenv("QUOTA_OVERRIDES")); err == nil {
+		quotaOverrides = overrides
+	}
+}
+
+func parseQuotaOverrides(spec string) (map[string]int64, error) {
+	overrides := map[string]int64{}
+	for _, raw := range strings.Split(spec, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		key, limit, ok := strings.Cut(raw, "=")
+		n, err := strconv.ParseInt(strings.TrimSpace(limit), 10, 64)
+		if !ok || strings.TrimSpace(key) == "" || err != nil || n < 0 {
+			return nil, fmt.Errorf("override %q: want <api key>=<requests per day>", raw)
+		}
+		overrides[strings.TrimSpace(key)] = n
+	}
+	return overrides, nil
+}
+
+// quotaLimit returns key's daily limit; quotaMu must be held.
+func quotaLimit(key string) int64 {
+	if n, ok := quotaOverrides[key]; ok {
+		return n
+	}
+	return quotaDefault.Load()
+}
+
+// take refills the bucket up to now and spends a token if there is one.
+func (b *quotaBucket) take(now time.Time) bool {
+	b.tokens = math.Min(b.limit, b.tokens+now.Sub(b.updated).Seconds()*b.limit/86400)
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// quotaOverflowID labels the overflow bucket in metrics and reports.
+const quotaOverflowID = "overflow"
+
+// quotaBucketFor returns key's bucket, creating it if there is room and
+// falling back to the overflow bucket if not; quotaMu must be held.
+func quotaBucketFor(key string, limit int64, now time.Time) (*quotaBucket, string) {
+	if b := quotaBuckets[key]; b != nil {
+		return b, fingerprint(key)
+	}
+	if len(quotaBuckets) >= cfg.QuotaMaxKeys && now.Sub(quotaSweptAt) >= time.Second {
+		sweepQuotaBuckets(now)
+	}
+	if _, overridden := quotaOverrides[key]; overridden || len(quotaBuckets) < cfg.QuotaMaxKeys {
+		b := &quotaBucket{tokens: float64(limit), updated: now}
+		quotaBuckets[key] = b
+		return b, fingerprint(key)
+	}
+	if quotaOverflow == nil {
+		quotaOverflow = &quotaBucket{tokens: float64(limit), updated: now}
+	}
+	return quotaOverflow, quotaOverflowID
+}
+
+// sweepQuotaBuckets drops the buckets that have refilled; quotaMu must be
+// held.
+func sweepQuotaBuckets(now time.Time) {
+	quotaSweptAt = now
+	for key, b := range quotaBuckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*b.limit/86400 >= b.limit {
+			delete(quotaBuckets, key)
+			apiKeyQuotaRemaining.DeleteLabelValues(fingerprint(key))
+		}
+	}
+}
+
+// quotaAllows meters requests that carry an API key.
+func quotaAllows(w http.ResponseWriter, r *http.Request) bool {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return true
+	}
+	now := time.Now()
+	quotaMu.Lock()
+	limit := quotaLimit(key)
+	if limit == 0 {
+		quotaMu.Unlock()
+		return true
+	}
+	b, id := quotaBucketFor(key, limit, now)
+	b.limit = float64(limit)
+	allowed := b.take(now)
+	remaining := math.Floor(b.tokens)
+	reset := math.Ceil((b.limit - b.tokens) * 86400 / b.limit)
+	retryAfter := math.Ceil((1 - b.tokens) * 86400 / b.limit)
+	quotaMu.Unlock()
+
+	w.Header().Set("RateLimit-Limit", strconv.FormatInt(limit, 10))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatFloat(remaining, 'f', 0, 64))
+	w.Header().Set("RateLimit-Reset", strconv.FormatFloat(reset, 'f', 0, 64))
+	if lvs := apiKeyQuotaGuard.admit([]string{id}); lvs[0] == id {
+		apiKeyQuotaRemaining.WithLabelValues(id).Set(remaining)
+	}
+	if allowed {
+		apiKeyRequests.WithLabelValues(id, "allowed").Inc()
+		return true
+	}
+	apiKeyRequests.WithLabelValues(id, "exhausted").Inc()
+	quotaExhaustedTotal.Inc()
+	w.Header().Set("Retry-After", strconv.FormatFloat(retryAfter, 'f', 0, 64))
+	writeProblem(w, r, fmt.Sprintf("API key %s has used its quota of %d requests per day", id, limit), http.StatusTooManyRequests)
+	return false
+}
+
+// handleAdminQuotas reports the buckets or changes quotas:
+// {"daily_requests": 1000}, {"overrides": {"key": 50}}, {"refill": "key"}
+// or {"refill": "*"}.
+func handleAdminQuotas(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			DailyRequests *int64           `json:"daily_requests"`
+			Overrides     map[string]int64 `json:"overrides"`
+			Refill        string           `json:"refill"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.DailyRequests != nil && *req.DailyRequests < 0 {
+			writeProblem(w, r, "daily_requests must not be negative", http.StatusBadRequest)
+			return
+		}
+		quotaMu.Lock()
+		if req.DailyRequests != nil {
+			quotaDefault.Store(*req.DailyRequests)
+		}
+		for key, limit := range req.Overrides {
+			if limit < 0 {
+				delete(quotaOverrides, key)
+				continue
+			}
+			quotaOverrides[key] = limit
+		}
+		refilled := 0
+		for key, b := range quotaBuckets {
+			if req.Refill == "*" || req.Refill == key {
+				b.tokens = float64(quotaLimit(key))
+				refilled++
+				if id := fingerprint(key); apiKeyQuotaGuard.admit([]string{id})[0] == id {
+					apiKeyQuotaRemaining.WithLabelValues(id).Set(b.tokens)
+				}
+			}
+		}
+		if quotaOverflow != nil && req.Refill == "*" {
+			quotaOverflow.tokens = float64(quotaDefault.Load())
+			refilled++
+		}
+		quotaMu.Unlock()
+		slog.Warn("Admin: API key quotas updated", "daily_requests", quotaDefault.Load(), "overrides", len(req.Overrides), "refilled", refilled)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type keyReport struct {
+		Key       string  `json:"api_key"`
+		Limit     int64   `json:"limit"`
+		Remaining float64 `json:"remaining"`
+	}
+	quotaMu.Lock()
+	keys := []keyReport{}
+	for key, b := range quotaBuckets {
+		keys = append(keys, keyReport{Key: fingerprint(key), Limit: quotaLimit(key), Remaining: math.Floor(b.tokens)})
+	}
+	if quotaOverflow != nil {
+		keys = append(keys, keyReport{Key: quotaOverflowID, Limit: quotaDefault.Load(), Remaining: math.Floor(quotaOverflow.tokens)})
+	}
+	tracked := len(quotaBuckets)
+	overrides := len(quotaOverrides)
+	quotaMu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Remaining < keys[j].Remaining })
+	if len(keys) > 50 {
+		keys = keys[:50]
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"daily_requests": quotaDefault.Load(),
+		"overrides":      overrides,
+		"tracked_keys":   tracked,
+		"max_keys":       cfg.QuotaMaxKeys,
+		"lowest_keys":    keys,
+	})
+}
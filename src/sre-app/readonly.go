@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Read-only mode: writes are refused while reads carry on, a common way to
+// degrade partially when the primary database is in trouble. A write is
+// /checkout or any request that is not GET, HEAD or OPTIONS. READ_ONLY_MODE
+// is:
+//
+//	off   writes are served
+//	on    writes are refused
+//	auto  writes are refused while the database is unhealthy: more than
+//	      READ_ONLY_AUTO_ERROR_PCT percent (default 50) of the queries in a
+//	      READ_ONLY_CHECK_S interval (default 5) failed, with at least 5
+//	      queries; it recovers below half that
+//
+// Refused writes get READ_ONLY_STATUS (503, the default, with Retry-After,
+// or 405). http_requests_by_kind_total splits every instrumented request
+// into read and write, so read and write availability are separate SLIs:
+// with 405 a refused write isn't a 5xx, and the error SLI never notices.
+// /admin/readonly changes the mode at runtime.
+var (
+	readOnlyMode atomic.Value // string: off, on, auto
+	readOnlyAuto atomic.Bool  // auto mode's verdict
+	dbCalls      atomic.Int64
+	dbFailures   atomic.Int64
+
+	readOnlyActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "read_only_mode",
+		Help: "1 while writes are refused",
+	})
+	requestsByKind = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_by_kind_total",
+			Help: "Instrumented requests by kind (read, write) and outcome (ok, error: 5xx, refused: turned away in read-only mode)",
+		},
+		[]string{"kind", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(readOnlyActive, requestsByKind)
+	readOnlyMode.Store(cfg.ReadOnlyMode)
+}
+
+func isWrite(route, method string) bool {
+	switch {
+	case route == "/checkout":
+		return true
+	case method == http.MethodGet, method == http.MethodHead, method == http.MethodOptions:
+		return false
+	}
+	return route != "/alerts/webhook"
+}
+
+func readOnly() bool {
+	switch readOnlyMode.Load().(string) {
+	case "on":
+		return true
+	case "auto":
+		return readOnlyAuto.Load()
+	}
+	return false
+}
+
+// readOnlyAllows refuses writes in read-only mode.
+func readOnlyAllows(w http.ResponseWriter, r *http.Request, route string) bool {
+	if !isWrite(route, r.Method) || !readOnly() {
+		return true
+	}
+	if cfg.ReadOnlyStatus == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", "GET, HEAD")
+	} else {
+		w.Header().Set("Retry-After", strconv.Itoa(60))
+	}
+	writeProblem(w, r, "read-only mode: writes are disabled", cfg.ReadOnlyStatus)
+	return false
+}
+
+func recordRequestKind(route, method string, status int, refused bool) {
+	kind := "read"
+	if isWrite(route, method) {
+		kind = "write"
+	}
+	outcome := "ok"
+	switch {
+	case refused:
+		outcome = "refused"
+	case status >= http.StatusInternalServerError:
+		outcome = "error"
+	}
+	requestsByKind.WithLabelValues(kind, outcome).Inc()
+}
+
+// observeDatabaseHealth feeds auto mode; queryDatabase calls it for every
+// query.
+func observeDatabaseHealth(err error) {
+	dbCalls.Add(1)
+	if err != nil {
+		dbFailures.Add(1)
+	}
+}
+
+func startReadOnlyMonitor() {
+	readOnlyActive.Set(boolGauge(readOnly()))
+	go func() {
+		for range time.Tick(time.Duration(cfg.ReadOnlyCheckSeconds) * time.Second) {
+			calls, failures := dbCalls.Swap(0), dbFailures.Swap(0)
+			if calls >= 5 {
+				pct := 100 * float64(failures) / float64(calls)
+				was := readOnlyAuto.Load()
+				switch {
+				case !was && pct > cfg.ReadOnlyAutoErrorPct:
+					readOnlyAuto.Store(true)
+				case was && pct < cfg.ReadOnlyAutoErrorPct/2:
+					readOnlyAuto.Store(false)
+				}
+				if now := readOnlyAuto.Load(); now != was && readOnlyMode.Load().(string) == "auto" {
+					slog.Warn("Read-only mode changed by database health", "read_only", now, "db_error_pct", pct)
+				}
+			}
+			readOnlyActive.Set(boolGauge(readOnly()))
+		}
+	}()
+}
+
+func handleAdminReadOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Mode *string `json:"mode"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Mode != nil {
+			switch *req.Mode {
+			case "off", "on", "auto":
+				readOnlyMode.Store(*req.Mode)
+				readOnlyActive.Set(boolGauge(readOnly()))
+			default:
+				writeProblem(w, r, "mode must be off, on or auto", http.StatusBadRequest)
+				return
+			}
+			slog.Warn("Admin: read-only mode updated", "mode", *req.Mode)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"mode":      readOnlyMode.Load(),
+		"read_only": readOnly(),
+		"status":    cfg.ReadOnlyStatus,
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Inventory reconciler: an in-app analogue of a GitOps controller. Desired
+// stock per catalog SKU is the spec (generation bumps on every change
+// through /admin/reconciler); actual stock is what the "warehouse" reports.
+// Every RECONCILER_INTERVAL_MS (default 1000) the loop diffs the two and
+// corrects at most RECONCILER_MAX_FIXES (default 2) SKUs, so large drift
+// takes several passes to converge. RECONCILER_DRIFT_RATE (percent per pass)
+// perturbs actual stock at random and RECONCILER_ERROR_RATE (percent) makes
+// corrections fail and retry on the next pass.
+var (
+	reconcilerInterval = time.Second
+	reconcilerMaxFixes = 2
+
+	reconcilerMu        sync.Mutex
+	desiredInventory    = map[string]int{}
+	actualInventory     = map[string]int{}
+	desiredGeneration   = int64(1)
+	observedGeneration  int64
+	reconcilerPaused    bool
+	reconcilerDriftRate int
+	reconcilerErrorRate int
+	driftSince          time.Time
+)
+
+var (
+	reconcilerDrifted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "reconciler_drifted_resources",
+		Help: "SKUs whose actual stock differs from desired",
+	})
+	reconcilerCorrections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "reconciler_corrections_total",
+			Help: "Corrections attempted by the reconciler, by outcome (applied, failed)",
+		},
+		[]string{"outcome"},
+	)
+	reconcilerDriftInjected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "reconciler_drift_injected_total",
+		Help: "SKUs perturbed by drift injection",
+	})
+	reconcilerLoopDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "reconciler_loop_duration_seconds",
+		Help:    "Duration of reconcile passes",
+		Buckets: []float64{.001, .005, .01, .05, .1, .25, .5, 1},
+	})
+	reconcilerTimeToConverge = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "reconciler_time_to_converge_seconds",
+		Help:    "Time from drift first being seen to actual matching desired again",
+		Buckets: []float64{1, 2, 5, 10, 20, 30, 60, 120, 300},
+	})
+	reconcilerLastConverged = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "reconciler_last_converged_timestamp_seconds",
+		Help: "Unix time actual last matched desired",
+	})
+	reconcilerGeneration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "reconciler_generation",
+			Help: "Spec generation, desired and last fully reconciled (observed)",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(reconcilerDrifted, reconcilerCorrections, reconcilerDriftInjected, reconcilerLoopDuration,
+		reconcilerTimeToConverge, reconcilerLastConverged, reconcilerGeneration)
+}
+
+func startReconciler() {
+	reconcilerInterval = time.Duration(cfg.ReconcilerIntervalMs) * time.Millisecond
+	reconcilerMaxFixes = cfg.ReconcilerMaxFixes
+	reconcilerDriftRate = cfg.ReconcilerDriftRate
+	reconcilerErrorRate = cfg.ReconcilerErrorRate
+	for _, item := range catalogItems {
+		sku := item["sku"].(string)
+		desiredInventory[sku] = 100
+		actualInventory[sku] = 100
+	}
+	reconcilerCorrections.WithLabelValues("applied")
+	reconcilerCorrections.WithLabelValues("failed")
+	go func() {
+		for range time.Tick(reconcilerInterval) {
+			reconcileInventory()
+		}
+	}()
+}
+
+// driftedSKUs lists SKUs out of spec in a stable order; callers hold
+// reconcilerMu.
+func driftedSKUs() []string {
+	var drifted []string
+	for sku, want := range desiredInventory {
+		if actualInventory[sku] != want {
+			drifted = append(drifted, sku)
+		}
+	}
+	sort.Strings(drifted)
+	return drifted
+}
+
+// injectDrift perturbs n random SKUs; callers hold reconcilerMu.
+func injectDrift(n int) {
+	skus := make([]string, 0, len(actualInventory))
+	for sku := range actualInventory {
+		skus = append(skus, sku)
+	}
+	for i := 0; i < n && len(skus) > 0; i++ {
+		sku := skus[rand.Intn(len(skus))]
+		delta := 1 + rand.Intn(20)
+		if rand.Intn(2) == 0 && actualInventory[sku] >= delta {
+			delta = -delta
+		}
+		actualInventory[sku] += delta
+		reconcilerDriftInjected.Inc()
+	}
+}
+
+func reconcileInventory() {
+	start := time.Now()
+	reconcilerMu.Lock()
+	defer reconcilerMu.Unlock()
+	defer func() { reconcilerLoopDuration.Observe(time.Since(start).Seconds()) }()
+
+	reconcilerGeneration.WithLabelValues("desired").Set(float64(desiredGeneration))
+	reconcilerGeneration.WithLabelValues("observed").Set(float64(observedGeneration))
+	if reconcilerPaused {
+		return
+	}
+	if reconcilerDriftRate > 0 && rand.Intn(100) < reconcilerDriftRate {
+		injectDrift(1)
+	}
+
+	drifted := driftedSKUs()
+	reconcilerDrifted.Set(float64(len(drifted)))
+	if len(drifted) == 0 {
+		observedGeneration = desiredGeneration
+		reconcilerLastConverged.SetToCurrentTime()
+		return
+	}
+	if driftSince.IsZero() {
+		driftSince = start
+	}
+
+	// Only passes with work get a span; a converged controller stays quiet.
+	_, span := tracer.Start(context.Background(), "reconcile inventory",
+		trace.WithAttributes(attribute.Int64("app.reconciler.generation", desiredGeneration), attribute.Int("app.reconciler.drifted", len(drifted))))
+	defer span.End()
+	for _, sku := range drifted[:min(reconcilerMaxFixes, len(drifted))] {
+		if reconcilerErrorRate > 0 && rand.Intn(100) < reconcilerErrorRate {
+			reconcilerCorrections.WithLabelValues("failed").Inc()
+			span.AddEvent("correction failed", trace.WithAttributes(attribute.String("app.order.sku", sku)))
+			continue
+		}
+		span.AddEvent("corrected", trace.WithAttributes(
+			attribute.String("app.order.sku", sku),
+			attribute.Int("app.reconciler.from", actualInventory[sku]),
+			attribute.Int("app.reconciler.to", desiredInventory[sku]),
+		))
+		actualInventory[sku] = desiredInventory[sku]
+		reconcilerCorrections.WithLabelValues("applied").Inc()
+	}
+
+	remaining := len(driftedSKUs())
+	reconcilerDrifted.Set(float64(remaining))
+	span.SetAttributes(attribute.Int("app.reconciler.remaining", remaining))
+	if remaining == 0 {
+		reconcilerTimeToConverge.Observe(time.Since(driftSince).Seconds())
+		driftSince = time.Time{}
+		observedGeneration = desiredGeneration
+		reconcilerLastConverged.SetToCurrentTime()
+		slog.Info("Reconciler converged", "generation", observedGeneration)
+	}
+}
+
+// handleAdminReconciler reports the reconciler or changes it:
+// {"drift": 4} perturbs four SKUs now, {"desired": {"coffee-beans": 250}}
+// changes the spec, and "paused", "drift_rate" and "error_rate" set chaos.
+func handleAdminReconciler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Drift     int            `json:"drift"`
+			Desired   map[string]int `json:"desired"`
+			Paused    *bool          `json:"paused"`
+			DriftRate *int           `json:"drift_rate"`
+			ErrorRate *int           `json:"error_rate"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		reconcilerMu.Lock()
+		for sku, qty := range req.Desired {
+			if _, ok := desiredInventory[sku]; !ok || qty < 0 {
+				reconcilerMu.Unlock()
+				writeProblem(w, r, fmt.Sprintf("unknown sku %q or negative quantity", sku), http.StatusBadRequest)
+				return
+			}
+		}
+		if len(req.Desired) > 0 {
+			for sku, qty := range req.Desired {
+				desiredInventory[sku] = qty
+			}
+			desiredGeneration++
+		}
+		injectDrift(req.Drift)
+		if req.Paused != nil {
+			reconcilerPaused = *req.Paused
+		}
+		if req.DriftRate != nil {
+			reconcilerDriftRate = *req.DriftRate
+		}
+		if req.ErrorRate != nil {
+			reconcilerErrorRate = *req.ErrorRate
+		}
+		slog.Warn("Admin: reconciler updated", "generation", desiredGeneration, "drift", req.Drift, "paused", reconcilerPaused,
+			"drift_rate", reconcilerDriftRate, "error_rate", reconcilerErrorRate)
+		reconcilerMu.Unlock()
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reconcilerMu.Lock()
+	defer reconcilerMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"generation":          desiredGeneration,
+		"observed_generation": observedGeneration,
+		"paused":              reconcilerPaused,
+		"drift_rate":          reconcilerDriftRate,
+		"error_rate":          reconcilerErrorRate,
+		"drifted":             driftedSKUs(),
+		"desired":             desiredInventory,
+		"actual":              actualInventory,
+	})
+}
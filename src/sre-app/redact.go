@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PII redaction. Log records and exported spans (attributes, error events
+// and status) are scrubbed of email addresses and card numbers, and keys
+// listed in REDACT_FIELDS are blanked outright. /admin/chaos/redaction
+// (or REDACTION_DISABLED=true) turns the layer off to show what leaking
+// telemetry looks like.
+var (
+	redactionEnabled atomic.Bool
+	redactFields     = map[string]bool{}
+
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	cardPattern  = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+
+	telemetryRedactionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "telemetry_redactions_total",
+			Help: "Total number of values redacted from telemetry",
+		},
+		[]string{"signal", "rule"},
+	)
+	telemetryRedactionEnabled = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemetry_redaction_enabled",
+		Help: "1 while the PII redaction layer is active",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(telemetryRedactionsTotal)
+	prometheus.MustRegister(telemetryRedactionEnabled)
+}
+
+func loadRedactionConfig() {
+	fields := os.Getenv("REDACT_FIELDS")
+	if fields == "" {
+		fields = "app.customer.email,email,card_number"
+	}
+	for _, f := range strings.Split(fields, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			redactFields[f] = true
+		}
+	}
+	setRedaction(!cfg.RedactionDisabled)
+}
+
+func setRedaction(enabled bool) {
+	redactionEnabled.Store(enabled)
+	if enabled {
+		telemetryRedactionEnabled.Set(1)
+	} else {
+		telemetryRedactionEnabled.Set(0)
+	}
+}
+
+func redactString(signal, s string) string {
+	s = emailPattern.ReplaceAllStringFunc(s, func(string) string {
+		telemetryRedactionsTotal.WithLabelValues(signal, "email").Inc()
+		return "[REDACTED:email]"
+	})
+	return cardPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if !luhnValid(m) {
+			return m
+		}
+		telemetryRedactionsTotal.WithLabelValues(signal, "card").Inc()
+		return "[REDACTED:card]"
+	})
+}
+
+// luhnValid keeps long numbers that aren't card numbers (timestamps, sizes)
+// out of the redaction counter.
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+func redactKeyValue(signal string, kv attribute.KeyValue) attribute.KeyValue {
+	if redactFields[string(kv.Key)] {
+		telemetryRedactionsTotal.WithLabelValues(signal, "field").Inc()
+		return kv.Key.String("[REDACTED]")
+	}
+	if kv.Value.Type() == attribute.STRING {
+		return kv.Key.String(redactString(signal, kv.Value.AsString()))
+	}
+	return kv
+}
+
+func redactKeyValues(signal string, kvs []attribute.KeyValue) []attribute.KeyValue {
+	out := make([]attribute.KeyValue, len(kvs))
+	for i, kv := range kvs {
+		out[i] = redactKeyValue(signal, kv)
+	}
+	return out
+}
+
+// redactingExporter scrubs spans on their way to the real exporter.
+type redactingExporter struct {
+	sdktrace.SpanExporter
+}
+
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+func (s redactedSpan) Attributes() []attribute.KeyValue {
+	return redactKeyValues("span", s.ReadOnlySpan.Attributes())
+}
+
+func (s redactedSpan) Events() []sdktrace.Event {
+	events := s.ReadOnlySpan.Events()
+	out := make([]sdktrace.Event, len(events))
+	for i, ev := range events {
+		ev.Attributes = redactKeyValues("span", ev.Attributes)
+		out[i] = ev
+	}
+	return out
+}
+
+func (s redactedSpan) Status() sdktrace.Status {
+	st := s.ReadOnlySpan.Status()
+	st.Description = redactString("span", st.Description)
+	return st
+}
+
+func (e redactingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if !redactionEnabled.Load() {
+		return e.SpanExporter.ExportSpans(ctx, spans)
+	}
+	out := make([]sdktrace.ReadOnlySpan, len(spans))
+	for i, s := range spans {
+		out[i] = redactedSpan{s}
+	}
+	return e.SpanExporter.ExportSpans(ctx, out)
+}
+
+// redactingHandler scrubs log messages and attributes.
+type redactingHandler struct {
+	slog.Handler
+}
+
+func (h redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !redactionEnabled.Load() {
+		return h.Handler.Handle(ctx, r)
+	}
+	out := slog.NewRecord(r.Time, r.Level, redactString("log", r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactSlogAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = redactSlogAttr(a)
+	}
+	return redactingHandler{h.Handler.WithAttrs(out)}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{h.Handler.WithGroup(name)}
+}
+
+func redactSlogAttr(a slog.Attr) slog.Attr {
+	if redactFields[a.Key] {
+		telemetryRedactionsTotal.WithLabelValues("log", "field").Inc()
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactString("log", v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		out := make([]any, len(group))
+		for i, ga := range group {
+			out[i] = redactSlogAttr(ga)
+		}
+		return slog.Group(a.Key, out...)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, redactString("log", err.Error()))
+		}
+	}
+	return a
+}
+
+// credentialURL returns u with only its scheme and host, for URLs whose
+// path or query is itself a credential: chat webhooks, presigned object
+// URLs. Unlike the PII layer this is never switched off.
+func credentialURL(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// credentialURLTransport sits under otelhttp.NewTransport and cuts the
+// client span's http.url down to credentialURL before the span is exported.
+type credentialURLTransport struct {
+	base http.RoundTripper
+}
+
+func (t credentialURLTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.url", credentialURL(r.URL)))
+	return t.base.RoundTrip(r)
+}
+
+// handleAdminRedaction reports (GET) or toggles (PUT/POST) redaction,
+// e.g. {"enabled": false} to start leaking PII into Loki and Tempo.
+func handleAdminRedaction(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Enabled *bool `json:"enabled"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			writeProblem(w, r, `invalid JSON body, want {"enabled": bool}`, http.StatusBadRequest)
+			return
+		}
+		setRedaction(*req.Enabled)
+		slog.Warn("Admin: PII redaction toggled", "enabled", *req.Enabled)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"enabled": redactionEnabled.Load()})
+}
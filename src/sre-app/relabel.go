@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// In-app metric relabeling, the source-side analogue of Prometheus'
+// metric_relabel_configs: the same series are never produced, rather than
+// scraped and thrown away. METRIC_RELABEL_RULES is a ";"-separated list
+// applied in order to every /metrics response:
+//
+//	drop:<metric regex>                      drop whole metric families
+//	drop:<metric regex>:<label>=<value regex> drop the matching series
+//	labeldrop:<metric regex>:<label>         remove a label
+//	rename:<metric>:<new name>               rename a family
+//
+// Regexes are anchored. Series that become identical after a labeldrop are
+// merged: counter, gauge and untyped values and histogram buckets are summed,
+// summaries keep only their count and sum. A family renamed onto a name
+// another family already has is merged into it the same way, as the
+// exposition format allows one family per name; if their types differ the
+// renamed family is dropped instead. telemetry_relabel_series reports
+// what the previous scrape carried before and after the rules, and
+// /admin/metrics/relabel replaces the rules at runtime.
+type relabelRule struct {
+	raw    string
+	action string
+	metric *regexp.Regexp
+	label  string
+	value  *regexp.Regexp
+	rename string
+}
+
+var (
+	relabelRules atomic.Pointer[[]relabelRule]
+	// relabelConflictsWarned holds the names whose collision has been logged.
+	relabelConflictsWarned sync.Map
+
+	relabelSeries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "telemetry_relabel_series",
+			Help: "Series in the previous /metrics response, before and after METRIC_RELABEL_RULES",
+		},
+		[]string{"stage"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(relabelSeries)
+	// A malformed spec is reported by loadConfig and main refuses to start.
+	rules, _ := parseRelabelRules(os.Getenv("METRIC_RELABEL_RULES"))
+	relabelRules.Store(&rules)
+}
+
+func parseRelabelRules(spec string) ([]relabelRule, error) {
+	var rules []relabelRule
+	for _, raw := range strings.Split(spec, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		parts := strings.SplitN(raw, ":", 3)
+		if len(parts) < 2 || parts[1] == "" {
+			return nil, fmt.Errorf("rule %q: want action:metric[:argument]", raw)
+		}
+		metric, err := regexp.Compile("^(?:" + parts[1] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", raw, err)
+		}
+		rule := relabelRule{raw: raw, action: parts[0], metric: metric}
+		arg := ""
+		if len(parts) == 3 {
+			arg = parts[2]
+		}
+		switch rule.action {
+		case "drop":
+			if arg == "" {
+				break
+			}
+			label, value, ok := strings.Cut(arg, "=")
+			if !ok || label == "" {
+				return nil, fmt.Errorf("rule %q: want drop:metric:label=regex", raw)
+			}
+			if rule.value, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, fmt.Errorf("rule %q: %v", raw, err)
+			}
+			rule.label = label
+		case "labeldrop":
+			if arg == "" {
+				return nil, fmt.Errorf("rule %q: want labeldrop:metric:label", raw)
+			}
+			rule.label = arg
+		case "rename":
+			if !prometheusName.MatchString(arg) {
+				return nil, fmt.Errorf("rule %q: %q is not a valid metric name", raw, arg)
+			}
+			rule.rename = arg
+		default:
+			return nil, fmt.Errorf("rule %q: unknown action %q (use drop, labeldrop or rename)", raw, rule.action)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+var prometheusName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// relabelingGatherer applies the relabel rules to everything it gathers.
+type relabelingGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g relabelingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	rules := *relabelRules.Load()
+	before := countSeries(families)
+	if len(rules) > 0 {
+		families = relabel(families, rules)
+	}
+	relabelSeries.WithLabelValues("before").Set(float64(before))
+	relabelSeries.WithLabelValues("after").Set(float64(countSeries(families)))
+	return families, err
+}
+
+func countSeries(families []*dto.MetricFamily) int {
+	n := 0
+	for _, mf := range families {
+		n += len(mf.GetMetric())
+	}
+	return n
+}
+
+func relabel(families []*dto.MetricFamily, rules []relabelRule) []*dto.MetricFamily {
+	kept := families[:0]
+	renamed := map[*dto.MetricFamily]bool{}
+	for _, mf := range families {
+		dropped := false
+		for _, rule := range rules {
+			if !rule.metric.MatchString(mf.GetName()) {
+				continue
+			}
+			switch rule.action {
+			case "drop":
+				if rule.value == nil {
+					dropped = true
+					break
+				}
+				mf.Metric = dropSeries(mf.Metric, rule.label, rule.value)
+				dropped = len(mf.Metric) == 0
+			case "labeldrop":
+				mf.Metric = mergeSeries(mf.GetType(), dropLabel(mf.Metric, rule.label))
+			case "rename":
+				mf.Name = &rule.rename
+				renamed[mf] = true
+			}
+			if dropped {
+				break
+			}
+		}
+		if !dropped {
+			kept = append(kept, mf)
+		}
+	}
+	// Renames can land a family out of the order the exposition expects, or
+	// on a name that is already taken; a family that kept its name sorts
+	// ahead of one renamed onto it.
+	sort.SliceStable(kept, func(i, j int) bool {
+		if a, b := kept[i].GetName(), kept[j].GetName(); a != b {
+			return a < b
+		}
+		return !renamed[kept[i]] && renamed[kept[j]]
+	})
+	return mergeFamilies(kept)
+}
+
+// mergeFamilies folds families that share a name, which are adjacent in
+// families, into the first of them.
+func mergeFamilies(families []*dto.MetricFamily) []*dto.MetricFamily {
+	merged := families[:0]
+	for _, mf := range families {
+		last := len(merged) - 1
+		if last < 0 || merged[last].GetName() != mf.GetName() {
+			merged = append(merged, mf)
+			continue
+		}
+		into := merged[last]
+		if into.GetType() != mf.GetType() {
+			if _, warned := relabelConflictsWarned.LoadOrStore(mf.GetName(), true); !warned {
+				slog.Warn("Metric relabel rename collides with a family of another type, dropping the renamed one",
+					"metric", mf.GetName(), "type", mf.GetType().String(), "existing_type", into.GetType().String())
+			}
+			continue
+		}
+		into.Metric = mergeSeries(into.GetType(), append(into.Metric, mf.Metric...))
+	}
+	return merged
+}
+
+func dropSeries(series []*dto.Metric, label string, value *regexp.Regexp) []*dto.Metric {
+	kept := series[:0]
+	for _, m := range series {
+		if !value.MatchString(labelValue(m, label)) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
+
+func dropLabel(series []*dto.Metric, label string) []*dto.Metric {
+	for _, m := range series {
+		labels := m.Label[:0]
+		for _, lp := range m.Label {
+			if lp.GetName() != label {
+				labels = append(labels, lp)
+			}
+		}
+		m.Label = labels
+	}
+	return series
+}
+
+// mergeSeries folds series with identical labels into one.
+func mergeSeries(kind dto.MetricType, series []*dto.Metric) []*dto.Metric {
+	byLabels := map[string]*dto.Metric{}
+	merged := series[:0]
+	for _, m := range series {
+		var key strings.Builder
+		for _, lp := range m.GetLabel() {
+			key.WriteString(lp.GetName() + "\xff" + lp.GetValue() + "\xff")
+		}
+		into, ok := byLabels[key.String()]
+		if !ok {
+			byLabels[key.String()] = m
+			merged = append(merged, m)
+			continue
+		}
+		switch kind {
+		case dto.MetricType_COUNTER:
+			*into.Counter.Value += m.Counter.GetValue()
+		case dto.MetricType_GAUGE:
+			*into.Gauge.Value += m.Gauge.GetValue()
+		case dto.MetricType_UNTYPED:
+			*into.Untyped.Value += m.Untyped.GetValue()
+		case dto.MetricType_HISTOGRAM:
+			*into.Histogram.SampleCount += m.Histogram.GetSampleCount()
+			*into.Histogram.SampleSum += m.Histogram.GetSampleSum()
+			for i, b := range m.Histogram.GetBucket() {
+				if i < len(into.Histogram.Bucket) {
+					*into.Histogram.Bucket[i].CumulativeCount += b.GetCumulativeCount()
+				}
+			}
+		case dto.MetricType_SUMMARY:
+			*into.Summary.SampleCount += m.Summary.GetSampleCount()
+			*into.Summary.SampleSum += m.Summary.GetSampleSum()
+			into.Summary.Quantile = nil
+		}
+	}
+	return merged
+}
+
+// handleAdminRelabel reports or replaces the relabel rules:
+// {"rules": "drop:go_gc_.*;labeldrop:http_requests_total:method"}.
+func handleAdminRelabel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Rules *string `json:"rules"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Rules != nil {
+			rules, err := parseRelabelRules(*req.Rules)
+			if err != nil {
+				writeProblem(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			relabelRules.Store(&rules)
+			slog.Warn("Admin: metric relabel rules updated", "rules", *req.Rules)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rules := []string{}
+	for _, rule := range *relabelRules.Load() {
+		rules = append(rules, rule.raw)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"rules": rules})
+}
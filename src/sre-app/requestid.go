@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"math/rand"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Request IDs, for correlating logs where tracing is sampled out. Every
+// request gets an X-Request-ID: the caller's when it sends a usable one (up
+// to 128 characters of letters, digits and -_.:/+=), a fresh random one
+// otherwise. The ID is echoed on the response, recorded on the server span
+// as app.request_id, added to every log line written with the request's
+// context and to the /admin/telemetry/errors ring, and forwarded on outbound
+// calls and queue messages by requestIDPropagator, so one grep follows a
+// request through every hop.
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+var requestIDsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "request_ids_total",
+		Help: "Request IDs by source (caller, generated, rejected: an unusable caller ID was replaced)",
+	},
+	[]string{"source"},
+)
+
+func init() {
+	prometheus.MustRegister(requestIDsTotal)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID settles the request's ID and echoes it on the response.
+// The propagator has already extracted a valid caller ID into ctx.
+func withRequestID(ctx context.Context, w http.ResponseWriter, r *http.Request) (context.Context, string) {
+	id := requestIDFromContext(ctx)
+	switch {
+	case id != "":
+		requestIDsTotal.WithLabelValues("caller").Inc()
+	case r.Header.Get(requestIDHeader) != "":
+		requestIDsTotal.WithLabelValues("rejected").Inc()
+	default:
+		requestIDsTotal.WithLabelValues("generated").Inc()
+	}
+	if id == "" {
+		var b [16]byte
+		rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+		ctx = context.WithValue(ctx, requestIDKey{}, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return ctx, id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDPropagator carries X-Request-ID alongside the trace context.
+type requestIDPropagator struct{}
+
+func (requestIDPropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	if id := requestIDFromContext(ctx); id != "" {
+		carrier.Set(requestIDHeader, id)
+	}
+}
+
+func (requestIDPropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	if id := carrier.Get(requestIDHeader); validRequestID(id) {
+		return context.WithValue(ctx, requestIDKey{}, id)
+	}
+	return ctx
+}
+
+func (requestIDPropagator) Fields() []string { return []string{requestIDHeader} }
+
+// requestIDHandler adds request_id to log records written with a request's
+// context.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
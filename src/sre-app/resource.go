@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// newResource layers, lowest precedence first: the lab defaults, the
+// Downward API k8s attributes, host/container/process/OS detectors, and
+// finally OTEL_RESOURCE_ATTRIBUTES / OTEL_SERVICE_NAME so an overlay can
+// always correct what detection got wrong.
+func newResource(ctx context.Context) (*resource.Resource, error) {
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			semconv.ServiceNameKey.String("sre-observability-app"),
+			semconv.ServiceVersionKey.String("1.0.0"),
+			attribute.String("environment", "lab"),
+		),
+		resource.WithDetectors(k8sDetector{}, regionDetector{}, zoneDetector{}),
+		resource.WithHost(),
+		resource.WithContainer(),
+		resource.WithProcessPID(),
+		resource.WithProcessExecutableName(),
+		resource.WithProcessRuntimeName(),
+		resource.WithProcessRuntimeVersion(),
+		resource.WithOS(),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if errors.Is(err, resource.ErrPartialResource) {
+		// Detectors that can't run here (e.g. no cgroup outside a container)
+		// are not fatal; keep what was detected.
+		log.Printf("resource detection incomplete: %v", err)
+		return res, nil
+	}
+	return res, err
+}
+
+// k8sDetector reads the pod identity the Deployment injects through the
+// Downward API (K8S_POD_NAME, K8S_NAMESPACE_NAME, K8S_NODE_NAME, K8S_POD_UID).
+type k8sDetector struct{}
+
+func (k8sDetector) Detect(ctx context.Context) (*resource.Resource, error) {
+	var attrs []attribute.KeyValue
+	if v := os.Getenv("K8S_POD_NAME"); v != "" {
+		attrs = append(attrs, semconv.K8SPodName(v))
+	}
+	if v := os.Getenv("K8S_NAMESPACE_NAME"); v != "" {
+		attrs = append(attrs, semconv.K8SNamespaceName(v))
+	}
+	if v := os.Getenv("K8S_NODE_NAME"); v != "" {
+		attrs = append(attrs, semconv.K8SNodeName(v))
+	}
+	if v := os.Getenv("K8S_POD_UID"); v != "" {
+		attrs = append(attrs, semconv.K8SPodUID(v))
+	}
+	if len(attrs) == 0 {
+		return resource.Empty(), nil
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attrs...), nil
+}
+
+// regionDetector reads the lab's multi-cluster identity: REGION maps to
+// cloud.region and CLUSTER to k8s.cluster.name.
+type regionDetector struct{}
+
+func (regionDetector) Detect(ctx context.Context) (*resource.Resource, error) {
+	var attrs []attribute.KeyValue
+	if v := os.Getenv("REGION"); v != "" {
+		attrs = append(attrs, semconv.CloudRegion(v))
+	}
+	if v := os.Getenv("CLUSTER"); v != "" {
+		attrs = append(attrs, semconv.K8SClusterName(v))
+	}
+	if len(attrs) == 0 {
+		return resource.Empty(), nil
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attrs...), nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// In-process response cache for GET routes wrapped in cached(). Entries are
+// fresh for RESPONSE_CACHE_TTL_S (default 30) and then served stale for up
+// to RESPONSE_CACHE_SWR_S more (default 60) while one background request
+// revalidates them. Misses are not coalesced here, so flushing the cache
+// through /admin/chaos/cache sends every concurrent request to the origin at
+// once; only singleflight in the origin lookup stands between them and the
+// database.
+// Entries are keyed on the route and the query parameters the handler reads,
+// so arbitrary query strings share one entry, and at most
+// RESPONSE_CACHE_MAX_ENTRIES (default 1000) are held: storing past that drops
+// expired entries, then the oldest.
+// RESPONSE_CACHE=false turns caching off. cached() records the route's
+// http_requests_total and http_request_duration_seconds for hits, misses
+// and bypasses alike, so the handlers it wraps don't, and background
+// revalidations are not counted as requests.
+var (
+	responseCacheEnabled = true
+	responseCacheTTL     = 30 * time.Second
+	responseCacheSWR     = 60 * time.Second
+	responseCacheMax     = 1000
+)
+
+type cachedResponse struct {
+	status       int
+	header       http.Header
+	body         []byte
+	storedAt     time.Time
+	revalidating bool
+}
+
+var (
+	respCacheMu sync.Mutex
+	respCache   = map[string]*cachedResponse{}
+)
+
+var (
+	responseCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "response_cache_requests_total",
+			Help: "Cacheable requests by route and result (hit, stale, miss, bypass)",
+		},
+		[]string{"route", "result"},
+	)
+	responseCacheRevalidations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "response_cache_revalidations_total",
+			Help: "Background stale-while-revalidate refreshes by route and outcome",
+		},
+		[]string{"route", "outcome"},
+	)
+	responseCacheEntries = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "response_cache_entries",
+		Help: "Responses currently held in the cache",
+	}, func() float64 {
+		respCacheMu.Lock()
+		defer respCacheMu.Unlock()
+		return float64(len(respCache))
+	})
+)
+
+func init() {
+	prometheus.MustRegister(responseCacheRequests, responseCacheRevalidations, responseCacheEntries)
+	responseCacheEnabled = cfg.ResponseCache
+	responseCacheTTL = time.Duration(cfg.ResponseCacheTTLS) * time.Second
+	responseCacheSWR = time.Duration(cfg.ResponseCacheSWRS) * time.Second
+	responseCacheMax = cfg.ResponseCacheMax
+}
+
+// captureWriter buffers a response so it can be both sent and cached.
+type captureWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *captureWriter) Header() http.Header { return c.header }
+
+func (c *captureWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	return c.body.Write(b)
+}
+
+// cached serves GETs for route from the response cache; params are the
+// query parameters h reads, the only ones that tell responses apart.
+func cached(route string, params []string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		status := http.StatusOK
+		defer func() {
+			httpRequestsTotal.WithLabelValues(route, strconv.Itoa(status)).Inc()
+			httpRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		}()
+		if !responseCacheEnabled || r.Method != http.MethodGet {
+			responseCacheRequests.WithLabelValues(route, "bypass").Inc()
+			rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			h(rw, r)
+			status = rw.status
+			return
+		}
+		key := cacheKey(route, params, r)
+
+		respCacheMu.Lock()
+		entry := respCache[key]
+		result := "miss"
+		if entry != nil {
+			switch age := time.Since(entry.storedAt); {
+			case age < responseCacheTTL:
+				result = "hit"
+			case age < responseCacheTTL+responseCacheSWR:
+				result = "stale"
+				if !entry.revalidating {
+					entry.revalidating = true
+					go revalidate(route, key, r.Clone(context.WithoutCancel(r.Context())), h)
+				}
+			default:
+				delete(respCache, key)
+				entry = nil
+			}
+		}
+		respCacheMu.Unlock()
+
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("app.cache.result", result))
+		responseCacheRequests.WithLabelValues(route, result).Inc()
+		if entry == nil {
+			entry = fetchForCache(key, r, h)
+		}
+		writeCachedResponse(w, entry, result)
+		status = entry.status
+	}
+}
+
+// cacheKey is route plus the values of params in r's query.
+func cacheKey(route string, params []string, r *http.Request) string {
+	query := r.URL.Query()
+	kept := url.Values{}
+	for _, p := range params {
+		if v, ok := query[p]; ok {
+			kept[p] = v
+		}
+	}
+	if len(kept) == 0 {
+		return route
+	}
+	return route + "?" + kept.Encode()
+}
+
+// fetchForCache runs the origin handler and stores a 200 response.
+func fetchForCache(key string, r *http.Request, h http.HandlerFunc) *cachedResponse {
+	cw := &captureWriter{header: http.Header{}}
+	h(cw, r)
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	entry := &cachedResponse{status: cw.status, header: cw.header, body: cw.body.Bytes(), storedAt: time.Now()}
+	if entry.status == http.StatusOK {
+		respCacheMu.Lock()
+		if _, ok := respCache[key]; !ok && len(respCache) >= responseCacheMax {
+			evictResponses()
+		}
+		respCache[key] = entry
+		respCacheMu.Unlock()
+	}
+	return entry
+}
+
+// evictResponses makes room for one entry by dropping expired entries, or
+// the oldest if none has expired; respCacheMu is held.
+func evictResponses() {
+	var oldestKey string
+	var oldest time.Time
+	for k, e := range respCache {
+		if time.Since(e.storedAt) >= responseCacheTTL+responseCacheSWR {
+			delete(respCache, k)
+		} else if oldestKey == "" || e.storedAt.Before(oldest) {
+			oldestKey, oldest = k, e.storedAt
+		}
+	}
+	if len(respCache) >= responseCacheMax {
+		delete(respCache, oldestKey)
+	}
+}
+
+// revalidate refreshes a stale entry off the request path; its trace links
+// back to the request that found the entry stale.
+func revalidate(route, key string, r *http.Request, h http.HandlerFunc) {
+	ctx, span := tracer.Start(context.Background(), "cache.revalidate",
+		trace.WithLinks(trace.Link{SpanContext: trace.SpanContextFromContext(r.Context())}),
+		trace.WithAttributes(attribute.String("app.cache.key", key)))
+	defer span.End()
+
+	entry := fetchForCache(key, r.WithContext(ctx), h)
+	outcome := "refreshed"
+	if entry.status != http.StatusOK {
+		outcome = "failed"
+		respCacheMu.Lock()
+		if stale := respCache[key]; stale != nil {
+			stale.revalidating = false
+		}
+		respCacheMu.Unlock()
+	}
+	responseCacheRevalidations.WithLabelValues(route, outcome).Inc()
+}
+
+func writeCachedResponse(w http.ResponseWriter, entry *cachedResponse, result string) {
+	for k, v := range entry.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Cache", map[string]string{"hit": "HIT", "stale": "STALE", "miss": "MISS"}[result])
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.storedAt).Seconds())))
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// handleAdminCache reports the cache or flushes it: {"flush": true}.
+func handleAdminCache(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Flush bool `json:"flush"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Flush {
+			respCacheMu.Lock()
+			flushed := len(respCache)
+			respCache = map[string]*cachedResponse{}
+			respCacheMu.Unlock()
+			slog.Warn("Admin: response cache flushed", "entries", flushed)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	respCacheMu.Lock()
+	entries := len(respCache)
+	respCacheMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"enabled": responseCacheEnabled,
+		"ttl_s":   responseCacheTTL.Seconds(),
+		"swr_s":   responseCacheSWR.Seconds(),
+		"entries": entries,
+		"max":     responseCacheMax,
+	})
+}
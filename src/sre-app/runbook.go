@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Runbook hints for exercises. /runbook lists the failure classes that are
+// active right now, from the live chaos settings, in symptom terms only:
+// what responders would see and where to look, never the injected fault
+// itself. ?reveal=true adds the fault, except while an incident simulation
+// with a locked ground truth is running (see incident.go), so a hint system
+// can't leak the answer early.
+type runbookClass struct {
+	class      string
+	symptoms   []string
+	lookAt     []string
+	activeWith func() (bool, string)
+}
+
+var runbookClasses = []runbookClass{
+	{
+		class:    "elevated_errors",
+		symptoms: []string{"A steady share of requests fail with 5xx on every endpoint", "Failures are spread evenly over time, not bursty"},
+		lookAt:   []string{"Error ratio by route and by pod", "Error spans: is any downstream call failing?"},
+		activeWith: func() (bool, string) {
+			return errorRate > 0, fmt.Sprintf("ERROR_RATE=%d%%", errorRate)
+		},
+	},
+	{
+		class:    "uniform_latency",
+		symptoms: []string{"Every endpoint is slower by about the same amount", "No downstream call accounts for the extra time"},
+		lookAt:   []string{"Latency percentiles by route", "Self time versus downstream time in traces"},
+		activeWith: func() (bool, string) {
+			return latencyMs > 0, fmt.Sprintf("LATENCY_MS=%d", latencyMs)
+		},
+	},
+	{
+		class:    "localized_latency",
+		symptoms: []string{"Only some clients see slow responses while overall percentiles look mild", "The slow requests share a user agent, tenant, method or payload size"},
+		lookAt:   []string{"Slow server spans grouped by user_agent.original, app.tenant, http.request.method and app.request.size_bucket"},
+		activeWith: func() (bool, string) {
+			rules := []string{}
+			for _, rule := range *latencyRules.Load() {
+				rules = append(rules, rule.raw)
+			}
+			return len(rules) > 0, "LATENCY_RULES=" + strings.Join(rules, "; ")
+		},
+	},
+	{
+		class:    "access_denied",
+		symptoms: []string{"Many or all users get 403 Forbidden", "Nothing changed in the application's code or dependencies"},
+		lookAt:   []string{"acl_denied_requests_total by rule", "The client.address the server spans resolved"},
+		activeWith: func() (bool, string) {
+			mode := aclChaos.Load().(string)
+			return mode != "", "IP ACL chaos mode " + mode
+		},
+	},
+	{
+		class:    "dependency_degraded",
+		symptoms: []string{"Checkout slows down or fails while other routes stay healthy", "Client spans to one peer dominate checkout traces"},
+		lookAt:   []string{"Client spans grouped by peer.service", "Bulkhead in-use and rejection metrics", "Retry attributes on client spans"},
+		activeWith: func() (bool, string) {
+			latency, errs, retries := paymentLatencyMs.Load(), paymentErrorRate.Load(), paymentRetries.Load()
+			active := latency > int64(cfg.PaymentLatencyMs) || errs > 0 || retries > int64(cfg.PaymentRetries)
+			return active, fmt.Sprintf("payment provider latency=%dms error_rate=%d%% client retries=%d", latency, errs, retries)
+		},
+	},
+	{
+		class:    "database_slow",
+		symptoms: []string{"Database-backed requests slow down", "Connection pool waits grow before timeouts appear"},
+		lookAt:   []string{"DB pool wait count and duration", "Query spans' durations"},
+		activeWith: func() (bool, string) {
+			return dbSlowQueryMs.Load() > 0, fmt.Sprintf("every query slowed by %dms", dbSlowQueryMs.Load())
+		},
+	},
+	{
+		class:    "broken_traces",
+		symptoms: []string{"Traces end at client spans with no children", "Downstream services show many root spans or traces missing their root"},
+		lookAt:   []string{"Service graph edges", "Traceparent headers on outbound calls"},
+		activeWith: func() (bool, string) {
+			loss, corrupt := propagationLossRate.Load(), propagationCorruptRate.Load()
+			return loss > 0 || corrupt > 0, fmt.Sprintf("propagation loss=%d%% corrupt=%d%%", loss, corrupt)
+		},
+	},
+	{
+		class:    "telemetry_pipeline",
+		symptoms: []string{"Spans arrive late, partially, or not at all", "The app's own export metrics show failures or a growing backlog"},
+		lookAt:   []string{"otel_export_failures_total and otel_exporter_up", "Collector refused and dropped span metrics"},
+		activeWith: func() (bool, string) {
+			exporterBlackholesMu.Lock()
+			modes := exporterBlackholeModes()
+			exporterBlackholesMu.Unlock()
+			var faults []string
+			for name, on := range modes {
+				if on {
+					faults = append(faults, "exporter "+name+" blackholed")
+				}
+			}
+			if rate := spanFloodRate.Load(); rate > 0 {
+				faults = append(faults, fmt.Sprintf("span flood on %d%% of requests", rate))
+			}
+			return len(faults) > 0, strings.Join(faults, ", ")
+		},
+	},
+	{
+		class:    "scrape_degraded",
+		symptoms: []string{"Scrapes are slow, fail, or return unusually many series", "Gaps appear in every metric from this target at once"},
+		lookAt:   []string{"up, scrape_duration_seconds and scrape_samples_scraped"},
+		activeWith: func() (bool, string) {
+			ms, rate, extra := metricsChaosLatencyMs.Load(), metricsChaosErrorRate.Load(), metricsChaosExtra.Load()
+			return ms > 0 || rate > 0 || extra > 0, fmt.Sprintf("scrape latency=%dms error_rate=%d%% extra_series=%d", ms, rate, extra)
+		},
+	},
+	{
+		class:    "async_pipeline",
+		symptoms: []string{"Requests succeed but follow-up work lags or goes missing", "Queues, retries or dead letters grow"},
+		lookAt:   []string{"Queue depth and dead-letter metrics", "Notification delivery latency and outcomes", "Consumer spans linked from producers"},
+		activeWith: func() (bool, string) {
+			poison, consumer := poisonRate.Load(), consumerErrorRate.Load()
+			notifyFail, notifyMs := notifyFailureRate.Load(), notifyLatencyMs.Load()
+			active := poison > 0 || consumer > 0 || notifyFail > 0 || notifyMs > 0
+			return active, fmt.Sprintf("poison messages=%d%% consumer errors=%d%% notification failures=%d%% notification latency=%dms", poison, consumer, notifyFail, notifyMs)
+		},
+	},
+	{
+		class:    "upload_failures",
+		symptoms: []string{"Uploads fail part-way while other requests are fine"},
+		lookAt:   []string{"Upload outcome metrics and error spans"},
+		activeWith: func() (bool, string) {
+			return uploadFailureRate.Load() > 0, fmt.Sprintf("upload failure rate=%d%%", uploadFailureRate.Load())
+		},
+	},
+	{
+		class:    "noisy_telemetry",
+		symptoms: []string{"Log volume or series count jumps without a traffic change", "Observability costs and query times rise"},
+		lookAt:   []string{"Log lines per second by message", "Series per metric and telemetry_series_dropped_total"},
+		activeWith: func() (bool, string) {
+			storm, bomb := logStormRate.Load(), cardinalityBombRate.Load()
+			return storm > 0 || bomb > 0, fmt.Sprintf("log storm=%d lines/s cardinality bomb=%d series/s", storm, bomb)
+		},
+	},
+	{
+		class:    "clock_skew",
+		symptoms: []string{"Some spans start before their parents or last negative time", "Trace waterfalls look impossible"},
+		lookAt:   []string{"Span start times against their parents'"},
+		activeWith: func() (bool, string) {
+			return clockSkewRate > 0, fmt.Sprintf("clock skew on %d%% of spans", clockSkewRate)
+		},
+	},
+	{
+		class:    "duplicate_processing",
+		symptoms: []string{"Fulfilled orders run ahead of orders placed", "Customers get the same notification more than once"},
+		lookAt:   []string{"Duplicate and redelivery metrics from the consumer", "Consumer spans sharing one message ID"},
+		activeWith: func() (bool, string) {
+			rate, dedupe := duplicateRate.Load(), queueDedupe.Load()
+			return rate > 0 || !dedupe, fmt.Sprintf("duplicate deliveries=%d%% deduplication=%t", rate, dedupe)
+		},
+	},
+	{
+		class:    "stuck_compensations",
+		symptoms: []string{"Failed checkouts leave stock reserved or customers charged", "Errors about manual repair after checkout failures"},
+		lookAt:   []string{"Saga outcomes and compensations by step", "Compensation spans under failed checkout traces"},
+		activeWith: func() (bool, string) {
+			rate := sagaCompensationErrorRate.Load()
+			return rate > 0, fmt.Sprintf("saga compensations failing on %d%% of attempts", rate)
+		},
+	},
+	{
+		class:    "slow_stream_consumers",
+		symptoms: []string{"Order status streams fall behind and skip updates", "Unary calls and HTTP traffic are unaffected"},
+		lookAt:   []string{"gRPC stream send duration, buffered and dropped messages", "Open streams and how long they stay open"},
+		activeWith: func() (bool, string) {
+			ms := grpcSlowConsumerMs.Load()
+			return ms > 0, fmt.Sprintf("gRPC streams stalled %dms per update", ms)
+		},
+	},
+	{
+		class:    "dns_failures",
+		symptoms: []string{"Downstream calls fail or hang before any connection is made", "Errors mention hosts that cannot be resolved"},
+		lookAt:   []string{"DNS lookup outcomes and duration by name", "dns.lookup spans ahead of downstream calls"},
+		activeWith: func() (bool, string) {
+			mode := dnsChaos.Load().(string)
+			return mode != "off", "DNS resolver chaos: " + mode
+		},
+	},
+	{
+		class:    "tls_failures",
+		symptoms: []string{"Downstream calls fail during the handshake, before any HTTP status", "Errors mention certificates"},
+		lookAt:   []string{"Outbound TLS errors by reason", "Downstream span errors and the certificate they name"},
+		activeWith: func() (bool, string) {
+			mode := outboundTLSChaos.Load().(string)
+			return mode != "off", "outbound TLS chaos: " + mode
+		},
+	},
+	{
+		class:    "auth_provider_outage",
+		symptoms: []string{"Logins fail or hang while the rest of the API stays healthy", "Only /login errors, with 502 or 504"},
+		lookAt:   []string{"Login outcomes", "Identity provider call latency by step", "oidc.* client spans in /login traces"},
+		activeWith: func() (bool, string) {
+			latency, errs := oidcLatencyMs.Load(), oidcErrorRate.Load()
+			active := latency > int64(cfg.OIDCProviderLatencyMs) || errs > 0
+			return active, fmt.Sprintf("identity provider latency=%dms error_rate=%d%%", latency, errs)
+		},
+	},
+	{
+		class:    "session_stampede",
+		symptoms: []string{"Clients are logged out at once and all log in again", "Login latency and timeouts spike, 401s on every route"},
+		lookAt:   []string{"Session lookups by outcome", "Active sessions", "Identity provider queueing in oidc.* spans"},
+		activeWith: func() (bool, string) {
+			since := time.Now().Unix() - sessionsWipedAt.Load()
+			return since < 300, fmt.Sprintf("every session expired %ds ago", since)
+		},
+	},
+	{
+		class:    "fd_exhaustion",
+		symptoms: []string{"Errors mention \"too many open files\"", "New connections fail while CPU and memory look normal"},
+		lookAt:   []string{"Open file descriptors against the process limit", "Accept and dial errors in logs"},
+		activeWith: func() (bool, string) {
+			fdChaosMu.Lock()
+			defer fdChaosMu.Unlock()
+			held := fdHeld()
+			return held > 0, fmt.Sprintf("%d descriptors held by FD chaos", held)
+		},
+	},
+	{
+		class:    "disk_pressure",
+		symptoms: []string{"Free space on the pod's volume falls steadily", "Writes fail with \"no space left on device\", or the pod is evicted"},
+		lookAt:   []string{"Volume available bytes against size", "Pod events for ephemeral-storage eviction"},
+		activeWith: func() (bool, string) {
+			rate, written := diskChaosRate.Load(), diskChaosWritten.Load()
+			return rate > 0 || written > 0, fmt.Sprintf("disk chaos writing %d MiB/s, %d MiB written", rate, written>>20)
+		},
+	},
+	{
+		class:    "slow_storage",
+		symptoms: []string{"Writes slow down while reads and CPU look normal", "Latency grows with concurrency on the write path"},
+		lookAt:   []string{"Disk operation latency by phase", "disk.fsync spans and their wait against fsync time"},
+		activeWith: func() (bool, string) {
+			slowdown := fsyncSlowdown.Load()
+			return slowdown > 1, fmt.Sprintf("fsync slowed %dx", slowdown)
+		},
+	},
+	{
+		class:    "cpu_throttling",
+		symptoms: []string{"Latency spikes while CPU usage stays below the limit", "Tail latency in steps of the 100ms CFS period"},
+		lookAt:   []string{"Throttled periods against total periods", "GOMAXPROCS against the CPU limit"},
+		activeWith: func() (bool, string) {
+			procs, ok := quotaMaxProcs()
+			current := runtime.GOMAXPROCS(0)
+			return ok && current > procs, fmt.Sprintf("GOMAXPROCS=%d with a CPU limit of %d", current, procs)
+		},
+	},
+	{
+		class:    "lock_contention",
+		symptoms: []string{"One route's latency climbs with traffic while CPU stays idle", "Throughput plateaus however much CPU is free"},
+		lookAt:   []string{"Lock wait time and waiters", "The mutex and block profiles"},
+		activeWith: func() (bool, string) {
+			hold := contentionHoldMs.Load()
+			return hold > int64(cfg.ContentionHoldMs), fmt.Sprintf("critical section held %dms", hold)
+		},
+	},
+	{
+		class:    "hung_requests",
+		symptoms: []string{"Some requests never complete and clients time out", "No errors and no error logs for them; in-flight requests only grow"},
+		lookAt:   []string{"Handlers past the watchdog deadline", "Watchdog stack dumps in the logs"},
+		activeWith: func() (bool, string) {
+			rate := stuckHandlerRate.Load()
+			return rate > 0, fmt.Sprintf("%d%% of handlers block forever", rate)
+		},
+	},
+	{
+		class:    "crash_loop",
+		symptoms: []string{"Restart count climbs; the pod cycles through CrashLoopBackOff", "Gaps in metrics and logs at each restart, or a pod that stays unready"},
+		lookAt:   []string{"Container restarts and last termination reason", "The last log lines before each exit"},
+		activeWith: func() (bool, string) {
+			crashMu.Lock()
+			armed, reason := crashTimer != nil, crashReason
+			crashMu.Unlock()
+			limit := unreadyAfter.Load()
+			return armed || limit > 0, fmt.Sprintf("exit armed=%t (%s), unready after %d requests", armed, reason, limit)
+		},
+	},
+	{
+		class:    "startup_failure",
+		symptoms: []string{"New pods never become Ready, or restart before they do", "A rollout stalls with the old ReplicaSet still serving"},
+		lookAt:   []string{"The startup: log lines of the pod's first seconds and schema_migration_dirty", "Startup probe failures in the pod's events and what /readyz lists as blocked"},
+		activeWith: func() (bool, string) {
+			return cfg.InitFailureRate > 0 || cfg.MigrationInjectFailure, fmt.Sprintf("init failure rate=%d%% mode=%s duration=%ds, failing migration=%t", cfg.InitFailureRate, cfg.InitFailureMode, cfg.InitDurationS, cfg.MigrationInjectFailure)
+		},
+	},
+	{
+		class:    "migration_drift",
+		symptoms: []string{"Shadow reads disagree with the primary while every request succeeds", "After cutover, some orders are missing or have the wrong totals"},
+		lookAt:   []string{"store_shadow_comparisons_total by result and the mismatched fields", "Shadow write errors since dual writes began, and whether a backfill ran"},
+		activeWith: func() (bool, string) {
+			errRate, drift := shadowWriteErrorRate.Load(), shadowDriftRate.Load()
+			return errRate > 0 || drift > 0, fmt.Sprintf("mode=%s shadow write errors=%d%% drift=%d%%", storeMigrationMode.Load(), errRate, drift)
+		},
+	},
+	{
+		class:    "event_ordering",
+		symptoms: []string{"Orders show an earlier status after a later one", "Events are dropped as stale or skip ahead"},
+		lookAt:   []string{"Ordering violations by kind", "Event timestamps per order ID across partitions"},
+		activeWith: func() (bool, string) {
+			rate, ordered := orderEventReorder.Load(), orderEventsOrdered.Load()
+			return rate > 0 || !ordered, fmt.Sprintf("reordered events=%d%% per-key ordering=%t", rate, ordered)
+		},
+	},
+	{
+		class:    "data_inconsistency",
+		symptoms: []string{"Requests succeed but stored orders no longer add up", "Data-quality alerts fire with no error or latency change"},
+		lookAt:   []string{"data_inconsistencies_total by invariant", "Which records broke and when they were last written"},
+		activeWith: func() (bool, string) {
+			orderStoreMu.Lock()
+			n := len(inconsistent)
+			orderStoreMu.Unlock()
+			return n > 0, fmt.Sprintf("%d stored orders corrupted", n)
+		},
+	},
+}
+
+func handleRunbook(w http.ResponseWriter, r *http.Request) {
+	incident.Lock()
+	revealLocked := incident.running && incident.locked
+	incident.Unlock()
+	reveal := r.URL.Query().Get("reveal") == "true" && !revealLocked
+
+	active := []map[string]any{}
+	for _, c := range runbookClasses {
+		on, fault := c.activeWith()
+		if !on {
+			continue
+		}
+		entry := map[string]any{
+			"class":         c.class,
+			"symptoms":      c.symptoms,
+			"where_to_look": c.lookAt,
+		}
+		if reveal {
+			entry["fault"] = fault
+		}
+		active = append(active, entry)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"active":        active,
+		"revealed":      reveal,
+		"reveal_locked": revealLocked,
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Order receipts in S3-compatible object storage (MinIO in the lab). When
+// RECEIPTS_S3_ENDPOINT is set (e.g. http://minio:9000), every placed order
+// PUTs receipts/<date>/<order id>.json into RECEIPTS_S3_BUCKET (default
+// "receipts") with path-style addressing, signed with SigV4 from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY (both reloadable from files, see
+// secrets.go) and AWS_REGION (default us-east-1). Like the AWS SDKs, 503
+// SlowDown and 5xx answers are retried up to S3_MAX_RETRIES times (default 3)
+// with jittered exponential backoff. The upload is made by the outbox relay,
+// not the checkout request (see outbox.go). S3_THROTTLE_RATE (percent) answers
+// that share of attempts with a synthetic 503 SlowDown before they leave the
+// process.
+var (
+	s3Endpoint   *url.URL
+	s3Bucket     = "receipts"
+	s3Region     = "us-east-1"
+	s3MaxRetries = 3
+	s3Throttle   atomic.Int64
+	s3HTTPClient = &http.Client{
+		Transport: otelhttp.NewTransport(http.DefaultTransport),
+		Timeout:   10 * time.Second,
+	}
+)
+
+var (
+	s3RequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "s3_requests_total",
+			Help: "S3 request attempts by operation and status code (0 for transport errors)",
+		},
+		[]string{"operation", "status"},
+	)
+	s3RequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "s3_request_duration_seconds",
+			Help:    "S3 operation duration including retries",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		},
+		[]string{"operation"},
+	)
+	s3RetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "s3_retries_total",
+			Help: "S3 attempts retried, by operation and error code",
+		},
+		[]string{"operation", "code"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(s3RequestsTotal, s3RequestDuration, s3RetriesTotal)
+}
+
+func loadS3Config() {
+	if v := os.Getenv("RECEIPTS_S3_ENDPOINT"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Host == "" {
+			slog.Error("Ignoring invalid RECEIPTS_S3_ENDPOINT", "value", v)
+		} else {
+			s3Endpoint = u
+		}
+	}
+	if v := os.Getenv("RECEIPTS_S3_BUCKET"); v != "" {
+		s3Bucket = v
+	}
+	if v := os.Getenv("AWS_REGION"); v != "" {
+		s3Region = v
+	}
+	s3MaxRetries = cfg.S3MaxRetries
+	s3Throttle.Store(int64(cfg.S3ThrottleRate))
+}
+
+// storeReceipt uploads an order receipt, logging rather than returning
+// failures.
+func storeReceipt(ctx context.Context, orderID int64, receipt []byte) {
+	if s3Endpoint == nil {
+		return
+	}
+	key := fmt.Sprintf("receipts/%s/%d.json", time.Now().UTC().Format("2006/01/02"), orderID)
+	if err := s3PutObject(ctx, key, receipt); err != nil {
+		slog.WarnContext(ctx, "Failed to store order receipt", "order_id", orderID, "key", key, "error", err)
+	}
+}
+
+func s3PutObject(ctx context.Context, key string, body []byte) error {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "S3.PutObject", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	defer func() { addDownstreamTime(ctx, time.Since(start)) }()
+	span.SetAttributes(
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", "S3"),
+		attribute.String("rpc.method", "PutObject"),
+		attribute.String("aws.s3.bucket", s3Bucket),
+		attribute.String("aws.s3.key", key),
+	)
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var status int
+		var code string
+		status, code, err = s3Attempt(ctx, key, body)
+		s3RequestsTotal.WithLabelValues("PutObject", strconv.Itoa(status)).Inc()
+		retryable := status == 0 || status >= 500
+		if err == nil || !retryable || attempt >= s3MaxRetries {
+			span.SetAttributes(attribute.Int("http.response.status_code", status), attribute.Int("app.s3.attempts", attempt+1))
+			break
+		}
+		s3RetriesTotal.WithLabelValues("PutObject", code).Inc()
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("app.s3.attempt", attempt+1), attribute.String("aws.error.code", code)))
+		backoff := time.Duration(25<<attempt) * time.Millisecond
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+	}
+	s3RequestDuration.WithLabelValues("PutObject").Observe(time.Since(start).Seconds())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// s3Attempt makes one PutObject request and returns its status and S3 error
+// code.
+func s3Attempt(ctx context.Context, key string, body []byte) (int, string, error) {
+	if rate := s3Throttle.Load(); rate > 0 && rand.Int63n(100) < rate {
+		trace.SpanFromContext(ctx).SetAttributes(attrFaultInjected.Bool(true))
+		noteChaos(ctx, "s3: SlowDown")
+		return http.StatusServiceUnavailable, "SlowDown", fmt.Errorf("PutObject: 503 SlowDown: Please reduce your request rate")
+	}
+
+	u := *s3Endpoint
+	u.Path = "/" + s3Bucket + "/" + key
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signV4(req, body, time.Now().UTC())
+
+	resp, err := s3HTTPClient.Do(req)
+	if err != nil {
+		return 0, "RequestError", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, "", nil
+	}
+	// Real S3 errors are XML; the code is all callers need.
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	code := http.StatusText(resp.StatusCode)
+	if i := bytes.Index(raw, []byte("<Code>")); i >= 0 {
+		if j := bytes.Index(raw[i:], []byte("</Code>")); j > 0 {
+			code = string(raw[i+len("<Code>") : i+j])
+		}
+	}
+	return resp.StatusCode, code, fmt.Errorf("PutObject: %d %s", resp.StatusCode, code)
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header. Anonymous
+// requests are sent unsigned.
+func signV4(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	accessKey, secretKey := s3AccessKey.get(), s3SecretKey.get()
+	if accessKey == "" {
+		return
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := fmt.Sprintf("%s\n%s\n%s\nhost:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n\n%s\n%s",
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, req.URL.Host, payloadHash, amzDate, signedHeaders, payloadHash)
+	scope := date + "/" + s3Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{s3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// handleAdminS3 reports or sets object storage chaos: {"throttle_rate": 50}.
+func handleAdminS3(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			ThrottleRate *int64 `json:"throttle_rate"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ThrottleRate != nil {
+			s3Throttle.Store(*req.ThrottleRate)
+		}
+		slog.Warn("Admin: S3 chaos updated", "throttle_rate", s3Throttle.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	endpoint := ""
+	if s3Endpoint != nil {
+		endpoint = s3Endpoint.String()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"endpoint":      endpoint,
+		"bucket":        s3Bucket,
+		"throttle_rate": s3Throttle.Load(),
+		"max_retries":   s3MaxRetries,
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Checkout saga. After the cart checks, /checkout runs
+//
+//	reserve_inventory  (compensated by releasing the reservation)
+//	charge_payment     (compensated by a refund)
+//	confirm_order      (placeOrder)
+//
+// and when a step fails, undoes the completed ones in reverse order. Each
+// step and compensation is a span under "saga checkout" and counted in
+// saga_steps_total. A compensation is tried up to 3 times;
+// SAGA_COMPENSATION_ERROR_RATE (percent per attempt) makes them fail, and a
+// saga whose compensation never succeeded ends "compensation_failed": stock
+// stays reserved or the customer stays charged for an order that doesn't
+// exist, the case that needs a human. Compensations outlive the request:
+// they run detached from its cancellation, each attempt bounded by
+// sagaCompensationTimeout, so a client hanging up doesn't fail them.
+// /admin/chaos/saga changes the rate at runtime.
+type sagaStep struct {
+	name       string
+	action     func(context.Context) error
+	compensate func(context.Context) error // nil when there is nothing to undo
+}
+
+// sagaError reports the step a saga failed at.
+type sagaError struct {
+	Step string
+	Err  error
+}
+
+func (e *sagaError) Error() string { return e.Step + ": " + e.Err.Error() }
+func (e *sagaError) Unwrap() error { return e.Err }
+
+const (
+	sagaCompensationAttempts = 3
+	sagaCompensationTimeout  = 5 * time.Second
+)
+
+var (
+	sagaCompensationErrorRate atomic.Int64
+
+	sagaSteps = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "saga_steps_total",
+			Help: "Saga steps by phase (action, compensation) and outcome (ok, failed)",
+		},
+		[]string{"saga", "step", "phase", "outcome"},
+	)
+	sagaCompensations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "saga_compensations_total",
+			Help: "Compensations executed after a failed saga step, by outcome (ok, failed: gave up after retries)",
+		},
+		[]string{"saga", "step", "outcome"},
+	)
+	sagaOutcomes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "saga_outcomes_total",
+			Help: "Finished sagas by outcome (completed, compensated, compensation_failed)",
+		},
+		[]string{"saga", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sagaSteps, sagaCompensations, sagaOutcomes)
+	sagaCompensationErrorRate.Store(int64(cfg.SagaCompensationErrorRate))
+	for _, outcome := range []string{"completed", "compensated", "compensation_failed"} {
+		sagaOutcomes.WithLabelValues("checkout", outcome)
+	}
+}
+
+// runCheckoutSaga reserves, charges and confirms an order, or leaves none of
+// it behind.
+func runCheckoutSaga(ctx context.Context, lines []orderLine) error {
+	return runSaga(ctx, "checkout", []sagaStep{
+		{
+			name:       "reserve_inventory",
+			action:     func(ctx context.Context) error { _, err := queryDatabase(ctx, "inventory_reserve"); return err },
+			compensate: func(ctx context.Context) error { _, err := queryDatabase(ctx, "inventory_release"); return err },
+		},
+		{name: "charge_payment", action: chargePayment, compensate: refundPayment},
+		{name: "confirm_order", action: func(ctx context.Context) error { return placeOrder(ctx, lines) }},
+	})
+}
+
+// checkoutSagaFailure maps a failed checkout saga to the response status and
+// detail.
+func checkoutSagaFailure(err error) (int, string) {
+	var se *sagaError
+	errors.As(err, &se)
+	switch {
+	case se == nil:
+		return http.StatusInternalServerError, "Checkout failed"
+	case se.Step == "charge_payment" && errors.Is(err, errBulkheadFull):
+		return http.StatusServiceUnavailable, "Payment failed"
+	case se.Step == "charge_payment":
+		return http.StatusBadGateway, "Payment failed"
+	case se.Step == "reserve_inventory":
+		return http.StatusServiceUnavailable, "Checkout inventory unavailable"
+	}
+	return http.StatusServiceUnavailable, "Checkout database unavailable"
+}
+
+func runSaga(ctx context.Context, saga string, steps []sagaStep) error {
+	ctx, span := tracer.Start(ctx, "saga "+saga, trace.WithAttributes(attribute.String("app.saga.name", saga)))
+	defer span.End()
+
+	for i, step := range steps {
+		err := runSagaStep(ctx, saga, step.name, "action", step.action)
+		if err == nil {
+			continue
+		}
+		outcome := "compensated"
+		undoCtx := context.WithoutCancel(ctx)
+		for j := i - 1; j >= 0; j-- {
+			if steps[j].compensate != nil && !compensate(undoCtx, saga, steps[j]) {
+				outcome = "compensation_failed"
+			}
+		}
+		sagaOutcomes.WithLabelValues(saga, outcome).Inc()
+		span.SetAttributes(attribute.String("app.saga.failed_step", step.name), attribute.String("app.saga.outcome", outcome))
+		span.SetStatus(codes.Error, step.name+" failed")
+		return &sagaError{Step: step.name, Err: err}
+	}
+	sagaOutcomes.WithLabelValues(saga, "completed").Inc()
+	span.SetAttributes(attribute.String("app.saga.outcome", "completed"))
+	return nil
+}
+
+// compensate retries a step's compensation and reports whether it took.
+func compensate(ctx context.Context, saga string, step sagaStep) bool {
+	var err error
+	for attempt := 1; attempt <= sagaCompensationAttempts; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, sagaCompensationTimeout)
+		err = runSagaStep(attemptCtx, saga, step.name, "compensation", step.compensate)
+		cancel()
+		if err == nil {
+			sagaCompensations.WithLabelValues(saga, step.name, "ok").Inc()
+			return true
+		}
+	}
+	sagaCompensations.WithLabelValues(saga, step.name, "failed").Inc()
+	slog.ErrorContext(ctx, "Saga compensation failed, manual repair needed", "saga", saga, "step", step.name, "attempts", sagaCompensationAttempts, "error", err)
+	return false
+}
+
+func runSagaStep(ctx context.Context, saga, step, phase string, fn func(context.Context) error) error {
+	ctx, span := tracer.Start(ctx, "saga."+phase+" "+step, trace.WithAttributes(
+		attribute.String("app.saga.name", saga),
+		attribute.String("app.saga.step", step),
+		attribute.String("app.saga.phase", phase),
+	))
+	defer span.End()
+
+	var err error
+	if rate := sagaCompensationErrorRate.Load(); phase == "compensation" && rate > 0 && rand.Int63n(100) < rate {
+		err = fmt.Errorf("%s compensation timed out", step)
+		noteChaos(ctx, "saga: %v", err)
+	} else {
+		err = fn(ctx)
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = "failed"
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	sagaSteps.WithLabelValues(saga, step, phase, outcome).Inc()
+	return err
+}
+
+// refundPayment reverses a charge with the payment provider.
+func refundPayment(ctx context.Context) error {
+	start := time.Now()
+	_, span := tracer.Start(ctx, "payment.refund", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	defer func() { addDownstreamTime(ctx, time.Since(start)) }()
+	span.SetAttributes(attribute.String("peer.service", "payment-provider"))
+	latency := paymentLatencyMs.Load()
+	time.Sleep(time.Duration(latency/2+rand.Int63n(latency+1)) * time.Millisecond)
+	return nil
+}
+
+func handleAdminSaga(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			CompensationErrorRate *int64 `json:"compensation_error_rate"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.CompensationErrorRate != nil {
+			if *req.CompensationErrorRate < 0 || *req.CompensationErrorRate > 100 {
+				writeProblem(w, r, "compensation_error_rate must be 0-100", http.StatusBadRequest)
+				return
+			}
+			sagaCompensationErrorRate.Store(*req.CompensationErrorRate)
+		}
+		slog.Warn("Admin: saga chaos updated", "compensation_error_rate", sagaCompensationErrorRate.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"compensation_error_rate":   sagaCompensationErrorRate.Load(),
+		"compensation_max_attempts": sagaCompensationAttempts,
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// traceSampler is installed once on the TracerProvider and swapped in place
+// by /admin/tracing/sampler. Rebuilding the provider instead would orphan the
+// tracers already handed out to otelhttp handlers and the package tracer.
+var traceSampler = &switchableSampler{}
+
+type samplerConfig struct {
+	Name string  `json:"sampler"`
+	Arg  float64 `json:"arg"`
+
+	sampler sdktrace.Sampler
+}
+
+type switchableSampler struct {
+	current atomic.Pointer[samplerConfig]
+}
+
+func (s *switchableSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	res := s.current.Load().sampler.ShouldSample(p)
+	if res.Decision == sdktrace.Drop && errorSpanRescue {
+		// Keep recording so errorRescueProcessor can still export failures.
+		res.Decision = sdktrace.RecordOnly
+	}
+	return res
+}
+
+func (s *switchableSampler) Description() string {
+	return "Switchable{" + s.current.Load().sampler.Description() + "}"
+}
+
+func (s *switchableSampler) config() samplerConfig {
+	return *s.current.Load()
+}
+
+// set validates and installs a sampler using the OTEL_TRACES_SAMPLER names.
+func (s *switchableSampler) set(name string, arg float64) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	var sampler sdktrace.Sampler
+	switch name {
+	case "always_on":
+		sampler = sdktrace.AlwaysSample()
+	case "always_off":
+		sampler = sdktrace.NeverSample()
+	case "traceidratio":
+		sampler = sdktrace.TraceIDRatioBased(arg)
+	case "parentbased_always_on":
+		sampler = sdktrace.ParentBased(sdktrace.AlwaysSample())
+	case "parentbased_always_off":
+		sampler = sdktrace.ParentBased(sdktrace.NeverSample())
+	case "parentbased_traceidratio":
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(arg))
+	default:
+		return fmt.Errorf("unsupported sampler %q", name)
+	}
+	if strings.HasSuffix(name, "traceidratio") && (arg < 0 || arg > 1) {
+		return fmt.Errorf("sampler arg %v out of range [0, 1]", arg)
+	}
+
+	s.current.Store(&samplerConfig{Name: name, Arg: arg, sampler: sampler})
+	return nil
+}
+
+// initSampler honours OTEL_TRACES_SAMPLER / OTEL_TRACES_SAMPLER_ARG and
+// defaults to parentbased_always_on like the SDK does.
+func initSampler() error {
+	name := os.Getenv("OTEL_TRACES_SAMPLER")
+	if name == "" {
+		name = "parentbased_always_on"
+	}
+	arg := 1.0
+	if v := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		var err error
+		if arg, err = strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("parsing OTEL_TRACES_SAMPLER_ARG: %w", err)
+		}
+	}
+	return traceSampler.set(name, arg)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Internal scheduler for cron-like tasks. A schedule is "daily HH:MM" (UTC)
+// or "every <duration>"; the nightly "reconciliation" task runs on
+// RECONCILIATION_SCHEDULE (default "daily 02:00"). Each task exports its last
+// run, last success and next run as timestamps, so missed runs are caught
+// with time() - scheduled_task_last_success_timestamp_seconds alerts.
+//
+// SCHEDULER_CHAOS ("reconciliation=skip") breaks runs on purpose:
+//
+//	skip  runs silently never start; only the last-success age gives it away
+//	hang  runs start and block until the mode is cleared
+//	fail  runs end in an error
+//
+// /admin/scheduler sets the mode at runtime and can trigger a run now.
+type scheduledTask struct {
+	name     string
+	schedule string
+	run      func(context.Context) error
+
+	mu      sync.Mutex
+	chaos   string
+	running bool
+	lastRun time.Time
+	lastOK  time.Time
+	next    time.Time
+	trigger chan struct{}
+}
+
+var (
+	scheduledTasksMu sync.Mutex
+	scheduledTasks   = map[string]*scheduledTask{}
+)
+
+var (
+	scheduledTaskRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "scheduled_task_runs_total",
+			Help: "Scheduled task runs by task and outcome (success, failure)",
+		},
+		[]string{"task", "outcome"},
+	)
+	scheduledTaskDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "scheduled_task_duration_seconds",
+			Help:    "Duration of finished scheduled task runs",
+			Buckets: []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 3600},
+		},
+		[]string{"task"},
+	)
+	scheduledTaskLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scheduled_task_last_success_timestamp_seconds",
+			Help: "Unix time the task last finished successfully (process start if never)",
+		},
+		[]string{"task"},
+	)
+	scheduledTaskLastRun = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scheduled_task_last_run_timestamp_seconds",
+			Help: "Unix time the task last started",
+		},
+		[]string{"task"},
+	)
+	scheduledTaskNextRun = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scheduled_task_next_run_timestamp_seconds",
+			Help: "Unix time the task is next due",
+		},
+		[]string{"task"},
+	)
+	scheduledTaskRunning = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scheduled_task_running",
+			Help: "1 while a run of the task is in progress",
+		},
+		[]string{"task"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(scheduledTaskRuns, scheduledTaskDuration, scheduledTaskLastSuccess,
+		scheduledTaskLastRun, scheduledTaskNextRun, scheduledTaskRunning)
+}
+
+func startScheduler() {
+	schedule := os.Getenv("RECONCILIATION_SCHEDULE")
+	if schedule == "" {
+		schedule = "daily 02:00"
+	}
+	scheduleTask("reconciliation", schedule, runReconciliation)
+
+	// A malformed SCHEDULER_CHAOS is reported by loadConfig.
+	rules, _ := parseSchedulerChaos(os.Getenv("SCHEDULER_CHAOS"))
+	for name, mode := range rules {
+		setTaskChaos(name, mode)
+	}
+}
+
+// parseSchedulerChaos parses SCHEDULER_CHAOS, task=mode pairs for the tasks
+// startScheduler registers.
+func parseSchedulerChaos(spec string) (map[string]string, error) {
+	rules := map[string]string{}
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		name, mode, ok := strings.Cut(rule, "=")
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("rule %q: want task=mode", rule)
+		case name != "reconciliation":
+			return nil, fmt.Errorf("rule %q: unknown task %q", rule, name)
+		case !validTaskChaos(mode):
+			return nil, fmt.Errorf("rule %q: mode must be one of skip, hang, fail or empty", rule)
+		}
+		rules[name] = mode
+	}
+	return rules, nil
+}
+
+// nextRun returns when schedule is next due after now.
+func nextRun(schedule string, now time.Time) (time.Time, error) {
+	kind, arg, _ := strings.Cut(schedule, " ")
+	switch kind {
+	case "every":
+		d, err := time.ParseDuration(arg)
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("invalid interval %q", arg)
+		}
+		return now.Add(d), nil
+	case "daily":
+		at, err := time.Parse("15:04", arg)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time of day %q", arg)
+		}
+		now = now.UTC()
+		next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, time.UTC)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		return next, nil
+	}
+	return time.Time{}, fmt.Errorf("schedule must be \"daily HH:MM\" or \"every <duration>\", got %q", schedule)
+}
+
+func scheduleTask(name, schedule string, run func(context.Context) error) {
+	next, err := nextRun(schedule, time.Now())
+	if err != nil {
+		log.Fatalf("Invalid schedule for task %s: %v", name, err)
+	}
+	t := &scheduledTask{name: name, schedule: schedule, run: run, next: next, trigger: make(chan struct{}, 1)}
+	scheduledTasksMu.Lock()
+	scheduledTasks[name] = t
+	scheduledTasksMu.Unlock()
+
+	// Until a first success, alert on age since start rather than since 1970.
+	scheduledTaskLastSuccess.WithLabelValues(name).SetToCurrentTime()
+	scheduledTaskRunning.WithLabelValues(name).Set(0)
+	scheduledTaskRuns.WithLabelValues(name, "success")
+	scheduledTaskRuns.WithLabelValues(name, "failure")
+	slog.Info("Scheduled task", "task", name, "schedule", schedule, "next_run", next)
+	go t.loop()
+}
+
+func (t *scheduledTask) loop() {
+	for {
+		t.mu.Lock()
+		next := t.next
+		t.mu.Unlock()
+		scheduledTaskNextRun.WithLabelValues(t.name).Set(float64(next.Unix()))
+
+		timer := time.NewTimer(time.Until(next))
+		trigger, due := "schedule", next
+		select {
+		case <-timer.C:
+		case <-t.trigger:
+			timer.Stop()
+			trigger, due = "manual", time.Now()
+		}
+
+		t.mu.Lock()
+		t.next, _ = nextRun(t.schedule, time.Now())
+		chaos, busy := t.chaos, t.running
+		if chaos != "skip" && !busy {
+			t.running = true
+		}
+		t.mu.Unlock()
+		switch {
+		case chaos == "skip":
+			slog.Debug("Scheduled run skipped by chaos", "task", t.name)
+		case busy:
+			slog.Warn("Scheduled task still running, skipping this run", "task", t.name)
+		default:
+			go t.execute(trigger, due)
+		}
+	}
+}
+
+// execute runs the task as the root of its own trace: nothing upstream
+// caused it but the clock, so there is no context to continue.
+func (t *scheduledTask) execute(trigger string, due time.Time) {
+	start := time.Now()
+	ctx, span := tracer.Start(context.Background(), t.name+" run",
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(
+			attribute.String("app.task.name", t.name),
+			attribute.String("app.task.schedule", t.schedule),
+			attribute.String("app.task.trigger", trigger),
+			attribute.String("app.task.scheduled_at", due.UTC().Format(time.RFC3339)),
+			attribute.Int64("app.task.start_delay_ms", start.Sub(due).Milliseconds()),
+		))
+	defer span.End()
+
+	scheduledTaskRunning.WithLabelValues(t.name).Set(1)
+	scheduledTaskLastRun.WithLabelValues(t.name).Set(float64(start.Unix()))
+	t.mu.Lock()
+	t.lastRun = start
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.running = false
+		t.mu.Unlock()
+		scheduledTaskRunning.WithLabelValues(t.name).Set(0)
+	}()
+
+	var err error
+	if t.chaosMode() == "hang" {
+		span.SetAttributes(attrFaultInjected.Bool(true))
+		slog.WarnContext(ctx, "Scheduled run hung by chaos", "task", t.name)
+		for t.chaosMode() == "hang" {
+			time.Sleep(time.Second)
+		}
+	}
+	if t.chaosMode() == "fail" {
+		span.SetAttributes(attrFaultInjected.Bool(true))
+		err = fmt.Errorf("%s: injected failure", t.name)
+	} else {
+		err = t.run(ctx)
+	}
+
+	scheduledTaskDuration.WithLabelValues(t.name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		scheduledTaskRuns.WithLabelValues(t.name, "failure").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "Scheduled task failed", "task", t.name, "error", err)
+		return
+	}
+	scheduledTaskRuns.WithLabelValues(t.name, "success").Inc()
+	scheduledTaskLastSuccess.WithLabelValues(t.name).SetToCurrentTime()
+	t.mu.Lock()
+	t.lastOK = time.Now()
+	t.mu.Unlock()
+	slog.InfoContext(ctx, "Scheduled task succeeded", "task", t.name, "duration_ms", time.Since(start).Milliseconds())
+}
+
+func (t *scheduledTask) chaosMode() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.chaos
+}
+
+func validTaskChaos(mode string) bool {
+	switch mode {
+	case "", "skip", "hang", "fail":
+		return true
+	}
+	return false
+}
+
+func setTaskChaos(name, mode string) error {
+	if !validTaskChaos(mode) {
+		return fmt.Errorf("mode must be one of skip, hang, fail or empty")
+	}
+	scheduledTasksMu.Lock()
+	t := scheduledTasks[name]
+	scheduledTasksMu.Unlock()
+	if t == nil {
+		return fmt.Errorf("unknown task %q", name)
+	}
+	t.mu.Lock()
+	t.chaos = mode
+	t.mu.Unlock()
+	return nil
+}
+
+// runReconciliation is the nightly job: it scans recent orders and flags
+// events still stuck in the outbox or dead-letter queue.
+func runReconciliation(ctx context.Context) error {
+	if _, err := queryDatabase(ctx, "order_reconciliation"); err != nil {
+		return err
+	}
+	outboxMu.Lock()
+	stuck := 0
+	for _, e := range outboxPending {
+		if time.Since(e.CreatedAt) > time.Minute {
+			stuck++
+		}
+	}
+	outboxMu.Unlock()
+	dlqMu.Lock()
+	deadLettered := len(dlq)
+	dlqMu.Unlock()
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int("app.reconciliation.stuck_outbox_events", stuck),
+		attribute.Int("app.reconciliation.dead_letters", deadLettered),
+	)
+	if stuck+deadLettered > 0 {
+		slog.WarnContext(ctx, "Reconciliation found unsettled orders", "stuck_outbox_events", stuck, "dead_letters", deadLettered)
+	}
+	return nil
+}
+
+// handleAdminScheduler lists tasks or changes one:
+// {"task": "reconciliation", "chaos": "hang"} or {"task": "reconciliation", "run_now": true}.
+func handleAdminScheduler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Task   string  `json:"task"`
+			Chaos  *string `json:"chaos"`
+			RunNow bool    `json:"run_now"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		scheduledTasksMu.Lock()
+		t := scheduledTasks[req.Task]
+		scheduledTasksMu.Unlock()
+		if t == nil {
+			writeProblem(w, r, fmt.Sprintf("unknown task %q", req.Task), http.StatusNotFound)
+			return
+		}
+		if req.Chaos != nil {
+			if err := setTaskChaos(req.Task, *req.Chaos); err != nil {
+				writeProblem(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.RunNow {
+			select {
+			case t.trigger <- struct{}{}:
+			default:
+			}
+		}
+		slog.Warn("Admin: scheduled task updated", "task", req.Task, "chaos", t.chaosMode(), "run_now", req.RunNow)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type taskStatus struct {
+		Name        string    `json:"name"`
+		Schedule    string    `json:"schedule"`
+		Chaos       string    `json:"chaos,omitempty"`
+		Running     bool      `json:"running"`
+		LastRun     time.Time `json:"last_run,omitzero"`
+		LastSuccess time.Time `json:"last_success,omitzero"`
+		NextRun     time.Time `json:"next_run"`
+	}
+	scheduledTasksMu.Lock()
+	tasks := make([]taskStatus, 0, len(scheduledTasks))
+	for _, t := range scheduledTasks {
+		t.mu.Lock()
+		tasks = append(tasks, taskStatus{t.name, t.schedule, t.chaos, t.running, t.lastRun, t.lastOK, t.next})
+		t.mu.Unlock()
+	}
+	scheduledTasksMu.Unlock()
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+	writeJSON(w, http.StatusOK, map[string]any{"tasks": tasks})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Secrets. Each secret below is read from its environment variable or, when
+// <NAME>_FILE is set, from that file (a mounted Kubernetes Secret, a Vault
+// agent sink). File-backed secrets are re-read every SECRETS_RELOAD_INTERVAL_S
+// (default 10), so rotating the mounted Secret takes effect without a restart;
+// a file that disappears, can't be read or is empty keeps the last good value
+// and counts as a failed reload, and one that is unusable at startup is a
+// configuration problem, since an empty ADMIN_TOKEN would leave /admin open.
+// Values are never logged or reported, only a short SHA-256 fingerprint, which
+// is enough to tell which pods have picked up a rotation. POST /admin/secrets
+// reloads immediately.
+var secretNames = []string{"ADMIN_TOKEN", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "GRAFANA_API_TOKEN", "CHATOPS_WEBHOOK_URL", "MAINTENANCE_BYPASS_TOKEN", "DATABASE_URL"}
+
+type secret struct {
+	name string
+	file string
+
+	mu         sync.RWMutex
+	value      string
+	loadedAt   time.Time
+	lastReload time.Time
+	lastError  string
+}
+
+var (
+	secrets = map[string]*secret{}
+
+	adminToken     = loadSecret("ADMIN_TOKEN")
+	s3AccessKey    = loadSecret("AWS_ACCESS_KEY_ID")
+	s3SecretKey    = loadSecret("AWS_SECRET_ACCESS_KEY")
+	grafanaToken   = loadSecret("GRAFANA_API_TOKEN")
+	databaseURL    = loadSecret("DATABASE_URL")
+	secretReloadMu sync.Mutex
+)
+
+var (
+	secretReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "secret_reloads_total",
+			Help: "File-backed secret reloads by secret and outcome (rotated, unchanged, failed)",
+		},
+		[]string{"secret", "outcome"},
+	)
+	secretLastReload = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "secret_last_reload_timestamp_seconds",
+			Help: "Unix time each secret's value was last loaded or changed",
+		},
+		[]string{"secret"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(secretReloads, secretLastReload)
+}
+
+func loadSecret(name string) *secret {
+	s := &secret{name: name, file: os.Getenv(name + "_FILE"), value: os.Getenv(name)}
+	if s.file != "" {
+		if value, err := readSecretFile(s.file); err == nil {
+			s.value = value
+		} else {
+			s.lastError = err.Error()
+		}
+	}
+	s.loadedAt = time.Now()
+	s.lastReload = s.loadedAt
+	secrets[name] = s
+	return s
+}
+
+// readSecretFile reads a mounted secret; an empty file is an error, as a
+// truncated write mid-rotation leaves one.
+func readSecretFile(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(b))
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	return value, nil
+}
+
+func (s *secret) get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// reload re-reads a file-backed secret.
+func (s *secret) reload() {
+	if s.file == "" {
+		return
+	}
+	value, err := readSecretFile(s.file)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastReload = time.Now()
+	if err != nil {
+		if s.lastError == "" {
+			slog.Error("Secret reload failed, keeping last value", "secret", s.name, "file", s.file, "error", err)
+		}
+		s.lastError = err.Error()
+		secretReloads.WithLabelValues(s.name, "failed").Inc()
+		return
+	}
+	s.lastError = ""
+	if value == s.value {
+		secretReloads.WithLabelValues(s.name, "unchanged").Inc()
+		return
+	}
+	s.value = value
+	s.loadedAt = s.lastReload
+	secretLastReload.WithLabelValues(s.name).Set(float64(s.loadedAt.Unix()))
+	secretReloads.WithLabelValues(s.name, "rotated").Inc()
+	slog.Warn("Secret rotated", "secret", s.name, "fingerprint", fingerprint(value))
+}
+
+func fingerprint(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:4])
+}
+
+func reloadSecrets() {
+	secretReloadMu.Lock()
+	defer secretReloadMu.Unlock()
+	for _, s := range secrets {
+		s.reload()
+	}
+}
+
+func startSecretReloader() {
+	watched := false
+	for name, s := range secrets {
+		secretLastReload.WithLabelValues(name).Set(float64(s.loadedAt.Unix()))
+		if s.file == "" {
+			continue
+		}
+		watched = true
+		for _, outcome := range []string{"rotated", "unchanged", "failed"} {
+			secretReloads.WithLabelValues(name, outcome)
+		}
+		if s.lastError != "" {
+			slog.Error("Secret file unreadable", "secret", name, "file", s.file, "error", s.lastError)
+		}
+	}
+	if !watched {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(cfg.SecretsReloadIntervalS) * time.Second) {
+			reloadSecrets()
+		}
+	}()
+}
+
+// handleAdminSecrets reports where each secret comes from and its
+// fingerprint; POST reloads file-backed secrets first.
+func handleAdminSecrets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		reloadSecrets()
+		slog.Warn("Admin: secrets reloaded")
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	report := make([]map[string]any, 0, len(names))
+	for _, name := range names {
+		s := secrets[name]
+		s.mu.RLock()
+		source := "env"
+		if s.file != "" {
+			source = "file"
+		}
+		report = append(report, map[string]any{
+			"secret":      name,
+			"source":      source,
+			"file":        s.file,
+			"set":         s.value != "",
+			"fingerprint": fingerprint(s.value),
+			"loaded_at":   s.loadedAt,
+			"last_reload": s.lastReload,
+			"last_error":  s.lastError,
+		})
+		s.mu.RUnlock()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"reload_interval_s": cfg.SecretsReloadIntervalS,
+		"secrets":           report,
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Controlled self-termination, for CrashLoopBackOff and restart alerts:
+//
+//	CRASH_AFTER_S           exit this long after start (default 0: never);
+//	                        a few seconds gives the fast crash loop and its
+//	                        growing back-off
+//	CRASH_SCHEDULE          exit when the schedule is due ("every 30m",
+//	                        "daily 03:00", as RECONCILIATION_SCHEDULE), the
+//	                        periodic restart that reads as a bad node
+//	CRASH_EXIT_CODE         exit status for both (default 1)
+//	UNREADY_AFTER_REQUESTS  fail readiness for good after serving this many
+//	                        requests (default 0: never): the pod leaves the
+//	                        Service but is never restarted
+//
+// Every exit logs its reason and writes it to /dev/termination-log, so
+// kubectl describe pod shows it under Last State. /admin/chaos/restart
+// arms an exit or the readiness trip at runtime.
+var (
+	crashMu       sync.Mutex
+	crashTimer    *time.Timer
+	crashAt       time.Time
+	crashReason   string
+	unreadyAfter  atomic.Int64
+	servedCounter atomic.Int64
+	processStart  = time.Now()
+
+	selfTerminationAt = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "self_termination_scheduled_timestamp_seconds",
+			Help: "When self-termination chaos will exit the process, as Unix time; 0 when none is armed",
+		},
+		func() float64 {
+			crashMu.Lock()
+			defer crashMu.Unlock()
+			if crashTimer == nil {
+				return 0
+			}
+			return float64(crashAt.Unix())
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(selfTerminationAt)
+	unreadyAfter.Store(int64(cfg.UnreadyAfterRequests))
+}
+
+// startSelfTermination arms the configured exits.
+func startSelfTermination() {
+	if cfg.CrashAfterS > 0 {
+		armExit(time.Duration(cfg.CrashAfterS)*time.Second, cfg.CrashExitCode, fmt.Sprintf("CRASH_AFTER_S=%d", cfg.CrashAfterS))
+	}
+	if schedule := os.Getenv("CRASH_SCHEDULE"); schedule != "" {
+		// A malformed CRASH_SCHEDULE is reported by loadConfig.
+		if next, err := nextRun(schedule, time.Now()); err == nil && (cfg.CrashAfterS == 0 || time.Until(next) < time.Duration(cfg.CrashAfterS)*time.Second) {
+			armExit(time.Until(next), cfg.CrashExitCode, "CRASH_SCHEDULE="+schedule)
+		}
+	}
+}
+
+// armExit replaces any armed exit with one after d.
+func armExit(d time.Duration, code int, reason string) {
+	crashMu.Lock()
+	defer crashMu.Unlock()
+	if crashTimer != nil {
+		crashTimer.Stop()
+	}
+	crashAt, crashReason = time.Now().Add(d), reason
+	crashTimer = time.AfterFunc(d, func() { selfTerminate(code, reason) })
+	slog.Warn("Self-termination armed", "in", d.Round(time.Second).String(), "exit_code", code, "reason", reason)
+}
+
+func disarmExit() {
+	crashMu.Lock()
+	defer crashMu.Unlock()
+	if crashTimer != nil {
+		crashTimer.Stop()
+		crashTimer = nil
+	}
+}
+
+func selfTerminate(code int, reason string) {
+	msg := fmt.Sprintf("self-termination chaos: %s", reason)
+	slog.Error("Self-termination: exiting", "exit_code", code, "reason", reason, "uptime", time.Since(processStart).Round(time.Second).String())
+	os.WriteFile("/dev/termination-log", []byte(msg), 0o644)
+	os.Exit(code)
+}
+
+// noteRequestServed counts a request towards UNREADY_AFTER_REQUESTS.
+func noteRequestServed() {
+	served := servedCounter.Add(1)
+	if limit := unreadyAfter.Load(); limit > 0 && served == limit {
+		readiness.block("self-termination", fmt.Sprintf("UNREADY_AFTER_REQUESTS=%d reached", limit))
+		slog.Error("Self-termination: failing readiness", "requests_served", served)
+	}
+}
+
+// handleAdminRestart reports or arms self-termination:
+// {"exit_in_s": 5, "exit_code": 2}, {"cancel": true},
+// {"unready_after_requests": 100}.
+func handleAdminRestart(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			ExitInS              *int   `json:"exit_in_s"`
+			ExitCode             *int   `json:"exit_code"`
+			Cancel               bool   `json:"cancel"`
+			UnreadyAfterRequests *int64 `json:"unready_after_requests"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		code := cfg.CrashExitCode
+		if req.ExitCode != nil {
+			if *req.ExitCode < 0 || *req.ExitCode > 255 {
+				writeProblem(w, r, "exit_code must be between 0 and 255", http.StatusBadRequest)
+				return
+			}
+			code = *req.ExitCode
+		}
+		if req.Cancel {
+			disarmExit()
+			slog.Warn("Admin: self-termination cancelled")
+		}
+		if req.ExitInS != nil && *req.ExitInS >= 0 {
+			armExit(time.Duration(*req.ExitInS)*time.Second, code, "/admin/chaos/restart")
+		}
+		if req.UnreadyAfterRequests != nil && *req.UnreadyAfterRequests >= 0 {
+			servedCounter.Store(0)
+			unreadyAfter.Store(*req.UnreadyAfterRequests)
+			readiness.unblock("self-termination")
+			slog.Warn("Admin: readiness trip updated", "unready_after_requests", *req.UnreadyAfterRequests)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := map[string]any{
+		"requests_served":        servedCounter.Load(),
+		"unready_after_requests": unreadyAfter.Load(),
+	}
+	crashMu.Lock()
+	if crashTimer != nil {
+		report["exit_at"] = crashAt.UTC().Format(time.RFC3339)
+		report["exit_reason"] = crashReason
+	}
+	crashMu.Unlock()
+	writeJSON(w, http.StatusOK, report)
+}
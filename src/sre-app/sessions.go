@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Login sessions. A successful /login stores its access token as a session
+// that lives SESSION_TTL_S (default 1800), spread by up to
+// SESSION_TTL_JITTER_PERCENT (default 0) so sessions created together do
+// not all end together, and sets it as the "session" cookie. Requests that
+// present the cookie must present a live session: an unknown or expired one
+// is a 401 and the client logs in again. Requests without it are anonymous
+// and unaffected; Authorization: Bearer is left to the routes that
+// authenticate with ADMIN_TOKEN, such as /alerts/webhook.
+//
+// With LOADGEN_SESSIONS=true the load generator's users log in on their
+// first request and whenever they get a 401, so its traffic carries
+// sessions. /admin/chaos/sessions {"expire_all": true} then ends every
+// session at once: a stampede of logins queues at the identity provider
+// (OIDC_PROVIDER_CONCURRENCY), login latency and timeouts spike, and
+// sessions_active drops to 0 and climbs back.
+type session struct {
+	user    string
+	expires time.Time
+}
+
+var (
+	sessionTTL       atomic.Int64 // seconds
+	sessionTTLJitter atomic.Int64 // percent
+	sessionsWipedAt  atomic.Int64 // Unix time of the last expire_all
+	sessionMu        sync.Mutex
+	sessions         = map[string]session{}
+
+	sessionsActive = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "sessions_active",
+			Help: "Sessions in the store, live or expired but not yet swept",
+		},
+		func() float64 {
+			sessionMu.Lock()
+			defer sessionMu.Unlock()
+			return float64(len(sessions))
+		},
+	)
+	sessionsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sessions_created_total",
+		Help: "Sessions created by successful logins",
+	})
+	sessionsEnded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sessions_expired_total",
+			Help: "Sessions removed from the store, by reason (ttl, chaos)",
+		},
+		[]string{"reason"},
+	)
+	sessionLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "session_lookups_total",
+			Help: "Requests presenting a session, by outcome (valid, expired, unknown)",
+		},
+		[]string{"outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sessionsActive, sessionsCreated, sessionsEnded, sessionLookups)
+	sessionTTL.Store(int64(cfg.SessionTTLS))
+	sessionTTLJitter.Store(int64(cfg.SessionTTLJitterPercent))
+	for _, outcome := range []string{"valid", "expired", "unknown"} {
+		sessionLookups.WithLabelValues(outcome)
+	}
+	go sweepSessions()
+}
+
+// createSession stores token for user and returns its lifetime.
+func createSession(token, user string) time.Duration {
+	ttl := time.Duration(sessionTTL.Load()) * time.Second
+	if jitter := sessionTTLJitter.Load(); jitter > 0 {
+		ttl -= time.Duration(rand.Int63n(int64(ttl)*jitter/100 + 1))
+	}
+	sessionMu.Lock()
+	sessions[token] = session{user: user, expires: time.Now().Add(ttl)}
+	sessionMu.Unlock()
+	sessionsCreated.Inc()
+	return ttl
+}
+
+func sessionToken(r *http.Request) string {
+	if c, err := r.Cookie("session"); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// sessionAllows refuses requests whose session is unknown or expired.
+func sessionAllows(w http.ResponseWriter, r *http.Request, route string) bool {
+	token := sessionToken(r)
+	if token == "" || route == "/login" {
+		return true
+	}
+	sessionMu.Lock()
+	s, ok := sessions[token]
+	expired := ok && time.Now().After(s.expires)
+	if expired {
+		delete(sessions, token)
+		sessionsEnded.WithLabelValues("ttl").Inc()
+	}
+	sessionMu.Unlock()
+	outcome := "valid"
+	switch {
+	case !ok:
+		outcome = "unknown"
+	case expired:
+		outcome = "expired"
+	}
+	sessionLookups.WithLabelValues(outcome).Inc()
+	if outcome == "valid" {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="session `+outcome+`"`)
+	writeProblem(w, r, "session "+outcome+", log in again at /login", http.StatusUnauthorized)
+	return false
+}
+
+func sweepSessions() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		sessionMu.Lock()
+		for token, s := range sessions {
+			if now.After(s.expires) {
+				delete(sessions, token)
+				sessionsEnded.WithLabelValues("ttl").Inc()
+			}
+		}
+		sessionMu.Unlock()
+	}
+}
+
+// expireAllSessions ends every session and returns how many there were.
+func expireAllSessions() int {
+	sessionMu.Lock()
+	n := len(sessions)
+	sessions = map[string]session{}
+	sessionMu.Unlock()
+	sessionsWipedAt.Store(time.Now().Unix())
+	sessionsEnded.WithLabelValues("chaos").Add(float64(n))
+	return n
+}
+
+// loadgenSessions holds the load generator users' session tokens.
+var loadgenSessions sync.Map // session id -> token
+
+// loadgenLogin logs u in and returns the new token, or "" on failure.
+func loadgenLogin(target string, u loadgenUser) string {
+	req, err := http.NewRequest(http.MethodGet, target+"/login", nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("User-Agent", u.userAgent)
+	req.Header.Set("X-Forwarded-For", u.ip)
+	req.Header.Set("X-Session-ID", u.session)
+	resp, err := loadgenClient.Do(req)
+	if err != nil {
+		loadgenRequests.WithLabelValues("/login", "error").Inc()
+		return ""
+	}
+	defer resp.Body.Close()
+	loadgenRequests.WithLabelValues("/login", strconv.Itoa(resp.StatusCode)).Inc()
+	var tokens oidcTokens
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&tokens) != nil {
+		return ""
+	}
+	loadgenSessions.Store(u.session, tokens.AccessToken)
+	return tokens.AccessToken
+}
+
+// handleAdminSessions reports the store or changes it:
+// {"expire_all": true}, {"ttl_s": 60, "ttl_jitter_percent": 20}.
+func handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			ExpireAll        bool   `json:"expire_all"`
+			TTLS             *int64 `json:"ttl_s"`
+			TTLJitterPercent *int64 `json:"ttl_jitter_percent"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.TTLS != nil && *req.TTLS > 0 {
+			sessionTTL.Store(*req.TTLS)
+		}
+		if req.TTLJitterPercent != nil && *req.TTLJitterPercent >= 0 && *req.TTLJitterPercent <= 100 {
+			sessionTTLJitter.Store(*req.TTLJitterPercent)
+		}
+		expired := 0
+		if req.ExpireAll {
+			expired = expireAllSessions()
+		}
+		slog.Warn("Admin: sessions updated", "ttl_s", sessionTTL.Load(), "ttl_jitter_percent", sessionTTLJitter.Load(), "expired", expired)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionMu.Lock()
+	active := len(sessions)
+	sessionMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"active":             active,
+		"ttl_s":              sessionTTL.Load(),
+		"ttl_jitter_percent": sessionTTLJitter.Load(),
+	})
+}
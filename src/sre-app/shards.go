@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Shard-aware store. Queries land on one of STORE_SHARDS (default 4)
+// partitions: by hash of the request's routing key (session/tenant) when it
+// has one, at random otherwise. SHARD_CHAOS makes individual shards slow,
+// flaky or hot, and /admin/chaos/shards changes that at runtime:
+//
+//	SHARD_CHAOS="2:latency=300,error=10;3:skew=60"
+//
+// latency adds milliseconds, error is a failure percentage, and skew steers
+// that percentage of all queries onto the shard.
+type shardFault struct {
+	LatencyMs int `json:"latency_ms"`
+	ErrorRate int `json:"error_rate"`
+	Skew      int `json:"skew"`
+}
+
+var (
+	storeShards = 4
+
+	shardFaultsMu sync.RWMutex
+	shardFaults   = map[int]shardFault{}
+)
+
+var (
+	shardQueriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "db_shard_queries_total",
+			Help: "Simulated store queries by shard and outcome (ok, error)",
+		},
+		[]string{"shard", "outcome"},
+	)
+	shardQueryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "db_shard_query_duration_seconds",
+			Help:    "Simulated store query latency by shard",
+			Buckets: []float64{.002, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		},
+		[]string{"shard"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(shardQueriesTotal, shardQueryDuration)
+}
+
+func loadShardConfig() {
+	storeShards = cfg.StoreShards
+	for shard := 0; shard < storeShards; shard++ {
+		shardQueriesTotal.WithLabelValues(strconv.Itoa(shard), "ok")
+		shardQueriesTotal.WithLabelValues(strconv.Itoa(shard), "error")
+	}
+
+	// A malformed SHARD_CHAOS is reported by loadConfig.
+	faults, _ := parseShardChaos(os.Getenv("SHARD_CHAOS"), storeShards)
+	for shard, f := range faults {
+		shardFaults[shard] = f
+		slog.Info("Shard chaos", "shard", shard, "latency_ms", f.LatencyMs, "error_rate", f.ErrorRate, "skew", f.Skew)
+	}
+}
+
+// parseShardChaos parses SHARD_CHAOS for a store of shards partitions.
+func parseShardChaos(spec string, shards int) (map[int]shardFault, error) {
+	faults := map[int]shardFault{}
+	for _, rule := range strings.Split(spec, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		id, list, ok := strings.Cut(rule, ":")
+		if !ok {
+			return nil, fmt.Errorf("rule %q: want shard:fault=N[,fault=N]", rule)
+		}
+		shard, err := strconv.Atoi(id)
+		if err != nil || shard < 0 || shard >= shards {
+			return nil, fmt.Errorf("rule %q: shard must be between 0 and %d", rule, shards-1)
+		}
+		var f shardFault
+		for _, fault := range strings.Split(list, ",") {
+			key, val, _ := strings.Cut(strings.TrimSpace(fault), "=")
+			n, err := strconv.Atoi(val)
+			switch {
+			case key == "latency" && err == nil && n >= 0 && n <= 60000:
+				f.LatencyMs = n
+			case key == "error" && err == nil && n >= 0 && n <= 100:
+				f.ErrorRate = n
+			case key == "skew" && err == nil && n >= 0 && n <= 100:
+				f.Skew = n
+			default:
+				return nil, fmt.Errorf("rule %q: bad fault %q (latency 0-60000, error 0-100, skew 0-100)", rule, fault)
+			}
+		}
+		faults[shard] = f
+	}
+	return faults, nil
+}
+
+func pickShard(ctx context.Context) int {
+	shardFaultsMu.RLock()
+	defer shardFaultsMu.RUnlock()
+	for shard, f := range shardFaults {
+		if f.Skew > 0 && rand.Intn(100) < f.Skew {
+			return shard
+		}
+	}
+	if key, ok := ctx.Value(routingKeyKey{}).(string); ok {
+		return int(hashKey(key) % uint32(storeShards))
+	}
+	return rand.Intn(storeShards)
+}
+
+// shardPenalty is the extra latency and, possibly, the failure a query on
+// shard pays.
+func shardPenalty(shard int) (time.Duration, error) {
+	shardFaultsMu.RLock()
+	f := shardFaults[shard]
+	shardFaultsMu.RUnlock()
+	var err error
+	if f.ErrorRate > 0 && rand.Intn(100) < f.ErrorRate {
+		err = fmt.Errorf("shard %d unavailable", shard)
+	}
+	return time.Duration(f.LatencyMs) * time.Millisecond, err
+}
+
+// handleAdminShards lists shard faults or sets one shard's faults, e.g.
+// {"shard": 2, "latency_ms": 300, "skew": 50}; zero values clear them.
+func handleAdminShards(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Shard *int `json:"shard"`
+			shardFault
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Shard == nil || *req.Shard < 0 || *req.Shard >= storeShards {
+			writeProblem(w, r, fmt.Sprintf("shard must be between 0 and %d", storeShards-1), http.StatusBadRequest)
+			return
+		}
+		shardFaultsMu.Lock()
+		if req.shardFault == (shardFault{}) {
+			delete(shardFaults, *req.Shard)
+		} else {
+			shardFaults[*req.Shard] = req.shardFault
+		}
+		shardFaultsMu.Unlock()
+		slog.Warn("Admin: shard chaos updated", "shard", *req.Shard, "latency_ms", req.LatencyMs, "error_rate", req.ErrorRate, "skew", req.Skew)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shardFaultsMu.RLock()
+	faults := map[string]shardFault{}
+	for shard, f := range shardFaults {
+		faults[strconv.Itoa(shard)] = f
+	}
+	shardFaultsMu.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]any{"shards": storeShards, "faults": faults})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Priority-aware load shedding. Callers tag requests with
+// X-Request-Priority: critical | normal | best-effort (default normal).
+// With MAX_INFLIGHT set, each class may only use part of the capacity, so
+// best-effort traffic is shed first, then normal, and critical last:
+//
+//	best-effort  50% of MAX_INFLIGHT
+//	normal       80%
+//	critical     100%
+var (
+	maxInflight     int64
+	inflightCount   atomic.Int64
+	priorityClasses = map[string]float64{"best-effort": 0.5, "normal": 0.8, "critical": 1.0}
+
+	inflightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_inflight_requests",
+		Help: "Number of requests currently being served",
+	})
+	priorityRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_by_priority_total",
+			Help: "Total number of HTTP requests by priority class and outcome (ok, error, shed)",
+		},
+		[]string{"priority", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(inflightRequests)
+	prometheus.MustRegister(priorityRequestsTotal)
+}
+
+func loadSheddingConfig() {
+	maxInflight = int64(cfg.MaxInflight)
+}
+
+func requestPriority(r *http.Request) string {
+	p := strings.ToLower(r.Header.Get("X-Request-Priority"))
+	if _, ok := priorityClasses[p]; ok {
+		return p
+	}
+	return "normal"
+}
+
+// admitRequest reserves an in-flight slot for the priority class; the
+// returned release must be called when the request is done.
+func admitRequest(priority string) (release func(), ok bool) {
+	n := inflightCount.Add(1)
+	if limit := currentInflightLimit(); limit > 0 && float64(n) > float64(limit)*priorityClasses[priority] {
+		inflightCount.Add(-1)
+		return nil, false
+	}
+	inflightRequests.Set(float64(n))
+	return func() {
+		inflightRequests.Set(float64(inflightCount.Add(-1)))
+	}, true
+}
+
+func shedRequest(w http.ResponseWriter, r *http.Request, route, priority string) {
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.Bool("app.shed", true))
+	httpRequestsTotal.WithLabelValues(route, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
+	w.Header().Set("Retry-After", "1")
+	writeProblem(w, r, "Overloaded, shedding "+priority+" traffic", http.StatusServiceUnavailable)
+}
+
+func recordPriorityOutcome(priority string, status int, shed bool) {
+	outcome := "ok"
+	switch {
+	case shed:
+		outcome = "shed"
+	case status >= 500:
+		outcome = "error"
+	}
+	priorityRequestsTotal.WithLabelValues(priority, outcome).Inc()
+}
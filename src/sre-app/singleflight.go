@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Request coalescing for expensive lookups, in the style of
+// golang.org/x/sync/singleflight: concurrent callers for the same key share
+// one execution. SINGLEFLIGHT=false (or /admin/chaos/singleflight) turns it
+// off so every caller hits the backend, which is the thundering herd.
+var singleflightEnabled atomic.Bool
+
+var singleflightCalls = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "singleflight_calls_total",
+		Help: "Coalescable calls by group and result (executed, coalesced, bypassed)",
+	},
+	[]string{"group", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(singleflightCalls)
+	singleflightEnabled.Store(cfg.Singleflight)
+}
+
+var errFlightPanicked = errors.New("singleflight: the shared call panicked")
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val any
+	err error
+}
+
+type flightGroup struct {
+	name  string
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+func newFlightGroup(name string) *flightGroup {
+	for _, result := range []string{"executed", "coalesced", "bypassed"} {
+		singleflightCalls.WithLabelValues(name, result)
+	}
+	return &flightGroup{name: name, calls: map[string]*flightCall{}}
+}
+
+// do runs fn once per key at a time; shared reports whether the result came
+// from another caller's execution.
+func (g *flightGroup) do(key string, fn func() (any, error)) (v any, err error, shared bool) {
+	if !singleflightEnabled.Load() {
+		singleflightCalls.WithLabelValues(g.name, "bypassed").Inc()
+		v, err = fn()
+		return v, err, false
+	}
+
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		singleflightCalls.WithLabelValues(g.name, "coalesced").Inc()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	singleflightCalls.WithLabelValues(g.name, "executed").Inc()
+	// If fn panics the waiters are released with errFlightPanicked and the
+	// key is freed for the next caller while the panic carries on up.
+	c.err = errFlightPanicked
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}
+
+// handleAdminSingleflight reports or toggles coalescing: {"enabled": false}.
+func handleAdminSingleflight(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Enabled *bool `json:"enabled"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Enabled != nil {
+			singleflightEnabled.Store(*req.Enabled)
+		}
+		slog.Warn("Admin: singleflight updated", "enabled", singleflightEnabled.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"enabled": singleflightEnabled.Load()})
+}
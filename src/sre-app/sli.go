@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// In-app SLI recording rules, for labs whose Prometheus has none
+// configured. Every instrumented request lands in a per-route ring of
+// SLI_SLOT_S-second slots (default 60) holding its request and error
+// counts, a t-digest of latencies and the http_request_duration_seconds
+// bucket counts; each scrape folds the slots into the SLI_WINDOWS sliding
+// windows (default 5m,30m,1h,6h, the multiwindow burn-rate set) and exposes
+// them as pre-aggregated series: sli_success_ratio, sli_error_budget_burn_rate
+// against SLI_SLO_TARGET (percent, default 99.5) and sli_latency_p99_seconds
+// from both the t-digest and the same histogram_quantile interpolation
+// Prometheus would do over the raw buckets, with their disagreement in
+// sli_latency_p99_divergence_ratio. Responses of 500 and above, including
+// shed requests, count as errors.
+const sliCompression = 100
+
+var sliBuckets = prometheus.DefBuckets
+
+type sliSlot struct {
+	index         int64
+	total, errors int64
+	digest        *tdigest
+	bucketCounts  []int64 // one per sliBuckets bound, plus +Inf
+}
+
+type sliSeries struct {
+	mu    sync.Mutex
+	slots []sliSlot
+}
+
+type sliWindow struct {
+	label string
+	slots int64
+}
+
+var (
+	// A malformed SLI_WINDOWS is reported by loadConfig. Initialised here
+	// rather than in init so other files' init functions can use it.
+	sliWindows, _ = parseSLIWindows(os.Getenv("SLI_WINDOWS"), cfg.SLISlotSeconds)
+
+	sliSeriesMu sync.Mutex
+	sliByRoute  = map[string]*sliSeries{}
+)
+
+func init() {
+	prometheus.MustRegister(sliCollector{})
+}
+
+func parseSLIWindows(spec string, slotSeconds int) ([]sliWindow, error) {
+	if spec == "" {
+		spec = "5m,30m,1h,6h"
+	}
+	var windows []sliWindow
+	for _, label := range strings.Split(spec, ",") {
+		label = strings.TrimSpace(label)
+		d, err := time.ParseDuration(label)
+		if err != nil {
+			return nil, err
+		}
+		slot := time.Duration(slotSeconds) * time.Second
+		if d < slot || d > 24*time.Hour {
+			return nil, fmt.Errorf("window %s is outside [%v, 24h]", label, slot)
+		}
+		windows = append(windows, sliWindow{label: label, slots: int64(d / slot)})
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].slots < windows[j].slots })
+	return windows, nil
+}
+
+// recordSLI adds one finished request to its route's SLI slots.
+func recordSLI(route string, status int, elapsed time.Duration) {
+	if len(sliWindows) == 0 {
+		return
+	}
+	sliSeriesMu.Lock()
+	s, ok := sliByRoute[route]
+	if !ok {
+		s = newSLISeries()
+		sliByRoute[route] = s
+	}
+	sliSeriesMu.Unlock()
+	s.record(status, elapsed)
+}
+
+// newSLISeries sizes the ring for the longest window; callers check that
+// there is one.
+func newSLISeries() *sliSeries {
+	return &sliSeries{slots: make([]sliSlot, sliWindows[len(sliWindows)-1].slots+1)}
+}
+
+func (s *sliSeries) record(status int, elapsed time.Duration) {
+	index := time.Now().Unix() / int64(cfg.SLISlotSeconds)
+	seconds := elapsed.Seconds()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot := &s.slots[index%int64(len(s.slots))]
+	if slot.index != index || slot.digest == nil {
+		*slot = sliSlot{index: index, digest: newTDigest(sliCompression), bucketCounts: make([]int64, len(sliBuckets)+1)}
+	}
+	slot.total++
+	if status >= http.StatusInternalServerError {
+		slot.errors++
+	}
+	slot.digest.add(seconds)
+	slot.bucketCounts[sort.SearchFloat64s(sliBuckets, seconds)]++
+}
+
+// sliAggregate is one route's totals over one window.
+type sliAggregate struct {
+	window        string
+	total, errors int64
+	tdigestP99    float64
+	histogramP99  float64
+}
+
+// aggregate folds the slots newest first, snapshotting at each window
+// boundary so every window costs one pass.
+func (s *sliSeries) aggregate(now int64) []sliAggregate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	digest := newTDigest(sliCompression)
+	buckets := make([]int64, len(sliBuckets)+1)
+	var total, errors int64
+	var out []sliAggregate
+	age := int64(0)
+	for _, w := range sliWindows {
+		for ; age < w.slots; age++ {
+			slot := &s.slots[(now-age)%int64(len(s.slots))]
+			if slot.index != now-age || slot.digest == nil {
+				continue
+			}
+			total += slot.total
+			errors += slot.errors
+			digest.merge(slot.digest)
+			for i, n := range slot.bucketCounts {
+				buckets[i] += n
+			}
+		}
+		if total == 0 {
+			continue
+		}
+		out = append(out, sliAggregate{
+			window:       w.label,
+			total:        total,
+			errors:       errors,
+			tdigestP99:   digest.quantile(0.99),
+			histogramP99: histogramQuantile(0.99, buckets),
+		})
+	}
+	return out
+}
+
+// histogramQuantile mirrors PromQL's histogram_quantile over per-bucket
+// (non-cumulative) counts: linear interpolation inside the bucket, with the
+// highest finite bound for anything in +Inf.
+func histogramQuantile(q float64, counts []int64) float64 {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	rank := q * float64(total)
+	cumulative := 0.0
+	for i, n := range counts {
+		if cumulative+float64(n) >= rank && n > 0 {
+			if i == len(sliBuckets) {
+				return sliBuckets[len(sliBuckets)-1]
+			}
+			lower := 0.0
+			if i > 0 {
+				lower = sliBuckets[i-1]
+			}
+			return lower + (sliBuckets[i]-lower)*(rank-cumulative)/float64(n)
+		}
+		cumulative += float64(n)
+	}
+	return math.NaN()
+}
+
+var (
+	sliRequestsDesc = prometheus.NewDesc("sli_requests",
+		"Requests in the sliding window", []string{"path", "window"}, nil)
+	sliSuccessRatioDesc = prometheus.NewDesc("sli_success_ratio",
+		"Share of requests in the sliding window that did not fail with a 5xx", []string{"path", "window"}, nil)
+	sliBurnRateDesc = prometheus.NewDesc("sli_error_budget_burn_rate",
+		"Error ratio in the sliding window divided by the budget SLI_SLO_TARGET allows", []string{"path", "window"}, nil)
+	sliLatencyP99Desc = prometheus.NewDesc("sli_latency_p99_seconds",
+		"p99 latency in the sliding window, by estimator (tdigest, histogram)", []string{"path", "window", "estimator"}, nil)
+	sliDivergenceDesc = prometheus.NewDesc("sli_latency_p99_divergence_ratio",
+		"(histogram p99 - tdigest p99) / tdigest p99: how far bucket interpolation is off", []string{"path", "window"}, nil)
+)
+
+type sliCollector struct{}
+
+func (sliCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sliRequestsDesc
+	ch <- sliSuccessRatioDesc
+	ch <- sliBurnRateDesc
+	ch <- sliLatencyP99Desc
+	ch <- sliDivergenceDesc
+}
+
+func (sliCollector) Collect(ch chan<- prometheus.Metric) {
+	sliSeriesMu.Lock()
+	routes := make(map[string]*sliSeries, len(sliByRoute))
+	for route, s := range sliByRoute {
+		routes[route] = s
+	}
+	sliSeriesMu.Unlock()
+
+	now := time.Now().Unix() / int64(cfg.SLISlotSeconds)
+	budget := 1 - cfg.SLOTarget/100
+	for route, s := range routes {
+		for _, a := range s.aggregate(now) {
+			success := 1 - float64(a.errors)/float64(a.total)
+			ch <- prometheus.MustNewConstMetric(sliRequestsDesc, prometheus.GaugeValue, float64(a.total), route, a.window)
+			ch <- prometheus.MustNewConstMetric(sliSuccessRatioDesc, prometheus.GaugeValue, success, route, a.window)
+			if budget > 0 {
+				ch <- prometheus.MustNewConstMetric(sliBurnRateDesc, prometheus.GaugeValue, (1-success)/budget, route, a.window)
+			}
+			ch <- prometheus.MustNewConstMetric(sliLatencyP99Desc, prometheus.GaugeValue, a.tdigestP99, route, a.window, "tdigest")
+			ch <- prometheus.MustNewConstMetric(sliLatencyP99Desc, prometheus.GaugeValue, a.histogramP99, route, a.window, "histogram")
+			if a.tdigestP99 > 0 {
+				ch <- prometheus.MustNewConstMetric(sliDivergenceDesc, prometheus.GaugeValue, (a.histogramP99-a.tdigestP99)/a.tdigestP99, route, a.window)
+			}
+		}
+	}
+}
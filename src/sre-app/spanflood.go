@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Span flood chaos, for collector backpressure drills. SPAN_FLOOD_RATE
+// percent of requests grow a synthetic span tree under their server span,
+// SPAN_FLOOD_WIDTH children per node (default 4) and SPAN_FLOOD_DEPTH levels
+// deep (default 4), so one request emits width + width^2 + ... spans (340
+// at the defaults). That is enough to fill the SDK batch queue and the
+// collector's exporter queue, and to show refused and dropped spans in the
+// collector's own metrics. Trees are capped at maxFloodSpans spans.
+// /admin/chaos/spanflood adjusts all three at runtime.
+const maxFloodSpans = 100000
+
+var (
+	spanFloodRate  atomic.Int64
+	spanFloodWidth atomic.Int64
+	spanFloodDepth atomic.Int64
+
+	spanFloodTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chaos_span_flood_spans_total",
+		Help: "Synthetic spans emitted by the span flood",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(spanFloodTotal)
+	spanFloodRate.Store(int64(cfg.SpanFloodRate))
+	spanFloodWidth.Store(int64(cfg.SpanFloodWidth))
+	spanFloodDepth.Store(int64(cfg.SpanFloodDepth))
+}
+
+// floodSpans grows a synthetic tree under the current span for a share of
+// requests.
+func floodSpans(ctx context.Context) {
+	if rate := spanFloodRate.Load(); rate <= 0 || rand.Int63n(100) >= rate {
+		return
+	}
+	budget := int64(maxFloodSpans)
+	emitted := floodLevel(ctx, int(spanFloodWidth.Load()), int(spanFloodDepth.Load()), 1, &budget)
+	spanFloodTotal.Add(float64(emitted))
+	serverSpan(ctx).SetAttributes(attrFaultInjected.Bool(true), attribute.Int("app.span_flood.spans", emitted))
+	noteChaos(ctx, "span flood: %d spans", emitted)
+}
+
+func floodLevel(ctx context.Context, width, depth, level int, budget *int64) int {
+	if level > depth {
+		return 0
+	}
+	emitted := 0
+	for i := 0; i < width && *budget > 0; i++ {
+		*budget--
+		childCtx, span := tracer.Start(ctx, "span flood")
+		span.SetAttributes(attribute.Int("app.span_flood.level", level), attribute.Int("app.span_flood.index", i))
+		emitted += 1 + floodLevel(childCtx, width, depth, level+1, budget)
+		span.End()
+	}
+	return emitted
+}
+
+// handleAdminSpanFlood reports or sets the flood:
+// {"rate": 10, "width": 5, "depth": 5}.
+func handleAdminSpanFlood(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Rate  *int64 `json:"rate"`
+			Width *int64 `json:"width"`
+			Depth *int64 `json:"depth"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Rate != nil {
+			spanFloodRate.Store(*req.Rate)
+		}
+		if req.Width != nil {
+			spanFloodWidth.Store(*req.Width)
+		}
+		if req.Depth != nil {
+			spanFloodDepth.Store(*req.Depth)
+		}
+		slog.Warn("Admin: span flood updated", "rate", spanFloodRate.Load(), "width", spanFloodWidth.Load(), "depth", spanFloodDepth.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"rate":  spanFloodRate.Load(),
+		"width": spanFloodWidth.Load(),
+		"depth": spanFloodDepth.Load(),
+	})
+}
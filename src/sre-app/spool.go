@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Telemetry spool. With TELEMETRY_SPOOL_DIR set (an emptyDir in the lab),
+// span batches the exporter fails to deliver are appended to the spool
+// instead of being dropped, up to TELEMETRY_SPOOL_MAX_BYTES (default 64 MiB;
+// past that new failures are dropped and counted). After the next
+// successful export the spool is replayed oldest first, at most
+// spoolReplayBatches batches per export so recovery doesn't stall live
+// traffic, and it survives a restart of the container. Only traces are
+// spooled: metrics are scraped, so an outage there is a gap on the
+// Prometheus side, not a buffer in the app.
+//
+// The spool is a run of segment files, spool-<seq>.jsonl, each closed at
+// 1/spoolSegments of the limit, plus spool.offset, how far into the oldest
+// segment replay has got. Replay streams from that offset and deletes a
+// segment once it is through it, so draining never rereads or rewrites
+// what is left, and it runs outside the lock failed exports append under.
+const (
+	spoolReplayBatches = 20
+	spoolSegments      = 16
+)
+
+var (
+	telemetrySpoolBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemetry_spool_bytes",
+		Help: "Bytes of span batches waiting in the on-disk spool",
+	})
+	telemetrySpoolBatches = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemetry_spool_batches",
+		Help: "Span batches waiting in the on-disk spool",
+	})
+	telemetrySpoolSpans = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "telemetry_spool_spans_total",
+			Help: "Spans through the spool by operation (spooled, replayed, dropped)",
+		},
+		[]string{"operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(telemetrySpoolBytes, telemetrySpoolBatches, telemetrySpoolSpans)
+}
+
+type spoolSegment struct {
+	seq  int64
+	size int64 // bytes written, including any already replayed
+}
+
+type spoolingExporter struct {
+	sdktrace.SpanExporter
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	// replayMu lets one export at a time replay, without holding mu.
+	replayMu sync.Mutex
+
+	mu       sync.Mutex
+	segments []spoolSegment // oldest first
+	offset   int64          // replayed bytes of segments[0]
+	size     int64          // bytes not yet replayed
+	batches  int
+}
+
+// newSpoolingExporter wraps exporter with the spool, or returns it unchanged
+// when TELEMETRY_SPOOL_DIR is unset.
+func newSpoolingExporter(exporter sdktrace.SpanExporter) sdktrace.SpanExporter {
+	dir := os.Getenv("TELEMETRY_SPOOL_DIR")
+	if dir == "" {
+		return exporter
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Error("Telemetry spool disabled", "dir", dir, "error", err)
+		return exporter
+	}
+	e := &spoolingExporter{
+		SpanExporter: exporter,
+		dir:          dir,
+		maxBytes:     cfg.TelemetrySpoolMaxBytes,
+		segmentBytes: max(cfg.TelemetrySpoolMaxBytes/spoolSegments, 1),
+	}
+	for _, op := range []string{"spooled", "replayed", "dropped"} {
+		telemetrySpoolSpans.WithLabelValues(op)
+	}
+	if err := e.load(); err != nil {
+		slog.Error("Telemetry spool unreadable, starting from what could be read", "dir", dir, "error", err)
+	}
+	if e.batches > 0 {
+		slog.Info("Telemetry spool has batches from a previous run", "batches", e.batches, "bytes", e.size)
+	}
+	e.updateGauges()
+	return e
+}
+
+func (e *spoolingExporter) segmentPath(seq int64) string {
+	return filepath.Join(e.dir, fmt.Sprintf("spool-%016d.jsonl", seq))
+}
+
+func (e *spoolingExporter) offsetPath() string {
+	return filepath.Join(e.dir, "spool.offset")
+}
+
+// load finds the segments a previous run left and where replay stopped.
+func (e *spoolingExporter) load() error {
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		num, ok := strings.CutPrefix(strings.TrimSuffix(entry.Name(), ".jsonl"), "spool-")
+		seq, err := strconv.ParseInt(num, 10, 64)
+		info, infoErr := entry.Info()
+		if !ok || err != nil || infoErr != nil || !strings.HasSuffix(entry.Name(), ".jsonl") {
+			continue
+		}
+		e.segments = append(e.segments, spoolSegment{seq: seq, size: info.Size()})
+	}
+	sort.Slice(e.segments, func(i, j int) bool { return e.segments[i].seq < e.segments[j].seq })
+	if len(e.segments) == 0 {
+		return nil
+	}
+	if b, err := os.ReadFile(e.offsetPath()); err == nil {
+		var seq, offset int64
+		if _, err := fmt.Sscan(string(b), &seq, &offset); err == nil && seq == e.segments[0].seq && offset <= e.segments[0].size {
+			e.offset = offset
+		}
+	}
+	for i, seg := range e.segments {
+		from := int64(0)
+		if i == 0 {
+			from = e.offset
+		}
+		n, err := countLines(e.segmentPath(seg.seq), from)
+		if err != nil {
+			return err
+		}
+		e.size += seg.size - from
+		e.batches += n
+	}
+	return nil
+}
+
+// countLines counts the newline-terminated lines in file after from.
+func countLines(file string, from int64) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, buf := 0, make([]byte, 64<<10)
+	for {
+		read, err := f.Read(buf)
+		n += bytes.Count(buf[:read], []byte{'\n'})
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+func (e *spoolingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	e.mu.Lock()
+	if err != nil {
+		defer e.mu.Unlock()
+		return e.spool(spans, err)
+	}
+	pending := e.batches > 0
+	e.mu.Unlock()
+	if pending && e.replayMu.TryLock() {
+		defer e.replayMu.Unlock()
+		e.replay(ctx)
+	}
+	return nil
+}
+
+// spool appends a failed batch to the newest segment; callers hold e.mu.
+func (e *spoolingExporter) spool(spans []sdktrace.ReadOnlySpan, exportErr error) error {
+	line, err := json.Marshal(spoolBatchFrom(spans))
+	if err != nil {
+		return exportErr
+	}
+	line = append(line, '\n')
+	if e.size+int64(len(line)) > e.maxBytes {
+		telemetrySpoolSpans.WithLabelValues("dropped").Add(float64(len(spans)))
+		return fmt.Errorf("%w (telemetry spool full)", exportErr)
+	}
+	if n := len(e.segments); n == 0 || e.segments[n-1].size >= e.segmentBytes {
+		seq := int64(0)
+		if n > 0 {
+			seq = e.segments[n-1].seq + 1
+		}
+		e.segments = append(e.segments, spoolSegment{seq: seq})
+	}
+	seg := &e.segments[len(e.segments)-1]
+	f, err := os.OpenFile(e.segmentPath(seg.seq), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		telemetrySpoolSpans.WithLabelValues("dropped").Add(float64(len(spans)))
+		return fmt.Errorf("%w (telemetry spool: %v)", exportErr, err)
+	}
+	defer f.Close()
+	if n, err := f.Write(line); err != nil {
+		// Cut a partial line off so the segment stays line-aligned.
+		if n > 0 {
+			f.Truncate(seg.size)
+		}
+		telemetrySpoolSpans.WithLabelValues("dropped").Add(float64(len(spans)))
+		return fmt.Errorf("%w (telemetry spool: %v)", exportErr, err)
+	}
+	seg.size += int64(len(line))
+	e.size += int64(len(line))
+	e.batches++
+	telemetrySpoolSpans.WithLabelValues("spooled").Add(float64(len(spans)))
+	e.updateGauges()
+	return nil
+}
+
+// replay re-exports up to spoolReplayBatches of the oldest spooled batches,
+// streaming them from the saved offset; callers hold e.replayMu.
+func (e *spoolingExporter) replay(ctx context.Context) {
+	budget := spoolReplayBatches
+	for budget > 0 {
+		e.mu.Lock()
+		if len(e.segments) == 0 {
+			e.mu.Unlock()
+			return
+		}
+		seg, offset := e.segments[0], e.offset
+		e.mu.Unlock()
+
+		sent, read, err := e.replaySegment(ctx, seg, offset, budget)
+		budget -= sent
+
+		e.mu.Lock()
+		e.offset += read
+		e.size -= read
+		e.batches -= sent
+		finished := e.offset >= e.segments[0].size && (len(e.segments) > 1 || e.offset > 0)
+		if finished {
+			os.Remove(e.segmentPath(seg.seq))
+			e.segments = e.segments[1:]
+			e.offset = 0
+		}
+		e.saveOffset()
+		e.updateGauges()
+		drained := e.batches == 0
+		e.mu.Unlock()
+
+		if err != nil {
+			slog.Error("Telemetry spool replay stopped", "segment", e.segmentPath(seg.seq), "error", err)
+			return
+		}
+		if drained {
+			slog.Info("Telemetry spool drained")
+			return
+		}
+		if !finished {
+			return
+		}
+	}
+}
+
+// replaySegment exports batches of seg from offset until budget is spent,
+// an export fails or it reaches what seg held when replay began. It returns
+// the batches it got through and the bytes they took.
+func (e *spoolingExporter) replaySegment(ctx context.Context, seg spoolSegment, offset int64, budget int) (int, int64, error) {
+	f, err := os.Open(e.segmentPath(seg.seq))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	r := bufio.NewReader(io.LimitReader(f, seg.size-offset))
+	sent, read := 0, int64(0)
+	for sent < budget {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Appends only count once their whole line is written, so an
+			// unterminated one is left over from a crash: skip it.
+			return sent, read + int64(len(line)), nil
+		}
+		if err != nil {
+			return sent, read, err
+		}
+		var batch spoolBatch
+		if json.Unmarshal(line, &batch) == nil {
+			if err := e.SpanExporter.ExportSpans(ctx, batch.snapshots()); err != nil {
+				return sent, read, nil
+			}
+			telemetrySpoolSpans.WithLabelValues("replayed").Add(float64(len(batch.Spans)))
+		}
+		sent++
+		read += int64(len(line))
+	}
+	return sent, read, nil
+}
+
+// saveOffset records how far replay has got; callers hold e.mu.
+func (e *spoolingExporter) saveOffset() {
+	if len(e.segments) == 0 {
+		os.Remove(e.offsetPath())
+		return
+	}
+	body := fmt.Sprintf("%d %d\n", e.segments[0].seq, e.offset)
+	if err := os.WriteFile(e.offsetPath(), []byte(body), 0o644); err != nil {
+		slog.Error("Telemetry spool offset not saved", "path", e.offsetPath(), "error", err)
+	}
+}
+
+func (e *spoolingExporter) updateGauges() {
+	telemetrySpoolBytes.Set(float64(e.size))
+	telemetrySpoolBatches.Set(float64(e.batches))
+}
+
+// The spool format: one JSON batch per line, holding everything an exporter
+// reads from a span.
+type spoolBatch struct {
+	Resource []spoolAttr `json:"resource"`
+	Spans    []spoolSpan `json:"spans"`
+}
+
+type spoolSpan struct {
+	TraceID      string       `json:"trace_id"`
+	SpanID       string       `json:"span_id"`
+	ParentSpanID string       `json:"parent_span_id,omitempty"`
+	Sampled      bool         `json:"sampled"`
+	TraceState   string       `json:"trace_state,omitempty"`
+	Name         string       `json:"name"`
+	Kind         int          `json:"kind"`
+	Start        time.Time    `json:"start"`
+	End          time.Time    `json:"end"`
+	Attributes   []spoolAttr  `json:"attributes,omitempty"`
+	Events       []spoolEvent `json:"events,omitempty"`
+	Links        []spoolLink  `json:"links,omitempty"`
+	StatusCode   uint32       `json:"status_code,omitempty"`
+	StatusDesc   string       `json:"status_description,omitempty"`
+	Scope        string       `json:"scope"`
+	ScopeVersion string       `json:"scope_version,omitempty"`
+}
+
+type spoolEvent struct {
+	Name       string      `json:"name"`
+	Time       time.Time   `json:"time"`
+	Attributes []spoolAttr `json:"attributes,omitempty"`
+}
+
+type spoolLink struct {
+	TraceID    string      `json:"trace_id"`
+	SpanID     string      `json:"span_id"`
+	TraceState string      `json:"trace_state,omitempty"`
+	Attributes []spoolAttr `json:"attributes,omitempty"`
+}
+
+type spoolAttr struct {
+	Key   string          `json:"k"`
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v"`
+}
+
+func spoolAttrs(kvs []attribute.KeyValue) []spoolAttr {
+	out := make([]spoolAttr, 0, len(kvs))
+	for _, kv := range kvs {
+		v, _ := json.Marshal(kv.Value.AsInterface())
+		out = append(out, spoolAttr{Key: string(kv.Key), Type: kv.Value.Type().String(), Value: v})
+	}
+	return out
+}
+
+func (a spoolAttr) keyValue() attribute.KeyValue {
+	k := attribute.Key(a.Key)
+	switch a.Type {
+	case "BOOL":
+		var v bool
+		json.Unmarshal(a.Value, &v)
+		return k.Bool(v)
+	case "INT64":
+		var v int64
+		json.Unmarshal(a.Value, &v)
+		return k.Int64(v)
+	case "FLOAT64":
+		var v float64
+		json.Unmarshal(a.Value, &v)
+		return k.Float64(v)
+	case "BOOLSLICE":
+		var v []bool
+		json.Unmarshal(a.Value, &v)
+		return k.BoolSlice(v)
+	case "INT64SLICE":
+		var v []int64
+		json.Unmarshal(a.Value, &v)
+		return k.Int64Slice(v)
+	case "FLOAT64SLICE":
+		var v []float64
+		json.Unmarshal(a.Value, &v)
+		return k.Float64Slice(v)
+	case "STRINGSLICE":
+		var v []string
+		json.Unmarshal(a.Value, &v)
+		return k.StringSlice(v)
+	default:
+		var v string
+		json.Unmarshal(a.Value, &v)
+		return k.String(v)
+	}
+}
+
+func keyValues(attrs []spoolAttr) []attribute.KeyValue {
+	out := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		out = append(out, a.keyValue())
+	}
+	return out
+}
+
+func spoolBatchFrom(spans []sdktrace.ReadOnlySpan) spoolBatch {
+	var batch spoolBatch
+	if len(spans) > 0 && spans[0].Resource() != nil {
+		batch.Resource = spoolAttrs(spans[0].Resource().Attributes())
+	}
+	for _, s := range spans {
+		sc := s.SpanContext()
+		out := spoolSpan{
+			TraceID:      sc.TraceID().String(),
+			SpanID:       sc.SpanID().String(),
+			Sampled:      sc.IsSampled(),
+			TraceState:   sc.TraceState().String(),
+			Name:         s.Name(),
+			Kind:         int(s.SpanKind()),
+			Start:        s.StartTime(),
+			End:          s.EndTime(),
+			Attributes:   spoolAttrs(s.Attributes()),
+			StatusCode:   uint32(s.Status().Code),
+			StatusDesc:   s.Status().Description,
+			Scope:        s.InstrumentationScope().Name,
+			ScopeVersion: s.InstrumentationScope().Version,
+		}
+		if s.Parent().IsValid() {
+			out.ParentSpanID = s.Parent().SpanID().String()
+		}
+		for _, ev := range s.Events() {
+			out.Events = append(out.Events, spoolEvent{Name: ev.Name, Time: ev.Time, Attributes: spoolAttrs(ev.Attributes)})
+		}
+		for _, l := range s.Links() {
+			out.Links = append(out.Links, spoolLink{
+				TraceID:    l.SpanContext.TraceID().String(),
+				SpanID:     l.SpanContext.SpanID().String(),
+				TraceState: l.SpanContext.TraceState().String(),
+				Attributes: spoolAttrs(l.Attributes),
+			})
+		}
+		batch.Spans = append(batch.Spans, out)
+	}
+	return batch
+}
+
+func spoolSpanContext(traceID, spanID, state string, sampled, remote bool) trace.SpanContext {
+	tid, _ := trace.TraceIDFromHex(traceID)
+	sid, _ := trace.SpanIDFromHex(spanID)
+	ts, _ := trace.ParseTraceState(state)
+	var flags trace.TraceFlags
+	if sampled {
+		flags = trace.FlagsSampled
+	}
+	return trace.NewSpanContext(trace.SpanContextConfig{TraceID: tid, SpanID: sid, TraceFlags: flags, TraceState: ts, Remote: remote})
+}
+
+// snapshots rebuilds the batch as spans an exporter can send.
+func (b spoolBatch) snapshots() []sdktrace.ReadOnlySpan {
+	res := resource.NewSchemaless(keyValues(b.Resource)...)
+	stubs := make(tracetest.SpanStubs, 0, len(b.Spans))
+	for _, s := range b.Spans {
+		stub := tracetest.SpanStub{
+			Name:        s.Name,
+			SpanContext: spoolSpanContext(s.TraceID, s.SpanID, s.TraceState, s.Sampled, false),
+			SpanKind:    trace.SpanKind(s.Kind),
+			StartTime:   s.Start,
+			EndTime:     s.End,
+			Attributes:  keyValues(s.Attributes),
+			Status:      sdktrace.Status{Code: codes.Code(s.StatusCode), Description: s.StatusDesc},
+			Resource:    res,
+			InstrumentationLibrary: instrumentation.Library{
+				Name:    s.Scope,
+				Version: s.ScopeVersion,
+			},
+		}
+		if s.ParentSpanID != "" {
+			stub.Parent = spoolSpanContext(s.TraceID, s.ParentSpanID, "", s.Sampled, false)
+		}
+		for _, ev := range s.Events {
+			stub.Events = append(stub.Events, sdktrace.Event{Name: ev.Name, Time: ev.Time, Attributes: keyValues(ev.Attributes)})
+		}
+		for _, l := range s.Links {
+			stub.Links = append(stub.Links, sdktrace.Link{
+				SpanContext: spoolSpanContext(l.TraceID, l.SpanID, l.TraceState, false, true),
+				Attributes:  keyValues(l.Attributes),
+			})
+		}
+		stubs = append(stubs, stub)
+	}
+	return stubs.Snapshots()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Startup dependency gating. STARTUP_DEPENDENCIES (comma-separated URLs,
+// defaulting to DOWNSTREAM_URL) are probed at boot and STARTUP_POLICY
+// decides what happens while they are down:
+//
+//	block    (default) stay unready until every dependency answers
+//	crash    exit non-zero if they are still down after STARTUP_TIMEOUT_S
+//	degrade  become ready at once, flagged degraded until they recover
+var (
+	startupDependencyUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "startup_dependency_up",
+			Help: "1 once a startup dependency has answered its probe",
+		},
+		[]string{"dependency"},
+	)
+	appDegraded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "app_degraded",
+		Help: "1 while the app runs degraded because a startup dependency is unavailable",
+	})
+	startupWaitSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "startup_dependency_wait_seconds",
+		Help: "Time spent waiting for startup dependencies",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(startupDependencyUp)
+	prometheus.MustRegister(appDegraded)
+	prometheus.MustRegister(startupWaitSeconds)
+}
+
+func startupDependencies() []string {
+	v := os.Getenv("STARTUP_DEPENDENCIES")
+	if v == "" {
+		v = os.Getenv("DOWNSTREAM_URL")
+	}
+	var deps []string
+	for _, d := range strings.Split(v, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			deps = append(deps, d)
+		}
+	}
+	return deps
+}
+
+// gateStartup runs the policy in the background so /readyz and /metrics
+// are served while dependencies are probed.
+func gateStartup() {
+	deps := startupDependencies()
+	if len(deps) == 0 {
+		return
+	}
+	policy := cfg.StartupPolicy
+	timeoutS := cfg.StartupTimeoutS
+
+	switch policy {
+	case "degrade":
+		appDegraded.Set(1)
+	default:
+		readiness.block("startup-dependencies", "waiting for "+strings.Join(deps, ", "))
+	}
+	slog.Info("startup: probing dependencies", "policy", policy, "dependencies", deps, "timeout_s", timeoutS)
+
+	go func() {
+		start := time.Now()
+		deadline := start.Add(time.Duration(timeoutS) * time.Second)
+		for attempt := 1; ; attempt++ {
+			down := probeDependencies(deps)
+			startupWaitSeconds.Set(time.Since(start).Seconds())
+			if len(down) == 0 {
+				readiness.unblock("startup-dependencies")
+				appDegraded.Set(0)
+				slog.Info("startup: dependencies available", "policy", policy, "attempts", attempt, "waited", time.Since(start).String())
+				return
+			}
+			slog.Warn("startup: dependencies unavailable", "policy", policy, "attempt", attempt, "down", down)
+			if policy == "crash" && time.Now().After(deadline) {
+				slog.Error("startup: dependencies still unavailable after timeout, exiting", "down", down, "timeout_s", timeoutS)
+				os.Exit(1)
+			}
+			time.Sleep(2 * time.Second)
+		}
+	}()
+}
+
+func probeDependencies(deps []string) []string {
+	client := &http.Client{Timeout: 2 * time.Second}
+	var down []string
+	for _, dep := range deps {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, dep, nil)
+		ok := false
+		if err == nil {
+			if resp, err := client.Do(req); err == nil {
+				resp.Body.Close()
+				ok = resp.StatusCode < 500
+			}
+		}
+		cancel()
+		if ok {
+			startupDependencyUp.WithLabelValues(dep).Set(1)
+		} else {
+			startupDependencyUp.WithLabelValues(dep).Set(0)
+			down = append(down, dep)
+		}
+	}
+	return down
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Embedded static assets under /static/ with strong ETags and
+// Cache-Control: public, max-age=STATIC_MAX_AGE_S (default 300). /cdn/static/
+// fronts the same assets with a simulated shared edge cache that honours
+// s-maxage and revalidates with If-None-Match, reporting X-Cache.
+//
+// STATIC_CACHE_CHAOS reproduces classic cache-busting incidents:
+//
+//	per-pod   ETags include the pod name, so revalidation misses across replicas
+//	rotate    ETags change every minute, as if assets were rebuilt constantly
+//	no-store  Cache-Control: no-store ships by mistake; nothing is cached
+//
+//go:embed static
+var staticFiles embed.FS
+
+type staticAsset struct {
+	body        []byte
+	etag        string
+	contentType string
+}
+
+var (
+	staticAssets    = map[string]staticAsset{}
+	staticMaxAge    = 300
+	staticChaosMode atomic.Value
+)
+
+var (
+	staticRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "static_requests_total",
+			Help: "Static asset requests by result (ok, not_modified, not_found)",
+		},
+		[]string{"result"},
+	)
+	cdnRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cdn_requests_total",
+			Help: "Simulated edge cache requests by result (hit, miss, revalidated, pass)",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(staticRequestsTotal, cdnRequestsTotal)
+	staticMaxAge = cfg.StaticMaxAgeS
+	staticChaosMode.Store(cfg.StaticCacheChaos)
+
+	err := fs.WalkDir(staticFiles, "static", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		body, err := staticFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(body)
+		staticAssets[strings.TrimPrefix(name, "static/")] = staticAsset{
+			body:        body,
+			etag:        hex.EncodeToString(sum[:8]),
+			contentType: mime.TypeByExtension(path.Ext(name)),
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("failed to load embedded static assets: %v", err)
+	}
+}
+
+// currentETag applies the cache chaos mode to an asset's content hash.
+func currentETag(a staticAsset) string {
+	tag := a.etag
+	switch staticChaosMode.Load().(string) {
+	case "per-pod":
+		sum := sha256.Sum256([]byte(podName() + tag))
+		tag = hex.EncodeToString(sum[:8])
+	case "rotate":
+		sum := sha256.Sum256([]byte(tag + strconv.FormatInt(time.Now().Unix()/60, 10)))
+		tag = hex.EncodeToString(sum[:8])
+	}
+	return `"` + tag + `"`
+}
+
+// etagMatches implements the weak comparison If-None-Match calls for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// originResponse is what the app itself answers for an asset.
+func originResponse(name, ifNoneMatch string) (int, http.Header, []byte) {
+	header := http.Header{}
+	asset, ok := staticAssets[name]
+	if !ok {
+		return http.StatusNotFound, header, []byte("404 page not found\n")
+	}
+	etag := currentETag(asset)
+	header.Set("ETag", etag)
+	if staticChaosMode.Load().(string) == "no-store" {
+		header.Set("Cache-Control", "no-store")
+	} else {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, s-maxage=%d", staticMaxAge, staticMaxAge))
+	}
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		return http.StatusNotModified, header, nil
+	}
+	header.Set("Content-Type", asset.contentType)
+	header.Set("Content-Length", strconv.Itoa(len(asset.body)))
+	return http.StatusOK, header, asset.body
+}
+
+func writeAssetResponse(w http.ResponseWriter, status int, header http.Header, body []byte) {
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	_, span := tracer.Start(r.Context(), "handleStatic")
+	defer span.End()
+
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	status, header, body := originResponse(name, r.Header.Get("If-None-Match"))
+	span.SetAttributes(attribute.String("app.static.asset", name), attribute.Bool("app.static.conditional", r.Header.Get("If-None-Match") != ""))
+	writeAssetResponse(w, status, header, body)
+
+	switch status {
+	case http.StatusOK:
+		staticRequestsTotal.WithLabelValues("ok").Inc()
+	case http.StatusNotModified:
+		staticRequestsTotal.WithLabelValues("not_modified").Inc()
+	default:
+		staticRequestsTotal.WithLabelValues("not_found").Inc()
+	}
+	httpRequestsTotal.WithLabelValues("/static/", strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues("/static/").Observe(time.Since(start).Seconds())
+}
+
+type edgeEntry struct {
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+}
+
+var (
+	edgeMu    sync.Mutex
+	edgeCache = map[string]*edgeEntry{}
+)
+
+// handleCDN plays a shared cache in front of the origin handler.
+func handleCDN(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	_, span := tracer.Start(r.Context(), "handleCDN")
+	defer span.End()
+
+	name := strings.TrimPrefix(r.URL.Path, "/cdn/static/")
+	maxAge := time.Duration(staticMaxAge) * time.Second
+
+	edgeMu.Lock()
+	entry := edgeCache[name]
+	result := "hit"
+	switch {
+	case entry != nil && time.Since(entry.storedAt) < maxAge:
+	case entry != nil:
+		status, header, body := originResponse(name, entry.header.Get("ETag"))
+		if status == http.StatusNotModified {
+			result = "revalidated"
+			entry.storedAt = time.Now()
+		} else {
+			result = "miss"
+			entry = storeEdge(name, status, header, body)
+		}
+	default:
+		result = "miss"
+		status, header, body := originResponse(name, "")
+		entry = storeEdge(name, status, header, body)
+	}
+	var storedAt time.Time // revalidation rewrites entry.storedAt under edgeMu
+	if entry != nil {
+		storedAt = entry.storedAt
+	}
+	edgeMu.Unlock()
+
+	status := http.StatusOK
+	if entry == nil {
+		// Uncacheable: pass straight through to the origin.
+		result = "pass"
+		var header http.Header
+		var body []byte
+		status, header, body = originResponse(name, r.Header.Get("If-None-Match"))
+		header.Set("X-Cache", "PASS")
+		writeAssetResponse(w, status, header, body)
+	} else {
+		header := entry.header.Clone()
+		header.Set("X-Cache", strings.ToUpper(result))
+		header.Set("Age", strconv.Itoa(int(time.Since(storedAt).Seconds())))
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, header.Get("ETag")) {
+			header.Del("Content-Type")
+			header.Del("Content-Length")
+			status = http.StatusNotModified
+			writeAssetResponse(w, status, header, nil)
+		} else {
+			writeAssetResponse(w, http.StatusOK, header, entry.body)
+		}
+	}
+
+	span.SetAttributes(attribute.String("app.static.asset", name), attribute.String("app.cdn.result", result))
+	cdnRequestsTotal.WithLabelValues(result).Inc()
+	httpRequestsTotal.WithLabelValues("/cdn/static/", strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues("/cdn/static/").Observe(time.Since(start).Seconds())
+}
+
+// storeEdge caches a 200 unless the origin forbids it; callers hold edgeMu.
+func storeEdge(name string, status int, header http.Header, body []byte) *edgeEntry {
+	if status != http.StatusOK || strings.Contains(header.Get("Cache-Control"), "no-store") {
+		delete(edgeCache, name)
+		return nil
+	}
+	entry := &edgeEntry{header: header, body: body, storedAt: time.Now()}
+	edgeCache[name] = entry
+	return entry
+}
+
+// handleAdminStatic reports or sets the cache chaos mode and can purge the
+// edge: {"mode": "per-pod"}, {"mode": ""}, {"purge": true}.
+func handleAdminStatic(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Mode  *string `json:"mode"`
+			Purge bool    `json:"purge"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Mode != nil {
+			switch *req.Mode {
+			case "", "per-pod", "rotate", "no-store":
+				staticChaosMode.Store(*req.Mode)
+			default:
+				writeProblem(w, r, "mode must be one of per-pod, rotate, no-store or empty", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Purge {
+			edgeMu.Lock()
+			edgeCache = map[string]*edgeEntry{}
+			edgeMu.Unlock()
+		}
+		slog.Warn("Admin: static cache chaos updated", "mode", staticChaosMode.Load(), "purge", req.Purge)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	edgeMu.Lock()
+	cached := len(edgeCache)
+	edgeMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"mode":         staticChaosMode.Load(),
+		"max_age_s":    staticMaxAge,
+		"edge_entries": cached,
+		"assets":       len(staticAssets),
+	})
+}
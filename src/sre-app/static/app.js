@@ -0,0 +1,6 @@
+fetch("/checkout")
+  .then((res) => res.text())
+  .then((body) => {
+    const match = body.match(/trace=([0-9a-f]{32})/);
+    document.getElementById("trace").textContent = match ? "Last checkout trace: " + match[1] : body;
+  });
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Storage migration, for data-migration verification. The order store is
+// the primary backend; STORE_MIGRATION_MODE moves orders onto a second,
+// shadow backend the way an online migration does:
+//
+//	off          (default) primary only
+//	dual_write   orders are written to both, reads come from the primary
+//	shadow_read  as dual_write, and every read also reads the shadow and
+//	             compares the two; the primary's answer is served
+//	cutover      reads are served from the shadow, still compared against
+//	             the primary
+//
+// Shadow writes take STORE_SHADOW_LATENCY_MS (default 5) and are best
+// effort: STORE_SHADOW_WRITE_ERROR_RATE percent of them fail, leaving the
+// order missing from the shadow while the request succeeds, and
+// STORE_SHADOW_DRIFT_RATE percent store it wrongly, as a conversion bug in
+// the new schema would. Nothing fails until reads are compared:
+// store_shadow_comparisons_total{result} counts match, mismatch,
+// missing_shadow and missing_primary, and store_shadow_mismatch_fields_total
+// the fields that differ. Orders placed before dual writes began are
+// missing_shadow until {"backfill": true} on /admin/chaos/storemigration,
+// which also changes the mode and rates at runtime.
+//
+// GET /orders lists the most recent orders and GET /orders/{id} reads one,
+// both through the migration.
+var storeMigrationModes = []string{"off", "dual_write", "shadow_read", "cutover"}
+
+// orderBackend is one of the two stores an order can be read from.
+type orderBackend interface {
+	name() string
+	get(id int64) (storedOrder, bool)
+}
+
+type primaryBackend struct{}
+
+func (primaryBackend) name() string { return "primary" }
+
+func (primaryBackend) get(id int64) (storedOrder, bool) {
+	orderStoreMu.Lock()
+	defer orderStoreMu.Unlock()
+	o, ok := orderStore[id]
+	if !ok {
+		return storedOrder{}, false
+	}
+	copied := *o
+	copied.Lines = slices.Clone(o.Lines)
+	return copied, true
+}
+
+type shadowBackend struct {
+	mu     sync.Mutex
+	orders map[int64]storedOrder
+}
+
+func (*shadowBackend) name() string { return "shadow" }
+
+func (s *shadowBackend) get(id int64) (storedOrder, bool) {
+	time.Sleep(time.Duration(shadowLatencyMs.Load()) * time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[id]
+	return o, ok
+}
+
+func (s *shadowBackend) put(o storedOrder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders[o.ID] = o
+}
+
+func (s *shadowBackend) forget(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.orders, id)
+}
+
+var (
+	storeMigrationMode   atomic.Value
+	shadowLatencyMs      atomic.Int64
+	shadowWriteErrorRate atomic.Int64
+	shadowDriftRate      atomic.Int64
+
+	shadowStore = &shadowBackend{orders: map[int64]storedOrder{}}
+
+	shadowWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "store_shadow_writes_total",
+			Help: "Dual writes to the shadow order store by outcome (ok, error)",
+		},
+		[]string{"outcome"},
+	)
+	shadowComparisons = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "store_shadow_comparisons_total",
+			Help: "Order reads compared between the primary and shadow stores by result (match, mismatch, missing_shadow, missing_primary)",
+		},
+		[]string{"result"},
+	)
+	shadowMismatchFields = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "store_shadow_mismatch_fields_total",
+			Help: "Fields that differed in mismatched comparisons, by field",
+		},
+		[]string{"field"},
+	)
+	shadowRecords = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "store_shadow_records",
+			Help: "Orders held by the shadow order store",
+		},
+		func() float64 {
+			shadowStore.mu.Lock()
+			defer shadowStore.mu.Unlock()
+			return float64(len(shadowStore.orders))
+		},
+	)
+	storeBackendDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "store_backend_operation_duration_seconds",
+			Help:    "Order store operations by backend (primary, shadow) and operation (read, write)",
+			Buckets: []float64{.0001, .001, .005, .01, .025, .05, .1, .25, .5, 1},
+		},
+		[]string{"backend", "operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(shadowWrites, shadowComparisons, shadowMismatchFields, shadowRecords, storeBackendDuration)
+	for _, outcome := range []string{"ok", "error"} {
+		shadowWrites.WithLabelValues(outcome)
+	}
+	for _, result := range []string{"match", "mismatch", "missing_shadow", "missing_primary"} {
+		shadowComparisons.WithLabelValues(result)
+	}
+	storeMigrationMode.Store(cfg.StoreMigrationMode)
+	shadowLatencyMs.Store(int64(cfg.StoreShadowLatencyMs))
+	shadowWriteErrorRate.Store(int64(cfg.StoreShadowWriteErrorRate))
+	shadowDriftRate.Store(int64(cfg.StoreShadowDriftRate))
+}
+
+// dualWrite copies a newly stored order to the shadow outside off mode; o
+// must be a copy the primary no longer shares.
+func dualWrite(o storedOrder) {
+	if storeMigrationMode.Load().(string) == "off" {
+		return
+	}
+	start := time.Now()
+	defer func() {
+		storeBackendDuration.WithLabelValues("shadow", "write").Observe(time.Since(start).Seconds())
+	}()
+	time.Sleep(time.Duration(shadowLatencyMs.Load()) * time.Millisecond)
+	if rate := shadowWriteErrorRate.Load(); rate > 0 && rand.Int63n(100) < rate {
+		shadowWrites.WithLabelValues("error").Inc()
+		slog.Debug("Shadow order write failed", "order_id", o.ID)
+		return
+	}
+	if rate := shadowDriftRate.Load(); rate > 0 && rand.Int63n(100) < rate {
+		driftOrder(&o)
+	}
+	shadowStore.put(o)
+	// The ring may have evicted o while the write was in flight, and its
+	// forget ran before this put.
+	orderStoreMu.Lock()
+	if _, ok := orderStore[o.ID]; !ok {
+		shadowStore.forget(o.ID)
+	}
+	orderStoreMu.Unlock()
+	shadowWrites.WithLabelValues("ok").Inc()
+}
+
+// driftOrder damages o the way a bad schema conversion would: totals
+// truncated to whole units, or the last line dropped.
+func driftOrder(o *storedOrder) {
+	if len(o.Lines) > 1 && rand.Intn(2) == 0 {
+		o.Lines = o.Lines[:len(o.Lines)-1]
+		return
+	}
+	o.Total = math.Trunc(o.Total)
+}
+
+// diffOrders returns the fields in which a and b differ.
+func diffOrders(a, b storedOrder) []string {
+	var fields []string
+	if math.Abs(a.Total-b.Total) > 0.005 {
+		fields = append(fields, "total")
+	}
+	if !slices.Equal(a.Lines, b.Lines) {
+		fields = append(fields, "lines")
+	}
+	if !a.PlacedAt.Equal(b.PlacedAt) {
+		fields = append(fields, "placed_at")
+	}
+	return fields
+}
+
+// readOrder reads id from the backend the mode serves from and, in
+// shadow_read and cutover, compares it with the other one.
+func readOrder(ctx context.Context, id int64) (storedOrder, string, bool) {
+	_, span := tracer.Start(ctx, "order_store.read")
+	defer span.End()
+	mode := storeMigrationMode.Load().(string)
+	span.SetAttributes(attribute.String("app.store.migration_mode", mode), attribute.Int64("app.order.id", id))
+
+	var serving, other orderBackend = primaryBackend{}, shadowStore
+	if mode == "cutover" {
+		serving, other = shadowStore, primaryBackend{}
+	}
+	timedGet := func(b orderBackend) (storedOrder, bool) {
+		start := time.Now()
+		o, ok := b.get(id)
+		storeBackendDuration.WithLabelValues(b.name(), "read").Observe(time.Since(start).Seconds())
+		return o, ok
+	}
+	o, found := timedGet(serving)
+	span.SetAttributes(attribute.String("app.store.backend", serving.name()))
+	if mode != "shadow_read" && mode != "cutover" {
+		return o, serving.name(), found
+	}
+
+	compared, comparedFound := timedGet(other)
+	primary, shadow, primaryFound, shadowFound := o, compared, found, comparedFound
+	if mode == "cutover" {
+		primary, shadow, primaryFound, shadowFound = compared, o, comparedFound, found
+	}
+	result := "match"
+	switch {
+	case !primaryFound && !shadowFound:
+		return o, serving.name(), false
+	case !shadowFound:
+		result = "missing_shadow"
+	case !primaryFound:
+		result = "missing_primary"
+	default:
+		if fields := diffOrders(primary, shadow); len(fields) > 0 {
+			result = "mismatch"
+			for _, field := range fields {
+				shadowMismatchFields.WithLabelValues(field).Inc()
+			}
+			slog.WarnContext(ctx, "Shadow order read mismatch", "order_id", id, "fields", fields)
+		}
+	}
+	shadowComparisons.WithLabelValues(result).Inc()
+	span.SetAttributes(attribute.String("app.store.comparison", result))
+	return o, serving.name(), found
+}
+
+// backfillShadow copies every primary order that is missing or different
+// in the shadow, returning how many it copied.
+func backfillShadow() int {
+	orderStoreMu.Lock()
+	primary := make([]storedOrder, 0, len(orderStore))
+	for _, o := range orderStore {
+		copied := *o
+		copied.Lines = slices.Clone(o.Lines)
+		primary = append(primary, copied)
+	}
+	orderStoreMu.Unlock()
+	copied := 0
+	shadowStore.mu.Lock()
+	defer shadowStore.mu.Unlock()
+	for _, o := range primary {
+		if s, ok := shadowStore.orders[o.ID]; ok && len(diffOrders(o, s)) == 0 {
+			continue
+		}
+		shadowStore.orders[o.ID] = o
+		copied++
+	}
+	return copied
+}
+
+// recentOrderIDs returns up to n of the most recently stored order IDs,
+// newest first.
+func recentOrderIDs(n int) []int64 {
+	orderStoreMu.Lock()
+	defer orderStoreMu.Unlock()
+	ids := []int64{}
+	for i := 1; i <= len(orderStoreRing) && len(ids) < n; i++ {
+		id := orderStoreRing[(orderStoreNext-i+len(orderStoreRing))%len(orderStoreRing)]
+		if id == 0 {
+			break
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func handleOrders(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := tracer.Start(r.Context(), "handleOrders")
+	defer span.End()
+
+	orders := []storedOrder{}
+	for _, id := range recentOrderIDs(10) {
+		if o, _, ok := readOrder(ctx, id); ok {
+			orders = append(orders, o)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"orders": orders})
+
+	httpRequestsTotal.WithLabelValues("/orders", strconv.Itoa(http.StatusOK)).Inc()
+	httpRequestDuration.WithLabelValues("/orders").Observe(time.Since(start).Seconds())
+}
+
+func handleOrder(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := tracer.Start(r.Context(), "handleOrder")
+	defer span.End()
+
+	status := http.StatusOK
+	defer func() {
+		httpRequestsTotal.WithLabelValues("/orders/{id}", strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues("/orders/{id}").Observe(time.Since(start).Seconds())
+	}()
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		status = http.StatusBadRequest
+		writeProblem(w, r, "order id must be an integer", status)
+		return
+	}
+	o, backend, ok := readOrder(ctx, id)
+	w.Header().Set("Store-Backend", backend)
+	if !ok {
+		status = http.StatusNotFound
+		writeProblem(w, r, "order not found", status)
+		return
+	}
+	writeJSON(w, status, o)
+}
+
+// handleAdminStoreMigration reports or sets the migration:
+// {"mode": "shadow_read", "write_error_rate": 2, "drift_rate": 1},
+// {"backfill": true}.
+func handleAdminStoreMigration(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Mode           *string `json:"mode"`
+			LatencyMs      *int64  `json:"latency_ms"`
+			WriteErrorRate *int64  `json:"write_error_rate"`
+			DriftRate      *int64  `json:"drift_rate"`
+			Backfill       bool    `json:"backfill"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Mode != nil {
+			if !slices.Contains(storeMigrationModes, *req.Mode) {
+				writeProblem(w, r, fmt.Sprintf("mode must be one of %v", storeMigrationModes), http.StatusBadRequest)
+				return
+			}
+			storeMigrationMode.Store(*req.Mode)
+		}
+		if req.LatencyMs != nil && *req.LatencyMs >= 0 {
+			shadowLatencyMs.Store(*req.LatencyMs)
+		}
+		if req.WriteErrorRate != nil && *req.WriteErrorRate >= 0 && *req.WriteErrorRate <= 100 {
+			shadowWriteErrorRate.Store(*req.WriteErrorRate)
+		}
+		if req.DriftRate != nil && *req.DriftRate >= 0 && *req.DriftRate <= 100 {
+			shadowDriftRate.Store(*req.DriftRate)
+		}
+		if req.Backfill {
+			slog.Warn("Admin: shadow order store backfilled", "copied", backfillShadow())
+		}
+		slog.Warn("Admin: storage migration updated",
+			"mode", storeMigrationMode.Load(),
+			"write_error_rate", shadowWriteErrorRate.Load(),
+			"drift_rate", shadowDriftRate.Load(),
+		)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	orderStoreMu.Lock()
+	primary := len(orderStore)
+	orderStoreMu.Unlock()
+	shadowStore.mu.Lock()
+	shadow := len(shadowStore.orders)
+	shadowStore.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"mode":             storeMigrationMode.Load(),
+		"latency_ms":       shadowLatencyMs.Load(),
+		"write_error_rate": shadowWriteErrorRate.Load(),
+		"drift_rate":       shadowDriftRate.Load(),
+		"primary_records":  primary,
+		"shadow_records":   shadow,
+	})
+}
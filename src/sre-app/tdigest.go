@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// tdigest is a merging t-digest (Dunning & Ertl): a quantile sketch that
+// keeps a few hundred weighted centroids, small near the tails and large in
+// the middle, so p99 and p999 stay accurate in bounded memory and digests
+// from different windows can be merged. Not safe for concurrent use.
+type tdigest struct {
+	compression float64
+	centroids   []centroid
+	buffer      []centroid
+	count       float64
+	min, max    float64
+}
+
+type centroid struct {
+	mean, weight float64
+}
+
+func newTDigest(compression float64) *tdigest {
+	return &tdigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (t *tdigest) add(x float64) {
+	t.addCentroid(centroid{mean: x, weight: 1})
+}
+
+func (t *tdigest) addCentroid(c centroid) {
+	t.buffer = append(t.buffer, c)
+	t.count += c.weight
+	t.min = math.Min(t.min, c.mean)
+	t.max = math.Max(t.max, c.mean)
+	if len(t.buffer) >= int(5*t.compression) {
+		t.compress()
+	}
+}
+
+// merge folds o into t; o is left unchanged.
+func (t *tdigest) merge(o *tdigest) {
+	for _, c := range o.centroids {
+		t.addCentroid(c)
+	}
+	for _, c := range o.buffer {
+		t.addCentroid(c)
+	}
+	t.min = math.Min(t.min, o.min)
+	t.max = math.Max(t.max, o.max)
+}
+
+// compress merges buffered points into the centroids, letting a centroid
+// grow to at most 4·n·q·(1-q)/compression points.
+func (t *tdigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+	all := append(t.centroids, t.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+	merged := make([]centroid, 0, len(t.centroids)+1)
+	merged = append(merged, all[0])
+	before := 0.0
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		q := (before + (last.weight+c.weight)/2) / t.count
+		if last.weight+c.weight <= 4*t.count*q*(1-q)/t.compression {
+			last.mean += (c.mean - last.mean) * c.weight / (last.weight + c.weight)
+			last.weight += c.weight
+			continue
+		}
+		before += last.weight
+		merged = append(merged, c)
+	}
+	t.centroids = merged
+	t.buffer = t.buffer[:0]
+}
+
+// quantile estimates the q-quantile, interpolating between centroid
+// centres and out to the exact min and max; NaN when empty.
+func (t *tdigest) quantile(q float64) float64 {
+	t.compress()
+	if len(t.centroids) == 0 {
+		return math.NaN()
+	}
+	target := q * t.count
+	prevCentre, prevMean := 0.0, t.min
+	cumulative := 0.0
+	for _, c := range t.centroids {
+		centre := cumulative + c.weight/2
+		if target < centre {
+			if centre == prevCentre {
+				return c.mean
+			}
+			return prevMean + (c.mean-prevMean)*(target-prevCentre)/(centre-prevCentre)
+		}
+		cumulative += c.weight
+		prevCentre, prevMean = centre, c.mean
+	}
+	if t.count == prevCentre {
+		return t.max
+	}
+	return prevMean + (t.max-prevMean)*(target-prevCentre)/(t.count-prevCentre)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outbound TLS chaos. With OUTBOUND_TLS_CHAOS (or /admin/chaos/tls) set,
+// downstream calls go over HTTPS to an in-process endpoint whose
+// certificate is broken in one of the usual ways:
+//
+//	expired            signed by a CA the client trusts, but expired
+//	                   yesterday: the forgotten renewal
+//	hostname_mismatch  valid, but for another name: the wrong SAN after a
+//	                   migration
+//	unknown_ca         valid for the name, but the client trusts a
+//	                   different CA: a rotated root or wrong CA bundle
+//
+// Failed handshakes are counted in outbound_tls_errors_total by reason and
+// downstream_requests_total tags them status="tls_error", so certificate
+// problems stand apart from generic connection errors and 5xx.
+var (
+	outboundTLSChaos atomic.Value // string: off, expired, hostname_mismatch, unknown_ca
+
+	tlsChaosOnce      sync.Once
+	tlsChaosTransport *http.Transport
+
+	outboundTLSErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outbound_tls_errors_total",
+			Help: "Outbound TLS handshakes that failed, by target and reason (expired, hostname_mismatch, unknown_authority, handshake, other)",
+		},
+		[]string{"target", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(outboundTLSErrors)
+	outboundTLSChaos.Store(cfg.OutboundTLSChaos)
+}
+
+// tlsChaosRoundTripper sends requests to the broken endpoint while the
+// chaos is on.
+type tlsChaosRoundTripper struct {
+	base http.RoundTripper
+}
+
+func (t tlsChaosRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if outboundTLSChaos.Load().(string) == "off" {
+		return t.base.RoundTrip(req)
+	}
+	tlsChaosOnce.Do(startTLSChaosEndpoint)
+	if tlsChaosTransport == nil {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "https"
+	noteChaos(req.Context(), "tls: %s certificate", outboundTLSChaos.Load())
+	return tlsChaosTransport.RoundTrip(req)
+}
+
+type chaosCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newChaosCA(name string) (*chaosCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return &chaosCA{cert, key}, err
+}
+
+// issue signs a serving certificate for host valid from notBefore to
+// notAfter.
+func (ca *chaosCA) issue(host string, notBefore, notAfter time.Time) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.DNSNames, tmpl.IPAddresses = nil, []net.IP{ip}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}, nil
+}
+
+// startTLSChaosEndpoint serves HTTPS on loopback with a certificate made
+// for the current mode and the name the client asked for.
+func startTLSChaosEndpoint() {
+	trusted, err := newChaosCA("sre-app chaos CA")
+	if err == nil {
+		var rogue *chaosCA
+		if rogue, err = newChaosCA("sre-app rogue CA"); err == nil {
+			err = serveTLSChaos(trusted, rogue)
+		}
+	}
+	if err != nil {
+		slog.Error("TLS chaos endpoint failed to start", "error", err)
+	}
+}
+
+func serveTLSChaos(trusted, rogue *chaosCA) error {
+	getCert := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		host, now := hello.ServerName, time.Now()
+		if host == "" {
+			host = "localhost"
+		}
+		switch outboundTLSChaos.Load().(string) {
+		case "expired":
+			return trusted.issue(host, now.Add(-90*24*time.Hour), now.Add(-24*time.Hour))
+		case "hostname_mismatch":
+			return trusted.issue("wrong-host.invalid", now.Add(-time.Hour), now.Add(24*time.Hour))
+		case "unknown_ca":
+			return rogue.issue(host, now.Add(-time.Hour), now.Add(24*time.Hour))
+		}
+		return trusted.issue(host, now.Add(-time.Hour), now.Add(24*time.Hour))
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: getCert})
+	if err != nil {
+		return err
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(trusted.cert)
+	addr := ln.Addr().String()
+	var d net.Dialer
+	tlsChaosTransport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig:     &tls.Config{RootCAs: roots},
+		TLSHandshakeTimeout: 5 * time.Second,
+		DisableKeepAlives:   true, // every call handshakes against the current mode
+	}
+	return nil
+}
+
+// tlsErrorReason classifies a TLS failure, or returns "" for other errors.
+func tlsErrorReason(err error) string {
+	var (
+		invalid   x509.CertificateInvalidError
+		hostname  x509.HostnameError
+		authority x509.UnknownAuthorityError
+		verify    *tls.CertificateVerificationError
+		record    tls.RecordHeaderError
+		alert     tls.AlertError
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return "expired"
+	case errors.As(err, &hostname):
+		return "hostname_mismatch"
+	case errors.As(err, &authority):
+		return "unknown_authority"
+	case errors.As(err, &record), errors.As(err, &alert):
+		return "handshake"
+	case errors.As(err, &verify), errors.As(err, &invalid):
+		return "other"
+	}
+	return ""
+}
+
+func handleAdminTLSChaos(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Mode *string `json:"mode"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Mode != nil {
+			switch *req.Mode {
+			case "off", "expired", "hostname_mismatch", "unknown_ca":
+				outboundTLSChaos.Store(*req.Mode)
+			default:
+				writeProblem(w, r, "mode must be off, expired, hostname_mismatch or unknown_ca", http.StatusBadRequest)
+				return
+			}
+			slog.Warn("Admin: outbound TLS chaos updated", "mode", *req.Mode)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"mode": outboundTLSChaos.Load()})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Serving TLS. With TLS_CERT_FILE and TLS_KEY_FILE (PEM, e.g. a
+// cert-manager Secret) the main listener serves HTTPS; TLS_CLIENT_CA_FILE
+// adds client certificate verification against that bundle, required or
+// only checked when offered per TLS_CLIENT_AUTH (require, verify_if_given).
+// The files are re-read every SECRETS_RELOAD_INTERVAL_S so a renewed
+// certificate is picked up without a restart; a bad file keeps the last
+// good ones.
+//
+// tls_certificate_expiry_timestamp_seconds exports the NotAfter of the
+// serving certificate chain and of every client CA, so the app can alert on
+// its own certificates:
+//
+//	tls_certificate_expiry_timestamp_seconds - time() < 14 * 86400
+type servingTLS struct {
+	cert      tls.Certificate
+	chain     []*x509.Certificate
+	clientCAs []*x509.Certificate
+	pool      *x509.CertPool
+	raw       []byte // the files as read, to spot changes
+}
+
+var (
+	servingCerts atomic.Pointer[servingTLS]
+
+	tlsCertExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tls_certificate_expiry_timestamp_seconds",
+			Help: "NotAfter of the serving certificate chain (source=serving) and the client CAs (source=client_ca), as Unix time",
+		},
+		[]string{"source", "subject", "serial"},
+	)
+	tlsCertReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tls_certificate_reloads_total",
+			Help: "Serving certificate reloads by outcome (changed, unchanged, failed)",
+		},
+		[]string{"outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tlsCertExpiry, tlsCertReloads)
+}
+
+// loadServingTLS reads the configured files, or returns nil without
+// TLS_CERT_FILE.
+func loadServingTLS() (*servingTLS, error) {
+	certFile, keyFile, caFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &servingTLS{raw: append(append([]byte{}, certPEM...), keyPEM...)}
+	if s.cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	for _, der := range s.cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		s.chain = append(s.chain, c)
+	}
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		s.raw = append(s.raw, caPEM...)
+		s.pool = x509.NewCertPool()
+		for block, rest := pem.Decode(caPEM); block != nil; block, rest = pem.Decode(rest) {
+			c, err := x509.ParseCertificate(block.Bytes)
+			if block.Type != "CERTIFICATE" || err != nil {
+				return nil, fmt.Errorf("%s: not a PEM certificate bundle", caFile)
+			}
+			s.clientCAs = append(s.clientCAs, c)
+			s.pool.AddCert(c)
+		}
+		if len(s.clientCAs) == 0 {
+			return nil, fmt.Errorf("%s: no certificates", caFile)
+		}
+	}
+	return s, nil
+}
+
+func (s *servingTLS) recordExpiry() {
+	tlsCertExpiry.Reset()
+	for _, c := range s.chain {
+		tlsCertExpiry.WithLabelValues("serving", c.Subject.String(), c.SerialNumber.Text(16)).Set(float64(c.NotAfter.Unix()))
+	}
+	for _, c := range s.clientCAs {
+		tlsCertExpiry.WithLabelValues("client_ca", c.Subject.String(), c.SerialNumber.Text(16)).Set(float64(c.NotAfter.Unix()))
+	}
+}
+
+// withTLS wraps the main listener in TLS when it is configured.
+func withTLS(ln net.Listener) net.Listener {
+	// A failing load is reported by loadConfig.
+	s, _ := loadServingTLS()
+	if s == nil {
+		return ln
+	}
+	servingCerts.Store(s)
+	s.recordExpiry()
+	go reloadServingTLS()
+	slog.Info("Serving TLS", "subject", s.chain[0].Subject.String(), "not_after", s.chain[0].NotAfter, "client_cas", len(s.clientCAs))
+	return tls.NewListener(ln, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s := servingCerts.Load()
+			c := &tls.Config{Certificates: []tls.Certificate{s.cert}}
+			if s.pool != nil {
+				c.ClientCAs, c.ClientAuth = s.pool, tls.RequireAndVerifyClientCert
+				if cfg.TLSClientAuth == "verify_if_given" {
+					c.ClientAuth = tls.VerifyClientCertIfGiven
+				}
+			}
+			return c, nil
+		},
+	})
+}
+
+func reloadServingTLS() {
+	for range time.Tick(time.Duration(cfg.SecretsReloadIntervalS) * time.Second) {
+		s, err := loadServingTLS()
+		switch {
+		case err != nil || s == nil:
+			tlsCertReloads.WithLabelValues("failed").Inc()
+			slog.Error("TLS certificate reload failed, keeping last certificates", "error", err)
+		case bytes.Equal(s.raw, servingCerts.Load().raw):
+			tlsCertReloads.WithLabelValues("unchanged").Inc()
+		default:
+			servingCerts.Store(s)
+			s.recordExpiry()
+			tlsCertReloads.WithLabelValues("changed").Inc()
+			slog.Warn("TLS certificates reloaded", "subject", s.chain[0].Subject.String(), "not_after", s.chain[0].NotAfter)
+		}
+	}
+}
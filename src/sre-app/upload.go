@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Streaming uploads. POST /upload takes multipart/form-data and streams each
+// part through a SHA-256 without buffering it, rejecting bodies over
+// UPLOAD_MAX_BYTES (default 10 MiB) with 413. UPLOAD_FAILURE_RATE (percent)
+// aborts that share of uploads partway through the body, as a crashed
+// storage backend would.
+var (
+	uploadMaxBytes    int64 = 10 << 20
+	uploadFailureRate atomic.Int64
+)
+
+var errUploadInterrupted = errors.New("upload interrupted")
+
+var (
+	uploadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uploads_total",
+			Help: "Uploads by outcome (ok, too_large, bad_request, interrupted)",
+		},
+		[]string{"outcome"},
+	)
+	uploadBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "upload_bytes_total",
+		Help: "Bytes received by /upload, including aborted uploads",
+	})
+	uploadThroughput = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "upload_throughput_bytes_per_second",
+		Help:    "Per-upload receive throughput",
+		Buckets: prometheus.ExponentialBuckets(64<<10, 4, 8),
+	})
+	uploadSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "upload_size_bytes",
+		Help:    "Size of completed uploads",
+		Buckets: prometheus.ExponentialBuckets(1<<10, 4, 10),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(uploadsTotal, uploadBytesTotal, uploadThroughput, uploadSize)
+	uploadMaxBytes = cfg.UploadMaxBytes
+	uploadFailureRate.Store(int64(cfg.UploadFailureRate))
+}
+
+type uploadedPart struct {
+	Field    string `json:"field"`
+	Filename string `json:"filename,omitempty"`
+	Bytes    int64  `json:"bytes"`
+	SHA256   string `json:"sha256"`
+}
+
+// failingReader returns errUploadInterrupted once budget bytes have been read.
+type failingReader struct {
+	r      io.Reader
+	budget int64
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.budget <= 0 {
+		return 0, errUploadInterrupted
+	}
+	if int64(len(p)) > f.budget {
+		p = p[:f.budget]
+	}
+	n, err := f.r.Read(p)
+	f.budget -= int64(n)
+	return n, err
+}
+
+// countingReader tallies bytes as they stream past.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	_, span := tracer.Start(r.Context(), "handleUpload")
+	defer span.End()
+
+	status := http.StatusOK
+	defer func() {
+		httpRequestsTotal.WithLabelValues("/upload", strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues("/upload").Observe(time.Since(start).Seconds())
+	}()
+
+	if r.Method != http.MethodPost {
+		status = http.StatusMethodNotAllowed
+		w.Header().Set("Allow", "POST")
+		writeProblem(w, r, "method not allowed", status)
+		return
+	}
+	if r.ContentLength > uploadMaxBytes {
+		status = http.StatusRequestEntityTooLarge
+		uploadsTotal.WithLabelValues("too_large").Inc()
+		writeProblem(w, r, fmt.Sprintf("upload exceeds %d bytes", uploadMaxBytes), status)
+		return
+	}
+
+	counter := &countingReader{r: http.MaxBytesReader(w, r.Body, uploadMaxBytes)}
+	var body io.Reader = counter
+	if rate := uploadFailureRate.Load(); rate > 0 && rand.Int63n(100) < rate {
+		limit := int64(64 << 10)
+		if r.ContentLength > 0 {
+			limit = r.ContentLength
+		}
+		body = &failingReader{r: counter, budget: rand.Int63n(limit)}
+		span.SetAttributes(attrFaultInjected.Bool(true))
+	}
+	r.Body = io.NopCloser(body)
+
+	parts, err := streamParts(r)
+	uploadBytesTotal.Add(float64(counter.n))
+	span.SetAttributes(attribute.Int64("app.upload.bytes", counter.n), attribute.Int("app.upload.parts", len(parts)))
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		status = http.StatusRequestEntityTooLarge
+		uploadsTotal.WithLabelValues("too_large").Inc()
+		writeProblem(w, r, fmt.Sprintf("upload exceeds %d bytes", uploadMaxBytes), status)
+		return
+	case errors.Is(err, errUploadInterrupted):
+		status = http.StatusInternalServerError
+		uploadsTotal.WithLabelValues("interrupted").Inc()
+		markFault(r.Context(), err)
+		slog.WarnContext(r.Context(), "Upload interrupted by chaos", "bytes_received", counter.n)
+		// The rest of the body is never read, so the connection cannot be reused.
+		w.Header().Set("Connection", "close")
+		writeProblem(w, r, err.Error(), status)
+		return
+	case err != nil:
+		status = http.StatusBadRequest
+		uploadsTotal.WithLabelValues("bad_request").Inc()
+		writeProblem(w, r, "invalid multipart body: "+err.Error(), status)
+		return
+	}
+
+	elapsed := time.Since(start).Seconds()
+	if elapsed > 0 {
+		uploadThroughput.Observe(float64(counter.n) / elapsed)
+	}
+	uploadSize.Observe(float64(counter.n))
+	uploadsTotal.WithLabelValues("ok").Inc()
+	writeJSON(w, status, map[string]any{"bytes": counter.n, "parts": parts})
+}
+
+// streamParts hashes every part as it arrives; nothing is held in memory.
+func streamParts(r *http.Request) ([]uploadedPart, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	var parts []uploadedPart
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return parts, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, part)
+		part.Close()
+		if err != nil {
+			return parts, err
+		}
+		parts = append(parts, uploadedPart{
+			Field:    part.FormName(),
+			Filename: part.FileName(),
+			Bytes:    n,
+			SHA256:   hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+}
+
+// handleAdminUpload reports or sets upload chaos: {"failure_rate": 30}.
+func handleAdminUpload(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			FailureRate *int64 `json:"failure_rate"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.FailureRate != nil {
+			uploadFailureRate.Store(*req.FailureRate)
+		}
+		slog.Warn("Admin: upload chaos updated", "failure_rate", uploadFailureRate.Load())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"failure_rate": uploadFailureRate.Load(),
+		"max_bytes":    uploadMaxBytes,
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stuck handlers and the watchdog that finds them. STUCK_HANDLER_RATE
+// percent of requests (default 0; /admin/chaos/stuck at runtime) block
+// forever on a channel before their handler runs, ignoring cancellation,
+// as a handler waiting on a lock nobody will release does: no error, no
+// log line, the request just never ends, and the client's timeout is the
+// only trace of it. {"release": true} lets them all go.
+//
+// Every handler is registered with the watchdog while it runs. Every
+// WATCHDOG_INTERVAL_S (default 5) it looks for handlers running longer than
+// WATCHDOG_DEADLINE_S (default 30, 0 disables), counts them in
+// watchdog_stuck_handlers and logs, once per handler, an error with that
+// goroutine's stack, which is where a deadlock gets diagnosed.
+type watchedHandler struct {
+	route     string
+	start     time.Time
+	goroutine string // "goroutine 123 "
+	reported  bool
+}
+
+var (
+	stuckHandlerRate atomic.Int64
+	stuckMu          sync.Mutex
+	stuckRelease     = make(chan struct{})
+
+	watchdogMu       sync.Mutex
+	watchdogHandlers = map[*watchedHandler]struct{}{}
+
+	stuckInjected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "stuck_handlers_injected_total",
+		Help: "Requests stuck on purpose by STUCK_HANDLER_RATE",
+	})
+	watchdogStuck = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "watchdog_stuck_handlers",
+			Help: "Handlers running past WATCHDOG_DEADLINE_S at the last watchdog pass, by route",
+		},
+		[]string{"route"},
+	)
+	watchdogDetections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "watchdog_detections_total",
+			Help: "Handlers the watchdog found past their deadline, counted once each, by route",
+		},
+		[]string{"route"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(stuckInjected, watchdogStuck, watchdogDetections)
+	stuckHandlerRate.Store(int64(cfg.StuckHandlerRate))
+	if cfg.WatchdogDeadlineS > 0 {
+		go runWatchdog()
+	}
+}
+
+// watchHandler registers the calling goroutine's handler; call the result
+// when it returns.
+func watchHandler(route string) func() {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	h := &watchedHandler{route: route, start: time.Now()}
+	if i := bytes.IndexByte(buf, '['); i > 0 {
+		h.goroutine = string(buf[:i])
+	}
+	watchdogMu.Lock()
+	watchdogHandlers[h] = struct{}{}
+	watchdogMu.Unlock()
+	return func() {
+		watchdogMu.Lock()
+		delete(watchdogHandlers, h)
+		watchdogMu.Unlock()
+	}
+}
+
+// maybeGetStuck blocks until released for STUCK_HANDLER_RATE percent of
+// requests.
+func maybeGetStuck(ctx context.Context) {
+	if rate := stuckHandlerRate.Load(); rate == 0 || rand.Int63n(100) >= rate {
+		return
+	}
+	stuckInjected.Inc()
+	noteChaos(ctx, "stuck: handler blocked until released")
+	stuckMu.Lock()
+	release := stuckRelease
+	stuckMu.Unlock()
+	<-release
+}
+
+// releaseStuckHandlers unblocks every stuck request.
+func releaseStuckHandlers() {
+	stuckMu.Lock()
+	close(stuckRelease)
+	stuckRelease = make(chan struct{})
+	stuckMu.Unlock()
+}
+
+// goroutineStack returns the stack of the goroutine with header prefix
+// from a full dump.
+func goroutineStack(dump []byte, header string) []byte {
+	i := bytes.Index(dump, []byte(header+"["))
+	if header == "" || i < 0 {
+		return nil
+	}
+	stack := dump[i:]
+	if end := bytes.Index(stack, []byte("\n\n")); end >= 0 {
+		stack = stack[:end]
+	}
+	return stack
+}
+
+func runWatchdog() {
+	deadline := time.Duration(cfg.WatchdogDeadlineS) * time.Second
+	for range time.Tick(time.Duration(cfg.WatchdogIntervalS) * time.Second) {
+		stuck := map[string]int{}
+		var fresh []*watchedHandler
+		watchdogMu.Lock()
+		for h := range watchdogHandlers {
+			if time.Since(h.start) < deadline {
+				continue
+			}
+			stuck[h.route]++
+			if !h.reported {
+				h.reported = true
+				fresh = append(fresh, h)
+			}
+		}
+		watchdogMu.Unlock()
+
+		watchdogStuck.Reset()
+		for route, n := range stuck {
+			watchdogStuck.WithLabelValues(route).Set(float64(n))
+		}
+		if len(fresh) == 0 {
+			continue
+		}
+		dump := make([]byte, 4<<20)
+		dump = dump[:runtime.Stack(dump, true)]
+		for _, h := range fresh {
+			watchdogDetections.WithLabelValues(h.route).Inc()
+			slog.Error("Watchdog: handler past its deadline",
+				"route", h.route,
+				"running_s", int(time.Since(h.start).Seconds()),
+				"deadline_s", cfg.WatchdogDeadlineS,
+				"stack", string(goroutineStack(dump, h.goroutine)),
+			)
+		}
+	}
+}
+
+// handleAdminStuck reports or sets stuck-handler chaos:
+// {"rate": 5}, {"rate": 0, "release": true}.
+func handleAdminStuck(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Rate    *int64 `json:"rate"`
+			Release bool   `json:"release"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Rate != nil && *req.Rate >= 0 && *req.Rate <= 100 {
+			stuckHandlerRate.Store(*req.Rate)
+		}
+		if req.Release {
+			releaseStuckHandlers()
+		}
+		slog.Warn("Admin: stuck handler chaos updated", "rate", stuckHandlerRate.Load(), "released", req.Release)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	watchdogMu.Lock()
+	running := len(watchdogHandlers)
+	watchdogMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"rate":                stuckHandlerRate.Load(),
+		"handlers_running":    running,
+		"watchdog_deadline_s": cfg.WatchdogDeadlineS,
+	})
+}
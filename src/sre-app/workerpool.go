@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// workerPool runs tasks on a resizable set of goroutines fed by a bounded
+// queue. submit never blocks; callers turn errPoolQueueFull into
+// backpressure. Pools register themselves so /admin/workers can resize them
+// mid-demo and the USE metrics (utilization, queue depth and wait,
+// rejections) move accordingly.
+var errPoolQueueFull = errors.New("worker pool queue full")
+
+type poolTask struct {
+	fn       func()
+	enqueued time.Time
+}
+
+type workerPool struct {
+	name  string
+	tasks chan poolTask
+	quit  chan struct{}
+
+	mu   sync.Mutex
+	size int
+	busy int
+}
+
+var (
+	workerPoolsMu sync.Mutex
+	workerPools   = map[string]*workerPool{}
+)
+
+var (
+	workerPoolWorkers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "worker_pool_workers",
+			Help: "Worker goroutines by pool and state (busy, idle)",
+		},
+		[]string{"pool", "state"},
+	)
+	workerPoolUtilization = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "worker_pool_utilization_ratio",
+			Help: "Busy workers divided by pool size",
+		},
+		[]string{"pool"},
+	)
+	workerPoolQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "worker_pool_queue_depth",
+			Help: "Tasks waiting for a worker",
+		},
+		[]string{"pool"},
+	)
+	workerPoolQueueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "worker_pool_queue_wait_seconds",
+			Help:    "Time a task waited in the queue before a worker picked it up",
+			Buckets: []float64{.001, .01, .05, .1, .5, 1, 5, 10, 30, 60},
+		},
+		[]string{"pool"},
+	)
+	workerPoolRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "worker_pool_rejected_total",
+			Help: "Tasks rejected because the queue was full",
+		},
+		[]string{"pool"},
+	)
+	workerPoolTaskDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "worker_pool_task_duration_seconds",
+			Help:    "Time a worker spent on a task",
+			Buckets: []float64{.01, .05, .1, .5, 1, 2, 5, 10, 30, 60},
+		},
+		[]string{"pool"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(workerPoolWorkers, workerPoolUtilization, workerPoolQueueDepth,
+		workerPoolQueueWait, workerPoolRejected, workerPoolTaskDuration)
+}
+
+func newWorkerPool(name string, workers, queueSize int) *workerPool {
+	p := &workerPool{name: name, tasks: make(chan poolTask, queueSize), quit: make(chan struct{}, 1024)}
+	workerPoolQueueDepth.WithLabelValues(name).Set(0)
+	workerPoolRejected.WithLabelValues(name)
+	p.resize(workers)
+
+	workerPoolsMu.Lock()
+	workerPools[name] = p
+	workerPoolsMu.Unlock()
+	return p
+}
+
+func (p *workerPool) submit(task func()) error {
+	select {
+	case p.tasks <- poolTask{fn: task, enqueued: time.Now()}:
+		workerPoolQueueDepth.WithLabelValues(p.name).Set(float64(len(p.tasks)))
+		return nil
+	default:
+		workerPoolRejected.WithLabelValues(p.name).Inc()
+		return errPoolQueueFull
+	}
+}
+
+// resize grows the pool at once; shrinking retires workers as they finish
+// their current task.
+func (p *workerPool) resize(workers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ; p.size < workers; p.size++ {
+		select {
+		case <-p.quit:
+			// Cancel a retirement that no worker has picked up yet.
+		default:
+			go p.work()
+		}
+	}
+	for ; p.size > workers; p.size-- {
+		p.quit <- struct{}{}
+	}
+	p.updateGauges()
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case <-p.quit:
+			return
+		case task := <-p.tasks:
+			workerPoolQueueDepth.WithLabelValues(p.name).Set(float64(len(p.tasks)))
+			workerPoolQueueWait.WithLabelValues(p.name).Observe(time.Since(task.enqueued).Seconds())
+			p.setBusy(1)
+			start := time.Now()
+			task.fn()
+			workerPoolTaskDuration.WithLabelValues(p.name).Observe(time.Since(start).Seconds())
+			p.setBusy(-1)
+		}
+	}
+}
+
+func (p *workerPool) setBusy(delta int) {
+	p.mu.Lock()
+	p.busy += delta
+	p.updateGauges()
+	p.mu.Unlock()
+}
+
+// updateGauges requires p.mu. While shrinking, busy can briefly exceed size.
+func (p *workerPool) updateGauges() {
+	idle := max(p.size-p.busy, 0)
+	workerPoolWorkers.WithLabelValues(p.name, "busy").Set(float64(p.busy))
+	workerPoolWorkers.WithLabelValues(p.name, "idle").Set(float64(idle))
+	utilization := 1.0
+	if p.size > 0 {
+		utilization = min(float64(p.busy)/float64(p.size), 1)
+	}
+	workerPoolUtilization.WithLabelValues(p.name).Set(utilization)
+}
+
+type workerPoolStatus struct {
+	Name        string  `json:"name"`
+	Workers     int     `json:"workers"`
+	Busy        int     `json:"busy"`
+	Queued      int     `json:"queued"`
+	QueueSize   int     `json:"queue_size"`
+	Utilization float64 `json:"utilization"`
+}
+
+func (p *workerPool) status() workerPoolStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := workerPoolStatus{Name: p.name, Workers: p.size, Busy: p.busy, Queued: len(p.tasks), QueueSize: cap(p.tasks), Utilization: 1}
+	if p.size > 0 {
+		s.Utilization = min(float64(p.busy)/float64(p.size), 1)
+	}
+	return s
+}
+
+// handleAdminWorkers lists pools or resizes one: {"pool": "jobs", "workers": 1}.
+func handleAdminWorkers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := struct {
+			Pool    string `json:"pool"`
+			Workers *int   `json:"workers"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		workerPoolsMu.Lock()
+		p, ok := workerPools[req.Pool]
+		workerPoolsMu.Unlock()
+		if !ok {
+			writeProblem(w, r, "unknown pool "+req.Pool, http.StatusBadRequest)
+			return
+		}
+		if req.Workers == nil || *req.Workers < 0 || *req.Workers > 1024 {
+			writeProblem(w, r, "workers must be between 0 and 1024", http.StatusBadRequest)
+			return
+		}
+		p.resize(*req.Workers)
+		slog.Warn("Admin: worker pool resized", "pool", req.Pool, "workers", *req.Workers)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeProblem(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	workerPoolsMu.Lock()
+	var out []workerPoolStatus
+	for _, p := range workerPools {
+		out = append(out, p.status())
+	}
+	workerPoolsMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, http.StatusOK, out)
+}
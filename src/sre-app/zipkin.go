@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// zipkinExporter posts spans to a Zipkin v2 JSON endpoint
+// (/api/v2/spans), which Zipkin, Tempo and most Zipkin-compatible
+// backends accept.
+type zipkinExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newZipkinExporter(endpoint string) *zipkinExporter {
+	return &zipkinExporter{endpoint: endpoint, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+type zipkinSpan struct {
+	TraceID       string             `json:"traceId"`
+	ID            string             `json:"id"`
+	ParentID      string             `json:"parentId,omitempty"`
+	Name          string             `json:"name"`
+	Kind          string             `json:"kind,omitempty"`
+	Timestamp     int64              `json:"timestamp"`
+	Duration      int64              `json:"duration"`
+	LocalEndpoint zipkinEndpoint     `json:"localEndpoint"`
+	Tags          map[string]string  `json:"tags,omitempty"`
+	Annotations   []zipkinAnnotation `json:"annotations,omitempty"`
+}
+
+func (e *zipkinExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	out := make([]zipkinSpan, 0, len(spans))
+	for _, s := range spans {
+		zs := zipkinSpan{
+			TraceID:   s.SpanContext().TraceID().String(),
+			ID:        s.SpanContext().SpanID().String(),
+			Name:      s.Name(),
+			Kind:      zipkinKind(s.SpanKind()),
+			Timestamp: s.StartTime().UnixMicro(),
+			Duration:  s.EndTime().Sub(s.StartTime()).Microseconds(),
+			Tags:      map[string]string{},
+		}
+		if s.Parent().IsValid() {
+			zs.ParentID = s.Parent().SpanID().String()
+		}
+		if v, ok := s.Resource().Set().Value(semconv.ServiceNameKey); ok {
+			zs.LocalEndpoint.ServiceName = v.AsString()
+		}
+		for _, kv := range s.Attributes() {
+			zs.Tags[string(kv.Key)] = kv.Value.Emit()
+		}
+		if s.Status().Code == codes.Error {
+			zs.Tags["error"] = s.Status().Description
+		}
+		for _, ev := range s.Events() {
+			zs.Annotations = append(zs.Annotations, zipkinAnnotation{Timestamp: ev.Time.UnixMicro(), Value: ev.Name})
+		}
+		out = append(out, zs)
+	}
+
+	body, err := json.Marshal(out)
+	if err != nil {
+		return fmt.Errorf("encoding zipkin spans: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting zipkin spans: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("zipkin endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *zipkinExporter) Shutdown(ctx context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+func zipkinKind(k trace.SpanKind) string {
+	switch k {
+	case trace.SpanKindServer:
+		return "SERVER"
+	case trace.SpanKindClient:
+		return "CLIENT"
+	case trace.SpanKindProducer:
+		return "PRODUCER"
+	case trace.SpanKindConsumer:
+		return "CONSUMER"
+	}
+	return ""
+}
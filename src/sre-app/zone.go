@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// Zone-aware degradation. ZONE comes from the pod's
+// topology.kubernetes.io/zone label through the Downward API, and
+// ZONE_CHAOS scopes faults to zones:
+//
+//	ZONE_CHAOS="zone-b:latency=300;zone-c:latency=50,error=20"
+//
+// latency is added to LATENCY_MS, error replaces ERROR_RATE.
+var chaosZoneDegraded = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chaos_zone_degraded",
+		Help: "1 if a ZONE_CHAOS rule matched this replica's zone",
+	},
+	[]string{"zone"},
+)
+
+func init() {
+	prometheus.MustRegister(chaosZoneDegraded)
+}
+
+// zoneFault is one ZONE_CHAOS rule; errorRate is nil when the rule leaves
+// ERROR_RATE alone.
+type zoneFault struct {
+	zone      string
+	latencyMs int
+	errorRate *int
+}
+
+func applyZoneChaos() {
+	zone := os.Getenv("ZONE")
+	if zone == "" {
+		return
+	}
+	chaosZoneDegraded.WithLabelValues(zone).Set(0)
+
+	// A malformed ZONE_CHAOS is reported by loadConfig.
+	rules, _ := parseZoneChaos(os.Getenv("ZONE_CHAOS"))
+	for _, f := range rules {
+		if f.zone != zone {
+			continue
+		}
+		latencyMs += f.latencyMs
+		if f.errorRate != nil {
+			errorRate = *f.errorRate
+		}
+		chaosZoneDegraded.WithLabelValues(zone).Set(1)
+		slog.Info("Zone chaos: zone degraded", "zone", zone, "error_rate", errorRate, "latency_ms", latencyMs)
+	}
+}
+
+func parseZoneChaos(spec string) ([]zoneFault, error) {
+	var rules []zoneFault
+	for _, rule := range strings.Split(spec, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		ruleZone, faults, ok := strings.Cut(rule, ":")
+		if !ok || ruleZone == "" {
+			return nil, fmt.Errorf("rule %q: want zone:fault=N[,fault=N]", rule)
+		}
+		f := zoneFault{zone: ruleZone}
+		for _, fault := range strings.Split(faults, ",") {
+			key, val, _ := strings.Cut(strings.TrimSpace(fault), "=")
+			n, err := strconv.Atoi(val)
+			switch {
+			case key == "latency" && err == nil && n >= 0 && n <= 60000:
+				f.latencyMs = n
+			case key == "error" && err == nil && n >= 0 && n <= 100:
+				f.errorRate = &n
+			default:
+				return nil, fmt.Errorf("rule %q: bad fault %q (latency 0-60000, error 0-100)", rule, fault)
+			}
+		}
+		rules = append(rules, f)
+	}
+	return rules, nil
+}
+
+// zoneDetector exposes ZONE as cloud.availability_zone so traces and logs
+// can be grouped by zone in Tempo and Loki.
+type zoneDetector struct{}
+
+func (zoneDetector) Detect(ctx context.Context) (*resource.Resource, error) {
+	zone := os.Getenv("ZONE")
+	if zone == "" {
+		return resource.Empty(), nil
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, semconv.CloudAvailabilityZone(zone)), nil
+}